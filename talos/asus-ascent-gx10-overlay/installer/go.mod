@@ -2,5 +2,9 @@ module github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer
 
 go 1.22.7
 
-require go.yaml.in/yaml/v4 v4.0.0-rc.3
-
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/ulikunitz/xz v0.5.12
+	go.yaml.in/yaml/v4 v4.0.0-rc.3
+	golang.org/x/sys v0.28.0
+)
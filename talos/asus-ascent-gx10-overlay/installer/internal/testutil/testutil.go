@@ -0,0 +1,260 @@
+// Package testutil builds fake overlays and rootfs trees for tests of the
+// installer, so a test of copy, verify or uninstall sets up a realistic
+// fixture in a few lines:
+//
+//	overlayPath := testutil.Overlay{
+//		KernelModules: testutil.Tree{
+//			"6.1/kernel/gpu/nvidia.ko": testutil.File(string(testutil.Module(elf.EM_AARCH64, "firmware=nvidia/gsp.bin"))),
+//		},
+//		Firmware: testutil.Tree{
+//			"nvidia/gsp.bin":  testutil.File("gsp"),
+//			"nvidia/gsp2.bin": testutil.Symlink("gsp.bin"),
+//		},
+//		Files: testutil.Tree{"etc/nvidia/app.conf": testutil.File("x=1\n")},
+//	}.Build(t)
+//	rootfsPath := testutil.Rootfs(t, "6.1")
+package testutil
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Entry is a file, symlink or directory of a Tree
+type Entry struct {
+	// Data is a file's contents
+	Data string
+	// Link, when set, makes the entry a symlink to it
+	Link string
+	// Dir makes the entry an empty directory
+	Dir bool
+	// Mode is the permissions of a file or directory, 0644 or 0755 when 0
+	Mode os.FileMode
+}
+
+// File returns a regular file entry holding data
+func File(data string) Entry {
+	return Entry{Data: data}
+}
+
+// Symlink returns a symlink entry pointing at target, which needn't exist
+func Symlink(target string) Entry {
+	return Entry{Link: target}
+}
+
+// Dir returns an empty directory entry
+func Dir() Entry {
+	return Entry{Dir: true}
+}
+
+// Tree maps slash-separated paths, relative to the directory the tree is
+// written into, to what they hold. Parent directories are created as
+// needed, so only empty directories need an entry.
+type Tree map[string]Entry
+
+// Overlay describes a fake overlay laid out the way the installer expects
+// to find it next to its binary
+type Overlay struct {
+	// KernelModules is written to install/kernel-modules, with a <kver>
+	// directory per kernel
+	KernelModules Tree
+	// Firmware is written to install/firmware
+	Firmware Tree
+	// Files is written to files, mirroring the rootfs
+	Files Tree
+	// Config, when set, is written as overlay.yaml
+	Config string
+}
+
+// Build writes the overlay into a new temporary directory, which the test
+// removes when it is done, and returns its path. Sections left empty are
+// not created at all, as for an overlay that ships none.
+func (o Overlay) Build(t testing.TB) string {
+	t.Helper()
+	dir := t.TempDir()
+	for sub, tree := range map[string]Tree{
+		"install/kernel-modules": o.KernelModules,
+		"install/firmware":       o.Firmware,
+		"files":                  o.Files,
+	} {
+		if len(tree) > 0 {
+			WriteTree(t, filepath.Join(dir, filepath.FromSlash(sub)), tree)
+		}
+	}
+	if o.Config != "" {
+		WriteTree(t, dir, Tree{"overlay.yaml": File(o.Config)})
+	}
+	return dir
+}
+
+// Rootfs returns a new temporary rootfs holding a stub module tree for
+// each of kvers, enough for the installer to detect the target kernel
+func Rootfs(t testing.TB, kvers ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	tree := Tree{}
+	for _, kver := range kvers {
+		tree["lib/modules/"+kver+"/modules.builtin"] = File("")
+	}
+	WriteTree(t, dir, tree)
+	return dir
+}
+
+// WriteTree creates tree below dir, failing the test on any error. Paths
+// must stay inside dir.
+func WriteTree(t testing.TB, dir string, tree Tree) {
+	t.Helper()
+	paths := make([]string, 0, len(tree))
+	for path := range tree {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		entry := tree[path]
+		if !filepath.IsLocal(filepath.FromSlash(path)) || strings.HasPrefix(path, "/") {
+			t.Fatalf("testutil: tree path %q is not inside the tree", path)
+		}
+		dst := filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			t.Fatalf("testutil: %v", err)
+		}
+
+		switch {
+		case entry.Link != "":
+			if err := os.Symlink(entry.Link, dst); err != nil {
+				t.Fatalf("testutil: %v", err)
+			}
+		case entry.Dir:
+			mode := entry.Mode
+			if mode == 0 {
+				mode = 0o755
+			}
+			if err := os.MkdirAll(dst, mode); err != nil {
+				t.Fatalf("testutil: %v", err)
+			}
+			// MkdirAll is subject to the umask
+			if err := os.Chmod(dst, mode); err != nil {
+				t.Fatalf("testutil: %v", err)
+			}
+		default:
+			mode := entry.Mode
+			if mode == 0 {
+				mode = 0o644
+			}
+			if err := os.WriteFile(dst, []byte(entry.Data), mode); err != nil {
+				t.Fatalf("testutil: %v", err)
+			}
+			if err := os.Chmod(dst, mode); err != nil {
+				t.Fatalf("testutil: %v", err)
+			}
+		}
+	}
+}
+
+// Module returns a minimal little-endian 64-bit relocatable ELF for
+// machine, like a kernel module with no code. Its .modinfo section holds
+// the given key=value fields, such as "firmware=nvidia/gsp.bin" or
+// "vermagic=6.1 SMP", which is all the installer reads of a module.
+func Module(machine elf.Machine, modinfo ...string) []byte {
+	return buildModule(machine, modinfoSection(modinfo))
+}
+
+// DebugModule is Module built with debug info, as an unstripped kernel
+// build leaves it: debugInfo in .debug_info, one relocation against it in
+// .rela.debug_info and a .debug_str, between .modinfo and .shstrtab.
+func DebugModule(machine elf.Machine, debugInfo []byte, modinfo ...string) []byte {
+	return buildModule(machine,
+		modinfoSection(modinfo),
+		section{name: ".debug_info", typ: elf.SHT_PROGBITS, data: debugInfo, align: 1},
+		// Info is the index of the section the relocations apply to
+		section{name: ".rela.debug_info", typ: elf.SHT_RELA, data: make([]byte, 24), info: 2, entsize: 24, align: 8},
+		section{name: ".debug_str", typ: elf.SHT_PROGBITS, flags: elf.SHF_MERGE | elf.SHF_STRINGS, data: []byte("nvidia\x00"), entsize: 1, align: 1},
+	)
+}
+
+// section is one section of a module buildModule writes
+type section struct {
+	name    string
+	typ     elf.SectionType
+	flags   elf.SectionFlag
+	data    []byte
+	info    uint32
+	entsize uint64
+	align   uint64
+}
+
+func modinfoSection(modinfo []string) section {
+	var info []byte
+	for _, field := range modinfo {
+		info = append(append(info, field...), 0)
+	}
+	return section{name: ".modinfo", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC, data: info, align: 1}
+}
+
+// buildModule lays out the ELF header, then each section's data at its
+// alignment in order, then .shstrtab and the section headers
+func buildModule(machine elf.Machine, sections ...section) []byte {
+	shstrtab := []byte("\x00")
+	var names []uint32
+	for _, s := range sections {
+		names = append(names, uint32(len(shstrtab)))
+		shstrtab = append(append(shstrtab, s.name...), 0)
+	}
+	names = append(names, uint32(len(shstrtab)))
+	shstrtab = append(shstrtab, ".shstrtab\x00"...)
+	sections = append(sections, section{name: ".shstrtab", typ: elf.SHT_STRTAB, data: shstrtab, align: 1})
+
+	hdrSize := uint64(binary.Size(elf.Header64{}))
+	var buf bytes.Buffer
+	buf.Write(make([]byte, hdrSize))
+	shdrs := []elf.Section64{{}}
+	for i, s := range sections {
+		for s.align > 1 && uint64(buf.Len())%s.align != 0 {
+			buf.WriteByte(0)
+		}
+		shdrs = append(shdrs, elf.Section64{
+			Name:      names[i],
+			Type:      uint32(s.typ),
+			Flags:     uint64(s.flags),
+			Off:       uint64(buf.Len()),
+			Size:      uint64(len(s.data)),
+			Info:      s.info,
+			Addralign: s.align,
+			Entsize:   s.entsize,
+		})
+		buf.Write(s.data)
+	}
+	for buf.Len()%8 != 0 {
+		buf.WriteByte(0)
+	}
+
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(machine),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     uint64(buf.Len()),
+		Ehsize:    uint16(hdrSize),
+		Shentsize: uint16(binary.Size(elf.Section64{})),
+		Shnum:     uint16(len(shdrs)),
+		Shstrndx:  uint16(len(shdrs) - 1),
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+
+	// Writes to a bytes.Buffer can't fail
+	_ = binary.Write(&buf, binary.LittleEndian, shdrs)
+	out := buf.Bytes()
+	buf.Reset()
+	_ = binary.Write(&buf, binary.LittleEndian, &hdr)
+	copy(out, buf.Bytes())
+	return out
+}
@@ -0,0 +1,127 @@
+package testutil
+
+import (
+	"bytes"
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOverlayBuild(t *testing.T) {
+	dir := Overlay{
+		KernelModules: Tree{"6.1.0-talos/kernel/drivers/gpu/nvidia.ko": File("module")},
+		Firmware: Tree{
+			"nvidia/gsp.bin":        File("gsp firmware"),
+			"nvidia/gsp-latest.bin": Symlink("gsp.bin"),
+			"nvidia/empty":          Dir(),
+		},
+		Files: Tree{
+			"etc/nvidia/app.conf": {Data: "key=value\n", Mode: 0o600},
+			"etc/nvidia/private":  {Dir: true, Mode: 0o700},
+		},
+		Config: "kernelArgs: []\n",
+	}.Build(t)
+
+	for _, tc := range []struct {
+		path string
+		mode os.FileMode
+		// data is a file's contents, or a symlink's target
+		data string
+	}{
+		{"install/kernel-modules/6.1.0-talos/kernel/drivers/gpu/nvidia.ko", 0o644, "module"},
+		{"install/firmware/nvidia/gsp.bin", 0o644, "gsp firmware"},
+		{"install/firmware/nvidia/gsp-latest.bin", os.ModeSymlink, "gsp.bin"},
+		{"install/firmware/nvidia/empty", os.ModeDir | 0o755, ""},
+		{"files/etc/nvidia/app.conf", 0o600, "key=value\n"},
+		{"files/etc/nvidia/private", os.ModeDir | 0o700, ""},
+		{"overlay.yaml", 0o644, "kernelArgs: []\n"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			path := filepath.Join(dir, filepath.FromSlash(tc.path))
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got string
+			switch {
+			case tc.mode&os.ModeSymlink != 0:
+				if info.Mode().Type() != os.ModeSymlink {
+					t.Fatalf("mode %v, want a symlink", info.Mode())
+				}
+				got, err = os.Readlink(path)
+			case info.Mode() != tc.mode:
+				t.Errorf("mode %v, want %v", info.Mode(), tc.mode)
+			case !tc.mode.IsDir():
+				var data []byte
+				data, err = os.ReadFile(path)
+				got = string(data)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.data {
+				t.Errorf("holds %q, want %q", got, tc.data)
+			}
+		})
+	}
+}
+
+func TestModule(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		machine elf.Machine
+		modinfo []string
+	}{
+		{"arm64", elf.EM_AARCH64, []string{"firmware=nvidia/gsp.bin", "vermagic=6.1 SMP"}},
+		{"amd64", elf.EM_X86_64, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := elf.NewFile(bytes.NewReader(Module(tc.machine, tc.modinfo...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Machine != tc.machine || f.Type != elf.ET_REL {
+				t.Errorf("module is a %v %v, want a %v %v", f.Machine, f.Type, tc.machine, elf.ET_REL)
+			}
+			section := f.Section(".modinfo")
+			if section == nil {
+				t.Fatal("module has no .modinfo section")
+			}
+			data, err := section.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []byte
+			for _, field := range tc.modinfo {
+				want = append(append(want, field...), 0)
+			}
+			if !bytes.Equal(data, want) {
+				t.Errorf(".modinfo = %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestDebugModule(t *testing.T) {
+	f, err := elf.NewFile(bytes.NewReader(DebugModule(elf.EM_AARCH64, []byte("dwarf"), "vermagic=6.1 SMP")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range f.Sections {
+		names = append(names, s.Name)
+	}
+	want := []string{"", ".modinfo", ".debug_info", ".rela.debug_info", ".debug_str", ".shstrtab"}
+	if !slices.Equal(names, want) {
+		t.Errorf("sections = %q, want %q", names, want)
+	}
+	if rela := f.Section(".rela.debug_info"); rela.Info != 2 {
+		t.Errorf(".rela.debug_info applies to section %d, want .debug_info", rela.Info)
+	}
+	data, err := f.Section(".debug_info").Data()
+	if err != nil || string(data) != "dwarf" {
+		t.Errorf(".debug_info = %q, %v, want %q", data, err, "dwarf")
+	}
+}
@@ -0,0 +1,308 @@
+// Command asus-ascent-gx10-overlay is the Talos overlay installer for ASUS
+// Ascent GX10. The install itself lives in package overlay; this wraps it
+// as the binary the imager runs.
+//
+// The installer is called by Talos imager with "install" as the first argument
+// and YAML InstallOptions passed via stdin. For local runs they can be read
+// from a file with -options instead. The exit code tells the kind of failure
+// apart, as "help" lists.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"go.yaml.in/yaml/v4"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/overlay"
+)
+
+// Exit codes, told apart so the imager or a script can react to the kind of
+// failure without parsing the error
+const (
+	exitOK               = 0
+	exitFailure          = 1
+	exitInvalidOptions   = 2
+	exitMissingArtifacts = 3
+	exitIO               = 4
+	exitVerification     = 5
+)
+
+// exitCodeUsage documents the exit codes in the usage output
+const exitCodeUsage = `Exit codes:
+  0  success
+  1  any other failure
+  2  invalid install options, flags or command
+  3  overlay artifacts missing or empty
+  4  rootfs I/O error, read-only or out of space
+  5  verification of artifacts or installed files failed
+`
+
+func main() {
+	os.Exit(run(os.Args, os.Stdin, os.Stdout, os.Stderr))
+}
+
+// invalidOptionsError marks errors in the options or flags read here, before
+// a command gets to check its own
+type invalidOptionsError struct{ error }
+
+func (e invalidOptionsError) Unwrap() error { return e.error }
+
+func (e invalidOptionsError) Is(target error) bool { return target == overlay.ErrInvalidOptions }
+
+// exitCode maps a command's error to the exit code for its kind of failure
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, overlay.ErrInvalidOptions):
+		return exitInvalidOptions
+	case errors.Is(err, overlay.ErrMissingArtifacts):
+		return exitMissingArtifacts
+	case errors.Is(err, overlay.ErrVerification):
+		return exitVerification
+	case overlay.IsIOError(err):
+		return exitIO
+	}
+	return exitFailure
+}
+
+// usage writes the commands and exit codes to w
+func usage(w io.Writer, name string) {
+	fmt.Fprintf(w, "Usage: %s <command>\n", name)
+	fmt.Fprintf(w, "Commands: install, uninstall, rollback, verify, status, prune, doctor, selftest, validate-options, list-artifacts, artifacts-digest, get-options, version, help\n")
+	fmt.Fprint(w, exitCodeUsage)
+}
+
+// run dispatches the command named by args[1], reading InstallOptions from
+// stdin, or the file given with -options, and returns the process exit code
+// for how it went. Command output goes to stdout; logs and errors go to
+// stderr.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) < 2 {
+		usage(stderr, args[0])
+		return exitInvalidOptions
+	}
+
+	overlay.Version = version
+
+	command := args[1]
+	overlayPath, args, err := stringFlag(args, "overlay-path")
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return exitInvalidOptions
+	}
+	optionsPath, args, err := stringFlag(args, "options")
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return exitInvalidOptions
+	}
+	// InstallOptions are decoded the same way from a file as from stdin
+	if optionsPath != "" {
+		f, err := os.Open(optionsPath)
+		if err != nil {
+			fmt.Fprintf(stderr, "Error: failed to open install options: %v\n", err)
+			return exitInvalidOptions
+		}
+		defer f.Close()
+		stdin = f
+	}
+
+	switch command {
+	case "install":
+		err = install(args[2:], overlay.Install, overlayPath, stdin, stdout, stderr)
+	case "selftest":
+		err = install(args[2:], overlay.SelfTest, overlayPath, stdin, stdout, stderr)
+	case "uninstall":
+		err = runCommand(args[2:], overlay.Uninstall, true, overlayPath, stdin, stdout, stderr)
+	case "rollback":
+		err = runCommand(args[2:], overlay.Rollback, true, overlayPath, stdin, stdout, stderr)
+	case "verify":
+		err = runCommand(args[2:], overlay.Verify, true, overlayPath, stdin, stdout, stderr)
+	case "status":
+		err = runCommand(args[2:], overlay.Status, false, overlayPath, stdin, stdout, stderr)
+		if errors.Is(err, overlay.ErrNotInstalled) {
+			fmt.Fprintf(stderr, "Not installed: %v\n", err)
+			return exitFailure
+		}
+	case "prune":
+		err = runCommand(args[2:], overlay.Prune, true, overlayPath, stdin, stdout, stderr)
+	case "doctor":
+		err = runCommand(args[2:], overlay.Doctor, true, overlayPath, stdin, stdout, stderr)
+	case "validate-options":
+		err = runCommand(args[2:], overlay.ValidateOptions, false, overlayPath, stdin, stdout, stderr)
+	case "version", "-version", "--version":
+		err = printVersion(args[2:], stdout, stderr)
+	case "help", "-help", "--help", "-h":
+		usage(stdout, args[0])
+	case "list-artifacts", "artifacts-digest":
+		// Reads no InstallOptions
+		if overlayPath, err = resolveOverlayPath(overlayPath, nil); err != nil {
+			break
+		}
+		options := &overlay.Options{OverlayPath: overlayPath, Args: args[2:], Stdout: stdout}
+		if command == "list-artifacts" {
+			err = overlay.ListArtifacts(options)
+		} else {
+			err = overlay.ArtifactsDigest(options)
+		}
+	case "get-options":
+		// The imager passes the overlay's ExtraOptions alone, not wrapped
+		// in InstallOptions
+		var extra map[string]interface{}
+		if extra, err = readExtraOptions(stdin); err != nil {
+			break
+		}
+		if overlayPath, err = resolveOverlayPath(overlayPath, extra); err != nil {
+			break
+		}
+		options := &overlay.Options{OverlayPath: overlayPath, Args: args[2:], Stdout: stdout}
+		options.ExtraOptions = extra
+		err = overlay.GetOptions(options)
+	default:
+		fmt.Fprintf(stderr, "Unknown command: %s\n", command)
+		usage(stderr, args[0])
+		return exitInvalidOptions
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+	}
+	return exitCode(err)
+}
+
+// overlayDir returns the overlay directory the installer was unpacked into
+func overlayDir() string {
+	// Overlay path is the directory containing the installer's parent directory
+	// The installer is at: /tmp/imager.../overlay/installers/asus-ascent-gx10-overlay
+	// So overlay is at: /tmp/imager.../overlay/
+	executablePath, err := os.Executable()
+	if err != nil {
+		// Fallback: try to get from /proc/self/exe or use a default
+		executablePath = os.Args[0]
+	}
+	// Get the directory containing installers/ (which is the overlay directory)
+	installersDir := filepath.Dir(executablePath)
+	return filepath.Dir(installersDir)
+}
+
+// stringFlag removes a -name flag, or --name, from the arguments following
+// the command, returning its value. Flags every command shares are taken
+// out before a command parses the rest.
+func stringFlag(args []string, name string) (string, []string, error) {
+	rest := args[:2:2]
+	var value string
+	for i := 2; i < len(args); i++ {
+		flagName, flagValue, hasValue := strings.Cut(strings.TrimPrefix(args[i], "-"), "=")
+		if flagName != "-"+name && flagName != name {
+			rest = append(rest, args[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return "", nil, fmt.Errorf("flag needs an argument: %s", args[i])
+			}
+			i++
+			flagValue = args[i]
+		}
+		value = flagValue
+	}
+	return value, rest, nil
+}
+
+// resolveOverlayPath returns the overlay directory a command works on: the
+// -overlay-path flag, else ExtraOptions["overlayPath"], else the directory
+// the installer was unpacked into. Paths given explicitly must look like an
+// overlay.
+func resolveOverlayPath(overlayPath string, extra map[string]interface{}) (string, error) {
+	if overlayPath == "" {
+		if raw, ok := extra["overlayPath"]; ok && raw != nil {
+			s, isString := raw.(string)
+			if !isString {
+				return "", invalidOptionsError{fmt.Errorf("extraOptions.overlayPath: expected a string, got %T", raw)}
+			}
+			overlayPath = s
+		}
+	}
+	if overlayPath == "" {
+		return overlayDir(), nil
+	}
+	if err := overlay.CheckOverlayPath(overlayPath); err != nil {
+		return "", invalidOptionsError{err}
+	}
+	return overlayPath, nil
+}
+
+// readInstallOptions decodes YAML InstallOptions as passed by the imager.
+// Unknown fields are rejected so a typo can't go unnoticed, while empty
+// input, as for a selftest in CI, gives empty options. overlayPath is the
+// -overlay-path flag, if any.
+func readInstallOptions(r io.Reader, overlayPath string) (*overlay.Options, error) {
+	options := &overlay.Options{}
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(&options.InstallOptions); err != nil && !errors.Is(err, io.EOF) {
+		return nil, invalidOptionsError{fmt.Errorf("failed to decode install options: %w", err)}
+	}
+	var err error
+	if options.OverlayPath, err = resolveOverlayPath(overlayPath, options.ExtraOptions); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// readExtraOptions decodes YAML ExtraOptions as the imager passes them to
+// get-options. Empty input gives none.
+func readExtraOptions(r io.Reader) (map[string]interface{}, error) {
+	var extra map[string]interface{}
+	if err := yaml.NewDecoder(r).Decode(&extra); err != nil && !errors.Is(err, io.EOF) {
+		return nil, invalidOptionsError{fmt.Errorf("failed to decode extra options: %w", err)}
+	}
+	return extra, nil
+}
+
+// runCommand runs a command with the InstallOptions on stdin and the
+// arguments following it, first setting up logging from them when logs is set
+func runCommand(args []string, command func(*overlay.Options) error, logs bool, overlayPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	options, err := readInstallOptions(stdin, overlayPath)
+	if err != nil {
+		return err
+	}
+	options.Args = args
+	options.Stdout = stdout
+	if logs {
+		if err := overlay.SetupLogging(stderr, options.ExtraOptions); err != nil {
+			return err
+		}
+	}
+	return command(options)
+}
+
+// install runs a command that installs the overlay, install itself or
+// selftest, with logging set up from the arguments too and the install
+// stopped on SIGINT or SIGTERM
+func install(args []string, command func(context.Context, *overlay.Options) error, overlayPath string, stdin io.Reader, stdout, stderr io.Writer) error {
+	// Read YAML InstallOptions from stdin
+	options, err := readInstallOptions(stdin, overlayPath)
+	if err != nil {
+		return err
+	}
+	options.Args = args
+	options.Stdout = stdout
+
+	if err := overlay.SetupLogging(stderr, options.ExtraOptions, args...); err != nil {
+		return err
+	}
+
+	// The imager may be stopped
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return command(ctx, options)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"go.yaml.in/yaml/v4"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/overlay"
+)
+
+func TestRun(t *testing.T) {
+	const kver = "6.1.0-talos"
+	overlayPath := testutil.Overlay{
+		KernelModules: testutil.Tree{
+			kver + "/kernel/drivers/gpu/nvidia.ko": testutil.File(string(testutil.Module(elf.EM_AARCH64))),
+		},
+		Firmware: testutil.Tree{"nvidia/gsp.bin": testutil.File("gsp firmware")},
+		Files:    testutil.Tree{"etc/nvidia/app.conf": testutil.File("key=value\n")},
+	}.Build(t)
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		// stdin is the options, with $ROOTFS standing for the test rootfs
+		stdin string
+		want  int
+		// check, when set, looks at the command's output
+		check func(t *testing.T, rootfs, stdout, stderr string)
+	}{
+		{
+			name:  "install",
+			args:  []string{"install", "-overlay-path", overlayPath},
+			stdin: "mountPrefix: $ROOTFS\n",
+			want:  exitOK,
+			check: func(t *testing.T, rootfs, _, _ string) {
+				if _, err := os.Stat(filepath.Join(rootfs, "lib/firmware/nvidia/gsp.bin")); err != nil {
+					t.Errorf("install did not copy the firmware: %v", err)
+				}
+			},
+		},
+		{
+			name:  "get-options",
+			args:  []string{"get-options", "-overlay-path", overlayPath},
+			stdin: "kernelArgs: [console=ttyAMA0]\n",
+			want:  exitOK,
+			check: func(t *testing.T, _, stdout, _ string) {
+				var options struct {
+					Name       string   `yaml:"name"`
+					KernelArgs []string `yaml:"kernelArgs"`
+				}
+				if err := yaml.Unmarshal([]byte(stdout), &options); err != nil {
+					t.Fatalf("get-options output is not YAML: %v\n%s", err, stdout)
+				}
+				if options.Name != overlay.Name || strings.Join(options.KernelArgs, " ") != "console=ttyAMA0" {
+					t.Errorf("get-options printed %+v", options)
+				}
+			},
+		},
+		{
+			name:  "malformed YAML",
+			args:  []string{"install", "-overlay-path", overlayPath},
+			stdin: "mountPrefix: [unclosed\n",
+			want:  exitInvalidOptions,
+		},
+		{
+			name:  "unknown InstallOptions field",
+			args:  []string{"install", "-overlay-path", overlayPath},
+			stdin: "mountPrefx: /mnt\n",
+			want:  exitInvalidOptions,
+			check: func(t *testing.T, _, _, stderr string) {
+				if !strings.Contains(stderr, "mountPrefx") {
+					t.Errorf("stderr does not name the unknown field:\n%s", stderr)
+				}
+			},
+		},
+		{
+			name: "missing options file",
+			args: []string{"install", "-overlay-path", overlayPath, "-options", filepath.Join(t.TempDir(), "missing.yaml")},
+			want: exitInvalidOptions,
+		},
+		{
+			name: "unknown command",
+			args: []string{"instal"},
+			want: exitInvalidOptions,
+			check: func(t *testing.T, _, _, stderr string) {
+				if !strings.Contains(stderr, "Unknown command: instal") || !strings.Contains(stderr, "Usage: ") {
+					t.Errorf("stderr lacks the unknown command and usage:\n%s", stderr)
+				}
+			},
+		},
+		{
+			name: "no command",
+			want: exitInvalidOptions,
+			check: func(t *testing.T, _, _, stderr string) {
+				if !strings.Contains(stderr, "Usage: ") {
+					t.Errorf("stderr lacks usage:\n%s", stderr)
+				}
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rootfs := testutil.Rootfs(t, kver)
+			stdin := strings.ReplaceAll(tc.stdin, "$ROOTFS", rootfs)
+
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"asus-ascent-gx10-overlay"}, tc.args...)
+			if got := run(args, strings.NewReader(stdin), &stdout, &stderr); got != tc.want {
+				t.Fatalf("run(%q) = %d, want %d\nstderr:\n%s", tc.args, got, tc.want, stderr.String())
+			}
+			if tc.check != nil {
+				tc.check(t, rootfs, stdout.String(), stderr.String())
+			}
+		})
+	}
+}
+func TestExitCode(t *testing.T) {
+	cause := errors.New("cause")
+	for _, tc := range []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, exitOK},
+		{"unclassified", fmt.Errorf("install: %w", cause), exitFailure},
+		{"invalid options", fmt.Errorf("install: %w", errors.Join(cause, overlay.ErrInvalidOptions)), exitInvalidOptions},
+		{"missing artifacts", fmt.Errorf("install: %w", errors.Join(cause, overlay.ErrMissingArtifacts)), exitMissingArtifacts},
+		{"rootfs I/O", fmt.Errorf("install: %w", errors.Join(cause, overlay.ErrIO)), exitIO},
+		{"no space", fmt.Errorf("install: %w", &os.PathError{Op: "write", Path: "gsp.bin", Err: syscall.ENOSPC}), exitIO},
+		{"read-only", fmt.Errorf("install: %w", &os.PathError{Op: "open", Path: "gsp.bin", Err: syscall.EROFS}), exitIO},
+		{"verification", fmt.Errorf("install: %w", errors.Join(cause, overlay.ErrVerification)), exitVerification},
+		{"flag error", invalidOptionsError{cause}, exitInvalidOptions},
+		{"wrapped flag error", fmt.Errorf("get-options: %w", invalidOptionsError{cause}), exitInvalidOptions},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exitCode(tc.err); got != tc.want {
+				t.Errorf("exitCode(%v) = %d, want %d", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInvalidOptionsError(t *testing.T) {
+	cause := errors.New("cause")
+	err := fmt.Errorf("get-options: %w", invalidOptionsError{cause})
+	if !errors.Is(err, overlay.ErrInvalidOptions) {
+		t.Errorf("%v does not match overlay.ErrInvalidOptions", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Errorf("%v does not match its cause", err)
+	}
+	if errors.Is(err, overlay.ErrVerification) {
+		t.Errorf("%v matches overlay.ErrVerification", err)
+	}
+}
@@ -0,0 +1,197 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultArch is the GX10's architecture, assumed when neither
+// ExtraOptions["targetArch"] nor the rootfs says otherwise
+const defaultArch = "arm64"
+
+// archMachines maps GOARCH style architecture names to their ELF machine
+var archMachines = map[string]elf.Machine{
+	"386":     elf.EM_386,
+	"amd64":   elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"ppc64le": elf.EM_PPC64,
+	"riscv64": elf.EM_RISCV,
+	"s390x":   elf.EM_S390,
+}
+
+// machineArch returns the architecture name of an ELF machine
+func machineArch(machine elf.Machine) string {
+	for arch, m := range archMachines {
+		if m == machine {
+			return arch
+		}
+	}
+	return machine.String()
+}
+
+// errNotELF is returned for a file without an ELF header
+var errNotELF = errors.New("not an ELF file")
+
+// readELFMachine reads the machine an ELF file is built for from its
+// header, without reading the rest of the file
+func readELFMachine(r io.Reader) (elf.Machine, error) {
+	// e_machine follows the 16 byte ident and the 2 byte e_type
+	var hdr [20]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, errNotELF
+		}
+		return 0, err
+	}
+	if !bytes.Equal(hdr[:4], []byte(elf.ELFMAG)) {
+		return 0, errNotELF
+	}
+
+	var order binary.ByteOrder
+	switch elf.Data(hdr[elf.EI_DATA]) {
+	case elf.ELFDATA2LSB:
+		order = binary.LittleEndian
+	case elf.ELFDATA2MSB:
+		order = binary.BigEndian
+	default:
+		return 0, fmt.Errorf("unknown ELF data encoding %d", hdr[elf.EI_DATA])
+	}
+	return elf.Machine(order.Uint16(hdr[18:])), nil
+}
+
+// moduleMachine reads the machine of a module, given compressed or not
+func moduleMachine(r io.Reader, name string) (elf.Machine, error) {
+	dec, err := decompressModule(io.NopCloser(r), name)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	defer dec.Close()
+	machine, err := readELFMachine(dec)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", name, err)
+	}
+	return machine, nil
+}
+
+// rootfsArchFiles are rootfs binaries whose architecture is the target's
+var rootfsArchFiles = []string{"sbin/init", "usr/sbin/init", "bin/sh", "usr/bin/sh", "bin/busybox"}
+
+// detectRootfsArch returns the architecture of the first rootfs binary
+// found. Symlinks are skipped, since their targets resolve against the
+// host rather than the rootfs.
+func detectRootfsArch(fsys filesystem, rootfsPath string) (string, bool) {
+	for _, rel := range rootfsArchFiles {
+		path := filepath.Join(rootfsPath, filepath.FromSlash(rel))
+		info, err := fsys.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		f, err := fsys.Open(path)
+		if err != nil {
+			continue
+		}
+		machine, err := readELFMachine(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		slog.Debug("Detected rootfs architecture", "file", path, "machine", machine)
+		return machineArch(machine), true
+	}
+	return "", false
+}
+
+// targetArch returns the architecture the overlay's modules must be built
+// for: ExtraOptions["targetArch"], else whatever the rootfs binaries are,
+// else the GX10's arm64
+func targetArch(fsys filesystem, cfg *installConfig, rootfsPath string) string {
+	if cfg.targetArch != "" {
+		return cfg.targetArch
+	}
+	if arch, ok := detectRootfsArch(fsys, rootfsPath); ok {
+		return arch
+	}
+	return defaultArch
+}
+
+// checkModuleArch fails unless every kernel module the overlay ships is
+// built for arch. A module for another architecture copies fine but never
+// loads, so this runs before anything is copied.
+func checkModuleArch(fsys filesystem, overlayPath string, config *OverlayConfig, arch string) error {
+	want, ok := archMachines[arch]
+	if !ok {
+		return fmt.Errorf("unknown target architecture %q", arch)
+	}
+
+	wrong := make(map[string][]string)
+	check := func(name string, r io.Reader) error {
+		machine, err := moduleMachine(r, name)
+		if err != nil {
+			return err
+		}
+		if machine != want {
+			got := machineArch(machine)
+			wrong[got] = append(wrong[got], name)
+		}
+		return nil
+	}
+
+	for _, dir := range artifactSources(fsys, overlayPath, config) {
+		if archive, ok := artifactArchive(fsys, dir); ok {
+			err := walkArchive(fsys, archive, nil, func(hdr *tar.Header, r io.Reader) error {
+				if hdr.Typeflag != tar.TypeReg || !isKernelModule(hdr.Name) {
+					return nil
+				}
+				return check(archiveMember(archive, hdr.Name), r)
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == dir && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() || !isKernelModule(path) {
+				return nil
+			}
+			f, err := fsys.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return check(path, f)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(wrong) > 0 {
+		var errs []error
+		for got, names := range wrong {
+			sort.Strings(names)
+			errs = append(errs, fmt.Errorf("%d kernel modules are built for %s, not the target's %s: %s", len(names), got, arch, strings.Join(names, ", ")))
+		}
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+		return fmt.Errorf("kernel module architecture mismatch: %w", errors.Join(errs...))
+	}
+	slog.Info("🧬 Kernel module architecture", "arch", arch)
+	return nil
+}
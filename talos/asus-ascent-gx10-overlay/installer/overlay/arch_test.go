@@ -0,0 +1,87 @@
+package overlay
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestInstallModuleArch(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		module []byte
+		file   string
+		// init, when set, is the rootfs sbin/init the target is detected from
+		init  []byte
+		extra map[string]interface{}
+		// wantErr is part of the expected error, or empty for success
+		wantErr string
+	}{
+		{
+			name:   "arm64 module for the GX10",
+			module: testutil.Module(elf.EM_AARCH64),
+		},
+		{
+			name:    "amd64 module for the GX10",
+			module:  testutil.Module(elf.EM_X86_64),
+			wantErr: "1 kernel modules are built for amd64, not the target's arm64",
+		},
+		{
+			name:    "compressed amd64 module",
+			module:  testutil.Module(elf.EM_X86_64),
+			file:    "nvidia.ko.xz",
+			wantErr: "built for amd64, not the target's arm64",
+		},
+		{
+			name:   "amd64 target option",
+			module: testutil.Module(elf.EM_X86_64),
+			extra:  map[string]interface{}{"targetArch": "amd64"},
+		},
+		{
+			name:   "amd64 rootfs",
+			module: testutil.Module(elf.EM_X86_64),
+			init:   testutil.Module(elf.EM_X86_64),
+		},
+		{
+			name:    "arm64 module for an amd64 rootfs",
+			module:  testutil.Module(elf.EM_AARCH64),
+			init:    testutil.Module(elf.EM_X86_64),
+			wantErr: "built for arm64, not the target's amd64",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := tc.file
+			if file == "" {
+				file = "nvidia.ko"
+			}
+			fixture := testOverlay()
+			fixture.KernelModules = testutil.Tree{
+				testKver + "/kernel/drivers/gpu/" + file: testutil.File(string(compressTest(t, file, tc.module))),
+			}
+			overlayPath := fixture.Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+			if tc.init != nil {
+				testutil.WriteTree(t, rootfs, testutil.Tree{"sbin/init": testutil.File(string(tc.init))})
+			}
+
+			err := runInstallTest(t, overlayPath, rootfs, tc.extra)
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("install: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("install returned %v, want an error containing %q", err, tc.wantErr)
+			}
+			// The check runs before anything is copied
+			if _, err := os.Lstat(filepath.Join(rootfs, "lib/modules", testKver, "kernel/drivers/gpu", file)); !os.IsNotExist(err) {
+				t.Errorf("mismatched module was installed: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveSuffixes are the compressed tarballs an artifact directory may be
+// shipped as instead, e.g. install/firmware.tar.zst for install/firmware
+var archiveSuffixes = []string{".tar.zst", ".tar.gz"}
+
+// artifactArchive returns the archive standing in for the artifacts
+// directory dir. A directory that exists always wins.
+func artifactArchive(fsys filesystem, dir string) (string, bool) {
+	if _, err := fsys.Stat(dir); err == nil {
+		return "", false
+	}
+	for _, suffix := range archiveSuffixes {
+		if info, err := fsys.Stat(dir + suffix); err == nil && info.Mode().IsRegular() {
+			return dir + suffix, true
+		}
+	}
+	return "", false
+}
+
+// walkArchive calls fn for each entry of a compressed tar archive, with a
+// reader for the entry's contents that is valid until fn returns. When
+// prog is set it counts the compressed bytes read.
+func walkArchive(fsys filesystem, archive string, prog *progress, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := fsys.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if prog != nil {
+		r = &progressReader{r: f, prog: prog}
+	}
+	switch {
+	case strings.HasSuffix(archive, ".tar.zst"):
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", archive, err)
+		}
+		defer dec.Close()
+		r = dec
+	case strings.HasSuffix(archive, ".tar.gz"):
+		dec, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", archive, err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", archive, err)
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// archiveMember names an entry of an archive in logs and errors
+func archiveMember(archive, name string) string {
+	return archive + ":" + path.Clean(strings.TrimPrefix(name, "/"))
+}
+
+// archiveEntryName returns an entry's slash separated path relative to
+// prefix, or false when the entry lies elsewhere. The prefix itself is ".".
+func archiveEntryName(name, prefix string) (string, bool) {
+	name = path.Clean(strings.TrimPrefix(name, "/"))
+	if prefix == "" {
+		return name, true
+	}
+	if name == prefix {
+		return ".", true
+	}
+	return strings.CutPrefix(name, prefix+"/")
+}
+
+// copyArchive streams the entries of a compressed tar archive below prefix
+// into dst, the way copyDirectory copies a directory: modes, ownership,
+// times, symlinks and hard links are kept and every file is recorded in the
+// manifest. Entries are written one at a time in archive order, since the
+// stream can only be read once. It returns how many entries were below
+// prefix.
+func (inst *Installer) copyArchive(ctx context.Context, archive, dst, prefix string, fileMode os.FileMode, include []string) (int, error) {
+	var createdDirs []string
+	var createdInfos []os.FileInfo
+
+	// A later entry must not be written through a symlink an earlier one
+	// created, which could point anywhere
+	symlinks := make(map[string]bool)
+
+	// An opaque whiteout keeps what the archive itself wrote before it
+	written := make(map[string]bool)
+
+	var failures []error
+	fail := func(name, dstPath string, err error) error {
+		err = copyPathError(archiveMember(archive, name), dstPath, err)
+		if isFatal(err) {
+			return err
+		}
+		failures = append(failures, err)
+		return nil
+	}
+
+	var prog *progress
+	if info, err := inst.fs.Stat(archive); err == nil {
+		// Only the compressed size is known up front
+		prog = newProgress(dst, info.Size())
+		defer prog.finish()
+	}
+
+	matched := 0
+	err := walkArchive(inst.fs, archive, prog, func(hdr *tar.Header, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		name, ok := archiveEntryName(hdr.Name, prefix)
+		if !ok {
+			return nil
+		}
+		matched++
+		if name == "." && hdr.Typeflag != tar.TypeDir {
+			return fail(hdr.Name, "", fmt.Errorf("expected a directory"))
+		}
+
+		dstPath := filepath.Join(dst, filepath.FromSlash(name))
+		if !withinDir(dst, dstPath) {
+			return fail(hdr.Name, "", fmt.Errorf("destination %s is outside %s", dstPath, dst))
+		}
+		for dir := filepath.Dir(dstPath); dir != dst && withinDir(dst, dir); dir = filepath.Dir(dir) {
+			if symlinks[dir] {
+				return fail(hdr.Name, "", fmt.Errorf("destination %s is below symlink %s", dstPath, dir))
+			}
+		}
+		dstPath, err := inst.resolveDest(dstPath)
+		if err != nil {
+			return fail(hdr.Name, "", err)
+		}
+
+		// Excluding a directory excludes everything below it, and as with
+		// copyDirectory the top directory itself is never excluded
+		for p := name; p != "."; p = path.Dir(p) {
+			if inst.excluded(p) {
+				slog.Debug("Excluding file", "path", archiveMember(archive, hdr.Name))
+				return nil
+			}
+		}
+		if hdr.Typeflag != tar.TypeDir && !included(include, name) {
+			slog.Debug("Skipping file not included", "path", archiveMember(archive, hdr.Name))
+			return nil
+		}
+
+		// Whiteouts delete from dst rather than being copied
+		if hdr.Typeflag != tar.TypeDir && isWhiteout(path.Base(name)) {
+			var err error
+			if path.Base(name) == whiteoutOpaque {
+				err = inst.clearOpaque(filepath.Dir(dstPath), written)
+			} else {
+				err = inst.whiteout(dstPath)
+			}
+			if err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+			return nil
+		}
+
+		info := hdr.FileInfo()
+		decompress := inst.cfg.decompressModules && hdr.Typeflag == tar.TypeReg && isCompressedModule(name)
+		if decompress {
+			dstPath = strings.TrimSuffix(dstPath, filepath.Ext(dstPath))
+		}
+		for p := dstPath; p != dst && withinDir(dst, p); p = filepath.Dir(p) {
+			written[p] = true
+		}
+
+		if inst.cfg.dryRun {
+			switch hdr.Typeflag {
+			case tar.TypeSymlink:
+				slog.Info("would link", "dst", dstPath, "target", hdr.Linkname)
+				inst.planSymlink(dstPath, info, hdr.Linkname)
+				return nil
+			case tar.TypeReg:
+				if err := inst.planFile(dstPath, info.Mode(), r, archiveMember(archive, hdr.Name), decompress); err != nil {
+					return fail(hdr.Name, dstPath, err)
+				}
+			case tar.TypeLink:
+				// Hard links share the contents of the file they name
+				if name, ok := archiveEntryName(hdr.Linkname, prefix); ok {
+					if entry, ok := inst.manifest.entry(filepath.Join(dst, filepath.FromSlash(name))); ok {
+						inst.manifest.addEntry(dstPath, entry)
+					}
+				}
+			}
+			inst.reportCopy(archiveMember(archive, hdr.Name), dstPath, info)
+			return nil
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			created, err := inst.mkdirAll(dstPath, info.Mode())
+			if err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+			// Existing rootfs directories keep their owner
+			if created {
+				inst.preserveOwnership(dstPath, info)
+				if err := inst.setArchiveXattrs(dstPath, hdr); err != nil {
+					return fail(hdr.Name, dstPath, err)
+				}
+				createdDirs = append(createdDirs, dstPath)
+				createdInfos = append(createdInfos, info)
+			}
+			return nil
+		}
+
+		// Archives needn't list every directory
+		if _, err := inst.mkdirAll(filepath.Dir(dstPath), inst.cfg.dirMode); err != nil {
+			return fail(hdr.Name, dstPath, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			open, err := inst.archiveEntrySource(r)
+			if err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+			job := copyJob{src: archiveMember(archive, hdr.Name), dst: dstPath, info: info, mode: info.Mode(), decompress: decompress, open: open}
+			if fileMode != 0 {
+				job.mode = fileMode
+			}
+			if err := inst.copyRegularFile(ctx, job); err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+			if err := inst.setArchiveXattrs(dstPath, hdr); err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+		case tar.TypeSymlink:
+			existed := inst.exists(dstPath)
+			if err := inst.backup(dstPath); err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+			if err := inst.symlink(hdr.Linkname, dstPath); err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+			symlinks[dstPath] = true
+			inst.preserveOwnership(dstPath, info)
+			dstInfo, err := inst.fs.Lstat(dstPath)
+			if err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+			inst.manifest.addSymlink(dstPath, dstInfo, hdr.Linkname)
+			inst.wrote(dstPath, 0, existed)
+			slog.Debug("linked", "dst", dstPath, "target", hdr.Linkname)
+		case tar.TypeLink:
+			targetName, ok := archiveEntryName(hdr.Linkname, prefix)
+			if !ok {
+				return fail(hdr.Name, dstPath, fmt.Errorf("hard link target %s is outside %s", hdr.Linkname, prefix))
+			}
+			target := filepath.Join(dst, filepath.FromSlash(targetName))
+			if !withinDir(dst, target) {
+				return fail(hdr.Name, dstPath, fmt.Errorf("hard link target %s is outside %s", target, dst))
+			}
+			if inst.cfg.decompressModules && isCompressedModule(targetName) {
+				target = strings.TrimSuffix(target, filepath.Ext(target))
+				dstPath = strings.TrimSuffix(dstPath, filepath.Ext(dstPath))
+			}
+			// Should linking fail, the file is copied from the first name's copy
+			job := copyJob{src: archiveMember(archive, hdr.Name), dst: dstPath, info: info, mode: info.Mode(), open: func() (io.ReadCloser, error) {
+				return inst.fs.Open(target)
+			}}
+			if fileMode != 0 {
+				job.mode = fileMode
+			}
+			if err := inst.copyHardLink(ctx, linkJob{copyJob: job, target: target}); err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+		case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+			if err := inst.copySpecial(archiveMember(archive, hdr.Name), dstPath, info); err != nil {
+				return fail(hdr.Name, dstPath, err)
+			}
+		default:
+			slog.Warn("⚠️  Skipping unsupported tar entry", "name", archiveMember(archive, hdr.Name), "type", string(hdr.Typeflag))
+		}
+		return nil
+	})
+	if err != nil {
+		return matched, err
+	}
+
+	for i, dir := range createdDirs {
+		if err := inst.preserveTimes(dir, createdInfos[i]); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", dir, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return matched, fileFailures(failures)
+	}
+	return matched, nil
+}
+
+// errArchiveReread is returned when an archive entry's contents are asked
+// for a second time, as a retried copy would
+var errArchiveReread = errors.New("archive entry can only be read once")
+
+// archiveEntrySource returns an opener for an entry's contents. Entries are
+// streamed straight to the rootfs, except when the copy compares them with
+// the existing file first, which reads them twice; those are held in memory.
+func (inst *Installer) archiveEntrySource(r io.Reader) (func() (io.ReadCloser, error), error) {
+	if inst.cfg.incremental != "" || inst.cfg.onConflict != conflictOverwrite {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}, nil
+	}
+
+	read := false
+	return func() (io.ReadCloser, error) {
+		if read {
+			return nil, errArchiveReread
+		}
+		read = true
+		return io.NopCloser(r), nil
+	}, nil
+}
+
+// setArchiveXattrs gives dst the extended attributes recorded for an
+// archive entry, when ExtraOptions["preserveXattrs"] is set
+func (inst *Installer) setArchiveXattrs(dst string, hdr *tar.Header) error {
+	if !inst.cfg.preserveXattrs {
+		return nil
+	}
+	attrs := make(map[string][]byte)
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, "SCHILY.xattr."); ok {
+			attrs[name] = []byte(value)
+		}
+	}
+	return inst.setXattrs(dst, attrs)
+}
+
+// archiveSize sums the sizes of the regular files in an archive, which
+// takes reading it through
+func archiveSize(fsys filesystem, archive string) (uint64, error) {
+	var size uint64
+	err := walkArchive(fsys, archive, nil, func(hdr *tar.Header, _ io.Reader) error {
+		if hdr.Typeflag == tar.TypeReg {
+			size += uint64(hdr.Size)
+		}
+		return nil
+	})
+	return size, err
+}
+
+// progressReader counts the bytes read through it as copy progress
+type progressReader struct {
+	r    io.Reader
+	prog *progress
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.prog.add(int64(n))
+	return n, err
+}
@@ -0,0 +1,176 @@
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+// backupDir returns the directory below stateDir holding the files an
+// install replaced, at their rootfs relative paths, relative to the rootfs
+func backupDir(stateDir string) string {
+	return stateDir + "/backup"
+}
+
+// backup saves the file at path before the install replaces it, when
+// ExtraOptions["enableBackup"] is set. Each path is saved once per install,
+// so the backup is what was there before this install touched it.
+func (inst *Installer) backup(path string) error {
+	if !inst.cfg.enableBackup || inst.cfg.dryRun {
+		return nil
+	}
+	rel, ok := inst.manifest.relPath(path)
+	if !ok {
+		return nil
+	}
+
+	info, err := inst.fs.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if !inst.manifest.addBackup(rel) {
+		return nil
+	}
+
+	dst := filepath.Join(inst.rootfsPath, filepath.FromSlash(backupDir(inst.cfg.stateDir)), filepath.FromSlash(rel))
+	if err := inst.fs.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		if _, err := inst.copySymlink(path, dst); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", path, err)
+		}
+		return nil
+	}
+
+	src, err := inst.fs.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	defer src.Close()
+	if _, _, err := inst.copyFile(src, dst, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", path, err)
+	}
+	inst.preserveOwnership(dst, info)
+	return inst.preserveTimes(dst, info)
+}
+
+// clearBackups drops the backups of an earlier install, whether or not
+// this one takes any. Only the most recent install can be rolled back, and
+// backups left by an older one would not match what this one replaced.
+func (inst *Installer) clearBackups() error {
+	if inst.cfg.dryRun {
+		return nil
+	}
+	if err := inst.fs.RemoveAll(rootfsJoin(inst.rootfsPath, backupDir(inst.cfg.stateDir))); err != nil {
+		return fmt.Errorf("failed to clear old backups: %w", err)
+	}
+	return nil
+}
+
+// Rollback undoes the most recent install made with backups enabled: files
+// it replaced are restored, including the previous manifest, and files and
+// directories it added are removed.
+func Rollback(options *Options) error {
+	rootfsPath, err := installRoot(osFS{}, options.MountPrefix, options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	stateDir, err := stateDirOption(options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+
+	fsys := osFS{}
+	manifest, err := readManifest(fsys, rootfsPath, stateDir)
+	if err != nil {
+		return err
+	}
+	// The manifest, not whatever the backup directory holds, says whether
+	// the install kept backups
+	if !manifest.BackupEnabled && len(manifest.Backups) == 0 {
+		return errors.New("no backup to roll back to, install with extraOptions.enableBackup")
+	}
+
+	slog.Info("Rolling back ASUS Ascent GX10 overlay...", "rootfs", rootfsPath, "backups", len(manifest.Backups))
+
+	var errs []error
+
+	// Files the install added have no backup to restore
+	removed := 0
+	for _, entry := range manifest.Files {
+		if slices.Contains(manifest.Backups, entry.Path) {
+			continue
+		}
+		if err := fsys.Remove(rootfsJoin(rootfsPath, entry.Path)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+
+	for _, rel := range manifest.Backups {
+		path := rootfsJoin(rootfsPath, rel)
+		if err := fsys.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := fsys.Rename(rootfsJoin(rootfsPath, backupDir(stateDir)+"/"+rel), path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("restored", "path", path)
+	}
+
+	manifestRel := stateDir + "/" + manifestFile
+	if !slices.Contains(manifest.Backups, manifestRel) {
+		if err := fsys.Remove(manifestPath(rootfsPath, stateDir)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	// Directories the restored manifest still lists stay
+	var keep []string
+	if previous, err := readManifest(fsys, rootfsPath, stateDir); err == nil {
+		keep = previous.Directories
+	}
+	dirs := append([]string(nil), manifest.Directories...)
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if slices.Contains(keep, dir) {
+			continue
+		}
+		path := rootfsJoin(rootfsPath, dir)
+		if entries, err := fsys.ReadDir(path); err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := fsys.Remove(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed++
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to roll back %d paths: %w", len(errs), errors.Join(errs...))
+	}
+
+	if err := fsys.RemoveAll(rootfsJoin(rootfsPath, backupDir(stateDir))); err != nil {
+		return fmt.Errorf("failed to remove backups: %w", err)
+	}
+
+	slog.Log(context.Background(), levelResult, "✅ Rolled back overlay install", "restored", len(manifest.Backups), "removed", removed)
+	return nil
+}
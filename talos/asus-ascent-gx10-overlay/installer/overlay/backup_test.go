@@ -0,0 +1,76 @@
+package overlay
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestRollback(t *testing.T) {
+	backup := map[string]interface{}{"enableBackup": true}
+
+	for _, tc := range []struct {
+		name string
+		// installs run in order, each with these ExtraOptions
+		installs []map[string]interface{}
+		wantErr  bool
+		// want maps rootfs paths to their contents after the rollback, or
+		// to "" when they must be gone
+		want map[string]string
+	}{
+		{
+			name:     "restores replaced files",
+			installs: []map[string]interface{}{backup},
+			want: map[string]string{
+				"etc/nvidia/app.conf":         "node's own\n",
+				"lib/firmware/nvidia/gsp.bin": "",
+			},
+		},
+		{
+			// The second install replaces the first one's files without
+			// backups, so rolling it back would restore nothing that matches
+			name:     "install without backups after one with",
+			installs: []map[string]interface{}{backup, nil},
+			wantErr:  true,
+			want: map[string]string{
+				"etc/nvidia/app.conf":         "key=value\n",
+				"lib/firmware/nvidia/gsp.bin": "gsp firmware",
+			},
+		},
+		{
+			name:     "install without backups",
+			installs: []map[string]interface{}{nil},
+			wantErr:  true,
+			want:     map[string]string{"etc/nvidia/app.conf": "key=value\n"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testOverlay().Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+			testutil.WriteTree(t, rootfs, testutil.Tree{"etc/nvidia/app.conf": testutil.File("node's own\n")})
+
+			for _, extra := range tc.installs {
+				if err := runInstallTest(t, overlayPath, rootfs, extra); err != nil {
+					t.Fatalf("install: %v", err)
+				}
+			}
+
+			err := Rollback(&Options{InstallOptions: InstallOptions{MountPrefix: rootfs}, Stdout: io.Discard})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Rollback() error = %v, want error %v", err, tc.wantErr)
+			}
+			for rel, want := range tc.want {
+				data, err := os.ReadFile(filepath.Join(rootfs, filepath.FromSlash(rel)))
+				switch {
+				case want == "" && !os.IsNotExist(err):
+					t.Errorf("%s still there after rollback: %v", rel, err)
+				case want != "" && string(data) != want:
+					t.Errorf("%s = %q, %v; want %q", rel, data, err, want)
+				}
+			}
+		})
+	}
+}
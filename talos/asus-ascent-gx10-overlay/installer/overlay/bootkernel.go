@@ -0,0 +1,217 @@
+package overlay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// kernelImagePattern matches the file names kernel images are installed
+// under, capturing the kernel version those that carry one end in
+var kernelImagePattern = regexp.MustCompile(`^(?:vmlinuz|vmlinux|Image|bzImage)(?:-(.+?))?(?:\.efi)?$`)
+
+// bootScanDepth is how deep below a partition's mount point kernel images
+// are looked for, enough for boot/, EFI/Linux/ and Talos' A/ and B/
+const bootScanDepth = 3
+
+// linuxBannerPattern matches the version banner every kernel image holds
+var linuxBannerPattern = regexp.MustCompile(`Linux version ([0-9][^\s\x00]*)`)
+
+// resolveKernelVersion determines the target kernel from the module trees
+// under modulesDir and from the kernel images on the install disk, which
+// it returns too for cross-checking. The rootfs wins when both yield a
+// version; the disk is only relied on when it boots a single kernel.
+func resolveKernelVersion(fsys filesystem, modulesDir, installDisk string) (string, []string, error) {
+	kver, rootfsErr := detectKernelVersion(fsys, modulesDir)
+
+	var bootKvers []string
+	var bootErr error
+	if installDisk != "" {
+		bootKvers, bootErr = bootKernelVersions(installDisk)
+	}
+	switch {
+	case rootfsErr == nil:
+		return kver, bootKvers, nil
+	case bootErr != nil:
+		return "", nil, errors.Join(rootfsErr, fmt.Errorf("failed to read boot kernels on %s: %w", installDisk, bootErr))
+	case len(bootKvers) == 1:
+		return bootKvers[0], bootKvers, nil
+	case len(bootKvers) > 1:
+		return "", bootKvers, errors.Join(rootfsErr, fmt.Errorf("install disk %s boots several kernels (%s)", installDisk, strings.Join(bootKvers, ", ")))
+	case installDisk != "":
+		return "", nil, errors.Join(rootfsErr, fmt.Errorf("no kernel images found on install disk %s", installDisk))
+	}
+	return "", nil, rootfsErr
+}
+
+// bootKernelVersions returns the sorted versions of the kernel images on
+// the mounted partitions of installDisk. A version comes from the image's
+// file name, else from the version string in the image itself, which
+// compressed images don't show and so don't count.
+func bootKernelVersions(installDisk string) ([]string, error) {
+	diskInfo, err := os.Stat(installDisk)
+	if err != nil {
+		return nil, err
+	}
+	if diskInfo.Mode()&os.ModeDevice == 0 || diskInfo.Mode()&os.ModeCharDevice != 0 {
+		return nil, fmt.Errorf("install disk %s is not a block device", installDisk)
+	}
+	disk := uint64(diskInfo.Sys().(*syscall.Stat_t).Rdev)
+
+	mounts, err := diskMounts(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for mount, dev := range mounts {
+		err := filepath.WalkDir(mount, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Partitions hold more than boot assets, some unreadable
+				if d != nil && d.IsDir() && path != mount {
+					return fs.SkipDir
+				}
+				return err
+			}
+			rel, _ := filepath.Rel(mount, path)
+			if d.IsDir() {
+				if rel == "." {
+					return nil
+				}
+				// Mounts below the partition's, like /proc, are someone else's
+				info, err := d.Info()
+				if err != nil || uint64(info.Sys().(*syscall.Stat_t).Dev) != dev || strings.Count(rel, string(filepath.Separator)) >= bootScanDepth-1 {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			m := kernelImagePattern.FindStringSubmatch(d.Name())
+			if m == nil || !d.Type().IsRegular() {
+				return nil
+			}
+			kver := m[1]
+			if kver == "" {
+				if kver, err = imageKernelVersion(path); err != nil {
+					return fmt.Errorf("failed to read kernel image %s: %w", path, err)
+				}
+			}
+			if kver != "" && !slices.Contains(versions, kver) {
+				versions = append(versions, kver)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// diskMounts returns the mount points of disk and of its partitions, read
+// from /proc/self/mountinfo, with the device mounted at each
+func diskMounts(disk uint64) (map[string]uint64, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+
+	mounts := make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		var major, minor uint64
+		if _, err := fmt.Sscanf(fields[2], "%d:%d", &major, &minor); err != nil {
+			continue
+		}
+		dev := makeDevice(major, minor)
+		if dev != disk {
+			if parent, err := parentDevice(dev); err != nil || parent != disk {
+				continue
+			}
+		}
+		mounts[unescapeMountPath(fields[4])] = dev
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escapes mountinfo writes whitespace
+// and backslashes in paths as
+func unescapeMountPath(path string) string {
+	var out strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(path[i])
+	}
+	return out.String()
+}
+
+// imageKernelVersion reads the kernel version from a kernel image: from
+// the x86 boot header's version pointer, else from the version banner of
+// an uncompressed image such as arm64's Image. It is empty when the image
+// shows neither.
+func imageKernelVersion(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The boot protocol's kernel_version field points 0x200 bytes short
+	// of a NUL terminated string starting with the version
+	header := make([]byte, 0x210)
+	if _, err := io.ReadFull(f, header); err == nil && string(header[0x202:0x206]) == "HdrS" {
+		if offset := int64(binary.LittleEndian.Uint16(header[0x20e:])); offset != 0 {
+			buf := make([]byte, 256)
+			n, _ := f.ReadAt(buf, offset+0x200)
+			version, _, _ := strings.Cut(string(buf[:n]), "\x00")
+			if kver, _, _ := strings.Cut(version, " "); kver != "" && kver[0] >= '0' && kver[0] <= '9' {
+				return kver, nil
+			}
+		}
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// The banner may straddle two reads, so each keeps the tail of the last
+	var carry []byte
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := io.ReadFull(f, buf)
+		chunk := append(carry, buf[:n]...)
+		// A banner cut short by the end of the chunk is matched in full by
+		// the next one
+		if m := linuxBannerPattern.FindSubmatchIndex(chunk); m != nil && m[1] < len(chunk) {
+			return string(chunk[m[2]:m[3]]), nil
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if m := linuxBannerPattern.FindSubmatch(chunk); m != nil {
+				return string(m[1]), nil
+			}
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		keep := min(len(chunk), 256)
+		carry = append(carry[:0:0], chunk[len(chunk)-keep:]...)
+	}
+}
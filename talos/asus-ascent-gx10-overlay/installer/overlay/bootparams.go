@@ -0,0 +1,77 @@
+package overlay
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// bootCmdlineFile is where earlier versions wrote the kernel command line
+// additions, relative to the rootfs. Nothing on Talos reads it: the imager
+// takes them from the kernelArgs that get-options prints.
+const bootCmdlineFile = "boot/cmdline.d/" + Name + ".conf"
+
+// defaultKernelArgs are the command line additions the GX10 needs for the
+// NVIDIA driver: allow the open kernel modules to bind the GB10 GPU, enable
+// DRM kernel modesetting, and keep the SMMU in passthrough mode for device DMA.
+var defaultKernelArgs = []string{
+	"nvidia.NVreg_OpenRmEnableUnsupportedGpus=1",
+	"nvidia-drm.modeset=1",
+	"iommu.passthrough=1",
+}
+
+// kernelArgs returns the command line additions for this install:
+// defaultKernelArgs plus any kernelArgs from the bundled overlay config.
+// ExtraOptions["kernelArgs"] replaces both entirely when set.
+func kernelArgs(extra map[string]interface{}, config *OverlayConfig) ([]string, error) {
+	args, ok, err := stringListOption(extra, "kernelArgs")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return args, nil
+	}
+
+	args = append([]string(nil), defaultKernelArgs...)
+	for _, arg := range config.KernelArgs {
+		if !slices.Contains(args, arg) {
+			args = append(args, arg)
+		}
+	}
+	return args, nil
+}
+
+// removeBootParameters removes the bootCmdlineFile an earlier install
+// wrote, so that get-options stays the single source of the command line
+// additions. A file the previous manifest doesn't list, or that changed
+// since it was written, is left alone.
+func (inst *Installer) removeBootParameters() error {
+	path := filepath.Join(inst.rootfsPath, filepath.FromSlash(bootCmdlineFile))
+	entry, ok := inst.manifest.previousEntry(path)
+	if !ok {
+		return nil
+	}
+	if _, err := inst.fs.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := verifyEntry(inst.fs, path, entry); err != nil {
+		slog.Warn("⚠️  Keeping boot parameters changed since install", "path", path, "reason", err)
+		return nil
+	}
+	if inst.cfg.dryRun {
+		slog.Info("Would remove boot parameters, get-options supplies them", "path", path)
+		return nil
+	}
+
+	if err := inst.backup(path); err != nil {
+		return err
+	}
+	if err := inst.fs.Remove(path); err != nil {
+		return err
+	}
+	inst.markDirty(filepath.Dir(path))
+	inst.manifest.addRemoval(path)
+	slog.Info("🥾 Removed boot parameters, get-options supplies them", "path", path)
+	return nil
+}
@@ -0,0 +1,218 @@
+package overlay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"go.yaml.in/yaml/v4"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// getOptionsOutput is the get-options YAML the imager reads
+type getOptionsOutput struct {
+	Name          string             `yaml:"name"`
+	KernelArgs    []string           `yaml:"kernelArgs"`
+	MachineConfig MachineConfigPatch `yaml:"machineConfig"`
+}
+
+// getOptionsTest runs get-options on the overlay at overlayPath and decodes
+// its YAML
+func getOptionsTest(t *testing.T, overlayPath string, extra map[string]interface{}, args ...string) getOptionsOutput {
+	t.Helper()
+	var out bytes.Buffer
+	err := GetOptions(&Options{
+		InstallOptions: InstallOptions{ExtraOptions: extra},
+		OverlayPath:    overlayPath,
+		Args:           args,
+		Stdout:         &out,
+	})
+	if err != nil {
+		t.Fatalf("get-options: %v", err)
+	}
+
+	var options getOptionsOutput
+	if err := yaml.Unmarshal(out.Bytes(), &options); err != nil {
+		t.Fatalf("get-options output is not YAML: %v\n%s", err, out.String())
+	}
+	if options.Name != Name {
+		t.Errorf("name = %q, want %q", options.Name, Name)
+	}
+	return options
+}
+
+func TestGetOptionsKernelArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		extra  map[string]interface{}
+		want   []string
+	}{
+		{
+			name: "defaults",
+			want: defaultKernelArgs,
+		},
+		{
+			name:   "overlay config adds",
+			config: "kernelArgs:\n  - nvidia.NVreg_EnableGpuFirmware=1\n  - iommu.passthrough=1\n",
+			want:   append(slices.Clone(defaultKernelArgs), "nvidia.NVreg_EnableGpuFirmware=1"),
+		},
+		{
+			name:   "extra options replace",
+			config: "kernelArgs:\n  - nvidia.NVreg_EnableGpuFirmware=1\n",
+			extra:  map[string]interface{}{"kernelArgs": []interface{}{"console=ttyAMA0"}},
+			want:   []string{"console=ttyAMA0"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testutil.Overlay{Config: tc.config}.Build(t)
+			if got := getOptionsTest(t, overlayPath, tc.extra).KernelArgs; !slices.Equal(got, tc.want) {
+				t.Errorf("kernelArgs = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGetOptionsProfile(t *testing.T) {
+	const config = `kernelArgs:
+  - nvidia.NVreg_EnableGpuFirmware=1
+sysctls:
+  vm.max_map_count: "262144"
+profiles:
+  rev-a:
+    kernelArgs:
+      - nvidia.NVreg_EnableGpuFirmware=0
+    sysctls:
+      vm.nr_hugepages: "1024"
+  rev-b:
+    kernelArgs:
+      - nvidia.NVreg_EnableGpuFirmware=1
+      - iommu.strict=1
+`
+	for _, tc := range []struct {
+		name       string
+		extra      map[string]interface{}
+		args       []string
+		want       []string
+		wantSysctl map[string]string
+	}{
+		{
+			name:       "no profile",
+			want:       append(slices.Clone(defaultKernelArgs), "nvidia.NVreg_EnableGpuFirmware=1"),
+			wantSysctl: map[string]string{"net.core.bpf_jit_harden": "1", "vm.max_map_count": "262144"},
+		},
+		{
+			name:       "profile flag",
+			args:       []string{"--profile", "rev-a"},
+			want:       append(slices.Clone(defaultKernelArgs), "nvidia.NVreg_EnableGpuFirmware=0"),
+			wantSysctl: map[string]string{"net.core.bpf_jit_harden": "1", "vm.nr_hugepages": "1024"},
+		},
+		{
+			name:       "profile option",
+			extra:      map[string]interface{}{"profile": "rev-b"},
+			want:       append(slices.Clone(defaultKernelArgs), "nvidia.NVreg_EnableGpuFirmware=1", "iommu.strict=1"),
+			wantSysctl: map[string]string{"net.core.bpf_jit_harden": "1", "vm.max_map_count": "262144"},
+		},
+		{
+			name:       "flag over option",
+			extra:      map[string]interface{}{"profile": "rev-b"},
+			args:       []string{"--profile", "rev-a"},
+			want:       append(slices.Clone(defaultKernelArgs), "nvidia.NVreg_EnableGpuFirmware=0"),
+			wantSysctl: map[string]string{"net.core.bpf_jit_harden": "1", "vm.nr_hugepages": "1024"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testutil.Overlay{Config: config}.Build(t)
+			testutil.WriteTree(t, overlayPath, testutil.Tree{
+				profilesDir + "/rev-a": testutil.Dir(),
+				profilesDir + "/rev-b": testutil.Dir(),
+			})
+
+			got := getOptionsTest(t, overlayPath, tc.extra, tc.args...)
+			if !slices.Equal(got.KernelArgs, tc.want) {
+				t.Errorf("kernelArgs = %q, want %q", got.KernelArgs, tc.want)
+			}
+			if !maps.Equal(got.MachineConfig.Machine.Sysctls, tc.wantSysctl) {
+				t.Errorf("sysctls = %v, want %v", got.MachineConfig.Machine.Sysctls, tc.wantSysctl)
+			}
+			if got.MachineConfig.Machine.Udev == nil || len(got.MachineConfig.Machine.Udev.Rules) == 0 {
+				t.Error("machineConfig has no udev rules")
+			}
+		})
+	}
+}
+
+func TestGetOptionsUnknownProfile(t *testing.T) {
+	overlayPath := testutil.Overlay{}.Build(t)
+	testutil.WriteTree(t, overlayPath, testutil.Tree{profilesDir + "/rev-a": testutil.Dir()})
+
+	err := GetOptions(&Options{OverlayPath: overlayPath, Args: []string{"--profile", "rev-z"}, Stdout: io.Discard})
+	if !errors.Is(err, ErrInvalidOptions) || !strings.Contains(err.Error(), "available profiles: rev-a") {
+		t.Errorf("get-options with an unknown profile returned %v, want an %v listing rev-a", err, ErrInvalidOptions)
+	}
+}
+
+func TestInstallRemovesBootParameters(t *testing.T) {
+	const written = "nvidia-drm.modeset=1\n"
+
+	for _, tc := range []struct {
+		name string
+		// earlier is what an earlier install left at bootCmdlineFile, with
+		// recorded set when its manifest lists it
+		earlier  string
+		recorded bool
+		want     string
+	}{
+		{name: "fresh install"},
+		{name: "written by an earlier install", earlier: written, recorded: true},
+		{name: "changed since", earlier: "console=ttyAMA0\n", recorded: true, want: "console=ttyAMA0\n"},
+		{name: "not ours", earlier: written, want: written},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testOverlay().Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+			if err := runInstallTest(t, overlayPath, rootfs, nil); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			if tc.earlier != "" {
+				testutil.WriteTree(t, rootfs, testutil.Tree{bootCmdlineFile: testutil.File(tc.earlier)})
+			}
+			if tc.recorded {
+				manifest, err := readManifest(osFS{}, rootfs, defaultStateDir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				manifest.Files = append(manifest.Files, ManifestEntry{
+					Path:   bootCmdlineFile,
+					Size:   int64(len(written)),
+					Mode:   0644,
+					SHA256: sha256Hex(written),
+				})
+				if err := writeManifest(osFS{}, rootfs, defaultStateDir, manifest); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := runInstallTest(t, overlayPath, rootfs, nil); err != nil {
+				t.Fatalf("reinstall: %v", err)
+			}
+			got, err := os.ReadFile(filepath.Join(rootfs, bootCmdlineFile))
+			switch {
+			case tc.want == "" && !os.IsNotExist(err):
+				t.Errorf("%s left in place: %q, %v", bootCmdlineFile, got, err)
+			case tc.want != "" && string(got) != tc.want:
+				t.Errorf("%s = %q, %v, want %q kept", bootCmdlineFile, got, err, tc.want)
+			}
+			if err := verifyTest(t, rootfs, nil); err != nil {
+				t.Errorf("verify: %v", err)
+			}
+		})
+	}
+}
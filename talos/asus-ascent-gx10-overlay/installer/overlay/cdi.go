@@ -0,0 +1,232 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go.yaml.in/yaml/v4"
+)
+
+// cdiSpecFile is where container runtimes find the GPU's CDI spec,
+// relative to the rootfs
+const cdiSpecFile = "etc/cdi/nvidia.yaml"
+
+// cdiVersion is the CDI spec version written; it is the first to allow
+// spec level annotations
+const cdiVersion = "0.6.0"
+
+// cdiKind is the CDI device kind the spec declares; pods request a GPU as
+// nvidia.com/gpu=0, nvidia.com/gpu=<UUID> or nvidia.com/gpu=all
+const cdiKind = "nvidia.com/gpu"
+
+// moduleDeviceNodes are the control device nodes each NVIDIA module creates
+// once loaded, shared by every GPU
+var moduleDeviceNodes = map[string][]string{
+	"nvidia":         {"/dev/nvidiactl"},
+	"nvidia_uvm":     {"/dev/nvidia-uvm", "/dev/nvidia-uvm-tools"},
+	"nvidia_modeset": {"/dev/nvidia-modeset"},
+}
+
+// cdiMountOptions are how the spec's mounts are bound into containers
+var cdiMountOptions = []string{"ro", "nosuid", "nodev", "bind"}
+
+// cdiSpec is the subset of a CDI spec the installer fills in
+type cdiSpec struct {
+	CDIVersion     string            `yaml:"cdiVersion"`
+	Kind           string            `yaml:"kind"`
+	Annotations    map[string]string `yaml:"annotations,omitempty"`
+	Devices        []cdiDevice       `yaml:"devices"`
+	ContainerEdits cdiEdits          `yaml:"containerEdits"`
+}
+
+type cdiDevice struct {
+	Name           string   `yaml:"name"`
+	ContainerEdits cdiEdits `yaml:"containerEdits"`
+}
+
+type cdiEdits struct {
+	Env         []string        `yaml:"env,omitempty"`
+	DeviceNodes []cdiDeviceNode `yaml:"deviceNodes,omitempty"`
+	Mounts      []cdiMount      `yaml:"mounts,omitempty"`
+}
+
+type cdiDeviceNode struct {
+	Path string `yaml:"path"`
+}
+
+type cdiMount struct {
+	HostPath      string   `yaml:"hostPath"`
+	ContainerPath string   `yaml:"containerPath"`
+	Options       []string `yaml:"options,omitempty"`
+}
+
+// installCDISpec writes, when ExtraOptions["cdiSpec"] or
+// ["installContainerToolkitConfig"] is set, a CDI spec listing the GPU
+// device nodes, the device nodes of the modules loaded at boot, the
+// driver's firmware and ExtraOptions["cdiMounts"] as mounts, and the driver
+// version. ExtraOptions["gpuCount"] and ["gpuUUIDs"] describe boards with
+// more than the GX10's single GPU. The file belongs to the overlay, so
+// re-running replaces it.
+func (inst *Installer) installCDISpec() error {
+	if !inst.cfg.cdiSpec {
+		return nil
+	}
+
+	modules, err := inst.loadModules()
+	if err != nil {
+		return err
+	}
+	mounts := inst.cfg.cdiMounts
+	driverVersion := inst.summary.DriverVersion
+	// GSP firmware is read from inside the container by nvidia-smi and CUDA,
+	// which look for it at the base firmware path
+	if dir := inst.firmwareDir + "/nvidia/" + driverVersion; driverVersion != "" && inst.installedUnder(dir) {
+		containerDir := inst.cfg.firmwareDir + "/nvidia/" + driverVersion
+		mounts = append([]cdiMount{{HostPath: "/" + dir, ContainerPath: "/" + containerDir, Options: cdiMountOptions}}, mounts...)
+	}
+
+	spec := newCDISpec(driverVersion, inst.cfg.gpuCount, inst.cfg.gpuUUIDs, modules, mounts)
+	if err := validateCDISpec(spec); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(spec)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(inst.rootfsPath, filepath.FromSlash(cdiSpecFile))
+	slog.Info("🐳 Writing CDI spec", "dst", path, "kind", cdiKind, "gpus", inst.cfg.gpuCount, "mounts", len(mounts))
+	return inst.writeFile(path, append([]byte("# Added by "+Name+"\n"), data...), 0644)
+}
+
+// installedUnder reports whether this install records any file under dir,
+// relative to the rootfs
+func (inst *Installer) installedUnder(dir string) bool {
+	for _, entry := range inst.manifest.Files {
+		if strings.HasPrefix(entry.Path, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCDIMounts parses hostPath[:containerPath] mount entries; the
+// container path defaults to the host path
+func parseCDIMounts(entries []string) ([]cdiMount, error) {
+	var mounts []cdiMount
+	for _, entry := range entries {
+		hostPath, containerPath, ok := strings.Cut(entry, ":")
+		if !ok {
+			containerPath = hostPath
+		}
+		if !path.IsAbs(hostPath) || !path.IsAbs(containerPath) {
+			return nil, fmt.Errorf("extraOptions.cdiMounts: %q: paths must be absolute", entry)
+		}
+		mounts = append(mounts, cdiMount{HostPath: path.Clean(hostPath), ContainerPath: path.Clean(containerPath), Options: cdiMountOptions})
+	}
+	return mounts, nil
+}
+
+// newCDISpec builds the spec for gpus GPUs. Each is a device named by its
+// index and, when uuids are given, by its UUID too; "all" holds every GPU.
+// What every GPU needs, the control nodes of the loaded modules and the
+// mounts, is common to all devices.
+func newCDISpec(driverVersion string, gpus int, uuids []string, modules []string, mounts []cdiMount) cdiSpec {
+	spec := cdiSpec{CDIVersion: cdiVersion, Kind: cdiKind}
+
+	var all cdiEdits
+	for i := 0; i < gpus; i++ {
+		node := cdiDeviceNode{Path: fmt.Sprintf("/dev/nvidia%d", i)}
+		edits := cdiEdits{DeviceNodes: []cdiDeviceNode{node}}
+		spec.Devices = append(spec.Devices, cdiDevice{Name: fmt.Sprint(i), ContainerEdits: edits})
+		if i < len(uuids) {
+			spec.Devices = append(spec.Devices, cdiDevice{Name: uuids[i], ContainerEdits: edits})
+		}
+		all.DeviceNodes = append(all.DeviceNodes, node)
+	}
+	spec.Devices = append(spec.Devices, cdiDevice{Name: "all", ContainerEdits: all})
+
+	// The runtime's legacy hook must not inject devices on top of CDI
+	spec.ContainerEdits.Env = []string{"NVIDIA_VISIBLE_DEVICES=void"}
+	if driverVersion != "" {
+		spec.Annotations = map[string]string{"nvidia.com/driver-version": driverVersion}
+		spec.ContainerEdits.Env = append(spec.ContainerEdits.Env, "NVIDIA_DRIVER_VERSION="+driverVersion)
+	}
+	for _, module := range modules {
+		// kmod treats dashes and underscores alike
+		for _, node := range moduleDeviceNodes[strings.ReplaceAll(module, "-", "_")] {
+			spec.ContainerEdits.DeviceNodes = append(spec.ContainerEdits.DeviceNodes, cdiDeviceNode{Path: node})
+		}
+	}
+	spec.ContainerEdits.Mounts = mounts
+	return spec
+}
+
+// Names the CDI spec allows, from its schema
+var (
+	cdiVendorPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.-]*[a-zA-Z0-9])?$`)
+	cdiClassPattern  = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_-]*[a-zA-Z0-9])?$`)
+	cdiDevicePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9_.:-]*[a-zA-Z0-9])?$`)
+)
+
+// validateCDISpec checks spec against the rules of the CDI version it
+// declares, so a bad GPU UUID or mount fails the install rather than every
+// pod that asks for the GPU
+func validateCDISpec(spec cdiSpec) error {
+	var errs []error
+	vendor, class, ok := strings.Cut(spec.Kind, "/")
+	if !ok || !cdiVendorPattern.MatchString(vendor) || !cdiClassPattern.MatchString(class) {
+		errs = append(errs, fmt.Errorf("kind %q is not vendor/class", spec.Kind))
+	}
+	if len(spec.Devices) == 0 {
+		errs = append(errs, errors.New("no devices"))
+	}
+
+	seen := make(map[string]bool)
+	for _, device := range spec.Devices {
+		if !cdiDevicePattern.MatchString(device.Name) {
+			errs = append(errs, fmt.Errorf("invalid device name %q", device.Name))
+		}
+		if seen[device.Name] {
+			errs = append(errs, fmt.Errorf("duplicate device name %q", device.Name))
+		}
+		seen[device.Name] = true
+		if len(device.ContainerEdits.Env)+len(device.ContainerEdits.DeviceNodes)+len(device.ContainerEdits.Mounts) == 0 {
+			errs = append(errs, fmt.Errorf("device %q has no container edits", device.Name))
+		}
+		errs = append(errs, validateCDIEdits(device.ContainerEdits)...)
+	}
+	errs = append(errs, validateCDIEdits(spec.ContainerEdits)...)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid CDI spec: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// validateCDIEdits checks the environment, device nodes and mounts of a
+// set of container edits
+func validateCDIEdits(edits cdiEdits) []error {
+	var errs []error
+	for _, env := range edits.Env {
+		if name, _, ok := strings.Cut(env, "="); !ok || name == "" {
+			errs = append(errs, fmt.Errorf("env %q is not NAME=value", env))
+		}
+	}
+	for _, node := range edits.DeviceNodes {
+		if !path.IsAbs(node.Path) {
+			errs = append(errs, fmt.Errorf("device node %q is not an absolute path", node.Path))
+		}
+	}
+	for _, mount := range edits.Mounts {
+		if !path.IsAbs(mount.HostPath) || !path.IsAbs(mount.ContainerPath) {
+			errs = append(errs, fmt.Errorf("mount %s:%s needs absolute paths", mount.HostPath, mount.ContainerPath))
+		}
+	}
+	return errs
+}
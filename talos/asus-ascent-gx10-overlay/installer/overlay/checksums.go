@@ -0,0 +1,98 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sourceChecksumsFile is an unsigned sha256sum style listing in the
+// artifacts directory, with paths relative to it. Unlike SHA256SUMS it
+// guards against corrupted downloads and builds rather than tampering.
+const sourceChecksumsFile = "checksums.txt"
+
+// verifySourceChecksums checks every regular file the install would copy
+// from overlayPath against its checksums.txt, before anything is written.
+// Archives are checked as a whole. Files the listing misses fail, as do
+// listed files that are gone; an overlay without a listing is not checked.
+func verifySourceChecksums(fsys filesystem, overlayPath string, config *OverlayConfig) error {
+	listingPath := artifactDir(fsys, overlayPath, sourceChecksumsFile)
+	data, err := fsys.ReadFile(listingPath)
+	if os.IsNotExist(err) {
+		slog.Debug("No source checksums to verify", "path", listingPath)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", sourceChecksumsFile, err)
+	}
+	listed, err := parseChecksums(sourceChecksumsFile, data)
+	if err != nil {
+		return err
+	}
+	root := filepath.Dir(listingPath)
+
+	var errs []error
+	seen := make(map[string]bool)
+	check := func(path string) {
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			errs = append(errs, fmt.Errorf("%s: outside %s, not covered by %s", path, root, sourceChecksumsFile))
+			return
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		want, ok := listed[rel]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: not listed in %s", rel, sourceChecksumsFile))
+			return
+		}
+		got, err := fileSHA256(fsys, path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+			return
+		}
+		if got != want {
+			errs = append(errs, fmt.Errorf("%s: sha256 mismatch, expected %s, got %s", rel, want, got))
+		}
+	}
+
+	for _, dir := range artifactSources(fsys, overlayPath, config) {
+		if archive, ok := artifactArchive(fsys, dir); ok {
+			check(archive)
+			continue
+		}
+		err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == dir && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			// Symlinks are recreated rather than copied, and special
+			// files have no contents
+			if info.Mode().IsRegular() {
+				check(path)
+			}
+			return nil
+		})
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for rel := range listed {
+		if !seen[rel] {
+			errs = append(errs, fmt.Errorf("%s: listed in %s but missing", rel, sourceChecksumsFile))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("source checksum verification failed: %w", errors.Join(errs...))
+	}
+	slog.Info("🔎 Verified source checksums", "files", len(listed))
+	return nil
+}
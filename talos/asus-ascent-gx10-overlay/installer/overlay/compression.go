@@ -0,0 +1,217 @@
+package overlay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Values of ExtraOptions["onCompressionMismatch"]
+const (
+	compressionWarn       = "warn"
+	compressionError      = "error"
+	compressionRecompress = "recompress"
+)
+
+// kernelConfigCompressions maps the CONFIG_MODULE_COMPRESS_* choices of a
+// kernel config to the module suffix they install modules with
+var kernelConfigCompressions = map[string]string{
+	"CONFIG_MODULE_COMPRESS_NONE": "",
+	"CONFIG_MODULE_COMPRESS_GZIP": ".gz",
+	"CONFIG_MODULE_COMPRESS_XZ":   ".xz",
+	"CONFIG_MODULE_COMPRESS_ZSTD": ".zst",
+}
+
+// compressionName names a module suffix for logs and the summary
+func compressionName(suffix string) string {
+	switch suffix {
+	case ".gz":
+		return "gzip"
+	case ".xz":
+		return "xz"
+	case ".zst":
+		return "zstd"
+	}
+	return "none"
+}
+
+// moduleCompressionSuffix returns the compression suffix of a module file
+// name, empty for an uncompressed .ko
+func moduleCompressionSuffix(name string) string {
+	if !isCompressedModule(name) {
+		return ""
+	}
+	return filepath.Ext(name)
+}
+
+// kernelModuleCompression returns the suffix the kernel kver installs its
+// own modules with, read from its config at boot/config-<kver> in the
+// rootfs. It reports false when the rootfs has no config for kver.
+func kernelModuleCompression(rootfsPath, kver string) (string, bool, error) {
+	f, err := os.Open(filepath.Join(rootfsPath, "boot", "config-"+kver))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	// Kernels before 5.13 have no NONE choice, only the others behind a
+	// CONFIG_MODULE_COMPRESS switch, so no choice means uncompressed
+	suffix := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || value != "y" {
+			continue
+		}
+		if s, ok := kernelConfigCompressions[name]; ok {
+			suffix = s
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", false, err
+	}
+	return suffix, true, nil
+}
+
+// checkModuleCompression compares how the installed modules are compressed
+// with what each target kernel's config expects. A kernel built for
+// compressed modules may lack the decompressor for others, and depmod and
+// modprobe only look for the suffix the kernel's own modules have. A
+// mismatch is warned about, fails the install, or has the modules
+// recompressed, as ExtraOptions["onCompressionMismatch"] says.
+func (inst *Installer) checkModuleCompression(ctx context.Context) error {
+	if inst.cfg.dryRun {
+		slog.Debug("Skipping module compression check in dry run")
+		return nil
+	}
+
+	// Kernels without a config in the rootfs are looked up once and left
+	// unchecked
+	expected := make(map[string]string)
+	looked := make(map[string]bool)
+	mismatched := make(map[string][]string)
+	for _, entry := range inst.manifest.Files {
+		if !entry.Mode.IsRegular() {
+			continue
+		}
+		kver, ok := inst.moduleKernelVersion(entry.Path)
+		if !ok {
+			continue
+		}
+		if !looked[kver] {
+			looked[kver] = true
+			// The stage of a staged install has no boot directory
+			suffix, found, err := kernelModuleCompression(inst.mountPrefix, kver)
+			if err != nil {
+				return fmt.Errorf("failed to read kernel config for %s: %w", kver, err)
+			}
+			if !found {
+				slog.Debug("No kernel config to check module compression against", "kver", kver)
+				continue
+			}
+			expected[kver] = suffix
+		}
+		if want, ok := expected[kver]; ok && moduleCompressionSuffix(entry.Path) != want {
+			mismatched[kver] = append(mismatched[kver], entry.Path)
+		}
+	}
+
+	kvers := make([]string, 0, len(expected))
+	for kver, suffix := range expected {
+		kvers = append(kvers, kver)
+		if inst.summary.ModuleCompression == nil {
+			inst.summary.ModuleCompression = make(map[string]string)
+		}
+		inst.summary.ModuleCompression[kver] = compressionName(suffix)
+	}
+	sort.Strings(kvers)
+
+	for _, kver := range kvers {
+		want := compressionName(expected[kver])
+		modules := mismatched[kver]
+		if len(modules) == 0 {
+			slog.Info("🗜️  Module compression matches the kernel", "kver", kver, "compression", want)
+			continue
+		}
+		switch inst.cfg.onCompressionMismatch {
+		case compressionError:
+			return fmt.Errorf("%d modules for kernel %s aren't compressed with %s as its config expects, set extraOptions.onCompressionMismatch to recompress them: %s", len(modules), kver, want, strings.Join(modules, ", "))
+		case compressionRecompress:
+			for _, rel := range modules {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := inst.recompressModule(rootfsJoin(inst.rootfsPath, rel), expected[kver]); err != nil {
+					return fmt.Errorf("failed to recompress %s: %w", rel, err)
+				}
+			}
+			slog.Info("🗜️  Recompressed modules for the kernel", "kver", kver, "compression", want, "modules", len(modules))
+			if err := inst.regenerateModuleDeps(ctx, kver); err != nil {
+				return err
+			}
+		default:
+			slog.Warn("⚠️  Modules aren't compressed the way the kernel expects", "kver", kver, "compression", want, "modules", len(modules))
+		}
+	}
+	return nil
+}
+
+// recompressModule replaces the module at path with a copy compressed as
+// suffix says, renaming it to match, and moves its manifest entry along
+func (inst *Installer) recompressModule(path, suffix string) error {
+	info, err := inst.fs.Lstat(path)
+	if err != nil {
+		return err
+	}
+	data, err := readModule(inst.fs, path)
+	if err != nil {
+		return err
+	}
+	dst := strings.TrimSuffix(path, moduleCompressionSuffix(path)) + suffix
+
+	var buf bytes.Buffer
+	w, err := compressModule(&buf, dst)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	existed := inst.exists(dst)
+	if err := inst.backup(dst); err != nil {
+		return err
+	}
+	size, sum, err := inst.copyFile(&buf, dst, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	inst.preserveOwnership(dst, info)
+	if err := inst.preserveTimes(dst, info); err != nil {
+		return err
+	}
+	inst.wrote(dst, size, existed)
+	if err := inst.fs.Remove(path); err != nil {
+		return err
+	}
+	inst.markDirty(filepath.Dir(dst))
+
+	newInfo, err := inst.fs.Stat(dst)
+	if err != nil {
+		return err
+	}
+	inst.manifest.renameFile(path, dst, newInfo, sum)
+	return nil
+}
@@ -0,0 +1,45 @@
+package overlay
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// containerToolkitConfigFile is where the NVIDIA container toolkit reads
+// its config, relative to the rootfs
+const containerToolkitConfigFile = "etc/nvidia-container-runtime/config.toml"
+
+// installContainerToolkit writes, when
+// ExtraOptions["installContainerToolkitConfig"] is set, the NVIDIA
+// container runtime config. The CDI spec it points the runtime at is
+// written by installCDISpec. The file belongs to the overlay, so re-running
+// replaces it.
+func (inst *Installer) installContainerToolkit() error {
+	if !inst.cfg.containerToolkit {
+		return nil
+	}
+
+	driverVersion := inst.summary.DriverVersion
+	path := filepath.Join(inst.rootfsPath, filepath.FromSlash(containerToolkitConfigFile))
+	slog.Info("🐳 Writing container toolkit config", "dst", path, "driverVersion", driverVersion)
+	return inst.writeFile(path, renderContainerToolkitConfig(driverVersion), 0644)
+}
+
+// renderContainerToolkitConfig formats the container runtime config. The
+// runtime is put in CDI mode so it injects exactly what the spec lists,
+// rather than looking for the devices itself.
+func renderContainerToolkitConfig(driverVersion string) []byte {
+	var out strings.Builder
+	out.WriteString("# Added by " + Name + "\n")
+	if driverVersion != "" {
+		out.WriteString("# NVIDIA driver " + driverVersion + "\n")
+	}
+	out.WriteString("\n[nvidia-container-runtime]\n")
+	out.WriteString("mode = \"cdi\"\n")
+	out.WriteString("\n[nvidia-container-runtime.modes.cdi]\n")
+	fmt.Fprintf(&out, "default-kind = %q\n", cdiKind)
+	fmt.Fprintf(&out, "spec-dirs = [%q]\n", "/"+filepath.ToSlash(filepath.Dir(cdiSpecFile)))
+	return []byte(out.String())
+}
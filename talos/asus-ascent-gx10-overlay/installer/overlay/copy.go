@@ -0,0 +1,1021 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// copyDirectory recursively copies a directory, recording every file and
+// newly created directory in the manifest. In dry-run mode it only reports
+// what would be copied. The copy stops between files once ctx is done.
+// A non-zero fileMode replaces the permissions of every copied file, and
+// a non-empty include limits the files copied to those it matches; see
+// included.
+//
+// Every entry is attempted even when some fail, and the returned error lists
+// each failed path. Only errors that doom the rest of the copy, like a full
+// disk, stop it early.
+func (inst *Installer) copyDirectory(ctx context.Context, src, dst string, fileMode os.FileMode, include []string) error {
+	// Creating children bumps a directory's mtime, so created directories
+	// get their source times restored once the walk is done
+	var createdDirs []string
+	var createdInfos []os.FileInfo
+
+	// Regular files are queued during the walk and copied afterwards, so
+	// every directory exists before any worker starts writing
+	var jobs []copyJob
+
+	// Further names of a hard linked source file are linked to the first
+	// name's copy once the copies are done
+	var links []linkJob
+	firstNames := make(map[fileID]string)
+
+	var failures []error
+	fail := func(path, dstPath string, info os.FileInfo, err error) error {
+		err = copyPathError(path, dstPath, err)
+		if isFatal(err) {
+			return err
+		}
+		failures = append(failures, err)
+		// Nothing below a directory that failed can be copied
+		if info != nil && info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	err := inst.fs.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fail(path, "", info, err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return fail(path, "", info, err)
+		}
+
+		// Excluded directories drop everything below them
+		if relPath != "." && inst.excluded(filepath.ToSlash(relPath)) {
+			slog.Debug("Excluding file", "path", path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() && !included(include, filepath.ToSlash(relPath)) {
+			slog.Debug("Skipping file not included", "path", path)
+			return nil
+		}
+
+		dstPath := filepath.Join(dst, relPath)
+		if !withinDir(dst, dstPath) {
+			return fail(path, "", info, fmt.Errorf("destination %s is outside %s", dstPath, dst))
+		}
+		if dstPath, err = inst.resolveDest(dstPath); err != nil {
+			return fail(path, "", info, err)
+		}
+
+		// Whiteouts delete from dst rather than being copied, and an opaque
+		// directory drops what dst held before its children are copied
+		if info.IsDir() {
+			if _, err := inst.fs.Lstat(filepath.Join(path, whiteoutOpaque)); err == nil {
+				if err := inst.clearOpaque(dstPath, nil); err != nil {
+					return fail(path, dstPath, info, err)
+				}
+			}
+		} else if isWhiteout(info.Name()) {
+			if err := inst.whiteout(dstPath); err != nil {
+				return fail(path, dstPath, info, err)
+			}
+			return nil
+		}
+
+		// Compressed modules are stored uncompressed when asked, minus the extension
+		decompress := inst.cfg.decompressModules && info.Mode().IsRegular() && isCompressedModule(path)
+		if decompress {
+			dstPath = strings.TrimSuffix(dstPath, filepath.Ext(dstPath))
+		}
+
+		if inst.cfg.dryRun {
+			inst.reportCopy(path, dstPath, info)
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				target, err := inst.fs.Readlink(path)
+				if err != nil {
+					return fail(path, dstPath, info, err)
+				}
+				inst.planSymlink(dstPath, info, target)
+			case info.Mode().IsRegular():
+				if err := inst.planSourceFile(path, dstPath, info, decompress); err != nil {
+					return fail(path, dstPath, info, err)
+				}
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			// Directories above dst have no source to take a mode from
+			if path == src {
+				if _, err := inst.mkdirAll(filepath.Dir(dstPath), inst.cfg.dirMode); err != nil {
+					return fail(path, dstPath, info, err)
+				}
+			}
+			created, err := inst.mkdirAll(dstPath, info.Mode())
+			if err != nil {
+				return fail(path, dstPath, info, err)
+			}
+			// Existing rootfs directories keep their owner
+			if created {
+				inst.preserveOwnership(dstPath, info)
+				if err := inst.preserveXattrs(path, dstPath); err != nil {
+					return fail(path, dstPath, info, err)
+				}
+				createdDirs = append(createdDirs, dstPath)
+				createdInfos = append(createdInfos, info)
+			}
+			return nil
+		}
+
+		// Create parent directory if it doesn't exist, with the mode of
+		// the source directory
+		parentMode := inst.cfg.dirMode
+		if parent, err := inst.fs.Stat(filepath.Dir(path)); err == nil {
+			parentMode = parent.Mode().Perm()
+		}
+		if _, err := inst.mkdirAll(filepath.Dir(dstPath), parentMode); err != nil {
+			return fail(path, dstPath, info, err)
+		}
+
+		// Recreate symlinks verbatim rather than copying their targets
+		if info.Mode()&os.ModeSymlink != 0 {
+			existed := inst.exists(dstPath)
+			if err := inst.backup(dstPath); err != nil {
+				return fail(path, dstPath, info, err)
+			}
+			target, err := inst.copySymlink(path, dstPath)
+			if err != nil {
+				return fail(path, dstPath, info, err)
+			}
+			inst.preserveOwnership(dstPath, info)
+			if err := inst.preserveXattrs(path, dstPath); err != nil {
+				return fail(path, dstPath, info, err)
+			}
+			dstInfo, err := inst.fs.Lstat(dstPath)
+			if err != nil {
+				return fail(path, dstPath, info, err)
+			}
+			inst.manifest.addSymlink(dstPath, dstInfo, target)
+			inst.wrote(dstPath, 0, existed)
+			slog.Debug("linked", "dst", dstPath, "target", target)
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			if err := inst.copySpecial(path, dstPath, info); err != nil {
+				return fail(path, dstPath, info, err)
+			}
+			return nil
+		}
+
+		job := copyJob{src: path, dst: dstPath, info: info, mode: info.Mode(), decompress: decompress}
+		if fileMode != 0 {
+			job.mode = fileMode
+		}
+		if id, ok := hardLinkID(info); ok {
+			if first, seen := firstNames[id]; seen {
+				links = append(links, linkJob{copyJob: job, target: first})
+				return nil
+			}
+			firstNames[id] = dstPath
+		}
+		if target, ok := inst.dedupeTarget(job); ok {
+			links = append(links, linkJob{copyJob: job, target: target, deduped: true})
+			return nil
+		}
+		jobs = append(jobs, job)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	copyFailures, err := inst.copyFiles(ctx, dst, jobs)
+	if err != nil {
+		return err
+	}
+	failures = append(failures, copyFailures...)
+
+	for _, link := range links {
+		if err := inst.copyHardLink(ctx, link); err != nil {
+			err = copyPathError(link.src, link.dst, err)
+			if isFatal(err) {
+				return err
+			}
+			failures = append(failures, err)
+		}
+	}
+
+	for i, dir := range createdDirs {
+		if err := inst.preserveTimes(dir, createdInfos[i]); err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", dir, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fileFailures(failures)
+	}
+	return nil
+}
+
+// copyPathError names the source and, when known, the destination of a
+// failed copy. err stays wrapped, so errors.Is still finds the errno of the
+// *os.PathError below it.
+func copyPathError(src, dst string, err error) error {
+	if dst == "" {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return fmt.Errorf("%s -> %s: %w", src, dst, err)
+}
+
+// isFatal reports whether a copy error will hit every remaining file too,
+// so there is no point attempting them
+func isFatal(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) || errors.Is(err, syscall.EROFS)
+}
+
+// Values of ExtraOptions["onConflict"]
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	conflictError     = "error"
+)
+
+// conflicts reports whether job would replace a file this overlay doesn't
+// own with different content
+func (inst *Installer) conflicts(job copyJob) (bool, error) {
+	info, err := inst.fs.Lstat(job.dst)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() || inst.manifest.ownedPreviously(job.dst) {
+		return false, nil
+	}
+
+	dst, err := inst.fs.Open(job.dst)
+	if err != nil {
+		return false, err
+	}
+	existing, err := readerSHA256(dst)
+	dst.Close()
+	if err != nil {
+		return false, err
+	}
+
+	src, err := inst.openSource(job)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	incoming, err := readerSHA256(src)
+	if err != nil {
+		return false, err
+	}
+	return incoming != existing, nil
+}
+
+// Values of ExtraOptions["incremental"]
+const (
+	incrementalChecksum = "checksum"
+	incrementalMtime    = "mtime"
+	incrementalSince    = "since"
+)
+
+// unchanged reports whether job's destination already holds its contents,
+// returning the digest to record for it. In mtime mode the digest comes
+// from the previous manifest, or is left empty when it has none. In since
+// mode the since manifest's digest stands for the destination's, which
+// isn't read.
+func (inst *Installer) unchanged(job copyJob) (string, bool, error) {
+	info, err := inst.fs.Lstat(job.dst)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", false, nil
+	}
+
+	// A decompressed module's size is only known by decompressing it, so
+	// those are always compared by digest
+	if inst.cfg.incremental == incrementalMtime && !job.decompress {
+		if info.Size() != job.info.Size() || !info.ModTime().Equal(job.info.ModTime()) {
+			return "", false, nil
+		}
+		entry, ok := inst.manifest.previousEntry(job.dst)
+		if !ok || entry.Size != info.Size() {
+			return "", true, nil
+		}
+		return entry.SHA256, true, nil
+	}
+
+	var existing string
+	if inst.cfg.incremental == incrementalSince {
+		rel, _ := inst.manifest.relPath(job.dst)
+		entry, ok := inst.sinceFiles[rel]
+		if !ok || !entry.Mode.IsRegular() || entry.Size != info.Size() || entry.SHA256 == "" {
+			return "", false, nil
+		}
+		existing = entry.SHA256
+	} else {
+		if !job.decompress && info.Size() != job.info.Size() {
+			return "", false, nil
+		}
+		dst, err := inst.fs.Open(job.dst)
+		if err != nil {
+			return "", false, err
+		}
+		existing, err = readerSHA256(dst)
+		dst.Close()
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	src, err := inst.openSource(job)
+	if err != nil {
+		return "", false, err
+	}
+	defer src.Close()
+	incoming, err := readerSHA256(src)
+	if err != nil {
+		return "", false, err
+	}
+	return incoming, incoming == existing, nil
+}
+
+// fileID identifies a source inode shared by hard links
+type fileID struct {
+	dev, ino uint64
+}
+
+// hardLinkID returns the inode of a regular file with more than one name
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() || stat.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
+
+// linkJob is a further name of a hard linked file whose first name is
+// copied to target
+type linkJob struct {
+	copyJob
+	target string
+	// deduped is set for a source file that isn't hard linked itself but
+	// was copied to target before
+	deduped bool
+}
+
+// contentID identifies what a copy writes: the source's contents, and the
+// mode and owner a hard link to it would share
+type contentID struct {
+	size     int64
+	sha256   string
+	mode     os.FileMode
+	uid, gid uint32
+}
+
+// dedupeTarget returns, when ExtraOptions["dedupe"] is set, an earlier copy
+// with the same contents as job's source file that job can be a hard link
+// to. Sources are matched by size and SHA-256, so identical files shipped
+// under different names share one inode, not only names of one source
+// file. A link shares mode and owner, so only a copy made with the same
+// ones will do, and files the decompressModules option rewrites aren't
+// shared. Otherwise job is recorded for later copies. Each source is read
+// once more for its digest, which is why dedupe is opt-in.
+func (inst *Installer) dedupeTarget(job copyJob) (string, bool) {
+	if !inst.cfg.dedupe || job.decompress {
+		return "", false
+	}
+	src, err := inst.fs.Open(job.src)
+	if err != nil {
+		slog.Debug("Not deduplicating", "src", job.src, "error", err)
+		return "", false
+	}
+	sum, err := readerSHA256(src)
+	src.Close()
+	if err != nil {
+		slog.Debug("Not deduplicating", "src", job.src, "error", err)
+		return "", false
+	}
+
+	id := contentID{size: job.info.Size(), sha256: sum, mode: job.mode}
+	if stat, ok := job.info.Sys().(*syscall.Stat_t); ok {
+		id.uid, id.gid = stat.Uid, stat.Gid
+	}
+	if prior, ok := inst.copies[id]; ok {
+		return prior, prior != job.dst
+	}
+	if inst.copies == nil {
+		inst.copies = make(map[contentID]string)
+	}
+	inst.copies[id] = job.dst
+	return "", false
+}
+
+// copyHardLink makes job's destination a hard link to the copy of the
+// first name. When that can't be done, for example because the copy
+// failed, the file is copied in full instead.
+func (inst *Installer) copyHardLink(ctx context.Context, job linkJob) error {
+	if entry, copied := inst.manifest.entry(job.target); copied {
+		existed := inst.exists(job.dst)
+		if err := inst.backup(job.dst); err != nil {
+			return err
+		}
+		err := inst.link(job.target, job.dst)
+		if err == nil {
+			dstInfo, err := inst.fs.Lstat(job.dst)
+			if err != nil {
+				return err
+			}
+			inst.manifest.addFile(job.dst, dstInfo, entry.SHA256)
+			inst.wrote(job.dst, 0, existed)
+			inst.summary.countFile(job.dst, dstInfo.Size(), true)
+			if job.deduped {
+				inst.summary.dedupe(dstInfo.Size())
+			}
+			slog.Debug("linked", "dst", job.dst, "target", job.target)
+			return nil
+		}
+		slog.Debug("Copying hard link in full", "dst", job.dst, "target", job.target, "error", err)
+	}
+	return inst.copyRegularFile(ctx, job.copyJob)
+}
+
+// link hard links dst to target, replacing whatever dst was
+func (inst *Installer) link(target, dst string) error {
+	// Renaming a link over another name for the same file does nothing,
+	// which would leave the temporary name behind
+	if targetInfo, err := inst.fs.Lstat(target); err == nil {
+		if dstInfo, err := inst.fs.Lstat(dst); err == nil && os.SameFile(targetInfo, dstInfo) {
+			return nil
+		}
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", dst, os.Getpid())
+	if err := inst.fs.Link(target, tmp); err != nil {
+		return err
+	}
+	if err := inst.fs.Rename(tmp, dst); err != nil {
+		inst.fs.Remove(tmp)
+		return err
+	}
+	inst.markDirty(filepath.Dir(dst))
+	return nil
+}
+
+// copyJob is a regular file queued for copying
+type copyJob struct {
+	src  string
+	dst  string
+	info os.FileInfo
+	mode os.FileMode
+
+	// decompress writes the uncompressed contents of a kernel module
+	decompress bool
+
+	// open, when set, supplies the contents instead of src, which then
+	// only names them; see copyArchive
+	open func() (io.ReadCloser, error)
+}
+
+// openSource returns the contents to write to the job's destination
+func (inst *Installer) openSource(job copyJob) (io.ReadCloser, error) {
+	open := func() (io.ReadCloser, error) { return inst.fs.Open(job.src) }
+	if job.open != nil {
+		open = job.open
+	}
+	f, err := open()
+	if err != nil || !job.decompress {
+		return f, err
+	}
+	return decompressModule(f, job.src)
+}
+
+// withinDir reports whether path is root or lies below it. Source names
+// come from artifact bundles, which can't be trusted not to climb out.
+func withinDir(root, path string) bool {
+	root, path = filepath.Clean(root), filepath.Clean(path)
+	return path == root || strings.HasPrefix(path, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// maxSymlinks is how many symlinks resolveInRoot follows before giving up,
+// as the kernel does with ELOOP
+const maxSymlinks = 40
+
+// resolveInRoot resolves the symlinks along name, a path at or below root,
+// the way they resolve once root is the system's /: absolute targets are
+// relative to root and ".." stops at it. Only checking paths lexically
+// would let a rootfs symlink such as lib -> /usr/lib send writes to the
+// host. Components that don't exist yet are kept as they are.
+func resolveInRoot(fsys filesystem, root, name string) (string, error) {
+	if !withinDir(root, name) {
+		return "", fmt.Errorf("%s is outside %s", name, root)
+	}
+	rel, err := filepath.Rel(root, name)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := "/"
+	pending := strings.Split(filepath.ToSlash(rel), "/")
+	missing := false
+	links := 0
+	for len(pending) > 0 {
+		elem := pending[0]
+		pending = pending[1:]
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, elem)
+		if missing {
+			resolved = next
+			continue
+		}
+		hostPath := filepath.Join(root, filepath.FromSlash(next))
+		info, err := fsys.Lstat(hostPath)
+		switch {
+		case os.IsNotExist(err):
+			missing = true
+			resolved = next
+			continue
+		case err != nil:
+			return "", err
+		case info.Mode()&os.ModeSymlink == 0:
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", name)
+		}
+		target, err := fsys.Readlink(hostPath)
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return filepath.Join(root, filepath.FromSlash(resolved)), nil
+}
+
+// resolveDest returns where a write to dstPath lands, with the symlinks
+// along its parent resolved inside the rootfs; see resolveInRoot. The last
+// component is left alone, since a symlink there is replaced rather than
+// written through.
+func (inst *Installer) resolveDest(dstPath string) (string, error) {
+	if filepath.Clean(dstPath) == filepath.Clean(inst.rootfsPath) {
+		return dstPath, nil
+	}
+	parent, err := resolveInRoot(inst.fs, inst.rootfsPath, filepath.Dir(dstPath))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(dstPath)), nil
+}
+
+// copyFiles copies the queued files for dst through a pool of workers,
+// reporting progress by bytes as they finish.
+// Every job is attempted even after a failure; failures come back in job
+// order, each naming its source, so the outcome doesn't depend on scheduling.
+// Once ctx is done or a fatal error occurs the remaining jobs are dropped
+// and that error returned instead.
+func (inst *Installer) copyFiles(ctx context.Context, dst string, jobs []copyJob) ([]error, error) {
+	workers := max(1, min(inst.cfg.workers, len(jobs)))
+
+	var total int64
+	for _, job := range jobs {
+		total += job.info.Size()
+	}
+	prog := newProgress(dst, total)
+	defer prog.finish()
+
+	errs := make([]error, len(jobs))
+	queue := make(chan int)
+
+	var fatal atomic.Pointer[error]
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil || fatal.Load() != nil {
+					continue
+				}
+				if err := inst.copyRegularFile(ctx, jobs[i]); err != nil {
+					errs[i] = copyPathError(jobs[i].src, jobs[i].dst, err)
+				}
+				prog.add(jobs[i].info.Size())
+				if isFatal(errs[i]) {
+					fatal.CompareAndSwap(nil, &errs[i])
+				}
+			}
+		}()
+	}
+
+	for i := range jobs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := fatal.Load(); err != nil {
+		return nil, *err
+	}
+
+	var failures []error
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return failures, nil
+}
+
+// copyRegularFile copies a single file, restores its metadata and records it
+func (inst *Installer) copyRegularFile(ctx context.Context, job copyJob) error {
+	if inst.cfg.incremental != "" {
+		sum, ok, err := inst.unchanged(job)
+		if err != nil {
+			return err
+		}
+		if ok {
+			dstInfo, err := inst.fs.Stat(job.dst)
+			if err != nil {
+				return err
+			}
+			inst.manifest.addFile(job.dst, dstInfo, sum)
+			inst.summary.countFile(job.dst, dstInfo.Size(), false)
+			return nil
+		}
+	}
+
+	if inst.cfg.onConflict != conflictOverwrite {
+		conflict, err := inst.conflicts(job)
+		if err != nil {
+			return err
+		}
+		if conflict {
+			if inst.cfg.onConflict == conflictError {
+				return fmt.Errorf("%s already exists and differs from %s", job.dst, job.src)
+			}
+			slog.Warn("⚠️  Skipping file that exists with different content", "dst", job.dst, "src", job.src)
+			return nil
+		}
+	}
+
+	existed := inst.exists(job.dst)
+	if err := inst.backup(job.dst); err != nil {
+		return err
+	}
+
+	var sum string
+	for attempt := 1; ; attempt++ {
+		var err error
+		if sum, err = inst.copyJobData(ctx, job); err == nil {
+			break
+		}
+		if attempt >= inst.cfg.retryAttempts || !isTransient(err) {
+			return err
+		}
+
+		// Back off exponentially: 1x, 2x, 4x ... the base delay
+		delay := inst.cfg.retryBackoff << (attempt - 1)
+		slog.Warn("🔁 Retrying copy after transient error", "dst", job.dst, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+
+	inst.preserveOwnership(job.dst, job.info)
+	// Archive entries carry their attributes in the archive instead
+	if job.open == nil {
+		if err := inst.preserveXattrs(job.src, job.dst); err != nil {
+			return err
+		}
+	}
+	if err := inst.preserveTimes(job.dst, job.info); err != nil {
+		return err
+	}
+
+	// Record what actually landed on disk, after umask
+	dstInfo, err := inst.fs.Stat(job.dst)
+	if err != nil {
+		return err
+	}
+	inst.manifest.addFile(job.dst, dstInfo, sum)
+	inst.wrote(job.dst, dstInfo.Size(), existed)
+	inst.summary.countFile(job.dst, dstInfo.Size(), true)
+	slog.Debug("copied", "src", job.src, "dst", job.dst, "bytes", dstInfo.Size())
+	return nil
+}
+
+// copyJobData writes the job's contents to its destination, returning the
+// SHA-256 of what was written
+func (inst *Installer) copyJobData(ctx context.Context, job copyJob) (string, error) {
+	src, err := inst.openSource(job)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	_, sum, err := inst.copyFile(&contextReader{ctx: ctx, r: src}, job.dst, job.mode)
+	return sum, err
+}
+
+// isTransient reports whether a copy error is worth retrying. Storage in
+// some imager environments returns EIO once and then recovers; errors like
+// ENOSPC or EACCES won't go away on their own.
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR)
+}
+
+// mkdirAll works like os.MkdirAll but records each directory it creates.
+// It reports whether path itself had to be created.
+func (inst *Installer) mkdirAll(path string, mode os.FileMode) (bool, error) {
+	var created []string
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if _, err := inst.fs.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return false, err
+		}
+		created = append(created, dir)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+
+	if err := inst.fs.MkdirAll(path, mode); err != nil {
+		return false, err
+	}
+
+	for _, dir := range created {
+		inst.manifest.addDirectory(dir)
+		inst.markDirty(filepath.Dir(dir))
+	}
+	return len(created) > 0, nil
+}
+
+// preserveTimes sets the access and modification times of dst to the source's
+func (inst *Installer) preserveTimes(dst string, info os.FileInfo) error {
+	atime := info.ModTime()
+	switch sys := info.Sys().(type) {
+	case *syscall.Stat_t:
+		atime = time.Unix(sys.Atim.Unix())
+	case *tar.Header:
+		if !sys.AccessTime.IsZero() {
+			atime = sys.AccessTime
+		}
+	}
+	return inst.fs.Chtimes(dst, atime, info.ModTime())
+}
+
+// preserveOwnership gives dst the uid/gid of the source file.
+// Ownership can only be changed as root, which is how the Talos imager runs
+// the installer; otherwise, or if the chown fails, the copy carries on.
+func (inst *Installer) preserveOwnership(dst string, info os.FileInfo) {
+	if os.Geteuid() != 0 {
+		return
+	}
+
+	var uid, gid int
+	switch sys := info.Sys().(type) {
+	case *syscall.Stat_t:
+		uid, gid = int(sys.Uid), int(sys.Gid)
+	case *tar.Header:
+		uid, gid = sys.Uid, sys.Gid
+	default:
+		return
+	}
+
+	if err := inst.fs.Lchown(dst, uid, gid); err != nil {
+		slog.Warn("⚠️  Failed to preserve ownership", "dst", dst, "error", err)
+	}
+}
+
+// reportCopy describes a copy that dry-run mode skipped
+func (inst *Installer) reportCopy(src, dst string, info os.FileInfo) {
+	switch {
+	case info.IsDir():
+	case info.Mode()&os.ModeSymlink != 0:
+		target, _ := inst.fs.Readlink(src)
+		slog.Info("would link", "dst", dst, "target", target)
+	case !info.Mode().IsRegular():
+		slog.Info("would create", "src", src, "dst", dst, "type", specialKind(info.Mode()))
+	default:
+		slog.Info("would copy", "src", src, "dst", dst, "mode", info.Mode(), "bytes", info.Size())
+	}
+}
+
+// writeFile writes generated content to path and records it in the manifest
+func (inst *Installer) writeFile(path string, data []byte, mode os.FileMode) error {
+	if inst.cfg.dryRun {
+		slog.Info("would write", "dst", path, "mode", mode, "bytes", len(data))
+		return inst.planFile(path, mode, bytes.NewReader(data), path, false)
+	}
+
+	if _, err := inst.mkdirAll(filepath.Dir(path), inst.cfg.dirMode); err != nil {
+		return err
+	}
+
+	existed := inst.exists(path)
+	if err := inst.backup(path); err != nil {
+		return err
+	}
+	if err := inst.fs.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	inst.wrote(path, int64(len(data)), existed)
+	slog.Debug("wrote", "dst", path, "bytes", len(data))
+	if err := inst.syncWritten(path); err != nil {
+		return err
+	}
+	return inst.recordFile(path, data)
+}
+
+// mergeFile writes content that was merged with an existing file at path.
+// The file is only recorded in the manifest if this overlay placed it, in
+// this install or originally, so uninstall never deletes a file that
+// belongs to someone else.
+func (inst *Installer) mergeFile(path string, data []byte, mode os.FileMode, existed bool) error {
+	if !existed || inst.cfg.dryRun {
+		return inst.writeFile(path, data, mode)
+	}
+
+	if err := inst.backup(path); err != nil {
+		return err
+	}
+	if err := inst.fs.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+	inst.wrote(path, int64(len(data)), true)
+	slog.Debug("wrote", "dst", path, "bytes", len(data))
+	if err := inst.syncWritten(path); err != nil {
+		return err
+	}
+	// A file this install already copied, say from the config files, has
+	// an entry for what was there before the merge
+	if _, ok := inst.manifest.entry(path); ok {
+		info, err := inst.fs.Stat(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		inst.manifest.updateFile(path, info, hex.EncodeToString(sum[:]))
+		return nil
+	}
+	if !inst.manifest.ownedPreviously(path) && !inst.sinceOwns(path) {
+		return nil
+	}
+	return inst.recordFile(path, data)
+}
+
+// recordFile adds a generated file to the manifest
+func (inst *Installer) recordFile(path string, data []byte) error {
+	info, err := inst.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	inst.manifest.addFile(path, info, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+// copySymlink recreates the symlink src at dst with the same target.
+// Relative targets are kept as-is so the copied tree layout still resolves.
+func (inst *Installer) copySymlink(src, dst string) (string, error) {
+	target, err := inst.fs.Readlink(src)
+	if err != nil {
+		return "", err
+	}
+	return target, inst.symlink(target, dst)
+}
+
+// symlink creates dst pointing at target, replacing whatever dst was
+func (inst *Installer) symlink(target, dst string) error {
+	// Symlink refuses to replace an existing entry
+	if err := inst.fs.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	inst.markDirty(filepath.Dir(dst))
+	return inst.fs.Symlink(target, dst)
+}
+
+// contextReader fails reads once ctx is done, so cancellation interrupts a
+// large file mid-copy and copyFile discards its temp file
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// copyFile copies src to the file dst, returning the number of bytes
+// written and the hex encoded SHA-256 of exactly those bytes. Plain files
+// are copied in the kernel where the filesystems support it.
+// The data is written to a temp file next to dst and renamed into place, so
+// an interrupted copy leaves either the old file or the new one, never a
+// truncated file that looks complete.
+func (inst *Installer) copyFile(src io.Reader, dst string, mode os.FileMode) (int64, string, error) {
+	tmp := fmt.Sprintf("%s.tmp-%d", dst, os.Getpid())
+	dstFile, err := inst.fs.Create(tmp, mode)
+	if err != nil {
+		return 0, "", err
+	}
+
+	written, sum, ok, err := inst.copyFileRange(src, dstFile)
+	if !ok {
+		written, sum, err = inst.copyBuffered(src, dstFile)
+	}
+	if err != nil {
+		dstFile.Close()
+		inst.fs.Remove(tmp)
+		return written, "", err
+	}
+	// The data must be on disk before the rename makes it visible
+	if s, ok := dstFile.(syncer); ok && inst.cfg.fsync {
+		if err := s.Sync(); err != nil {
+			dstFile.Close()
+			inst.fs.Remove(tmp)
+			return written, "", err
+		}
+	}
+	if err := dstFile.Close(); err != nil {
+		inst.fs.Remove(tmp)
+		return written, "", err
+	}
+	if err := inst.fs.Rename(tmp, dst); err != nil {
+		inst.fs.Remove(tmp)
+		return written, "", err
+	}
+	inst.markDirty(filepath.Dir(dst))
+	return written, sum, nil
+}
+
+// copyBuffered copies src to dst through a pooled buffer, hashing alongside
+// the write so the data is only read once
+func (inst *Installer) copyBuffered(src io.Reader, dst io.Writer) (int64, string, error) {
+	buf := inst.buffers.Get().(*[]byte)
+	defer inst.buffers.Put(buf)
+
+	hash := sha256.New()
+	written, err := io.CopyBuffer(io.MultiWriter(dst, hash), src, *buf)
+	if err != nil {
+		return written, "", err
+	}
+	return written, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,520 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// traversalFS walks a source directory as if it also held an entry with a
+// name that climbs out of it, as a crafted artifact bundle could
+type traversalFS struct {
+	osFS
+	name string
+}
+
+func (fsys traversalFS) Walk(root string, fn filepath.WalkFunc) error {
+	err := fsys.osFS.Walk(root, fn)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(root, "app.conf")
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	return fn(root+string(filepath.Separator)+fsys.name, info, nil)
+}
+
+func TestCopyDirectoryTraversal(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// entry is a source name climbing out of the source directory
+		entry string
+		// link is a rootfs symlink at lib, whose target is given the
+		// escape directory
+		link func(escape string) string
+	}{
+		{
+			name:  "parent entry",
+			entry: "../../etc/passwd",
+		},
+		{
+			name: "absolute rootfs symlink",
+			link: func(escape string) string { return escape },
+		},
+		{
+			name: "relative rootfs symlink above the root",
+			link: func(escape string) string { return strings.Repeat("../", 32) + strings.TrimPrefix(escape, "/") },
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// escape stands for the host outside the rootfs
+			escape := t.TempDir()
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{"app.conf": testutil.File("key=value\n")})
+			rootfs := t.TempDir()
+			if tc.link != nil {
+				testutil.WriteTree(t, rootfs, testutil.Tree{"lib": testutil.Symlink(tc.link(escape))})
+			}
+			dst := filepath.Join(rootfs, "lib", "firmware")
+
+			inst := newTestInstaller(t, src, rootfs, nil)
+			if tc.entry != "" {
+				inst.fs = traversalFS{name: tc.entry}
+			}
+			err := inst.copyDirectory(context.Background(), src, dst, 0, nil)
+
+			if tc.entry != "" {
+				if err == nil || !strings.Contains(err.Error(), "outside") {
+					t.Errorf("copying %s returned %v, want it refused", tc.entry, err)
+				}
+				if _, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(tc.entry))); !os.IsNotExist(err) {
+					t.Errorf("%s was written: %v", tc.entry, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+			entries, err := os.ReadDir(escape)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) > 0 {
+				t.Errorf("copy wrote %s outside the rootfs", filepath.Join(escape, entries[0].Name()))
+			}
+			// Resolved inside the rootfs, the link leads to its own copy of escape
+			want := filepath.Join(rootfs, escape, "firmware", "app.conf")
+			if data, err := os.ReadFile(want); err != nil || string(data) != "key=value\n" {
+				t.Errorf("%s = %q, %v", want, data, err)
+			}
+		})
+	}
+}
+
+func TestCopyDirectorySymlinks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		target string
+	}{
+		{"relative", "gsp.bin"},
+		{"relative parent", "../nvidia/gsp.bin"},
+		{"absolute", "/lib/firmware/nvidia/gsp.bin"},
+		// A target needn't exist, in the overlay or the rootfs
+		{"dangling", "missing.bin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{
+				"nvidia/gsp.bin":    testutil.File("gsp firmware"),
+				"nvidia/linked.bin": testutil.Symlink(tc.target),
+			})
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "lib", "firmware")
+
+			inst := newTestInstaller(t, src, rootfs, nil)
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			path := filepath.Join(dst, "nvidia", "linked.bin")
+			info, err := os.Lstat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				t.Fatalf("linked.bin has mode %v, want a symlink", info.Mode())
+			}
+			if got, err := os.Readlink(path); err != nil || got != tc.target {
+				t.Errorf("linked.bin links to %q, %v; want %q", got, err, tc.target)
+			}
+			entry, ok := inst.manifest.entry(path)
+			if !ok || entry.Target != tc.target {
+				t.Errorf("manifest entry %+v, want target %q", entry, tc.target)
+			}
+		})
+	}
+}
+
+func TestCopyDirectoryOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership needs root")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		uid, gid int
+	}{
+		{"file", "nvidia/gsp.bin", 1000, 1000},
+		{"symlink", "nvidia/gsp-latest.bin", 1001, 1002},
+		{"directory", "nvidia", 0, 44},
+		{"root file", "nvidia/root.bin", 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{
+				"nvidia/gsp.bin":        testutil.File("gsp firmware"),
+				"nvidia/gsp-latest.bin": testutil.Symlink("gsp.bin"),
+				"nvidia/root.bin":       testutil.File("root"),
+			})
+			if err := os.Lchown(filepath.Join(src, filepath.FromSlash(tc.path)), tc.uid, tc.gid); err != nil {
+				t.Fatal(err)
+			}
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "lib", "firmware")
+
+			inst := newTestInstaller(t, src, rootfs, nil)
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			info, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(tc.path)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			st := info.Sys().(*syscall.Stat_t)
+			if int(st.Uid) != tc.uid || int(st.Gid) != tc.gid {
+				t.Errorf("%s owned by %d:%d, want %d:%d", tc.path, st.Uid, st.Gid, tc.uid, tc.gid)
+			}
+		})
+	}
+}
+
+func TestCopyDirectoryTimes(t *testing.T) {
+	mtime := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name string
+		path string
+	}{
+		{"file", "nvidia/gsp.bin"},
+		// Copying its children must not leave a created directory with
+		// the time of the copy
+		{"created directory", "nvidia"},
+		{"nested directory", "nvidia/ga10x"},
+		{"nested file", "nvidia/ga10x/gsp.bin"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{
+				"nvidia/gsp.bin":       testutil.File("gsp firmware"),
+				"nvidia/ga10x/gsp.bin": testutil.File("ga10x firmware"),
+			})
+			if err := os.Chtimes(filepath.Join(src, filepath.FromSlash(tc.path)), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "lib", "firmware")
+
+			inst := newTestInstaller(t, src, rootfs, nil)
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			info, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(tc.path)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := info.ModTime().Sub(mtime).Abs(); diff > time.Second {
+				t.Errorf("%s mtime %v, want %v", tc.path, info.ModTime(), mtime)
+			}
+		})
+	}
+}
+
+func TestCopyDirectoryModes(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		extra map[string]interface{}
+		// modes are the source directory modes to set
+		modes map[string]os.FileMode
+		// path is checked to have want, relative to the rootfs
+		path string
+		want os.FileMode
+	}{
+		{
+			name:  "source 0700",
+			modes: map[string]os.FileMode{"secret": 0o700},
+			path:  "etc/nvidia/secret",
+			want:  0o700,
+		},
+		{
+			name:  "nested source 0750",
+			modes: map[string]os.FileMode{"secret": 0o700, "secret/keys": 0o750},
+			path:  "etc/nvidia/secret/keys",
+			want:  0o750,
+		},
+		{
+			name:  "dirMode ignored for source directories",
+			extra: map[string]interface{}{"dirMode": "0755"},
+			modes: map[string]os.FileMode{"secret": 0o700},
+			path:  "etc/nvidia/secret",
+			want:  0o700,
+		},
+		{
+			name: "default for created parents",
+			path: "etc",
+			want: 0o755,
+		},
+		{
+			name:  "dirMode for created parents",
+			extra: map[string]interface{}{"dirMode": "0750"},
+			path:  "etc",
+			want:  0o750,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{
+				"app.conf":            testutil.File("key=value\n"),
+				"secret/token":        testutil.File("token"),
+				"secret/keys/key.pem": testutil.File("key"),
+			})
+			// Set from the top down, so a 0700 parent doesn't hide its
+			// children's modes
+			if err := os.Chmod(src, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			for _, rel := range []string{"secret", "secret/keys"} {
+				if mode, ok := tc.modes[rel]; ok {
+					if err := os.Chmod(filepath.Join(src, filepath.FromSlash(rel)), mode); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "etc", "nvidia")
+
+			inst := newTestInstaller(t, src, rootfs, tc.extra)
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			info, err := os.Stat(filepath.Join(rootfs, filepath.FromSlash(tc.path)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != tc.want {
+				t.Errorf("%s has mode %#o, want %#o", tc.path, got, tc.want)
+			}
+		})
+	}
+}
+
+// flakyFS fails the first writes to files it creates with err
+type flakyFS struct {
+	osFS
+	err      error
+	failures int
+	creates  int
+}
+
+func (fsys *flakyFS) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	f, err := fsys.osFS.Create(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	fsys.creates++
+	return &flakyWriter{WriteCloser: f, fsys: fsys}, nil
+}
+
+type flakyWriter struct {
+	io.WriteCloser
+	fsys *flakyFS
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if w.fsys.failures > 0 {
+		w.fsys.failures--
+		return 0, &os.PathError{Op: "write", Path: "flaky", Err: w.fsys.err}
+	}
+	return w.WriteCloser.Write(p)
+}
+
+func TestCopyRegularFileRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		failures int
+		// attempts is how many times the copy is tried
+		attempts int
+		wantErr  bool
+	}{
+		{"no failures", syscall.EIO, 0, 1, false},
+		{"EIO recovers", syscall.EIO, 2, 3, false},
+		{"EAGAIN recovers", syscall.EAGAIN, 1, 2, false},
+		{"EIO persists", syscall.EIO, 3, 3, true},
+		{"ENOSPC not retried", syscall.ENOSPC, 1, 1, true},
+		{"EACCES not retried", syscall.EACCES, 1, 1, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{"gsp.bin": testutil.File("gsp firmware")})
+			rootfs := t.TempDir()
+
+			inst := newTestInstaller(t, src, rootfs, map[string]interface{}{"retryAttempts": 3, "retryBackoffMs": 1})
+			fsys := &flakyFS{err: tc.err, failures: tc.failures}
+			inst.fs = fsys
+
+			path := filepath.Join(src, "gsp.bin")
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(rootfs, "gsp.bin")
+			err = inst.copyRegularFile(context.Background(), copyJob{src: path, dst: dst, info: info, mode: info.Mode()})
+
+			if tc.wantErr {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("copy returned %v, want %v", err, tc.err)
+				}
+			} else if err != nil {
+				t.Fatalf("copy: %v", err)
+			} else if got := readTestFile(t, rootfs, "gsp.bin"); got != "gsp firmware" {
+				t.Errorf("gsp.bin = %q", got)
+			}
+			if fsys.creates != tc.attempts {
+				t.Errorf("copy tried %d times, want %d", fsys.creates, tc.attempts)
+			}
+		})
+	}
+}
+
+// crossDeviceFS fails every hard link as if the destination were on
+// another filesystem
+type crossDeviceFS struct {
+	osFS
+}
+
+func (crossDeviceFS) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+}
+
+func TestCopyDirectoryHardLinks(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// links are further names for nvidia/gsp.bin
+		links []string
+		// crossDevice makes linking fail, so each name is copied in full
+		crossDevice bool
+	}{
+		{"same directory", []string{"nvidia/gsp-copy.bin"}, false},
+		{"other directory", []string{"nvidia/ga10x/gsp.bin"}, false},
+		{"three names", []string{"nvidia/gsp-copy.bin", "nvidia/ga10x/gsp.bin"}, false},
+		{"cross-device fallback", []string{"nvidia/gsp-copy.bin"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{
+				"nvidia/gsp.bin": testutil.File("gsp firmware"),
+				"nvidia/ga10x":   testutil.Dir(),
+			})
+			first := filepath.Join(src, "nvidia", "gsp.bin")
+			for _, rel := range tc.links {
+				if err := os.Link(first, filepath.Join(src, filepath.FromSlash(rel))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "lib", "firmware")
+
+			inst := newTestInstaller(t, src, rootfs, nil)
+			if tc.crossDevice {
+				inst.fs = crossDeviceFS{}
+			}
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			firstInfo, err := os.Stat(filepath.Join(dst, "nvidia", "gsp.bin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rel := range tc.links {
+				path := filepath.Join(dst, filepath.FromSlash(rel))
+				info, err := os.Lstat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if linked := os.SameFile(firstInfo, info); linked == tc.crossDevice {
+					t.Errorf("%s shares gsp.bin's inode: %v, want %v", rel, linked, !tc.crossDevice)
+				}
+				if got := readTestFile(t, rootfs, "lib/firmware/"+rel); got != "gsp firmware" {
+					t.Errorf("%s = %q", rel, got)
+				}
+				if _, ok := inst.manifest.entry(path); !ok {
+					t.Errorf("%s is not in the manifest", rel)
+				}
+			}
+			nlink := uint64(firstInfo.Sys().(*syscall.Stat_t).Nlink)
+			if want := uint64(len(tc.links) + 1); !tc.crossDevice && nlink != want {
+				t.Errorf("gsp.bin has %d links, want %d", nlink, want)
+			}
+		})
+	}
+}
+
+func TestInstallDedupe(t *testing.T) {
+	const blob = "shared firmware blob"
+
+	fixture := testOverlay()
+	fixture.Firmware["nvidia/a.bin"] = testutil.File(blob)
+	fixture.Firmware["nvidia/b.bin"] = testutil.File(blob)
+	fixture.Firmware["nvidia/c.bin"] = testutil.File("other firmware blob!")
+	// A link would share the mode, so a copy with another mode stays apart
+	fixture.Firmware["nvidia/d.bin"] = testutil.Entry{Data: blob, Mode: 0600}
+	rootfs := testutil.Rootfs(t, testKver)
+
+	var stdout bytes.Buffer
+	err := Install(context.Background(), &Options{
+		InstallOptions: InstallOptions{
+			MountPrefix:  rootfs,
+			ExtraOptions: map[string]interface{}{"dedupe": true, "outputFormat": "json"},
+		},
+		OverlayPath: fixture.Build(t),
+		Stdout:      &stdout,
+	})
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	var summary installSummary
+	if err := json.Unmarshal(stdout.Bytes(), &summary); err != nil {
+		t.Fatalf("summary: %v", err)
+	}
+
+	infos := make(map[string]os.FileInfo)
+	for _, name := range []string{"a.bin", "b.bin", "c.bin", "d.bin"} {
+		info, err := os.Stat(filepath.Join(rootfs, "lib/firmware/nvidia", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos[name] = info
+	}
+	if !os.SameFile(infos["a.bin"], infos["b.bin"]) {
+		t.Error("identical a.bin and b.bin were not linked")
+	}
+	for _, name := range []string{"c.bin", "d.bin"} {
+		if os.SameFile(infos["a.bin"], infos[name]) {
+			t.Errorf("a.bin was linked to %s", name)
+		}
+	}
+	if summary.DedupedBytes != int64(len(blob)) {
+		t.Errorf("summary dedupedBytes = %d, want %d", summary.DedupedBytes, len(blob))
+	}
+	if err := verifyTest(t, rootfs, nil); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+package overlay
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// firmwareCoverage compares the firmware in the rootfs with a reference
+// set, for tuning firmwareInclude. Paths are relative to firmwareDir.
+type firmwareCoverage struct {
+	Reference int     `json:"reference"`
+	Percent   float64 `json:"percent"`
+	// Installed are the reference files present in the rootfs
+	Installed []string `json:"installed"`
+	// Missing are the reference files absent from the rootfs
+	Missing []string `json:"missing"`
+	// Extra are files this install added that the reference doesn't list
+	Extra []string `json:"extra"`
+}
+
+// reportFirmwareCoverage measures, when ExtraOptions["firmwareCoverage"]
+// is set, how much of the reference firmware set the rootfs holds and adds
+// the result to the install summary. The reference is
+// ExtraOptions["firmwareReference"], else the firmware the installed
+// modules declare. A file counts as present compressed too, as the kernel
+// loads it either way.
+func (inst *Installer) reportFirmwareCoverage() error {
+	if !inst.cfg.firmwareCoverage {
+		return nil
+	}
+	if inst.cfg.dryRun {
+		slog.Debug("Skipping firmware coverage in dry run")
+		return nil
+	}
+
+	reference, err := inst.firmwareReference()
+	if err != nil {
+		return err
+	}
+
+	searchDirs := firmwareSearchDirs(filepath.Join(inst.rootfsPath, filepath.FromSlash(inst.cfg.firmwareDir)), inst.kver)
+	coverage := &firmwareCoverage{Reference: len(reference), Installed: []string{}, Missing: []string{}, Extra: []string{}}
+	listed := make(map[string]bool, len(reference))
+	for _, name := range reference {
+		listed[name] = true
+		if firmwarePresent(inst.fs, searchDirs, name) {
+			coverage.Installed = append(coverage.Installed, name)
+		} else {
+			coverage.Missing = append(coverage.Missing, name)
+		}
+	}
+	for _, entry := range inst.manifest.Files {
+		rel, ok := strings.CutPrefix(entry.Path, inst.cfg.firmwareDir+"/")
+		if !ok || slices.ContainsFunc(firmwareNames(rel), func(name string) bool { return listed[name] || listed[trimFirmwareCompression(name)] }) {
+			continue
+		}
+		coverage.Extra = append(coverage.Extra, rel)
+	}
+	sort.Strings(coverage.Extra)
+
+	coverage.Percent = 100
+	if len(reference) > 0 {
+		// Two decimals are plenty to compare runs
+		coverage.Percent = math.Round(10000*float64(len(coverage.Installed))/float64(len(reference))) / 100
+	}
+	inst.summary.FirmwareCoverage = coverage
+
+	for _, name := range coverage.Missing {
+		slog.Debug("reference firmware missing", "firmware", name)
+	}
+	slog.Info("📊 Firmware coverage", "percent", coverage.Percent, "installed", len(coverage.Installed), "missing", len(coverage.Missing), "extra", len(coverage.Extra))
+	return nil
+}
+
+// firmwareReference returns the sorted, deduplicated reference firmware
+// set coverage is measured against
+func (inst *Installer) firmwareReference() ([]string, error) {
+	names := inst.cfg.firmwareReference
+	switch {
+	case inst.cfg.firmwareReferenceFile != "":
+		file := inst.cfg.firmwareReferenceFile
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(inst.overlayPath, file)
+		}
+		data, err := inst.fs.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read firmware reference: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				names = append(names, line)
+			}
+		}
+	case len(names) == 0:
+		for _, entry := range inst.manifest.Files {
+			if !entry.Mode.IsRegular() || !isKernelModule(entry.Path) {
+				continue
+			}
+			firmware, err := moduleFirmware(inst.fs, rootfsJoin(inst.rootfsPath, entry.Path))
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, firmware...)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var reference []string
+	for _, name := range names {
+		name = path.Clean(strings.TrimPrefix(name, "/"))
+		if !seen[name] {
+			seen[name] = true
+			reference = append(reference, name)
+		}
+	}
+	sort.Strings(reference)
+	return reference, nil
+}
+
+// firmwareUpdatesDir is the directory below the firmware directory the
+// kernel's firmware loader searches first, then the <kver> directory
+// inside it, to override what the base directory holds
+const firmwareUpdatesDir = "updates"
+
+// firmwareSearchDirs returns the directories the firmware loader of kernel
+// kver searches, updates/<kver>, updates, <kver> and then firmwareDir itself
+func firmwareSearchDirs(firmwareDir, kver string) []string {
+	updates := filepath.Join(firmwareDir, firmwareUpdatesDir)
+	if kver == "" {
+		return []string{updates, firmwareDir}
+	}
+	return []string{filepath.Join(updates, kver), updates, filepath.Join(firmwareDir, kver), firmwareDir}
+}
+
+// firmwareNames returns the names a file at rel below the firmware
+// directory may be loaded as, not knowing whether a leading directory is a
+// kernel version: rel itself, then without updates/ and without a first
+// directory
+func firmwareNames(rel string) []string {
+	names := []string{rel}
+	if rest, ok := strings.CutPrefix(rel, firmwareUpdatesDir+"/"); ok {
+		names = append(names, rest)
+		rel = rest
+	}
+	if _, rest, ok := strings.Cut(rel, "/"); ok {
+		names = append(names, rest)
+	}
+	return names
+}
+
+// firmwarePresent reports whether one of firmwareDirs holds name in any form
+// the kernel's firmware loader accepts
+func firmwarePresent(fsys filesystem, firmwareDirs []string, name string) bool {
+	for _, dir := range firmwareDirs {
+		for _, ext := range firmwareCompressions {
+			if _, err := fsys.Stat(filepath.Join(dir, filepath.FromSlash(name+ext))); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trimFirmwareCompression strips a compression suffix the firmware loader
+// tries from a firmware path
+func trimFirmwareCompression(name string) string {
+	for _, ext := range firmwareCompressions {
+		if ext != "" {
+			if trimmed, ok := strings.CutSuffix(name, ext); ok {
+				return trimmed
+			}
+		}
+	}
+	return name
+}
@@ -0,0 +1,144 @@
+package overlay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// planFile records, in a diff run, the manifest entry copying the contents
+// of r to dst would produce. name is the source, which decides how a module
+// is decompressed.
+func (inst *Installer) planFile(dst string, mode os.FileMode, r io.Reader, name string, decompress bool) error {
+	if !inst.cfg.diff {
+		return nil
+	}
+	if decompress {
+		dec, err := decompressModule(io.NopCloser(r), name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	inst.manifest.addEntry(dst, ManifestEntry{Size: size, Mode: mode, SHA256: hex.EncodeToString(hash.Sum(nil))})
+	return nil
+}
+
+// planSourceFile is planFile for a source file on disk
+func (inst *Installer) planSourceFile(src, dst string, info os.FileInfo, decompress bool) error {
+	if !inst.cfg.diff {
+		return nil
+	}
+	f, err := inst.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return inst.planFile(dst, info.Mode(), f, src, decompress)
+}
+
+// planSymlink records, in a diff run, the manifest entry of a symlink
+func (inst *Installer) planSymlink(dst string, info os.FileInfo, target string) {
+	if inst.cfg.diff {
+		inst.manifest.addEntry(dst, ManifestEntry{Size: info.Size(), Mode: info.Mode(), Target: target})
+	}
+}
+
+// manifestDiff is how the files of a planned install differ from those of
+// the installed manifest
+type manifestDiff struct {
+	added, changed, removed []string
+	unchanged               int
+}
+
+// diffManifests compares planned, as recorded by a diff run, against the
+// installed manifest, which may be nil. Files are equal when their
+// contents, or symlink targets, are. The module dependency indexes depmod
+// writes aren't planned, since depmod doesn't run in a dry run, so they
+// aren't reported as removed.
+func diffManifests(planned, installed *Manifest, modulesDir string) manifestDiff {
+	var diff manifestDiff
+	before := make(map[string]ManifestEntry)
+	if installed != nil {
+		for _, entry := range installed.Files {
+			before[entry.Path] = entry
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range planned.Files {
+		if seen[entry.Path] {
+			continue
+		}
+		seen[entry.Path] = true
+		old, ok := before[entry.Path]
+		switch {
+		case !ok:
+			diff.added = append(diff.added, entry.Path)
+		case old.SHA256 != entry.SHA256 || old.Target != entry.Target || old.Mode.Type() != entry.Mode.Type():
+			diff.changed = append(diff.changed, entry.Path)
+		default:
+			diff.unchanged++
+		}
+	}
+	for rel := range before {
+		if !seen[rel] && !isModuleIndex(rel, modulesDir) {
+			diff.removed = append(diff.removed, rel)
+		}
+	}
+
+	sort.Strings(diff.added)
+	sort.Strings(diff.changed)
+	sort.Strings(diff.removed)
+	return diff
+}
+
+// isModuleIndex reports whether a manifest path is one of the modules.*
+// files depmod writes into a kernel's modules directory
+func isModuleIndex(rel, modulesDir string) bool {
+	rest, ok := strings.CutPrefix(rel, modulesDir+"/")
+	return ok && strings.Count(rest, "/") == 1 && strings.HasPrefix(path.Base(rest), "modules.")
+}
+
+// writeDiff prints the files an install would add, change and remove
+// compared to the installed manifest
+func (inst *Installer) writeDiff(w io.Writer) error {
+	// A sync is compared with the install it syncs from
+	installed := inst.manifest.previous
+	if inst.since != nil {
+		installed = inst.since
+	}
+	if installed == nil {
+		slog.Info("📋 No overlay installed, every file would be added")
+	}
+	diff := diffManifests(inst.manifest, installed, inst.cfg.modulesDir)
+
+	var b bytes.Buffer
+	for _, group := range []struct {
+		change string
+		paths  []string
+	}{{"added", diff.added}, {"changed", diff.changed}, {"removed", diff.removed}} {
+		for _, rel := range group.paths {
+			fmt.Fprintf(&b, "%s\t/%s\n", group.change, rel)
+		}
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return err
+	}
+	slog.Info("📋 Diff against installed overlay", "added", len(diff.added), "changed", len(diff.changed), "removed", len(diff.removed), "unchanged", diff.unchanged)
+	return nil
+}
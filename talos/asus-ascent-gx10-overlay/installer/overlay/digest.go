@@ -0,0 +1,130 @@
+package overlay
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ArtifactsDigest prints a single SHA-256 over the overlay's artifacts,
+// for keying caches on overlay content. Only options.OverlayPath and
+// options.Args are read.
+func ArtifactsDigest(options *Options) error {
+	flags := flag.NewFlagSet("artifacts-digest", flag.ContinueOnError)
+	profile := flags.String("profile", "", "digest the artifacts of this profile")
+	list := flags.Bool("list", false, "print the digest listing the digest is taken over")
+	if err := flags.Parse(options.Args); err != nil {
+		return err
+	}
+
+	listing, err := artifactsListing(osFS{}, options.OverlayPath, *profile)
+	if err != nil {
+		return err
+	}
+	if *list {
+		fmt.Fprint(options.stdout(), listing)
+	}
+	sum := sha256.Sum256([]byte(listing))
+	fmt.Fprintf(options.stdout(), "sha256:%s\n", hex.EncodeToString(sum[:]))
+	return nil
+}
+
+// artifactsListing returns a sha256sum style listing, sorted by path, of
+// the overlay config and every artifact of profile, with symlinks listed by
+// their targets. Paths are relative to the overlay and archives are listed
+// as a whole, so the listing only changes with file contents and names,
+// never with walk order, timestamps or where the overlay was unpacked.
+func artifactsListing(fsys filesystem, overlayPath, profile string) (string, error) {
+	lines := make(map[string]string)
+	add := func(path string) error {
+		rel, err := filepath.Rel(overlayPath, path)
+		if err != nil {
+			return err
+		}
+		info, err := fsys.Lstat(path)
+		if err != nil {
+			return err
+		}
+		switch {
+		// Installs recreate symlinks rather than copy their targets, which
+		// may only resolve inside the rootfs
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := fsys.Readlink(path)
+			if err != nil {
+				return err
+			}
+			lines[filepath.ToSlash(rel)] = fmt.Sprintf("symlink  %s -> %s", filepath.ToSlash(rel), target)
+			return nil
+		// Opening a FIFO would block
+		case !info.Mode().IsRegular():
+			lines[filepath.ToSlash(rel)] = fmt.Sprintf("%s  %s", specialKind(info.Mode()), filepath.ToSlash(rel))
+			return nil
+		}
+		sum, err := fileSHA256(fsys, path)
+		if err != nil {
+			return err
+		}
+		lines[filepath.ToSlash(rel)] = fmt.Sprintf("%s  %s", sum, filepath.ToSlash(rel))
+		return nil
+	}
+
+	// The overlay config decides what gets installed, so it counts too
+	for _, path := range []string{filepath.Join(overlayPath, "artifacts", overlayConfigFile), filepath.Join(overlayPath, overlayConfigFile)} {
+		if _, err := fsys.Lstat(path); err == nil {
+			if err := add(path); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	config, err := loadOverlayConfig(fsys, overlayPath)
+	if err != nil {
+		return "", err
+	}
+	root, config, err := applyProfile(fsys, overlayPath, config, profile)
+	if err != nil {
+		return "", err
+	}
+
+	for _, dir := range artifactSources(fsys, root, config) {
+		if archive, ok := artifactArchive(fsys, dir); ok {
+			if err := add(archive); err != nil {
+				return "", err
+			}
+			continue
+		}
+		err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == dir && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			return add(path)
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to digest %s: %w", dir, err)
+		}
+	}
+
+	paths := make([]string, 0, len(lines))
+	for path := range lines {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var b strings.Builder
+	for _, path := range paths {
+		b.WriteString(lines[path])
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,117 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkInstallDisk makes sure the rootfs is mounted from the install disk,
+// either directly or from one of its partitions. A MountPrefix pointing at
+// some other mount, like the imager's own scratch space, is an error.
+// When the disk layout can't be read the check is skipped with a warning.
+func checkInstallDisk(installDisk, rootfsPath string) error {
+	if installDisk == "" {
+		slog.Warn("⚠️  No installDisk set, skipping install disk check")
+		return nil
+	}
+
+	diskInfo, err := os.Stat(installDisk)
+	if err != nil {
+		return fmt.Errorf("failed to stat install disk: %w", err)
+	}
+	if diskInfo.Mode()&os.ModeDevice == 0 || diskInfo.Mode()&os.ModeCharDevice != 0 {
+		return fmt.Errorf("install disk %s is not a block device", installDisk)
+	}
+	disk := uint64(diskInfo.Sys().(*syscall.Stat_t).Rdev)
+
+	rootfsInfo, err := os.Stat(rootfsPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat rootfs: %w", err)
+	}
+	rootfs := uint64(rootfsInfo.Sys().(*syscall.Stat_t).Dev)
+
+	if rootfs == disk {
+		return nil
+	}
+
+	parent, err := parentDevice(rootfs)
+	if err != nil {
+		slog.Warn("⚠️  Could not confirm rootfs is on the install disk", "disk", installDisk, "rootfs", rootfsPath, "error", err)
+		return nil
+	}
+	if parent != disk {
+		return fmt.Errorf("rootfs %s is on device %s, not on install disk %s (%s)", rootfsPath, formatDevice(rootfs), installDisk, formatDevice(disk))
+	}
+	return nil
+}
+
+// parentDevice returns the disk a partition belongs to, as recorded in
+// sysfs. A whole disk is its own parent.
+func parentDevice(dev uint64) (uint64, error) {
+	path, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", formatDevice(dev)))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := os.Stat(filepath.Join(path, "partition")); os.IsNotExist(err) {
+		return dev, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(path), "dev"))
+	if err != nil {
+		return 0, err
+	}
+	var major, minor uint64
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(data)), "%d:%d", &major, &minor); err != nil {
+		return 0, fmt.Errorf("malformed device number %q", data)
+	}
+	return makeDevice(major, minor), nil
+}
+
+// Linux packs device numbers with the low minor bits first, then the
+// major, then the high minor bits
+func makeDevice(major, minor uint64) uint64 {
+	return minor&0xff | major&0xfff<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32
+}
+
+func formatDevice(dev uint64) string {
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return fmt.Sprintf("%d:%d", major, minor)
+}
+
+// checkWritable fails early when the rootfs is mounted read-only, instead
+// of letting the first copy hit EROFS part way through. It only reads the
+// mount flags, so it is safe before the overlay has been verified.
+func checkWritable(rootfsPath string) error {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(rootfsPath, &stat); err != nil {
+		return fmt.Errorf("failed to stat filesystem of %s: %w", rootfsPath, err)
+	}
+	if stat.Flags&unix.ST_RDONLY != 0 {
+		return classify(ErrIO, fmt.Errorf("rootfs %s is read-only", rootfsPath))
+	}
+	return nil
+}
+
+// probeWritable creates and removes a file in the rootfs through fsys, to
+// catch rootfs directories that are mounted writable but are otherwise
+// not. It writes, so it runs once the overlay checks out.
+func probeWritable(fsys filesystem, rootfsPath string) error {
+	path := filepath.Join(rootfsPath, fmt.Sprintf(".overlay-probe-%d", os.Getpid()))
+	f, err := fsys.Create(path, 0600)
+	if errors.Is(err, syscall.EROFS) {
+		return classify(ErrIO, fmt.Errorf("rootfs %s is read-only", rootfsPath))
+	}
+	if err != nil {
+		return classify(ErrIO, fmt.Errorf("rootfs %s is not writable: %w", rootfsPath, err))
+	}
+	f.Close()
+	return fsys.Remove(path)
+}
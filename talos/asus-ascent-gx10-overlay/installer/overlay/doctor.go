@@ -0,0 +1,162 @@
+package overlay
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Doctor inspects a prepared rootfs for the usual reasons the GPU doesn't
+// come up, printing each finding with its severity. Errors fail the command.
+func Doctor(options *Options) error {
+	if err := checkMountPrefix(options.MountPrefix); err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+	cfg, err := parseInstallConfig(options.ExtraOptions, nil)
+	if err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+
+	findings := diagnoseRootfs(osFS{}, options.MountPrefix, options.InstallDisk, cfg)
+
+	errs := 0
+	for _, f := range findings {
+		severity := "warning"
+		if f.fatal {
+			severity = "error"
+			errs++
+		}
+		fmt.Fprintf(options.stdout(), "%s: %s\n", severity, f.message)
+	}
+
+	if errs > 0 {
+		return fmt.Errorf("%d of %d findings are errors", errs, len(findings))
+	}
+	if len(findings) == 0 {
+		fmt.Fprintln(options.stdout(), "rootfs OK")
+	}
+	return nil
+}
+
+// diagnoseRootfs returns every problem found in the rootfs, looking for
+// modules and firmware where the install options put them. The rootfs
+// kernel is cross-checked against those installDisk boots, if set.
+func diagnoseRootfs(fsys filesystem, rootfsPath, installDisk string, cfg *installConfig) []optionProblem {
+	var findings []optionProblem
+	fail := func(format string, args ...interface{}) {
+		findings = append(findings, optionProblem{fatal: true, message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(format string, args ...interface{}) {
+		findings = append(findings, optionProblem{message: fmt.Sprintf(format, args...)})
+	}
+
+	modulesDir := filepath.Join(rootfsPath, filepath.FromSlash(cfg.modulesDir))
+	firmwareDir := filepath.Join(rootfsPath, filepath.FromSlash(cfg.firmwareDir))
+
+	// Which kernels have the nvidia module at all
+	var nvidiaKvers []string
+	nvidiaModules := make(map[string][]string)
+	entries, err := fsys.ReadDir(modulesDir)
+	if err != nil && !os.IsNotExist(err) {
+		fail("%v", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		kver := entry.Name()
+		err := fsys.Walk(filepath.Join(modulesDir, kver), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && isKernelModule(path) && strings.HasPrefix(moduleName(path), "nvidia") {
+				nvidiaModules[kver] = append(nvidiaModules[kver], path)
+				if moduleName(path) == "nvidia" && !slices.Contains(nvidiaKvers, kver) {
+					nvidiaKvers = append(nvidiaKvers, kver)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			fail("%v", err)
+		}
+	}
+
+	kver, err := cfg.kernelVersion, error(nil)
+	var bootKvers []string
+	if kver == "" {
+		kver, bootKvers, err = resolveKernelVersion(fsys, modulesDir, installDisk)
+	}
+	if err == nil && len(bootKvers) > 0 && !slices.Contains(bootKvers, kver) {
+		fail("rootfs kernel %s is not one install disk %s boots (%s); rebuild the rootfs for the boot kernel", kver, installDisk, strings.Join(bootKvers, ", "))
+	}
+	switch {
+	case err != nil:
+		fail("%v", err)
+	case len(nvidiaKvers) == 0:
+		fail("no nvidia module installed under %s; run the overlay install", modulesDir)
+	case !slices.Contains(nvidiaKvers, kver):
+		fail("nvidia module is installed for kernel %s but the rootfs kernel is %s; rebuild the overlay for %s", strings.Join(nvidiaKvers, ", "), kver, kver)
+	}
+
+	if kver != "" && slices.Contains(nvidiaKvers, kver) {
+		depPath := filepath.Join(modulesDir, kver, "modules.dep")
+		dep, err := fsys.ReadFile(depPath)
+		switch {
+		case os.IsNotExist(err):
+			fail("%s is missing; run depmod -b %s %s", depPath, rootfsPath, kver)
+		case err != nil:
+			fail("%v", err)
+		case !listsModule(dep, "nvidia"):
+			fail("%s does not list the nvidia module; run depmod -b %s %s", depPath, rootfsPath, kver)
+		}
+
+		missing, err := missingFirmware(fsys, firmwareSearchDirs(firmwareDir, kver), nvidiaModules[kver])
+		if err != nil {
+			fail("%v", err)
+		}
+		for _, m := range missing {
+			fail("firmware %s is missing from %s", m, firmwareDir)
+		}
+	}
+
+	if !modulesLoadLists(rootfsPath, "nvidia") {
+		warn("no modules-load.d entry loads nvidia; the driver is only loaded on demand")
+	}
+
+	return findings
+}
+
+// listsModule reports whether a modules.dep lists a module by name
+func listsModule(dep []byte, name string) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(dep))
+	for scanner.Scan() {
+		path, _, _ := strings.Cut(scanner.Text(), ":")
+		if isKernelModule(path) && moduleName(path) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// modulesLoadLists reports whether any modules-load.d file in the rootfs
+// loads the named module
+func modulesLoadLists(rootfsPath, name string) bool {
+	files, _ := filepath.Glob(filepath.Join(rootfsPath, "etc", "modules-load.d", "*.conf"))
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.ReplaceAll(strings.TrimSpace(line), "-", "_") == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package overlay
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// driverVersion reads the version of every nvidia module the overlay ships
+// and, when expected is set, fails unless they all match it. It returns the
+// version found, or "" when the overlay has no nvidia module.
+func driverVersion(fsys filesystem, overlayPath string, config *OverlayConfig, expected string) (string, error) {
+	var found string
+	check := func(path, v string) error {
+		if expected != "" && v != expected {
+			return fmt.Errorf("%s has driver version %q, expected %q", path, v, expected)
+		}
+		if found == "" {
+			found = v
+		}
+		return nil
+	}
+
+	for _, dir := range artifactSources(fsys, overlayPath, config) {
+		if archive, ok := artifactArchive(fsys, dir); ok {
+			err := walkArchive(fsys, archive, nil, func(hdr *tar.Header, r io.Reader) error {
+				if hdr.Typeflag != tar.TypeReg || !isKernelModule(hdr.Name) || moduleName(hdr.Name) != "nvidia" {
+					return nil
+				}
+				name := archiveMember(archive, hdr.Name)
+				v, err := readModuleVersion(r, name)
+				if err != nil {
+					return err
+				}
+				return check(name, v)
+			})
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == dir && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !info.Mode().IsRegular() || !isKernelModule(path) || moduleName(path) != "nvidia" {
+				return nil
+			}
+
+			v, err := moduleVersion(fsys, path)
+			if err != nil {
+				return err
+			}
+			return check(path, v)
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if expected != "" && found == "" {
+		return "", fmt.Errorf("no nvidia module with a version found to check against expected driver version %q", expected)
+	}
+	if found != "" {
+		slog.Info("🏷️  NVIDIA driver", "version", found)
+	}
+	return found, nil
+}
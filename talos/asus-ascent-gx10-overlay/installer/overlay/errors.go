@@ -0,0 +1,53 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Classes of failure, for callers to tell apart with errors.Is: a command
+// may fail because of what it was asked to do, what the overlay lacks,
+// what the rootfs can't take, or what doesn't check out
+var (
+	ErrInvalidOptions   = errors.New("invalid install options")
+	ErrMissingArtifacts = errors.New("missing overlay artifacts")
+	ErrIO               = errors.New("rootfs I/O error")
+	ErrVerification     = errors.New("verification failed")
+)
+
+// classifiedError marks err as one of the classes above without changing
+// its message
+type classifiedError struct {
+	err   error
+	class error
+}
+
+func (e *classifiedError) Error() string   { return e.err.Error() }
+func (e *classifiedError) Unwrap() []error { return []error{e.err, e.class} }
+
+// classify marks a non-nil err as being of class
+func classify(class, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classifiedError{err: err, class: class}
+}
+
+// IsIOError reports whether err comes from the rootfs failing a write or
+// read, a full or read-only filesystem included, rather than from the
+// install itself
+func IsIOError(err error) bool {
+	return errors.Is(err, ErrIO) || isNoSpace(err) || errors.Is(err, syscall.EROFS) || errors.Is(err, syscall.EIO)
+}
+
+// fileFailures collects the per-file failures of a copy that attempted
+// every entry, each naming its path. It is the only error keepGoing
+// downgrades; see tolerateFailures.
+type fileFailures []error
+
+func (f fileFailures) Error() string {
+	return fmt.Sprintf("failed to copy %d paths: %v", len(f), errors.Join(f...))
+}
+
+func (f fileFailures) Unwrap() []error { return f }
@@ -0,0 +1,41 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestTolerateFailures(t *testing.T) {
+	perFile := fileFailures{errors.New("a.conf: permission denied"), errors.New("b.conf: invalid argument")}
+
+	for _, tc := range []struct {
+		name      string
+		keepGoing bool
+		err       error
+		wantErr   bool
+		wantWarns int
+	}{
+		{name: "per-file failures", keepGoing: true, err: perFile, wantWarns: 2},
+		{name: "wrapped per-file failures", keepGoing: true, err: fmt.Errorf("phase: %w", perFile), wantWarns: 2},
+		{name: "without keepGoing", err: perFile, wantErr: true},
+		{name: "classified error", keepGoing: true, err: classify(ErrVerification, errors.New("digest mismatch")), wantErr: true},
+		{name: "several wrapped errors", keepGoing: true, err: fmt.Errorf("%w and %w", ErrIO, errors.New("bad")), wantErr: true},
+		{name: "full disk", keepGoing: true, err: fileFailures{fmt.Errorf("a.conf: %w", syscall.ENOSPC)}, wantErr: true},
+		{name: "no error", keepGoing: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &installConfig{keepGoing: tc.keepGoing}
+			inst := &Installer{cfg: cfg, summary: newInstallSummary(cfg, nil)}
+
+			err := inst.tolerateFailures("config-files", tc.err)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("tolerateFailures() = %v, want error %v", err, tc.wantErr)
+			}
+			if got := len(inst.summary.Warnings); got != tc.wantWarns {
+				t.Errorf("recorded %d warnings, want %d", got, tc.wantWarns)
+			}
+		})
+	}
+}
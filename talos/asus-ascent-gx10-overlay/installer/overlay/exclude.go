@@ -0,0 +1,88 @@
+package overlay
+
+import (
+	"path"
+	"strings"
+)
+
+// excluded reports whether a source-relative path matches one of the
+// ExtraOptions["exclude"] patterns
+func (inst *Installer) excluded(rel string) bool {
+	for _, pattern := range inst.cfg.exclude {
+		// Patterns are checked when the config is parsed
+		if ok, _ := matchGlob(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether a source-relative file matches one of the
+// include patterns, or whether there are none. A pattern like ".bin" is a
+// file extension, ignoring a firmware compression suffix; a pattern without
+// a slash matches the file name at any depth; any other pattern matches
+// the whole path.
+func included(include []string, rel string) bool {
+	if len(include) == 0 {
+		return true
+	}
+	name := path.Base(rel)
+	for _, pattern := range include {
+		var ok bool
+		switch {
+		case isExtensionPattern(pattern):
+			for _, suffix := range firmwareCompressions {
+				ok = ok || strings.HasSuffix(strings.TrimSuffix(name, suffix), pattern)
+			}
+		case !strings.Contains(pattern, "/"):
+			ok, _ = matchGlob(pattern, name)
+		default:
+			ok, _ = matchGlob(pattern, rel)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isExtensionPattern reports whether an include pattern is a plain file
+// extension such as ".bin"
+func isExtensionPattern(pattern string) bool {
+	return strings.HasPrefix(pattern, ".") && !strings.ContainsAny(pattern, "*?[/")
+}
+
+// matchGlob matches a slash separated path against a glob pattern.
+// Segments follow path.Match, and a "**" segment matches any number of
+// directories, including none, so "**/*.debug" matches at every depth.
+func matchGlob(pattern, name string) (bool, error) {
+	// path.Match only reports a bad pattern once it gets that far, so the
+	// whole pattern is checked up front
+	for _, seg := range strings.Split(pattern, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return false, err
+		}
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/")), nil
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
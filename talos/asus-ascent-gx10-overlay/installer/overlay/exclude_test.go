@@ -0,0 +1,205 @@
+package overlay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestMatchGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"**/*.debug", "gsp.debug", true},
+		{"**/*.debug", "nvidia/gsp.debug", true},
+		{"**/*.debug", "nvidia/ga10x/gsp.debug", true},
+		{"**/*.debug", "nvidia/gsp.bin", false},
+		{"**/*.debug", "nvidia/gsp.debug.bin", false},
+		{"nvidia/gsp.bin", "nvidia/gsp.bin", true},
+		{"nvidia/gsp.bin", "other/nvidia/gsp.bin", false},
+		{"nvidia/gsp.bin", "nvidia/gsp.bin.xz", false},
+		{"nvidia/*", "nvidia/gsp.bin", true},
+		{"nvidia/*", "nvidia/ga10x/gsp.bin", false},
+		{"nvidia/**", "nvidia/ga10x/gsp.bin", true},
+		{"*.bin", "nvidia/gsp.bin", false},
+	} {
+		t.Run(tc.pattern+" "+tc.name, func(t *testing.T) {
+			got, err := matchGlob(tc.pattern, tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("matchGlob(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCopyDirectoryExclude(t *testing.T) {
+	source := testutil.Tree{
+		"nvidia/gsp.bin":             testutil.File("gsp firmware"),
+		"nvidia/gsp.debug":           testutil.File("debug"),
+		"nvidia/ga10x/gsp.bin":       testutil.File("ga10x firmware"),
+		"nvidia/ga10x/gsp.debug":     testutil.File("debug"),
+		"nvidia/tools/dump.bin":      testutil.File("tool"),
+		"nvidia/tools/more/dump.bin": testutil.File("tool"),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		exclude []interface{}
+		// excluded are the source paths left out
+		excluded []string
+	}{
+		{
+			name:     "extension at any depth",
+			exclude:  []interface{}{"**/*.debug"},
+			excluded: []string{"nvidia/gsp.debug", "nvidia/ga10x/gsp.debug"},
+		},
+		{
+			name:     "exact path",
+			exclude:  []interface{}{"nvidia/ga10x/gsp.bin"},
+			excluded: []string{"nvidia/ga10x/gsp.bin"},
+		},
+		{
+			name:     "directory",
+			exclude:  []interface{}{"nvidia/tools"},
+			excluded: []string{"nvidia/tools/dump.bin", "nvidia/tools/more/dump.bin"},
+		},
+		{
+			name:     "several",
+			exclude:  []interface{}{"**/*.debug", "nvidia/tools/dump.bin"},
+			excluded: []string{"nvidia/gsp.debug", "nvidia/ga10x/gsp.debug", "nvidia/tools/dump.bin"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, source)
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "lib", "firmware")
+
+			inst := newTestInstaller(t, src, rootfs, map[string]interface{}{"exclude": tc.exclude})
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			excluded := make(map[string]bool)
+			for _, rel := range tc.excluded {
+				excluded[rel] = true
+			}
+			for rel := range source {
+				path := filepath.Join(dst, filepath.FromSlash(rel))
+				_, err := os.Lstat(path)
+				_, listed := inst.manifest.entry(path)
+				switch {
+				case excluded[rel] && !os.IsNotExist(err):
+					t.Errorf("excluded %s was copied: %v", rel, err)
+				case excluded[rel] && listed:
+					t.Errorf("excluded %s is in the manifest", rel)
+				case !excluded[rel] && (err != nil || !listed):
+					t.Errorf("%s was not copied and recorded: %v", rel, err)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallFirmwareInclude(t *testing.T) {
+	firmware := testutil.Tree{
+		"nvidia/gsp.bin":             testutil.File("gsp firmware"),
+		"nvidia/gsp-latest.bin":      testutil.Symlink("gsp.bin"),
+		"nvidia/ga10x/gsp_ga10x.bin": testutil.File("ga10x firmware"),
+		"nvidia/ga10x/boot.fw.xz":    testutil.File("boot firmware"),
+		"nvidia/README.txt":          testutil.File("notes"),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		include []interface{}
+		// want are the firmware paths installed
+		want []string
+	}{
+		{
+			name:    "unset",
+			include: nil,
+			want:    []string{"nvidia/gsp.bin", "nvidia/gsp-latest.bin", "nvidia/ga10x/gsp_ga10x.bin", "nvidia/ga10x/boot.fw.xz", "nvidia/README.txt"},
+		},
+		{
+			name:    "extension",
+			include: []interface{}{".bin"},
+			want:    []string{"nvidia/gsp.bin", "nvidia/gsp-latest.bin", "nvidia/ga10x/gsp_ga10x.bin"},
+		},
+		{
+			name:    "extension of compressed firmware",
+			include: []interface{}{".fw"},
+			want:    []string{"nvidia/ga10x/boot.fw.xz"},
+		},
+		{
+			name:    "name glob",
+			include: []interface{}{"gsp_*"},
+			want:    []string{"nvidia/ga10x/gsp_ga10x.bin"},
+		},
+		{
+			name:    "path glob",
+			include: []interface{}{"nvidia/ga10x/*"},
+			want:    []string{"nvidia/ga10x/gsp_ga10x.bin", "nvidia/ga10x/boot.fw.xz"},
+		},
+		{
+			name:    "several",
+			include: []interface{}{"nvidia/gsp.bin", ".txt"},
+			want:    []string{"nvidia/gsp.bin", "nvidia/README.txt"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fixture := testOverlay()
+			fixture.Firmware = firmware
+			// A module needing excluded firmware would fail the install
+			fixture.KernelModules = testutil.Tree{
+				testKver + "/kernel/drivers/gpu/nvidia.ko": testModule(),
+			}
+			overlayPath := fixture.Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+
+			extra := map[string]interface{}{}
+			if tc.include != nil {
+				extra["firmwareInclude"] = tc.include
+			}
+			if err := runInstallTest(t, overlayPath, rootfs, extra); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			manifest, err := readManifest(osFS{}, rootfs, defaultStateDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			listed := make(map[string]bool)
+			for _, entry := range manifest.Files {
+				listed[entry.Path] = true
+			}
+			want := make(map[string]bool)
+			for _, rel := range tc.want {
+				want[rel] = true
+			}
+			for rel := range firmware {
+				_, err := os.Lstat(filepath.Join(rootfs, "lib", "firmware", filepath.FromSlash(rel)))
+				switch recorded := listed["lib/firmware/"+rel]; {
+				case !want[rel] && !os.IsNotExist(err):
+					t.Errorf("%s not included but copied: %v", rel, err)
+				case !want[rel] && recorded:
+					t.Errorf("%s not included but in the manifest", rel)
+				case want[rel] && (err != nil || !recorded):
+					t.Errorf("%s was not copied and recorded: %v", rel, err)
+				}
+			}
+			// Only the firmware phase is limited
+			if got := readTestFile(t, rootfs, "etc/nvidia/app.conf"); got != "key=value\n" {
+				t.Errorf("app.conf = %q", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package overlay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// copyRangeChunk bounds each copy_file_range call, so cancellation is
+// noticed between chunks of a large file
+const copyRangeChunk = 64 << 20
+
+// copyFileRange copies src to dst inside the kernel with copy_file_range(2),
+// which filesystems like XFS and btrfs turn into a reflink. ok is false, with
+// nothing written, when either side isn't a plain file or the filesystems
+// can't do it, and the caller should copy the data itself.
+//
+// The digest is taken by reading dst back, which is normally still in the
+// page cache, as the data never passes through the installer.
+func (inst *Installer) copyFileRange(src io.Reader, dst io.Writer) (written int64, sum string, ok bool, err error) {
+	ctx := context.Background()
+	if r, isContextReader := src.(*contextReader); isContextReader {
+		ctx, src = r.ctx, r.r
+	}
+	srcFile, srcIsFile := src.(*os.File)
+	dstFile, dstIsFile := dst.(*os.File)
+	if !srcIsFile || !dstIsFile {
+		return 0, "", false, nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, "", true, err
+		}
+		n, err := unix.CopyFileRange(int(srcFile.Fd()), nil, int(dstFile.Fd()), nil, copyRangeChunk, 0)
+		if err != nil {
+			if written == 0 && copyRangeUnsupported(err) {
+				return 0, "", false, nil
+			}
+			return written, "", true, err
+		}
+		if n == 0 {
+			break
+		}
+		written += int64(n)
+	}
+
+	// What the kernel wrote is read back, rather than the source again, so
+	// the digest is of what actually landed in dst
+	written, sum, err = inst.hashFile(ctx, dstFile.Name())
+	return written, sum, true, err
+}
+
+// hashFile returns the size and hex encoded SHA-256 of the file at path
+func (inst *Installer) hashFile(ctx context.Context, path string) (int64, string, error) {
+	f, err := inst.fs.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	buf := inst.buffers.Get().(*[]byte)
+	defer inst.buffers.Put(buf)
+	hash := sha256.New()
+	n, err := io.CopyBuffer(hash, &contextReader{ctx: ctx, r: f}, *buf)
+	if err != nil {
+		return n, "", err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// copyRangeUnsupported reports whether a copy_file_range error means the
+// kernel or filesystems can't do the copy, rather than that it failed
+func copyRangeUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
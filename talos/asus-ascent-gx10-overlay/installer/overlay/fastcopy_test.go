@@ -0,0 +1,129 @@
+package overlay
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyFile(t *testing.T) {
+	data := strings.Repeat("firmware blob ", 100_000)
+	srcPath := filepath.Join(t.TempDir(), "src.bin")
+	if err := os.WriteFile(srcPath, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256([]byte(data))
+
+	for _, tc := range []struct {
+		name string
+		open func(t *testing.T) io.Reader
+		// fs, when set, creates the destination
+		fs filesystem
+	}{
+		{
+			// An *os.File on both sides takes copy_file_range
+			name: "file",
+			open: func(t *testing.T) io.Reader {
+				f, err := os.Open(srcPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { f.Close() })
+				return f
+			},
+		},
+		{
+			// Anything else falls back to the buffered copy
+			name: "buffered fallback",
+			open: func(t *testing.T) io.Reader { return bytes.NewReader([]byte(data)) },
+		},
+		{
+			// As does a destination that isn't an *os.File
+			name: "buffered fallback destination",
+			open: func(t *testing.T) io.Reader {
+				f, err := os.Open(srcPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { f.Close() })
+				return f
+			},
+			fs: &flakyFS{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inst := newTestInstaller(t, "", t.TempDir(), nil)
+			if tc.fs != nil {
+				inst.fs = tc.fs
+			}
+			dst := filepath.Join(inst.rootfsPath, "dst.bin")
+
+			written, sum, err := inst.copyFile(tc.open(t), dst, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if written != int64(len(data)) {
+				t.Errorf("copyFile() wrote %d bytes, want %d", written, len(data))
+			}
+			if sum != hex.EncodeToString(want[:]) {
+				t.Errorf("copyFile() digest = %s, want %x", sum, want)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != data {
+				t.Error("destination content differs from the source")
+			}
+		})
+	}
+}
+
+func TestCopyRangeUnsupported(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{unix.ENOSYS, true},
+		{unix.EXDEV, true},
+		{unix.EOPNOTSUPP, true},
+		{unix.EINVAL, true},
+		{fmt.Errorf("copy_file_range: %w", unix.EXDEV), true},
+		{unix.EIO, false},
+		{unix.ENOSPC, false},
+		{unix.EBADF, false},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			if got := copyRangeUnsupported(tc.err); got != tc.want {
+				t.Errorf("copyRangeUnsupported(%v) = %v, want %v", tc.err, got, tc.want)
+			}
+		})
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	data := bytes.Repeat([]byte("firmware blob "), 32<<20/14)
+	for _, kib := range []int{32, 256, 1024, 4096} {
+		b.Run(fmt.Sprintf("%dKiB", kib), func(b *testing.B) {
+			inst := newTestInstaller(b, "", b.TempDir(), map[string]interface{}{"copyBufferKiB": kib})
+			dst := filepath.Join(inst.rootfsPath, "dst.bin")
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				// A bytes.Reader takes the buffered copy this sizes
+				if _, _, err := inst.copyFile(bytes.NewReader(data), dst, 0o644); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package overlay
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// filesystem is the file access an Installer performs on the overlay and
+// the rootfs. osFS is the real filesystem; tests can substitute their own.
+type filesystem interface {
+	Open(name string) (io.ReadCloser, error)
+	// Create truncates or creates name with mode for writing
+	Create(name string, mode os.FileMode) (io.WriteCloser, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, mode os.FileMode) error
+	MkdirAll(path string, mode os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Walk(root string, fn filepath.WalkFunc) error
+	Readlink(name string) (string, error)
+	Symlink(target, name string) error
+	Link(oldname, newname string) error
+	// Mknod creates a FIFO or device node; mode carries the file type
+	Mknod(name string, mode os.FileMode, dev uint64) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	// RemoveAll removes path and everything below it, if it exists
+	RemoveAll(path string) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Lchown(name string, uid, gid int) error
+	// Xattrs and SetXattr don't follow symlinks
+	Xattrs(name string) (map[string][]byte, error)
+	SetXattr(name, attr string, value []byte) error
+}
+
+// osFS implements filesystem with the os package
+type osFS struct{}
+
+func (osFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(name)
+}
+
+func (osFS) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+func (osFS) WriteFile(name string, data []byte, mode os.FileMode) error {
+	return os.WriteFile(name, data, mode)
+}
+
+func (osFS) MkdirAll(path string, mode os.FileMode) error {
+	return os.MkdirAll(path, mode)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Walk(root string, fn filepath.WalkFunc) error {
+	return filepath.Walk(root, fn)
+}
+
+func (osFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (osFS) Symlink(target, name string) error {
+	return os.Symlink(target, name)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Mknod(name string, mode os.FileMode, dev uint64) error {
+	perm := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		perm |= unix.S_IFIFO
+	case mode&os.ModeCharDevice != 0:
+		perm |= unix.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		perm |= unix.S_IFBLK
+	default:
+		return &os.PathError{Op: "mknod", Path: name, Err: unix.EINVAL}
+	}
+	return unix.Mknod(name, perm, int(dev))
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFS) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+func (osFS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
+func (osFS) Xattrs(name string) (map[string][]byte, error) {
+	return listXattrs(name)
+}
+
+func (osFS) SetXattr(name, attr string, value []byte) error {
+	return unix.Lsetxattr(name, attr, value, 0)
+}
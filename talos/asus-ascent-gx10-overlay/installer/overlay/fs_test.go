@@ -0,0 +1,607 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// recordingFS is the real filesystem, noting every path written through it
+type recordingFS struct {
+	osFS
+	mu      sync.Mutex
+	written map[string]bool
+}
+
+func (fsys *recordingFS) record(name string) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	fsys.written[name] = true
+}
+
+func (fsys *recordingFS) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	fsys.record(name)
+	return fsys.osFS.Create(name, mode)
+}
+
+func (fsys *recordingFS) WriteFile(name string, data []byte, mode os.FileMode) error {
+	fsys.record(name)
+	return fsys.osFS.WriteFile(name, data, mode)
+}
+
+func (fsys *recordingFS) Symlink(target, name string) error {
+	fsys.record(name)
+	return fsys.osFS.Symlink(target, name)
+}
+
+func (fsys *recordingFS) Rename(oldpath, newpath string) error {
+	fsys.record(newpath)
+	return fsys.osFS.Rename(oldpath, newpath)
+}
+
+func TestInstallThroughFS(t *testing.T) {
+	overlayPath := testOverlay().Build(t)
+	rootfs := testutil.Rootfs(t, testKver)
+
+	cfg, err := parseInstallConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := &recordingFS{written: make(map[string]bool)}
+	options := &Options{
+		InstallOptions: InstallOptions{MountPrefix: rootfs},
+		OverlayPath:    overlayPath,
+		Stdout:         io.Discard,
+	}
+	if err := runInstall(context.Background(), fsys, options, cfg, newInstallSummary(cfg, nil)); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		path string
+	}{
+		{"firmware", "lib/firmware/nvidia/gsp.bin"},
+		{"firmware symlink", "lib/firmware/nvidia/gsp-latest.bin"},
+		{"config file", "etc/nvidia/app.conf"},
+		{"module index", "lib/modules/" + testKver + "/modules.dep"},
+		{"manifest", defaultStateDir + "/" + manifestFile},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(rootfs, filepath.FromSlash(tc.path))
+			if !fsys.written[path] {
+				t.Errorf("%s was not written through the installer's filesystem", tc.path)
+			}
+		})
+	}
+}
+
+// memFS is an in-memory filesystem, for installs that must not touch the
+// disk. Paths are absolute; hard links share a memNode.
+type memFS struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	mode    os.FileMode
+	data    []byte
+	target  string
+	modTime time.Time
+	xattrs  map[string][]byte
+}
+
+// newMemFS returns a memFS holding a copy of each of the trees at dirs
+func newMemFS(t *testing.T, dirs ...string) *memFS {
+	t.Helper()
+	fsys := &memFS{nodes: map[string]*memNode{"/": {mode: os.ModeDir | 0755}}}
+	for _, dir := range dirs {
+		if err := fsys.MkdirAll(filepath.Dir(dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			node := &memNode{mode: info.Mode(), modTime: info.ModTime()}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				node.target, err = os.Readlink(path)
+			case info.Mode().IsRegular():
+				node.data, err = os.ReadFile(path)
+			}
+			fsys.nodes[path] = node
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fsys
+}
+
+func memError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// resolve returns the key of name with the symlinks above it, and with
+// follow the last component too, resolved. The node needn't exist, but
+// its parent must.
+func (fsys *memFS) resolve(name string, follow bool) (string, error) {
+	pending := strings.Split(strings.TrimPrefix(filepath.Clean(name), "/"), "/")
+	resolved := "/"
+	for links := 0; len(pending) > 0; {
+		elem := pending[0]
+		pending = pending[1:]
+		if elem == "" {
+			continue
+		}
+		next := filepath.Join(resolved, elem)
+		node, ok := fsys.nodes[next]
+		switch {
+		case !ok && len(pending) > 0:
+			return "", syscall.ENOENT
+		case !ok:
+			resolved = next
+		case node.mode&os.ModeSymlink != 0 && (len(pending) > 0 || follow):
+			if links++; links > 40 {
+				return "", syscall.ELOOP
+			}
+			target := strings.Split(node.target, "/")
+			if filepath.IsAbs(node.target) {
+				resolved = "/"
+			}
+			pending = append(target, pending...)
+		case !node.mode.IsDir() && len(pending) > 0:
+			return "", syscall.ENOTDIR
+		default:
+			resolved = next
+		}
+	}
+	return resolved, nil
+}
+
+// lookup returns the node name resolves to
+func (fsys *memFS) lookup(op, name string, follow bool) (string, *memNode, error) {
+	key, err := fsys.resolve(name, follow)
+	if err != nil {
+		return "", nil, memError(op, name, err)
+	}
+	node, ok := fsys.nodes[key]
+	if !ok {
+		return "", nil, memError(op, name, syscall.ENOENT)
+	}
+	return key, node, nil
+}
+
+// create returns the key for a new node at name, failing if one exists
+func (fsys *memFS) create(op, name string) (string, error) {
+	key, err := fsys.resolve(name, false)
+	if err != nil {
+		return "", memError(op, name, err)
+	}
+	if _, ok := fsys.nodes[key]; ok {
+		return "", memError(op, name, syscall.EEXIST)
+	}
+	if parent := fsys.nodes[filepath.Dir(key)]; parent == nil || !parent.mode.IsDir() {
+		return "", memError(op, name, syscall.ENOTDIR)
+	}
+	return key, nil
+}
+
+// children returns the keys of the entries directly below key, sorted
+func (fsys *memFS) children(key string) []string {
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	var keys []string
+	for k := range fsys.nodes {
+		if rest, ok := strings.CutPrefix(k, prefix); ok && rest != "" && !strings.Contains(rest, "/") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type memInfo struct {
+	name string
+	node memNode
+}
+
+func (fi memInfo) Name() string       { return fi.name }
+func (fi memInfo) Mode() os.FileMode  { return fi.node.mode }
+func (fi memInfo) ModTime() time.Time { return fi.node.modTime }
+func (fi memInfo) IsDir() bool        { return fi.node.mode.IsDir() }
+func (fi memInfo) Sys() interface{}   { return nil }
+
+func (fi memInfo) Size() int64 {
+	if fi.node.mode&os.ModeSymlink != 0 {
+		return int64(len(fi.node.target))
+	}
+	return int64(len(fi.node.data))
+}
+
+func (fsys *memFS) stat(op, name string, follow bool) (os.FileInfo, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key, node, err := fsys.lookup(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	return memInfo{name: filepath.Base(key), node: *node}, nil
+}
+
+func (fsys *memFS) Stat(name string) (os.FileInfo, error) {
+	return fsys.stat("stat", name, true)
+}
+
+func (fsys *memFS) Lstat(name string) (os.FileInfo, error) {
+	return fsys.stat("lstat", name, false)
+}
+
+func (fsys *memFS) Open(name string) (io.ReadCloser, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(bytes.Clone(node.data))), nil
+}
+
+func (fsys *memFS) ReadFile(name string) ([]byte, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, memError("read", name, syscall.EISDIR)
+	}
+	return bytes.Clone(node.data), nil
+}
+
+// memFile writes to a memNode as it goes, like a truncated real file
+type memFile struct {
+	fsys *memFS
+	node *memNode
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	f.node.data = append(f.node.data, p...)
+	return len(p), nil
+}
+
+func (f *memFile) Close() error { return nil }
+
+func (fsys *memFS) Create(name string, mode os.FileMode) (io.WriteCloser, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if _, node, err := fsys.lookup("open", name, true); err == nil {
+		if node.mode.IsDir() {
+			return nil, memError("open", name, syscall.EISDIR)
+		}
+		node.data, node.modTime = nil, time.Now()
+		return &memFile{fsys: fsys, node: node}, nil
+	}
+	key, err := fsys.resolve(name, true)
+	if err != nil {
+		return nil, memError("open", name, err)
+	}
+	if key, err = fsys.create("open", key); err != nil {
+		return nil, err
+	}
+	node := &memNode{mode: mode.Perm(), modTime: time.Now()}
+	fsys.nodes[key] = node
+	return &memFile{fsys: fsys, node: node}, nil
+}
+
+func (fsys *memFS) WriteFile(name string, data []byte, mode os.FileMode) error {
+	f, err := fsys.Create(name, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (fsys *memFS) MkdirAll(path string, mode os.FileMode) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	dir := "/"
+	for _, elem := range strings.Split(strings.TrimPrefix(filepath.Clean(path), "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		key, err := fsys.resolve(filepath.Join(dir, elem), true)
+		if err != nil {
+			return memError("mkdir", path, err)
+		}
+		node, ok := fsys.nodes[key]
+		if !ok {
+			node = &memNode{mode: os.ModeDir | mode.Perm(), modTime: time.Now()}
+			fsys.nodes[key] = node
+		}
+		if !node.mode.IsDir() {
+			return memError("mkdir", path, syscall.ENOTDIR)
+		}
+		dir = key
+	}
+	return nil
+}
+
+func (fsys *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key, node, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, memError("readdirent", name, syscall.ENOTDIR)
+	}
+	var entries []os.DirEntry
+	for _, child := range fsys.children(key) {
+		entries = append(entries, fs.FileInfoToDirEntry(memInfo{name: filepath.Base(child), node: *fsys.nodes[child]}))
+	}
+	return entries, nil
+}
+
+func (fsys *memFS) Walk(root string, fn filepath.WalkFunc) error {
+	err := fsys.walk(root, fn)
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func (fsys *memFS) walk(path string, fn filepath.WalkFunc) error {
+	info, err := fsys.Lstat(path)
+	if err != nil {
+		return fn(path, nil, err)
+	}
+	if err := fn(path, info, nil); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return fn(path, info, err)
+	}
+	for _, entry := range entries {
+		if err := fsys.walk(filepath.Join(path, entry.Name()), fn); err != nil {
+			if err == filepath.SkipDir && !entry.IsDir() {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (fsys *memFS) Readlink(name string) (string, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", memError("readlink", name, syscall.EINVAL)
+	}
+	return node.target, nil
+}
+
+func (fsys *memFS) Symlink(target, name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key, err := fsys.create("symlink", name)
+	if err != nil {
+		return err
+	}
+	fsys.nodes[key] = &memNode{mode: os.ModeSymlink | 0777, target: target, modTime: time.Now()}
+	return nil
+}
+
+func (fsys *memFS) Link(oldname, newname string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.lookup("link", oldname, false)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() {
+		return memError("link", oldname, syscall.EPERM)
+	}
+	key, err := fsys.create("link", newname)
+	if err != nil {
+		return err
+	}
+	fsys.nodes[key] = node
+	return nil
+}
+
+func (fsys *memFS) Mknod(name string, mode os.FileMode, dev uint64) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key, err := fsys.create("mknod", name)
+	if err != nil {
+		return err
+	}
+	fsys.nodes[key] = &memNode{mode: mode, modTime: time.Now()}
+	return nil
+}
+
+func (fsys *memFS) Rename(oldpath, newpath string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	oldKey, node, err := fsys.lookup("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+	newKey, err := fsys.resolve(newpath, false)
+	if err != nil {
+		return memError("rename", newpath, err)
+	}
+	if existing, ok := fsys.nodes[newKey]; ok && existing.mode.IsDir() && len(fsys.children(newKey)) > 0 {
+		return memError("rename", newpath, syscall.ENOTEMPTY)
+	}
+	if node.mode.IsDir() {
+		for k, n := range fsys.nodes {
+			if rest, ok := strings.CutPrefix(k, oldKey+"/"); ok {
+				delete(fsys.nodes, k)
+				fsys.nodes[newKey+"/"+rest] = n
+			}
+		}
+	}
+	delete(fsys.nodes, oldKey)
+	fsys.nodes[newKey] = node
+	return nil
+}
+
+func (fsys *memFS) Remove(name string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key, node, err := fsys.lookup("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if node.mode.IsDir() && len(fsys.children(key)) > 0 {
+		return memError("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(fsys.nodes, key)
+	return nil
+}
+
+func (fsys *memFS) RemoveAll(path string) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	key, _, err := fsys.lookup("unlinkat", path, false)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for k := range fsys.nodes {
+		if k == key || strings.HasPrefix(k, key+"/") {
+			delete(fsys.nodes, k)
+		}
+	}
+	return nil
+}
+
+func (fsys *memFS) Chtimes(name string, atime, mtime time.Time) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.lookup("chtimes", name, true)
+	if err != nil {
+		return err
+	}
+	node.modTime = mtime
+	return nil
+}
+
+func (fsys *memFS) Lchown(name string, uid, gid int) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, _, err := fsys.lookup("lchown", name, false)
+	return err
+}
+
+func (fsys *memFS) Xattrs(name string) (map[string][]byte, error) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.lookup("llistxattr", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return maps.Clone(node.xattrs), nil
+}
+
+func (fsys *memFS) SetXattr(name, attr string, value []byte) error {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	_, node, err := fsys.lookup("lsetxattr", name, false)
+	if err != nil {
+		return err
+	}
+	if node.xattrs == nil {
+		node.xattrs = make(map[string][]byte)
+	}
+	node.xattrs[attr] = bytes.Clone(value)
+	return nil
+}
+
+func TestInstallInMemory(t *testing.T) {
+	overlayPath := testOverlay().Build(t)
+	rootfs := testutil.Rootfs(t, testKver)
+
+	cfg, err := parseInstallConfig(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rootfs stays on disk only for the read-only statfs checks
+	fsys := newMemFS(t, overlayPath, rootfs)
+	options := &Options{
+		InstallOptions: InstallOptions{MountPrefix: rootfs},
+		OverlayPath:    overlayPath,
+		Stdout:         io.Discard,
+	}
+	if err := runInstall(context.Background(), fsys, options, cfg, newInstallSummary(cfg, nil)); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+
+	for rel, want := range map[string]string{
+		"lib/firmware/nvidia/gsp.bin":        "gsp firmware",
+		"lib/firmware/nvidia/gsp-latest.bin": "gsp firmware",
+		"etc/nvidia/app.conf":                "key=value\n",
+	} {
+		data, err := fsys.ReadFile(filepath.Join(rootfs, rel))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", rel, data, err, want)
+		}
+	}
+	manifest, err := readManifest(fsys, rootfs, defaultStateDir)
+	if err != nil {
+		t.Fatalf("manifest: %v", err)
+	}
+	if len(manifest.Files) == 0 {
+		t.Error("manifest lists no files")
+	}
+
+	// Nothing may have reached the disk
+	var onDisk []string
+	err = filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(rootfs, path)
+			onDisk = append(onDisk, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"lib/modules/" + testKver + "/modules.builtin"}; !slices.Equal(onDisk, want) {
+		t.Errorf("rootfs on disk holds %q, want only %q", onDisk, want)
+	}
+}
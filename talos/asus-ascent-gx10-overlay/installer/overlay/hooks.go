@@ -0,0 +1,52 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+// Hook points for ExtraOptions["hooks"]. The post-kernel-modules and
+// post-firmware hooks only run with the built-in layout, since an overlay
+// config with steps has no such phases.
+const (
+	hookPreInstall        = "pre-install"
+	hookPostKernelModules = "post-kernel-modules"
+	hookPostFirmware      = "post-firmware"
+	hookPostInstall       = "post-install"
+)
+
+var hookNames = []string{hookPreInstall, hookPostKernelModules, hookPostFirmware, hookPostInstall}
+
+// runHook runs the shell command configured for a hook point, if any.
+// The command sees the hook point, rootfs and overlay in OVERLAY_HOOK,
+// OVERLAY_ROOTFS and OVERLAY_DIR. A hook that fails aborts the install,
+// so a pre-install hook can veto it and a post hook can fail it.
+func (inst *Installer) runHook(ctx context.Context, name string) error {
+	command := inst.cfg.hooks[name]
+	if command == "" {
+		return nil
+	}
+
+	if inst.cfg.dryRun {
+		slog.Info("would run hook", "hook", name, "command", command)
+		return nil
+	}
+
+	slog.Info("🪝 Running hook", "hook", name, "command", command)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"OVERLAY_HOOK="+name,
+		"OVERLAY_ROOTFS="+inst.rootfsPath,
+		"OVERLAY_DIR="+inst.overlayPath,
+	)
+	// Stdout is reserved for the install summary
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook failed: %w", name, err)
+	}
+	return nil
+}
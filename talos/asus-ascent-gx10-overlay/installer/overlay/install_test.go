@@ -0,0 +1,173 @@
+package overlay
+
+import (
+	"context"
+	"debug/elf"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestMain(m *testing.M) {
+	// The emoji progress logs would drown the test output
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// testKver is the kernel the fixtures ship modules for
+const testKver = "6.1.0-talos"
+
+// testModule is an arm64 module, as the GX10 takes
+func testModule(modinfo ...string) testutil.Entry {
+	return testutil.File(string(testutil.Module(elf.EM_AARCH64, modinfo...)))
+}
+
+// testOverlay is a small overlay with a module, firmware including a
+// relative symlink, and a config file
+func testOverlay() testutil.Overlay {
+	return testutil.Overlay{
+		KernelModules: testutil.Tree{
+			testKver + "/kernel/drivers/gpu/nvidia.ko": testModule("firmware=nvidia/gsp.bin"),
+		},
+		Firmware: testutil.Tree{
+			"nvidia/gsp.bin":        testutil.File("gsp firmware"),
+			"nvidia/gsp-latest.bin": testutil.Symlink("gsp.bin"),
+		},
+		Files: testutil.Tree{
+			"etc/nvidia/app.conf": testutil.File("key=value\n"),
+		},
+	}
+}
+
+// runInstallTest installs the overlay at overlayPath into rootfs with the
+// given ExtraOptions and install flags
+func runInstallTest(t *testing.T, overlayPath, rootfs string, extra map[string]interface{}, args ...string) error {
+	t.Helper()
+	return Install(context.Background(), &Options{
+		InstallOptions: InstallOptions{MountPrefix: rootfs, ExtraOptions: extra},
+		OverlayPath:    overlayPath,
+		Args:           args,
+		Stdout:         io.Discard,
+	})
+}
+
+// newTestInstaller returns an Installer with default options copying from
+// overlayPath into rootfs
+func newTestInstaller(t testing.TB, overlayPath, rootfs string, extra map[string]interface{}) *Installer {
+	t.Helper()
+	cfg, err := parseInstallConfig(extra, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newInstaller(osFS{}, overlayPath, rootfs, extra, &OverlayConfig{}, cfg, newInstallSummary(cfg, nil))
+}
+
+// verifyTest runs verify on rootfs with the given ExtraOptions
+func verifyTest(t *testing.T, rootfs string, extra map[string]interface{}) error {
+	t.Helper()
+	return Verify(&Options{
+		InstallOptions: InstallOptions{MountPrefix: rootfs, ExtraOptions: extra},
+		Stdout:         io.Discard,
+	})
+}
+
+// readTestFile returns the contents of a rootfs file
+func readTestFile(t *testing.T, rootfs, rel string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(rootfs, filepath.FromSlash(rel)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestInstallVerify(t *testing.T) {
+	overlayPath := testOverlay().Build(t)
+	rootfs := testutil.Rootfs(t, testKver)
+
+	if err := runInstallTest(t, overlayPath, rootfs, nil); err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	if err := verifyTest(t, rootfs, nil); err != nil {
+		t.Fatalf("verify after install: %v", err)
+	}
+	if got := readTestFile(t, rootfs, "etc/nvidia/app.conf"); got != "key=value\n" {
+		t.Errorf("app.conf = %q", got)
+	}
+	if target, err := os.Readlink(filepath.Join(rootfs, "lib/firmware/nvidia/gsp-latest.bin")); err != nil || target != "gsp.bin" {
+		t.Errorf("gsp-latest.bin links to %q, %v; want gsp.bin", target, err)
+	}
+}
+
+func TestInstallUnreadableManifest(t *testing.T) {
+	overlayPath := testOverlay().Build(t)
+	rootfs := testutil.Rootfs(t, testKver)
+	path := manifestPath(rootfs, defaultStateDir)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("files: {not a list"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runInstallTest(t, overlayPath, rootfs, nil); err == nil {
+		t.Fatal("install over a corrupt manifest succeeded")
+	}
+	if _, err := os.Lstat(filepath.Join(rootfs, "etc/nvidia/app.conf")); !os.IsNotExist(err) {
+		t.Errorf("install over a corrupt manifest copied files: %v", err)
+	}
+}
+
+// shippedConfigFiles are the module config files the overlay ships, which
+// the install merges its generated entries into
+var shippedConfigFiles = testutil.Tree{
+	"etc/modprobe.d/nvidia.conf": testutil.File(`# NVIDIA kernel module configuration
+
+# Device file permissions
+options nvidia NVreg_DeviceFileUID=0
+options nvidia NVreg_DeviceFileMode=0666
+
+# Preserve video memory allocations
+options nvidia NVreg_PreserveVideoMemoryAllocations=1
+`),
+	"etc/modules-load.d/nvidia.conf": testutil.File(`# NVIDIA kernel modules to load at boot
+
+# Core NVIDIA driver
+nvidia
+
+# Modesetting support
+nvidia-modeset
+`),
+}
+
+func TestInstallMergedConfigFilesVerify(t *testing.T) {
+	fixture := testOverlay()
+	for path, entry := range shippedConfigFiles {
+		fixture.Files[path] = entry
+	}
+	overlayPath := fixture.Build(t)
+	rootfs := testutil.Rootfs(t, testKver)
+
+	// The second install finds the files already owned by the first
+	for i := range 2 {
+		if err := runInstallTest(t, overlayPath, rootfs, nil); err != nil {
+			t.Fatalf("install %d: %v", i+1, err)
+		}
+		if err := verifyTest(t, rootfs, nil); err != nil {
+			t.Fatalf("verify after install %d: %v", i+1, err)
+		}
+	}
+
+	modprobe := readTestFile(t, rootfs, modprobeFile)
+	for _, line := range []string{"options nvidia NVreg_DeviceFileMode=0666", "options nvidia NVreg_PreserveVideoMemoryAllocations=1", ""} {
+		if !slices.Contains(strings.Split(modprobe, "\n"), line) {
+			t.Errorf("%s lost shipped line %q:\n%s", modprobeFile, line, modprobe)
+		}
+	}
+}
@@ -0,0 +1,925 @@
+// Package overlay implements the Talos overlay installer for ASUS Ascent
+// GX10
+//
+// The installer adds NVIDIA GPU support to Talos Linux by:
+// - Installing NVIDIA kernel modules
+// - Installing GPU firmware
+// - Reporting boot parameters through get-options
+// - Setting up module loading
+//
+// Each installer command is an exported function taking the Options of the
+// run, so imager tooling can embed the install rather than run the binary.
+package overlay
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"go.yaml.in/yaml/v4"
+)
+
+// Version is the overlay version recorded in install manifests and the
+// SBOM. The installer binary sets it from its build metadata.
+var Version = "dev"
+
+// InstallOptions matches the structure from Talos overlay package
+type InstallOptions struct {
+	InstallDisk   string                 `yaml:"installDisk"`
+	MountPrefix   string                 `yaml:"mountPrefix"`
+	ArtifactsPath string                 `yaml:"artifactsPath"`
+	ExtraOptions  map[string]interface{} `yaml:"extraOptions,omitempty"`
+}
+
+// checkMountPrefix fails unless mountPrefix is an absolute path. An empty
+// one would have every rootfs path resolve against the working directory,
+// writing into the imager's own filesystem.
+func checkMountPrefix(mountPrefix string) error {
+	switch {
+	case mountPrefix == "":
+		return errors.New("mountPrefix is empty")
+	case !filepath.IsAbs(mountPrefix):
+		return fmt.Errorf("mountPrefix %q is not an absolute path", mountPrefix)
+	}
+	return nil
+}
+
+// installRoot returns the directory an install's destinations, manifest
+// included, are rooted in: the rootfs at mountPrefix, or
+// ExtraOptions["targetPrefix"] under it when the payload is staged for a
+// later merge
+func installRoot(fsys filesystem, mountPrefix string, extra map[string]interface{}) (string, error) {
+	if err := checkMountPrefix(mountPrefix); err != nil {
+		return "", classify(ErrInvalidOptions, err)
+	}
+	prefix, err := targetPrefixOption(extra)
+	if err != nil || prefix == "" {
+		return mountPrefix, classify(ErrInvalidOptions, err)
+	}
+
+	// The prefix is checked lexically when parsed; a symlink along it could
+	// still lead out of the rootfs
+	dir := mountPrefix
+	for _, name := range strings.Split(prefix, "/") {
+		dir = filepath.Join(dir, name)
+		info, err := fsys.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", classify(ErrInvalidOptions, fmt.Errorf("extraOptions.targetPrefix: %s is a symlink, which could lead out of the rootfs", dir))
+		}
+		if !info.IsDir() {
+			return "", classify(ErrInvalidOptions, fmt.Errorf("extraOptions.targetPrefix: %s is not a directory", dir))
+		}
+	}
+	return filepath.Join(mountPrefix, filepath.FromSlash(prefix)), nil
+}
+
+// Options describe a run of one of the installer's commands
+type Options struct {
+	InstallOptions
+
+	// OverlayPath is the directory the overlay was unpacked into
+	OverlayPath string
+
+	// Args are the command's flags. Install flags override ExtraOptions.
+	Args []string
+
+	// Stdout receives the command's output, os.Stdout when nil. Logs go
+	// to the default slog logger; see SetupLogging.
+	Stdout io.Writer
+
+	// Progress, if set, is told about an install's phases and copies
+	Progress ProgressReporter
+}
+
+func (options *Options) stdout() io.Writer {
+	if options.Stdout == nil {
+		return os.Stdout
+	}
+	return options.Stdout
+}
+
+// GetOptions reports the overlay name and the kernel args Talos should add,
+// along with the machine config the overlay needs at runtime. Consumers
+// that only read kernelArgs can ignore machineConfig. Both follow the
+// profile named by a -profile argument or ExtraOptions["profile"], and the
+// kernel args an ExtraOptions["kernelArgs"] override. These kernelArgs are
+// the only source of the command line additions; install writes none to
+// the rootfs.
+func GetOptions(options *Options) error {
+	flags := flag.NewFlagSet("get-options", flag.ContinueOnError)
+	profile := flags.String("profile", "", "report the options of this profile")
+	if err := flags.Parse(options.Args); err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+	if *profile == "" {
+		var err error
+		if *profile, err = stringOption(options.ExtraOptions, "profile", ""); err != nil {
+			return classify(ErrInvalidOptions, err)
+		}
+	}
+
+	fsys := osFS{}
+	config, err := loadOverlayConfig(fsys, options.OverlayPath)
+	if err != nil {
+		return err
+	}
+	if _, config, err = applyProfile(fsys, options.OverlayPath, config, *profile); err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+
+	args, err := kernelArgs(options.ExtraOptions, config)
+	if err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+
+	patch, err := machineConfigPatch(config)
+	if err != nil {
+		return err
+	}
+
+	return yaml.NewEncoder(options.stdout()).Encode(map[string]interface{}{
+		"name":          Name,
+		"kernelArgs":    args,
+		"machineConfig": patch,
+	})
+}
+
+// Install installs the overlay at options.OverlayPath into the rootfs at
+// options.MountPrefix. Cancelling ctx stops the install between files.
+func Install(ctx context.Context, options *Options) error {
+	if err := checkMountPrefix(options.MountPrefix); err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+
+	cfg, err := parseInstallConfig(options.ExtraOptions, options.Args)
+	if err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+
+	// CI jobs need the install bounded
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		defer cancel()
+	}
+
+	summary := newInstallSummary(cfg, options.Progress)
+	err = runInstall(ctx, osFS{}, options, cfg, summary)
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("install timed out after %s: %w", cfg.timeout, err)
+	}
+
+	// The summary goes out even when the install failed part way
+	if cfg.outputFormat == "json" {
+		if werr := summary.write(options.stdout(), err); werr != nil && err == nil {
+			err = fmt.Errorf("failed to write summary: %w", werr)
+		}
+	} else {
+		summary.logTimings()
+	}
+	return err
+}
+
+// runInstall performs the install described by options and cfg, reading
+// the overlay and writing the rootfs through fsys
+func runInstall(ctx context.Context, fsys filesystem, options *Options, cfg *installConfig, summary *installSummary) error {
+	// MountPrefix is the rootfs path; destinations go under rootfsPath,
+	// which differs when they are staged below a targetPrefix
+	mountPrefix := options.MountPrefix
+	rootfsPath, err := installRoot(fsys, mountPrefix, options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+
+	if err := checkInstallDisk(options.InstallDisk, mountPrefix); err != nil {
+		return err
+	}
+	if err := checkWritable(mountPrefix); err != nil {
+		return err
+	}
+
+	overlayPath := options.OverlayPath
+
+	// A pulled artifact replaces the contents shipped next to the installer
+	if cfg.artifactRef != "" {
+		path, cleanup, err := fetchArtifact(ctx, cfg.artifactRef, cfg.artifactDigest, cfg.artifactPlainHTTP)
+		if err != nil {
+			return fmt.Errorf("failed to fetch artifact %s: %w", cfg.artifactRef, err)
+		}
+		defer cleanup()
+		overlayPath = path
+	}
+
+	// Nothing is read from the overlay, let alone written, until it checks out
+	if cfg.verifyKey != "" {
+		if err := verifyArtifacts(fsys, overlayPath, cfg.profile, cfg.verifyKey); err != nil {
+			return classify(ErrVerification, err)
+		}
+	}
+
+	overlayConfig, err := loadOverlayConfig(fsys, overlayPath)
+	if err != nil {
+		return err
+	}
+
+	// A profile's directory stands in for the overlay from here on
+	if overlayPath, overlayConfig, err = applyProfile(fsys, overlayPath, overlayConfig, cfg.profile); err != nil {
+		return err
+	}
+
+	slog.Info("Installing ASUS Ascent GX10 overlay...", "version", Version, "overlay", overlayPath, "rootfs", rootfsPath)
+	if cfg.dryRun {
+		slog.Info("Dry run: no changes will be made")
+	}
+
+	// Corrupted inputs are caught before anything is copied from them
+	if err := verifySourceChecksums(fsys, overlayPath, overlayConfig); err != nil {
+		return classify(ErrVerification, err)
+	}
+
+	// The first write to the rootfs, now the overlay checks out
+	if !cfg.dryRun {
+		if err := probeWritable(fsys, mountPrefix); err != nil {
+			return err
+		}
+	}
+
+	// A driver that doesn't match its firmware is caught before copying
+	expected := cfg.expectedDriverVersion
+	if expected == "" {
+		expected = overlayConfig.DriverVersion
+	}
+	if summary.DriverVersion, err = driverVersion(fsys, overlayPath, overlayConfig, expected); err != nil {
+		return err
+	}
+	if err := checkModuleArch(fsys, overlayPath, overlayConfig, targetArch(fsys, cfg, mountPrefix)); err != nil {
+		return err
+	}
+
+	if cfg.skipSpaceCheck {
+		slog.Warn("⚠️  Skipping disk space check")
+	} else if err := checkDiskSpace(fsys, artifactSources(fsys, overlayPath, overlayConfig), mountPrefix); err != nil {
+		return err
+	}
+
+	inst := newInstaller(fsys, overlayPath, rootfsPath, options.ExtraOptions, overlayConfig, cfg, summary)
+	inst.mountPrefix = mountPrefix
+	inst.installDisk = options.InstallDisk
+
+	// An earlier install's manifest tells us which existing paths are ours.
+	// Files of another version would linger among ours, so that install
+	// is either removed first or left alone.
+	// A manifest that can't be read must not pass for a fresh rootfs, which
+	// would forget which files are ours
+	previous, err := readManifest(fsys, rootfsPath, cfg.stateDir)
+	switch {
+	case err == nil:
+		inst.manifest.previous = previous
+	case !errors.Is(err, ErrNotInstalled):
+		return err
+	}
+	if cfg.since != "" {
+		if inst.since, err = readManifestFile(fsys, cfg.since); err != nil {
+			return classify(ErrInvalidOptions, err)
+		}
+		inst.sinceFiles = make(map[string]ManifestEntry, len(inst.since.Files))
+		for _, entry := range inst.since.Files {
+			inst.sinceFiles[entry.Path] = entry
+		}
+	}
+	replace := previous != nil && previous.Version != Version
+	if replace && !cfg.force {
+		return fmt.Errorf("rootfs has overlay version %s installed, not %s; set extraOptions.force to replace it", manifestVersion(previous), Version)
+	}
+
+	if err := inst.runHook(ctx, hookPreInstall); err != nil {
+		return err
+	}
+
+	if err := inst.clearBackups(); err != nil {
+		return err
+	}
+
+	if replace {
+		if cfg.dryRun {
+			slog.Info("♻️  Would remove installed overlay version", "version", manifestVersion(previous), "files", len(previous.Files))
+		} else {
+			slog.Info("♻️  Removing installed overlay version", "version", manifestVersion(previous), "files", len(previous.Files))
+			if err := removeInstalled(inst.fs, rootfsPath, cfg.stateDir, previous, inst.backup); err != nil {
+				return fmt.Errorf("failed to remove overlay version %s: %w", manifestVersion(previous), err)
+			}
+		}
+	}
+
+	if err := inst.run(ctx); err != nil {
+		if isNoSpace(err) && !cfg.dryRun {
+			err = inst.noSpaceError(err)
+			if cfg.cleanupOnNoSpace {
+				if cerr := inst.cleanupWritten(); cerr != nil {
+					return errors.Join(err, cerr)
+				}
+				return err
+			}
+		}
+		// Rollback needs to know what a failed install wrote and replaced
+		if cfg.enableBackup && !cfg.dryRun {
+			if merr := inst.finishManifest(); merr != nil {
+				slog.Warn("⚠️  Failed to record partial install", "error", merr)
+			}
+		}
+		return err
+	}
+
+	if cfg.dryRun {
+		if cfg.diff {
+			if err := inst.writeDiff(options.stdout()); err != nil {
+				return fmt.Errorf("failed to write diff: %w", err)
+			}
+		}
+		slog.Log(ctx, levelResult, "✅ Dry run completed, no changes made")
+		return nil
+	}
+
+	if err := inst.finishManifest(); err != nil {
+		return err
+	}
+	if cfg.incremental != "" {
+		slog.Info("♻️  Incremental install", "copied", summary.Copied, "unchanged", summary.Unchanged)
+	}
+	if summary.DedupedBytes > 0 {
+		slog.Info("🔗 Deduplicated files", "savedBytes", summary.DedupedBytes)
+	}
+	if summary.StrippedBytes > 0 {
+		slog.Info("🪶 Stripped module debug sections", "savedBytes", summary.StrippedBytes)
+	}
+
+	if err := inst.runHook(ctx, hookPostInstall); err != nil {
+		return err
+	}
+
+	slog.Log(ctx, levelResult, "✅ Overlay installation completed successfully")
+	return nil
+}
+
+// finishManifest writes the manifest of this install to the rootfs
+func (inst *Installer) finishManifest() error {
+	// Directories created by an earlier install are still ours to remove
+	manifest := inst.manifest
+	manifest.mergeDirectories()
+	manifest.dropRemoved()
+
+	path := manifestPath(inst.rootfsPath, inst.cfg.stateDir)
+	if err := inst.backup(path); err != nil {
+		return err
+	}
+
+	// The manifest must not list files that an unclean shutdown could lose
+	if err := inst.syncDirs(); err != nil {
+		return err
+	}
+	if err := writeManifest(inst.fs, inst.rootfsPath, inst.cfg.stateDir, manifest); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	inst.markDirty(filepath.Dir(path))
+	if err := inst.syncDirs(); err != nil {
+		return err
+	}
+	slog.Info("📝 Recorded install manifest", "files", len(manifest.Files), "path", path)
+	return nil
+}
+
+// Installer copies an overlay's artifacts into a rootfs, recording what it
+// installed in the manifest. All file access goes through fs.
+type Installer struct {
+	fs          filesystem
+	overlayPath string
+	rootfsPath  string
+	extra       map[string]interface{}
+	config      *OverlayConfig
+	cfg         *installConfig
+	manifest    *Manifest
+	summary     *installSummary
+
+	// mountPrefix is the rootfs itself, which rootfsPath is below when
+	// staging. The target kernel is detected there.
+	mountPrefix string
+
+	// installDisk holds the boot assets the target kernel is cross-checked
+	// against, if set
+	installDisk string
+
+	// kver is the target kernel, once targetKernelVersion has found it
+	kver string
+
+	// since is the manifest ExtraOptions["since"] syncs from, with its
+	// files by path
+	since      *Manifest
+	sinceFiles map[string]ManifestEntry
+
+	// firmwareDir is where the firmware phase installs to, relative to the
+	// rootfs: cfg.firmwareDir, or its updates/<kver> directory
+	firmwareDir string
+
+	// copies maps the contents of the source files queued for copying so
+	// far, across copies, to their destinations, for ExtraOptions["dedupe"].
+	// Only the walk queueing copies touches it.
+	copies map[contentID]string
+
+	// depmod regenerates the module dependency files for a kernel version
+	depmod func(ctx context.Context, fsys filesystem, rootfsPath, modulesDir, kver string) error
+
+	// dirty holds the directories fsync mode still has to flush
+	dirtyMu sync.Mutex
+	dirty   map[string]bool
+
+	// written lists what this run wrote to the rootfs, in order, so a run
+	// that fills the disk can be undone; see cleanupWritten
+	writtenMu sync.Mutex
+	written   []writtenPath
+
+	// buffers holds copy buffers of cfg.copyBuffer bytes, shared by the
+	// copy workers so each file doesn't allocate its own
+	buffers sync.Pool
+}
+
+// newInstaller returns an Installer working on fsys
+func newInstaller(fsys filesystem, overlayPath, rootfsPath string, extra map[string]interface{}, config *OverlayConfig, cfg *installConfig, summary *installSummary) *Installer {
+	inst := &Installer{
+		fs:          fsys,
+		overlayPath: overlayPath,
+		rootfsPath:  rootfsPath,
+		mountPrefix: rootfsPath,
+		extra:       extra,
+		config:      config,
+		cfg:         cfg,
+		manifest:    newManifest(rootfsPath),
+		summary:     summary,
+		firmwareDir: cfg.firmwareDir,
+		depmod:      runDepmod,
+	}
+	inst.manifest.BackupEnabled = cfg.enableBackup && !cfg.dryRun
+	inst.buffers.New = func() any {
+		buf := make([]byte, cfg.copyBuffer)
+		return &buf
+	}
+	return inst
+}
+
+// run copies the artifacts and writes the generated config files
+func (inst *Installer) run(ctx context.Context) error {
+	// An overlay config with steps declares its own layout
+	var err error
+	if len(inst.config.Steps) > 0 {
+		err = inst.installSteps(ctx)
+	} else {
+		err = inst.installLayout(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Modules and firmware may come from different steps, so this waits
+	// for the whole layout
+	if err := inst.summary.phase("firmware-check", inst.manifest, inst.checkFirmware); err != nil {
+		return fmt.Errorf("failed to check module firmware: %w", err)
+	}
+	if err := inst.summary.phase("firmware-coverage", inst.manifest, inst.reportFirmwareCoverage); err != nil {
+		return fmt.Errorf("failed to report firmware coverage: %w", err)
+	}
+	if err := inst.summary.phase("module-compression", inst.manifest, func() error { return inst.checkModuleCompression(ctx) }); err != nil {
+		return err
+	}
+	if err := inst.summary.phase("module-stripping", inst.manifest, func() error { return inst.stripModules(ctx) }); err != nil {
+		return err
+	}
+	if err := inst.summary.phase("module-signing", inst.manifest, func() error { return inst.signModules(ctx) }); err != nil {
+		return err
+	}
+	if err := inst.summary.phase("module-signatures", inst.manifest, inst.checkModuleSignatures); err != nil {
+		return err
+	}
+	if err := inst.summary.phase("modules-dep", inst.manifest, inst.checkModuleDeps); err != nil {
+		return err
+	}
+
+	// Kernel arguments come from get-options; only an earlier install's
+	// copy in the rootfs is cleaned up
+	if err := inst.summary.phase("boot-parameters", inst.manifest, inst.removeBootParameters); err != nil {
+		return fmt.Errorf("failed to remove boot parameters: %w", err)
+	}
+
+	// Set up module loading
+	if err := inst.summary.phase("modules-load", inst.manifest, inst.installModulesLoad); err != nil {
+		return fmt.Errorf("failed to install modules-load.d config: %w", err)
+	}
+
+	if err := inst.summary.phase("modprobe-options", inst.manifest, inst.installModprobeOptions); err != nil {
+		return fmt.Errorf("failed to install modprobe.d config: %w", err)
+	}
+
+	if err := inst.summary.phase("udev-rules", inst.manifest, inst.installUdevRules); err != nil {
+		return fmt.Errorf("failed to install udev rules: %w", err)
+	}
+
+	if err := inst.summary.phase("container-toolkit", inst.manifest, inst.installContainerToolkit); err != nil {
+		return fmt.Errorf("failed to install container toolkit config: %w", err)
+	}
+	if err := inst.summary.phase("cdi-spec", inst.manifest, inst.installCDISpec); err != nil {
+		return fmt.Errorf("failed to write CDI spec: %w", err)
+	}
+
+	if err := inst.summary.phase("stale-files", inst.manifest, inst.removeStale); err != nil {
+		return fmt.Errorf("failed to remove stale files: %w", err)
+	}
+
+	// The inventory covers everything above, so it comes last
+	if err := inst.summary.phase("sbom", inst.manifest, inst.installSBOM); err != nil {
+		return fmt.Errorf("failed to write SBOM: %w", err)
+	}
+	return nil
+}
+
+// overlayEntries are what an overlay directory holds at least one of
+var overlayEntries = []string{"artifacts", "install", "files", profilesDir, overlayConfigFile}
+
+// CheckOverlayPath fails unless path is a directory laid out like an
+// overlay, for overlay paths given explicitly rather than found next to
+// the installer
+func CheckOverlayPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("overlay path: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("overlay path %s is not a directory", path)
+	}
+	for _, entry := range overlayEntries {
+		if _, err := os.Stat(filepath.Join(path, entry)); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("overlay path %s holds none of %s", path, strings.Join(overlayEntries, ", "))
+}
+
+// artifactDir locates an artifacts directory in the overlay.
+// Both artifacts/<elem> and <elem> are checked for backward compatibility,
+// as is an archive of either; see artifactArchive.
+func artifactDir(fsys filesystem, overlayPath string, elem ...string) string {
+	dir := filepath.Join(append([]string{overlayPath, "artifacts"}, elem...)...)
+	if _, err := fsys.Stat(dir); os.IsNotExist(err) {
+		if _, ok := artifactArchive(fsys, dir); ok {
+			return dir
+		}
+		// Fallback to the path directly under the overlay
+		dir = filepath.Join(append([]string{overlayPath}, elem...)...)
+	}
+	return dir
+}
+
+// kernelModulesSource returns the overlay's kernel-modules directory
+func kernelModulesSource(fsys filesystem, overlayPath string) string {
+	return artifactDir(fsys, overlayPath, "install", "kernel-modules")
+}
+
+// firmwareSource returns the overlay's firmware directory
+func firmwareSource(fsys filesystem, overlayPath string) string {
+	return artifactDir(fsys, overlayPath, "install", "firmware")
+}
+
+// configFilesSource returns the overlay's config files directory
+func configFilesSource(fsys filesystem, overlayPath string) string {
+	return artifactDir(fsys, overlayPath, "files")
+}
+
+// installLayout copies the built-in overlay layout: kernel modules,
+// firmware and config files
+func (inst *Installer) installLayout(ctx context.Context) error {
+	// Install kernel modules
+	if err := inst.summary.phase("kernel-modules", inst.manifest, func() error {
+		return inst.installKernelModules(ctx)
+	}); err != nil {
+		return fmt.Errorf("failed to install kernel modules: %w", err)
+	}
+	if err := inst.runHook(ctx, hookPostKernelModules); err != nil {
+		return err
+	}
+
+	// Install firmware
+	if err := inst.summary.phase("firmware", inst.manifest, func() error {
+		return inst.installFirmware(ctx)
+	}); err != nil {
+		return fmt.Errorf("failed to install firmware: %w", err)
+	}
+	if err := inst.runHook(ctx, hookPostFirmware); err != nil {
+		return err
+	}
+
+	// Install configuration files
+	if err := inst.summary.phase("config-files", inst.manifest, func() error {
+		return inst.tolerateFailures("config-files", inst.installConfigFiles(ctx))
+	}); err != nil {
+		return fmt.Errorf("failed to install config files: %w", err)
+	}
+	return nil
+}
+
+// requireArtifactDir reports whether an artifacts directory exists. Unless
+// requireArtifacts is off, a missing directory is an error, since an overlay
+// without modules or firmware is a packaging bug. A directory that is
+// present but holds no files always is: that is a broken build artifact
+// rather than one left out on purpose.
+func (inst *Installer) requireArtifactDir(dir, what string) (bool, error) {
+	if _, err := inst.fs.Stat(dir); os.IsNotExist(err) {
+		if inst.cfg.requireArtifacts {
+			return false, classify(ErrMissingArtifacts, fmt.Errorf("%s directory missing: %s", what, dir))
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := inst.requireFiles(dir, what); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// requireFiles fails unless dir holds at least one file below it
+func (inst *Installer) requireFiles(dir, what string) error {
+	empty := true
+	err := inst.fs.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			empty = false
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if empty {
+		return classify(ErrMissingArtifacts, fmt.Errorf("%s directory present but empty: %s", what, dir))
+	}
+	return nil
+}
+
+// installKernelModules installs NVIDIA kernel modules
+func (inst *Installer) installKernelModules(ctx context.Context) error {
+	sourceDir := kernelModulesSource(inst.fs, inst.overlayPath)
+	targetDir := filepath.Join(inst.rootfsPath, filepath.FromSlash(inst.cfg.modulesDir))
+
+	if archive, ok := artifactArchive(inst.fs, sourceDir); ok {
+		return inst.installKernelModulesArchive(ctx, archive, targetDir)
+	}
+
+	if present, err := inst.requireArtifactDir(sourceDir, "kernel modules"); err != nil {
+		return err
+	} else if !present {
+		slog.Warn("⚠️  Kernel modules directory not found, skipping", "phase", "kernel-modules", "src", sourceDir)
+		inst.summary.skip(sourceDir)
+		return nil
+	}
+
+	versions, err := kernelVersions(inst.fs, sourceDir)
+	if err != nil {
+		return err
+	}
+
+	kver, err := inst.targetKernelVersion()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(versions, kver) {
+		return classify(ErrMissingArtifacts, fmt.Errorf("no kernel modules for target kernel %s, overlay has: %s", kver, strings.Join(versions, ", ")))
+	}
+	for _, v := range versions {
+		if v != kver {
+			slog.Info("⏭️  Skipping modules for other kernel", "phase", "kernel-modules", "kver", v, "target", kver)
+		}
+	}
+
+	sourceDir = filepath.Join(sourceDir, kver)
+	targetDir = filepath.Join(targetDir, kver)
+	if err := inst.requireFiles(sourceDir, "kernel modules"); err != nil {
+		return err
+	}
+
+	slog.Info("📦 Installing kernel modules", "phase", "kernel-modules", "kver", kver, "src", sourceDir, "dst", targetDir)
+	if err := inst.copyDirectory(ctx, sourceDir, targetDir, 0, nil); err != nil {
+		return err
+	}
+
+	return inst.regenerateModuleDeps(ctx, kver)
+}
+
+// targetKernelVersion returns the kernel modules are installed for:
+// ExtraOptions["kernelVersion"], else the kernel detected in the rootfs or
+// on the install disk. A rootfs kernel the disk doesn't boot is warned
+// about, as its modules would never load, and so is a kernel without a
+// module tree in the rootfs, or it fails the install with
+// ExtraOptions["requireInstalledKernel"].
+func (inst *Installer) targetKernelVersion() (string, error) {
+	if inst.kver != "" {
+		return inst.kver, nil
+	}
+	kver := inst.cfg.kernelVersion
+	if kver == "" {
+		var bootKvers []string
+		var err error
+		if kver, bootKvers, err = resolveKernelVersion(inst.fs, inst.kernelModulesDir(), inst.installDisk); err != nil {
+			return "", err
+		}
+		if len(bootKvers) > 0 && !slices.Contains(bootKvers, kver) {
+			slog.Warn("⚠️  Rootfs kernel is not one the install disk boots", "kver", kver, "boot", strings.Join(bootKvers, ", "))
+		}
+	}
+
+	installed, err := installedKernels(inst.fs, inst.kernelModulesDir())
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(installed, kver) {
+		known := "none"
+		if len(installed) > 0 {
+			known = strings.Join(installed, ", ")
+		}
+		if inst.cfg.requireInstalledKernel {
+			return "", fmt.Errorf("kernel %s is not installed in the rootfs, which has kernels: %s; its modules would never be loaded", kver, known)
+		}
+		slog.Warn("⚠️  Installing modules for a kernel the rootfs doesn't have, they will never be loaded", "kver", kver, "rootfsKernels", known)
+	}
+	inst.kver = kver
+	return kver, nil
+}
+
+// kernelModulesDir is where the rootfs's own kernel keeps its modules,
+// which a staged install doesn't have under its targetPrefix
+func (inst *Installer) kernelModulesDir() string {
+	return filepath.Join(inst.mountPrefix, filepath.FromSlash(inst.cfg.modulesDir))
+}
+
+// installKernelModulesArchive installs the target kernel's modules from a
+// kernel-modules archive, which holds a <kver> directory per kernel
+func (inst *Installer) installKernelModulesArchive(ctx context.Context, archive, targetDir string) error {
+	kver, err := inst.targetKernelVersion()
+	if err != nil {
+		return err
+	}
+
+	targetDir = filepath.Join(targetDir, kver)
+	slog.Info("📦 Installing kernel modules", "phase", "kernel-modules", "kver", kver, "src", archive, "dst", targetDir)
+	matched, err := inst.copyArchive(ctx, archive, targetDir, kver, 0, nil)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return classify(ErrMissingArtifacts, fmt.Errorf("no kernel modules for target kernel %s in %s", kver, archive))
+	}
+	return inst.regenerateModuleDeps(ctx, kver)
+}
+
+// regenerateModuleDeps runs depmod for kver, since without modules.dep the
+// modules can't be loaded at boot
+func (inst *Installer) regenerateModuleDeps(ctx context.Context, kver string) error {
+	if inst.cfg.dryRun {
+		slog.Info("🔗 Would regenerate module dependencies", "phase", "kernel-modules", "kver", kver)
+		return nil
+	}
+
+	// The indexes depmod writes are part of what this run wrote
+	kverDir := filepath.Join(inst.rootfsPath, filepath.FromSlash(inst.cfg.modulesDir), kver)
+	before := make(map[string]bool)
+	for _, name := range moduleIndexes(inst.fs, kverDir) {
+		before[name] = true
+	}
+	err := inst.depmod(ctx, inst.fs, inst.rootfsPath, inst.cfg.modulesDir, kver)
+	for _, name := range moduleIndexes(inst.fs, kverDir) {
+		path := filepath.Join(kverDir, name)
+		if info, err := inst.fs.Lstat(path); err == nil {
+			inst.wrote(path, info.Size(), before[name])
+		}
+	}
+	return err
+}
+
+// moduleIndexes lists the modules.* files in a kernel's modules directory
+func moduleIndexes(fsys filesystem, kverDir string) []string {
+	entries, _ := fsys.ReadDir(kverDir)
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "modules.") && !entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// moduleKernelVersion returns the kernel an installed module, given by its
+// manifest path, belongs to
+func (inst *Installer) moduleKernelVersion(rel string) (string, bool) {
+	rest, ok := strings.CutPrefix(rel, inst.cfg.modulesDir+"/")
+	if !ok || !isKernelModule(rest) {
+		return "", false
+	}
+	return strings.SplitN(rest, "/", 2)[0], true
+}
+
+// installFirmware installs GPU firmware blobs, into the target kernel's
+// updates directory with ExtraOptions["firmwareUpdatesDir"]
+func (inst *Installer) installFirmware(ctx context.Context) error {
+	sourceDir := firmwareSource(inst.fs, inst.overlayPath)
+	if inst.cfg.firmwareUpdates {
+		kver, err := inst.targetKernelVersion()
+		if err != nil {
+			return err
+		}
+		// A kernelVersion override could otherwise lead anywhere
+		if !filepath.IsLocal(kver) || strings.ContainsAny(kver, `/\`) {
+			return fmt.Errorf("firmware updates directory for kernel %q is not inside the rootfs", kver)
+		}
+		inst.firmwareDir = path.Join(inst.cfg.firmwareDir, firmwareUpdatesDir, kver)
+	}
+	targetDir := filepath.Join(inst.rootfsPath, filepath.FromSlash(inst.firmwareDir))
+
+	// The kernel's directory is there even when the overlay ships no firmware
+	if inst.cfg.firmwareUpdates && !inst.cfg.dryRun {
+		if _, err := inst.mkdirAll(targetDir, inst.cfg.dirMode); err != nil {
+			return err
+		}
+	}
+
+	if archive, ok := artifactArchive(inst.fs, sourceDir); ok {
+		slog.Info("📦 Installing firmware", "phase", "firmware", "src", archive, "dst", targetDir)
+		_, err := inst.copyArchive(ctx, archive, targetDir, "", 0, inst.cfg.firmwareInclude)
+		return err
+	}
+
+	if present, err := inst.requireArtifactDir(sourceDir, "firmware"); err != nil {
+		return err
+	} else if !present {
+		slog.Warn("⚠️  Firmware directory not found, skipping", "phase", "firmware", "src", sourceDir)
+		inst.summary.skip(sourceDir)
+		return nil
+	}
+
+	slog.Info("📦 Installing firmware", "phase", "firmware", "src", sourceDir, "dst", targetDir)
+	return inst.copyDirectory(ctx, sourceDir, targetDir, 0, inst.cfg.firmwareInclude)
+}
+
+// tolerateFailures downgrades the per-file failures err aggregates to
+// warnings recorded in the summary when ExtraOptions["keepGoing"] is set,
+// for phases whose files a node can boot without. Errors that stop the
+// whole copy, like a full disk or cancellation, still fail it.
+func (inst *Installer) tolerateFailures(phase string, err error) error {
+	if err == nil || !inst.cfg.keepGoing || isFatal(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	// Only the failures copyDirectory and copyArchive collect are per file
+	var failures fileFailures
+	if !errors.As(err, &failures) {
+		return err
+	}
+	for _, failure := range failures {
+		slog.Warn("⚠️  Skipping file that failed to copy", "phase", phase, "error", failure)
+		inst.summary.warn(failure.Error())
+	}
+	return nil
+}
+
+// installConfigFiles installs configuration files
+func (inst *Installer) installConfigFiles(ctx context.Context) error {
+	filesDir := configFilesSource(inst.fs, inst.overlayPath)
+
+	if archive, ok := artifactArchive(inst.fs, filesDir); ok {
+		slog.Info("📦 Installing config files", "phase", "config-files", "src", archive, "dst", inst.rootfsPath)
+		_, err := inst.copyArchive(ctx, archive, inst.rootfsPath, "", 0, nil)
+		return err
+	}
+
+	if _, err := inst.fs.Stat(filesDir); os.IsNotExist(err) {
+		slog.Warn("⚠️  Config files directory not found, skipping", "phase", "config-files", "src", filesDir)
+		inst.summary.skip(filesDir)
+		return nil
+	}
+
+	slog.Info("📦 Installing config files", "phase", "config-files", "src", filesDir, "dst", inst.rootfsPath)
+	return inst.copyDirectory(ctx, filesDir, inst.rootfsPath, 0, nil)
+}
@@ -0,0 +1,136 @@
+package overlay
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// artifact is an overlay file and where an install puts it
+type artifact struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Size   int64  `json:"size"`
+}
+
+// ListArtifacts prints every file the overlay would install with its size
+// and target path. Only options.OverlayPath and options.Args are read; the
+// rootfs defaults to /.
+func ListArtifacts(options *Options) error {
+	flags := flag.NewFlagSet("list-artifacts", flag.ContinueOnError)
+	output := flags.String("output", "text", "output format, text or json")
+	rootfs := flags.String("rootfs", "/", "rootfs the target paths are shown in")
+	profile := flags.String("profile", "", "list the artifacts of this profile")
+	if err := flags.Parse(options.Args); err != nil {
+		return err
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("invalid output format %q, expected text or json", *output)
+	}
+
+	overlayPath := options.OverlayPath
+	fsys := osFS{}
+	config, err := loadOverlayConfig(fsys, overlayPath)
+	if err != nil {
+		return err
+	}
+	root, config, err := applyProfile(fsys, overlayPath, config, *profile)
+	if err != nil {
+		return err
+	}
+
+	artifacts, err := overlayArtifacts(fsys, root, config, *rootfs)
+	if err != nil {
+		return err
+	}
+
+	if *output == "json" {
+		enc := json.NewEncoder(options.stdout())
+		enc.SetIndent("", "  ")
+		return enc.Encode(artifacts)
+	}
+	for _, a := range artifacts {
+		fmt.Fprintf(options.stdout(), "%d\t%s\t%s\n", a.Size, a.Target, a.Source)
+	}
+	return nil
+}
+
+// overlayArtifacts walks the overlay's sources and maps each file to its
+// target under rootfsPath. Kernel modules are listed for every kernel the
+// overlay ships, although an install only copies the running one.
+func overlayArtifacts(fsys filesystem, overlayPath string, config *OverlayConfig, rootfsPath string) ([]artifact, error) {
+	var dirs [][2]string
+	if len(config.Steps) == 0 {
+		dirs = [][2]string{
+			{kernelModulesSource(fsys, overlayPath), filepath.Join(rootfsPath, defaultModulesDir)},
+			{firmwareSource(fsys, overlayPath), filepath.Join(rootfsPath, defaultFirmwareDir)},
+			{configFilesSource(fsys, overlayPath), rootfsPath},
+		}
+	} else {
+		for _, step := range config.Steps {
+			dirs = append(dirs, [2]string{filepath.Join(overlayPath, step.From), filepath.Join(rootfsPath, strings.TrimPrefix(step.To, "/"))})
+		}
+	}
+
+	artifacts := []artifact{}
+	for _, dir := range dirs {
+		src, dst := dir[0], dir[1]
+		if archive, ok := artifactArchive(fsys, src); ok {
+			source, err := filepath.Rel(overlayPath, archive)
+			if err != nil {
+				return nil, err
+			}
+			err = walkArchive(fsys, archive, nil, func(hdr *tar.Header, _ io.Reader) error {
+				if hdr.Typeflag == tar.TypeDir {
+					return nil
+				}
+				name, _ := archiveEntryName(hdr.Name, "")
+				artifacts = append(artifacts, artifact{
+					Source: archiveMember(filepath.ToSlash(source), name),
+					Target: filepath.Join(dst, filepath.FromSlash(name)),
+					Size:   hdr.Size,
+				})
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to list %s: %w", archive, err)
+			}
+			continue
+		}
+		err := fsys.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if path == src && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(src, path)
+			if err != nil {
+				return err
+			}
+			source, err := filepath.Rel(overlayPath, path)
+			if err != nil {
+				return err
+			}
+			artifacts = append(artifacts, artifact{
+				Source: filepath.ToSlash(source),
+				Target: filepath.Join(dst, rel),
+				Size:   info.Size(),
+			})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", src, err)
+		}
+	}
+	return artifacts, nil
+}
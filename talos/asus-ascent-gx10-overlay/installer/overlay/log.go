@@ -0,0 +1,194 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variables that configure logging when ExtraOptions don't
+const (
+	logLevelEnv  = "OVERLAY_LOG_LEVEL"
+	logFormatEnv = "OVERLAY_LOG_FORMAT"
+)
+
+// levelResult is the level of a command's closing outcome line. It is above
+// every threshold, so the line prints however quiet the logs are.
+const levelResult = slog.LevelError + 4
+
+// verbosityLevels maps ExtraOptions["verbosity"] to the log level it sets:
+// quiet logs errors only, normal each phase, verbose every file
+var verbosityLevels = map[string]string{
+	"quiet":   "error",
+	"normal":  "info",
+	"verbose": "debug",
+}
+
+// SetupLogging installs the default slog logger for a command, logging to w.
+// ExtraOptions["logLevel"] and ExtraOptions["logFormat"] take precedence
+// over the environment. The format is "text" (default) or "json".
+// ExtraOptions["verbosity"], or a -quiet or -verbose flag among args, sets
+// the level instead of logLevel.
+func SetupLogging(w io.Writer, extra map[string]interface{}, args ...string) error {
+	level, format, err := logSettings(extra, args)
+	if err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+
+	logger, err := newLogger(w, level, format)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+
+	progressLine = nil
+	if f, ok := w.(*os.File); ok && (format == "" || format == "text") && isTerminal(f) && logger.Enabled(context.Background(), slog.LevelInfo) {
+		progressLine = f
+	}
+	return nil
+}
+
+// logSettings resolves the log level and format a command runs with
+func logSettings(extra map[string]interface{}, args []string) (level, format string, err error) {
+	if level, err = stringOption(extra, "logLevel", os.Getenv(logLevelEnv)); err != nil {
+		return "", "", err
+	}
+	if format, err = stringOption(extra, "logFormat", os.Getenv(logFormatEnv)); err != nil {
+		return "", "", err
+	}
+
+	verbosity, err := stringOption(extra, "verbosity", "")
+	if err != nil {
+		return "", "", err
+	}
+	// The flags are parsed with the other install flags later; logging is
+	// set up before that
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		switch arg {
+		case "-quiet", "--quiet":
+			verbosity = "quiet"
+		case "-verbose", "--verbose":
+			verbosity = "verbose"
+		}
+	}
+	if verbosity != "" {
+		var ok bool
+		if level, ok = verbosityLevels[verbosity]; !ok {
+			return "", "", fmt.Errorf("invalid verbosity %q, expected quiet, normal or verbose", verbosity)
+		}
+	}
+	return level, format, nil
+}
+
+// newLogger builds a logger writing to w
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+
+	switch format {
+	case "", "text":
+		return slog.New(newConsoleHandler(w, lvl)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lvl, ReplaceAttr: resultLevelAttr})), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+	}
+}
+
+// resultLevelAttr shows outcome lines as INFO in JSON logs
+func resultLevelAttr(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) == 0 && attr.Key == slog.LevelKey {
+		if level, ok := attr.Value.Any().(slog.Level); ok && level == levelResult {
+			attr.Value = slog.StringValue(slog.LevelInfo.String())
+		}
+	}
+	return attr
+}
+
+// consoleHandler renders records as "message key=value ..." lines, keeping
+// the console output readable while still carrying structured fields
+type consoleHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+}
+
+func newConsoleHandler(w io.Writer, level slog.Leveler) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	if r.Level >= slog.LevelError && r.Level != levelResult {
+		b.WriteString("Error: ")
+	}
+	b.WriteString(r.Message)
+
+	for _, attr := range h.attrs {
+		writeAttr(&b, "", attr)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		writeAttr(&b, h.prefix, attr)
+		return true
+	})
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, attr := range attrs {
+		attr.Key = h.prefix + attr.Key
+		clone.attrs = append(clone.attrs, attr)
+	}
+	return &clone
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.prefix = h.prefix + name + "."
+	return &clone
+}
+
+// writeAttr appends " key=value", quoting values that contain spaces
+func writeAttr(b *strings.Builder, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, child := range attr.Value.Group() {
+			writeAttr(b, prefix+attr.Key+".", child)
+		}
+		return
+	}
+
+	value := attr.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	fmt.Fprintf(b, " %s%s=%s", prefix, attr.Key, value)
+}
@@ -0,0 +1,63 @@
+package overlay
+
+import "maps"
+
+// defaultSysctls are the sysctls the NVIDIA container toolkit expects on
+// Talos: its eBPF device filter needs the JIT hardened rather than disabled.
+var defaultSysctls = map[string]string{
+	"net.core.bpf_jit_harden": "1",
+}
+
+// MachineConfigPatch is the part of a Talos machine config the overlay
+// needs at runtime. get-options reports it so it can be applied as a
+// config patch instead of being hand written.
+type MachineConfigPatch struct {
+	Machine MachinePatch `yaml:"machine"`
+}
+
+// MachinePatch mirrors the fields of the Talos "machine" section it sets
+type MachinePatch struct {
+	Sysctls map[string]string `yaml:"sysctls,omitempty"`
+	Udev    *UdevPatch        `yaml:"udev,omitempty"`
+	Kubelet *KubeletPatch     `yaml:"kubelet,omitempty"`
+}
+
+// UdevPatch mirrors machine.udev
+type UdevPatch struct {
+	Rules []string `yaml:"rules"`
+}
+
+// KubeletPatch mirrors machine.kubelet
+type KubeletPatch struct {
+	ExtraMounts []Mount `yaml:"extraMounts"`
+}
+
+// Mount is a bind mount into the kubelet, as in machine.kubelet.extraMounts
+type Mount struct {
+	Destination string   `yaml:"destination"`
+	Type        string   `yaml:"type,omitempty"`
+	Source      string   `yaml:"source"`
+	Options     []string `yaml:"options,omitempty"`
+}
+
+// machineConfigPatch builds the runtime requirements of this overlay:
+// defaultSysctls overlaid with the overlay config's sysctls, the udev rules
+// the install writes, and the overlay config's kubelet mounts
+func machineConfigPatch(config *OverlayConfig) (*MachineConfigPatch, error) {
+	sysctls := maps.Clone(defaultSysctls)
+	maps.Copy(sysctls, config.Sysctls)
+
+	rules, err := udevRules(nil, config)
+	if err != nil {
+		return nil, err
+	}
+
+	patch := &MachineConfigPatch{Machine: MachinePatch{
+		Sysctls: sysctls,
+		Udev:    &UdevPatch{Rules: rules},
+	}}
+	if len(config.ExtraMounts) > 0 {
+		patch.Machine.Kubelet = &KubeletPatch{ExtraMounts: config.ExtraMounts}
+	}
+	return patch, nil
+}
@@ -0,0 +1,436 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.yaml.in/yaml/v4"
+)
+
+const (
+	// Name is the name reported to the Talos imager
+	Name = "asus-ascent-gx10-overlay"
+
+	// defaultStateDir holds installer state on the rootfs, relative to
+	// MountPrefix, unless ExtraOptions["stateDir"] moves it
+	defaultStateDir = "var/lib/talos-overlay"
+
+	// manifestFile is the name of the install manifest inside the state dir
+	manifestFile = "asus-ascent-gx10.manifest.yaml"
+)
+
+// ErrNotInstalled is returned when a rootfs has no install manifest
+var ErrNotInstalled = errors.New("overlay is not installed")
+
+// Manifest records everything the overlay placed on the rootfs.
+// Paths are slash-separated and relative to the rootfs so the manifest stays
+// valid when the rootfs is mounted somewhere else.
+type Manifest struct {
+	Overlay     string          `yaml:"overlay"`
+	Version     string          `yaml:"version,omitempty"`
+	InstalledAt time.Time       `yaml:"installedAt"`
+	Directories []string        `yaml:"directories,omitempty"`
+	Files       []ManifestEntry `yaml:"files"`
+
+	// Backups lists the paths whose previous contents were saved under
+	// backupDir, for rollback to restore
+	Backups []string `yaml:"backups,omitempty"`
+
+	// BackupEnabled is set when the install ran with
+	// ExtraOptions["enableBackup"], so Backups lists everything it replaced
+	// and it can be rolled back even when that is nothing
+	BackupEnabled bool `yaml:"backupEnabled,omitempty"`
+
+	// Removed lists the paths this install deleted from the rootfs, for
+	// whiteouts in the overlay or as dropped since the since manifest;
+	// directories stand for everything below them
+	Removed []string `yaml:"removed,omitempty"`
+
+	// removedAt is how many Files entries there were when each Removed
+	// path went, for dropRemoved to tell what a removal deleted from what
+	// was copied back after it
+	removedAt map[string]int
+
+	// root is the rootfs the manifest paths are relative to
+	root string
+
+	// previous is the manifest of an earlier install into the same rootfs
+	previous *Manifest
+
+	// mu guards Files, Directories, Backups and Removed against concurrent copy workers
+	mu sync.Mutex
+}
+
+// ManifestEntry describes a single installed file
+type ManifestEntry struct {
+	Path   string      `yaml:"path"`
+	Size   int64       `yaml:"size"`
+	Mode   os.FileMode `yaml:"mode"`
+	SHA256 string      `yaml:"sha256,omitempty"`
+	Target string      `yaml:"target,omitempty"`
+}
+
+// newManifest starts an empty manifest for an install into rootfsPath
+func newManifest(rootfsPath string) *Manifest {
+	return &Manifest{
+		Overlay:     Name,
+		Version:     Version,
+		InstalledAt: time.Now().UTC(),
+		root:        rootfsPath,
+	}
+}
+
+// relPath converts an absolute destination into a manifest path.
+// Paths outside the rootfs are reported as not ok.
+func (m *Manifest) relPath(path string) (string, bool) {
+	rel, err := filepath.Rel(m.root, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// addFile records an installed file and the digest of its contents
+func (m *Manifest) addFile(path string, info os.FileInfo, sum string) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Files = append(m.Files, ManifestEntry{
+		Path:   rel,
+		Size:   info.Size(),
+		Mode:   info.Mode(),
+		SHA256: sum,
+	})
+}
+
+// updateFile records new contents for a file already in the manifest
+func (m *Manifest) updateFile(path string, info os.FileInfo, sum string) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.Files {
+		if m.Files[i].Path == rel {
+			m.Files[i].Size = info.Size()
+			m.Files[i].Mode = info.Mode()
+			m.Files[i].SHA256 = sum
+		}
+	}
+}
+
+// renameFile moves the entry of a file already in the manifest to newPath,
+// recording its new contents
+func (m *Manifest) renameFile(path, newPath string, info os.FileInfo, sum string) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return
+	}
+	newRel, ok := m.relPath(newPath)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.Files {
+		if m.Files[i].Path == rel {
+			m.Files[i] = ManifestEntry{Path: newRel, Size: info.Size(), Mode: info.Mode(), SHA256: sum}
+		}
+	}
+}
+
+// addEntry records entry for path, as planned by a diff run
+func (m *Manifest) addEntry(path string, entry ManifestEntry) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return
+	}
+	entry.Path = rel
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Files = append(m.Files, entry)
+}
+
+// addSymlink records an installed symlink and its target
+func (m *Manifest) addSymlink(path string, info os.FileInfo, target string) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Files = append(m.Files, ManifestEntry{
+		Path:   rel,
+		Size:   info.Size(),
+		Mode:   info.Mode(),
+		Target: target,
+	})
+}
+
+// addDirectory records a directory created by the install
+func (m *Manifest) addDirectory(path string) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Directories = append(m.Directories, rel)
+}
+
+// addBackup records that rel was backed up, reporting false if it already was
+func (m *Manifest) addBackup(rel string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if slices.Contains(m.Backups, rel) {
+		return false
+	}
+	m.Backups = append(m.Backups, rel)
+	return true
+}
+
+// addRemoval records that a whiteout deleted path
+func (m *Manifest) addRemoval(path string) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.removedAt == nil {
+		m.removedAt = make(map[string]int)
+	}
+	if _, ok := m.removedAt[rel]; !ok {
+		m.Removed = append(m.Removed, rel)
+	}
+	m.removedAt[rel] = len(m.Files)
+}
+
+// dropRemoved forgets the files this install copied and a later whiteout
+// deleted again. Entries are only dropped once the install is done, as
+// phases count theirs by position while it runs.
+func (m *Manifest) dropRemoved() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.removedAt) == 0 {
+		return
+	}
+	files := m.Files[:0]
+	for i, entry := range m.Files {
+		if !m.removedAfter(entry.Path, i) {
+			files = append(files, entry)
+		}
+	}
+	m.Files = files
+}
+
+// removedAfter reports whether rel, or a directory above it, was removed
+// after the Files entry at index i was added
+func (m *Manifest) removedAfter(rel string, i int) bool {
+	for p := rel; p != "."; p = path.Dir(p) {
+		if at, ok := m.removedAt[p]; ok && at > i {
+			return true
+		}
+	}
+	return false
+}
+
+// entry returns this install's record of path
+func (m *Manifest) entry(path string) (ManifestEntry, bool) {
+	rel, ok := m.relPath(path)
+	if !ok {
+		return ManifestEntry{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range m.Files {
+		if entry.Path == rel {
+			return entry, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// ownedPreviously reports whether an earlier install recorded path as its own
+func (m *Manifest) ownedPreviously(path string) bool {
+	_, ok := m.previousEntry(path)
+	return ok
+}
+
+// previousEntry returns the earlier install's record of path
+func (m *Manifest) previousEntry(path string) (ManifestEntry, bool) {
+	rel, ok := m.relPath(path)
+	if !ok || m.previous == nil {
+		return ManifestEntry{}, false
+	}
+	for _, entry := range m.previous.Files {
+		if entry.Path == rel {
+			return entry, true
+		}
+	}
+	return ManifestEntry{}, false
+}
+
+// mergeDirectories carries over directories recorded by the previous manifest,
+// since a re-install finds them already present and would otherwise forget them
+func (m *Manifest) mergeDirectories() {
+	if m.previous == nil {
+		return
+	}
+	seen := make(map[string]bool, len(m.Directories))
+	for _, dir := range m.Directories {
+		seen[dir] = true
+	}
+	for _, dir := range m.previous.Directories {
+		if !seen[dir] {
+			seen[dir] = true
+			m.Directories = append(m.Directories, dir)
+		}
+	}
+}
+
+// manifestVersion names the overlay version a manifest was written by.
+// Manifests from before versions were recorded have none.
+func manifestVersion(m *Manifest) string {
+	if m.Version == "" {
+		return "unknown"
+	}
+	return m.Version
+}
+
+// sort orders the manifest by path, so it comes out the same however the
+// copy workers interleaved. Entries for the same path keep their order.
+func (m *Manifest) sort() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sortEntries(m.Files)
+	sort.Strings(m.Directories)
+	sort.Strings(m.Backups)
+	sort.Strings(m.Removed)
+}
+
+// sortEntries orders manifest entries by path
+func sortEntries(entries []ManifestEntry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+}
+
+// manifestPath returns the location of the install manifest for a rootfs
+// keeping its state in stateDir
+func manifestPath(rootfsPath, stateDir string) string {
+	return filepath.Join(rootfsPath, filepath.FromSlash(stateDir), manifestFile)
+}
+
+// rootfsJoin resolves a manifest path against the rootfs
+func rootfsJoin(rootfsPath, relPath string) string {
+	return filepath.Join(rootfsPath, filepath.FromSlash(relPath))
+}
+
+// readManifest loads the install manifest from stateDir on the rootfs
+func readManifest(fsys filesystem, rootfsPath, stateDir string) (*Manifest, error) {
+	path := manifestPath(rootfsPath, stateDir)
+	manifest, err := readManifestFile(fsys, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: no manifest at %s", ErrNotInstalled, path)
+	}
+	return manifest, err
+}
+
+// readManifestFile reads the manifest at path, wherever it is kept
+func readManifestFile(fsys filesystem, path string) (*Manifest, error) {
+	data, err := fsys.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", path, err)
+	}
+
+	var manifest Manifest
+	if err := yaml.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %w", path, err)
+	}
+	if err := manifest.checkPaths(); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+	}
+	return &manifest, nil
+}
+
+// checkPaths fails unless every path the manifest lists stays inside the
+// rootfs. Uninstall, rollback and since remove what a manifest lists, and a
+// corrupt or hand-edited one must not point them at the host.
+func (m *Manifest) checkPaths() error {
+	paths := append(append(append([]string(nil), m.Directories...), m.Backups...), m.Removed...)
+	for _, entry := range m.Files {
+		paths = append(paths, entry.Path)
+	}
+	for _, p := range paths {
+		if !filepath.IsLocal(filepath.FromSlash(p)) {
+			return fmt.Errorf("path %q is not inside the rootfs", p)
+		}
+	}
+	return nil
+}
+
+// resolveRootfsPath returns the rootfs path a manifest path names, with the
+// symlinks along its parent resolved inside the rootfs, so a symlinked
+// directory can't redirect a removal to the host; see resolveInRoot. The
+// last component is left alone, since removing a symlink removes the link.
+func resolveRootfsPath(fsys filesystem, rootfsPath, relPath string) (string, error) {
+	path := rootfsJoin(rootfsPath, relPath)
+	if !withinDir(rootfsPath, path) || filepath.Clean(path) == filepath.Clean(rootfsPath) {
+		return "", fmt.Errorf("%s is outside %s", path, rootfsPath)
+	}
+	parent, err := resolveInRoot(fsys, rootfsPath, filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(path)), nil
+}
+
+// writeManifest atomically replaces the install manifest on the rootfs,
+// sorted so reproducible builds write identical manifests. The manifest is
+// written to a temp file in the same directory and renamed into place, so a
+// crash never leaves a truncated manifest behind.
+func writeManifest(fsys filesystem, rootfsPath, stateDir string, manifest *Manifest) error {
+	path := manifestPath(rootfsPath, stateDir)
+	if err := fsys.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	manifest.sort()
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	f, err := fsys.Create(tmp, 0644)
+	if err != nil {
+		return err
+	}
+	defer fsys.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if s, ok := f.(syncer); ok {
+		if err := s.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fsys.Rename(tmp, path)
+}
@@ -0,0 +1,135 @@
+package overlay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.yaml.in/yaml/v4"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestInstallManifestOrder(t *testing.T) {
+	fixture := testOverlay()
+	for i := range 64 {
+		// Nested, and sizes varying, so the copies finish out of order
+		name := fmt.Sprintf("nvidia/ga%02d/gsp_%02d.bin", i%8, i)
+		fixture.Firmware[name] = testutil.File(strings.Repeat("x", (64-i)<<10))
+	}
+	overlayPath := fixture.Build(t)
+
+	var first []byte
+	for _, tc := range []struct {
+		name     string
+		parallel int
+	}{
+		{"one at a time", 1},
+		{"parallel", 8},
+		{"parallel again", 8},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rootfs := testutil.Rootfs(t, testKver)
+			if err := runInstallTest(t, overlayPath, rootfs, map[string]interface{}{"parallel": tc.parallel}); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			manifest, err := readManifest(osFS{}, rootfs, defaultStateDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			paths := make([]string, len(manifest.Files))
+			for i, entry := range manifest.Files {
+				paths[i] = entry.Path
+			}
+			if !slices.IsSorted(paths) {
+				t.Errorf("manifest files are not sorted by path: %q", paths)
+			}
+			if !slices.IsSorted(manifest.Directories) {
+				t.Errorf("manifest directories are not sorted: %q", manifest.Directories)
+			}
+
+			// Only the install time may differ between runs
+			manifest.InstalledAt = time.Time{}
+			data, err := yaml.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first == nil {
+				first = data
+			} else if string(data) != string(first) {
+				t.Errorf("manifest differs from the first install's:\n%s\nthen\n%s", first, data)
+			}
+		})
+	}
+}
+
+func TestInstallStateDir(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stateDir string
+		// want is where the state is kept, relative to the rootfs
+		want string
+	}{
+		{"default", "", defaultStateDir},
+		{"custom", "opt/nvidia/state", "opt/nvidia/state"},
+		{"leading slash", "/var/lib/gx10", "var/lib/gx10"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testOverlay().Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+			// A file for the install to back up
+			testutil.WriteTree(t, rootfs, testutil.Tree{"etc/nvidia/app.conf": testutil.File("old\n")})
+
+			extra := map[string]interface{}{"enableBackup": true, "sbom": true}
+			if tc.stateDir != "" {
+				extra["stateDir"] = tc.stateDir
+			}
+			if err := runInstallTest(t, overlayPath, rootfs, extra); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			for _, rel := range []string{tc.want + "/" + manifestFile, tc.want + "/" + sbomFile, backupDir(tc.want) + "/etc/nvidia/app.conf"} {
+				if _, err := os.Lstat(filepath.Join(rootfs, filepath.FromSlash(rel))); err != nil {
+					t.Errorf("install did not write %s: %v", rel, err)
+				}
+			}
+			if tc.want != defaultStateDir {
+				if _, err := os.Lstat(filepath.Join(rootfs, defaultStateDir)); !os.IsNotExist(err) {
+					t.Errorf("install wrote to the default state dir: %v", err)
+				}
+				if err := verifyTest(t, rootfs, nil); !errors.Is(err, ErrNotInstalled) {
+					t.Errorf("verify without the override returned %v, want %v", err, ErrNotInstalled)
+				}
+			}
+
+			if err := verifyTest(t, rootfs, extra); err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+			var out bytes.Buffer
+			options := &Options{InstallOptions: InstallOptions{MountPrefix: rootfs, ExtraOptions: extra}, Stdout: &out}
+			if err := Status(options); err != nil {
+				t.Fatalf("status: %v", err)
+			}
+			if !strings.Contains(out.String(), "overlay: "+Name+"\n") {
+				t.Errorf("status output lacks the overlay:\n%s", out.String())
+			}
+			options.Stdout = io.Discard
+			if err := Uninstall(options); err != nil {
+				t.Fatalf("uninstall: %v", err)
+			}
+			if _, err := os.Lstat(filepath.Join(rootfs, "lib/firmware/nvidia/gsp.bin")); !os.IsNotExist(err) {
+				t.Errorf("uninstall left gsp.bin: %v", err)
+			}
+			if _, err := os.Lstat(manifestPath(rootfs, tc.want)); !os.IsNotExist(err) {
+				t.Errorf("uninstall left the manifest: %v", err)
+			}
+		})
+	}
+}
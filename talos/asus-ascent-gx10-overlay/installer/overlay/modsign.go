@@ -0,0 +1,574 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A signed module ends with its PKCS#7 signature, the kernel's struct
+// module_signature describing it, and this magic string
+const moduleSignatureMagic = "~Module signature appended~\n"
+
+// moduleSignatureInfoSize is the size of struct module_signature: algo,
+// hash, id_type, signer_len, key_id_len, three bytes of padding and a big
+// endian sig_len
+const moduleSignatureInfoSize = 12
+
+// pkeyIDPKCS7 is the module_signature id_type of a PKCS#7 signature, the
+// only kind current kernels accept
+const pkeyIDPKCS7 = 2
+
+// errModuleUnsigned is returned for a module without an appended signature
+var errModuleUnsigned = errors.New("module is not signed")
+
+// splitModuleSignature separates a module's signed contents from its
+// appended PKCS#7 signature
+func splitModuleSignature(data []byte) (content, sig []byte, err error) {
+	if !bytes.HasSuffix(data, []byte(moduleSignatureMagic)) {
+		return nil, nil, errModuleUnsigned
+	}
+	rest := data[:len(data)-len(moduleSignatureMagic)]
+	if len(rest) < moduleSignatureInfoSize {
+		return nil, nil, errors.New("truncated module signature")
+	}
+	info := rest[len(rest)-moduleSignatureInfoSize:]
+	rest = rest[:len(rest)-moduleSignatureInfoSize]
+
+	if info[2] != pkeyIDPKCS7 {
+		return nil, nil, fmt.Errorf("unsupported module signature type %d", info[2])
+	}
+	sigLen := binary.BigEndian.Uint32(info[8:])
+	if uint64(sigLen) > uint64(len(rest)) {
+		return nil, nil, errors.New("truncated module signature")
+	}
+	split := len(rest) - int(sigLen)
+	return rest[:split], rest[split:], nil
+}
+
+// The parts of a PKCS#7 SignedData (RFC 2315) that module signatures use.
+// The signed content is detached: it is the module itself.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	SID                       asn1.RawValue
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	Signature                 []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+var (
+	oidData            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256          = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+// moduleDigests are the digest algorithms module signatures may use
+var moduleDigests = map[string]crypto.Hash{
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+// signerAlgorithm is a signature's digest and the signing key's type
+type signerAlgorithm struct {
+	hash crypto.Hash
+	key  x509.PublicKeyAlgorithm
+}
+
+// signatureAlgorithms maps a signer's algorithms to the x509 algorithm that
+// checks its signature
+var signatureAlgorithms = map[signerAlgorithm]x509.SignatureAlgorithm{
+	{crypto.SHA256, x509.RSA}:   x509.SHA256WithRSA,
+	{crypto.SHA384, x509.RSA}:   x509.SHA384WithRSA,
+	{crypto.SHA512, x509.RSA}:   x509.SHA512WithRSA,
+	{crypto.SHA256, x509.ECDSA}: x509.ECDSAWithSHA256,
+	{crypto.SHA384, x509.ECDSA}: x509.ECDSAWithSHA384,
+	{crypto.SHA512, x509.ECDSA}: x509.ECDSAWithSHA512,
+}
+
+// verifyModuleSignature checks a module's PKCS#7 signature over content
+// against the signing certificates. One valid signer is enough.
+func verifyModuleSignature(content, sig []byte, certs []*x509.Certificate) error {
+	var info pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(sig, &info); err != nil {
+		return fmt.Errorf("malformed module signature: %w", err)
+	}
+	if !info.ContentType.Equal(oidSignedData) {
+		return fmt.Errorf("module signature is not PKCS#7 signed data")
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(info.Content.Bytes, &sd); err != nil {
+		return fmt.Errorf("malformed module signature: %w", err)
+	}
+
+	var errs []error
+	for _, signer := range sd.SignerInfos {
+		hash, ok := moduleDigests[signer.DigestAlgorithm.Algorithm.String()]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unsupported digest algorithm %s", signer.DigestAlgorithm.Algorithm))
+			continue
+		}
+		signed, err := signedBytes(signer, content, hash)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, cert := range certs {
+			algo, ok := signatureAlgorithms[signerAlgorithm{hash, cert.PublicKeyAlgorithm}]
+			if !ok {
+				continue
+			}
+			if err := cert.CheckSignature(algo, signed, signer.Signature); err == nil {
+				return nil
+			}
+		}
+		errs = append(errs, errors.New("signature does not match any signing certificate"))
+	}
+	if len(errs) == 0 {
+		return errors.New("module signature has no signers")
+	}
+	return errors.Join(errs...)
+}
+
+// signedBytes returns what a signer's signature covers: the content itself,
+// or, when the signer has authenticated attributes, their DER encoding as a
+// SET, once their message digest is checked against the content
+func signedBytes(signer pkcs7SignerInfo, content []byte, hash crypto.Hash) ([]byte, error) {
+	if len(signer.AuthenticatedAttributes.FullBytes) == 0 {
+		return content, nil
+	}
+
+	var attrs []pkcs7Attribute
+	if _, err := asn1.UnmarshalWithParams(signer.AuthenticatedAttributes.FullBytes, &attrs, "set,tag:0"); err != nil {
+		return nil, fmt.Errorf("malformed signed attributes: %w", err)
+	}
+	var digest []byte
+	for _, attr := range attrs {
+		if attr.Type.Equal(oidMessageDigest) {
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+				return nil, fmt.Errorf("malformed message digest: %w", err)
+			}
+		}
+	}
+	if digest == nil {
+		return nil, errors.New("signed attributes have no message digest")
+	}
+
+	h := hash.New()
+	h.Write(content)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return nil, errors.New("module contents do not match the signed digest")
+	}
+
+	// The attributes are signed as a SET, not with their implicit [0] tag
+	signed := append([]byte(nil), signer.AuthenticatedAttributes.FullBytes...)
+	signed[0] = 0x31
+	return signed, nil
+}
+
+// loadCertificates reads PEM or DER encoded certificates, given inline or
+// as a path to a file. The kernel's signing_key.x509 is DER.
+func loadCertificates(cert string) ([]*x509.Certificate, error) {
+	data := []byte(cert)
+	if !strings.HasPrefix(strings.TrimSpace(cert), "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(cert); err != nil {
+			return nil, fmt.Errorf("failed to read signing certificate: %w", err)
+		}
+	}
+
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		c, err := x509.ParseCertificate(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing certificate: %w", err)
+		}
+		return []*x509.Certificate{c}, nil
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse signing certificate: %w", err)
+		}
+		certs = append(certs, c)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found in signing certificate")
+	}
+	return certs, nil
+}
+
+// checkModuleSignatures inspects the appended signature of every installed
+// module, for targets whose secure boot refuses unsigned modules. With
+// ExtraOptions["moduleSigningCert"] each signature is verified against it;
+// with ExtraOptions["requireSignedModules"] unsigned modules fail the
+// install, otherwise they get a warning.
+func (inst *Installer) checkModuleSignatures() error {
+	if inst.cfg.moduleSigningCert == "" && !inst.cfg.requireSignedModules {
+		return nil
+	}
+	if inst.cfg.dryRun {
+		slog.Debug("Skipping module signature check in dry run")
+		return nil
+	}
+
+	var certs []*x509.Certificate
+	if inst.cfg.moduleSigningCert != "" {
+		var err error
+		if certs, err = loadCertificates(inst.cfg.moduleSigningCert); err != nil {
+			return err
+		}
+	}
+
+	var unsigned []string
+	var errs []error
+	checked := 0
+	for _, entry := range inst.manifest.Files {
+		if !entry.Mode.IsRegular() || !isKernelModule(entry.Path) {
+			continue
+		}
+		path := rootfsJoin(inst.rootfsPath, entry.Path)
+		data, err := readModule(inst.fs, path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		content, sig, err := splitModuleSignature(data)
+		if errors.Is(err, errModuleUnsigned) {
+			unsigned = append(unsigned, moduleName(path))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		checked++
+		if certs == nil {
+			continue
+		}
+		if err := verifyModuleSignature(content, sig, certs); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+		}
+	}
+
+	if len(unsigned) > 0 {
+		if inst.cfg.requireSignedModules {
+			errs = append(errs, fmt.Errorf("%d modules are unsigned and would not load under secure boot: %s", len(unsigned), strings.Join(unsigned, ", ")))
+		} else {
+			slog.Warn("⚠️  Unsigned modules", "modules", strings.Join(unsigned, " "))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("module signature check failed: %w", errors.Join(errs...))
+	}
+
+	if certs != nil {
+		slog.Info("🔏 Verified module signatures", "modules", checked, "dir", filepath.Join(inst.rootfsPath, filepath.FromSlash(inst.cfg.modulesDir)))
+	} else {
+		slog.Info("🔏 Modules signed", "modules", checked)
+	}
+	return nil
+}
+
+// signModule appends a signature over content to it the way the kernel's
+// sign-file does: a detached PKCS#7 SignedData with a SHA-256 digest, no
+// signed attributes and no certificates, naming the signer by issuer and
+// serial number
+func signModule(content []byte, key crypto.Signer, cert *x509.Certificate) ([]byte, error) {
+	var keyAlgorithm pkix.AlgorithmIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		keyAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		keyAlgorithm = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key.Public())
+	}
+
+	digest := sha256.Sum256(content)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign module: %w", err)
+	}
+
+	sid, err := asn1.Marshal(pkcs7IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+	sd, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{{Algorithm: oidSHA256}},
+		ContentInfo:      pkcs7ContentInfo{ContentType: oidData},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version:                   1,
+			SID:                       asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: oidSHA256},
+			DigestEncryptionAlgorithm: keyAlgorithm,
+			Signature:                 signature,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	sig, err := asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := make([]byte, moduleSignatureInfoSize)
+	info[2] = pkeyIDPKCS7
+	binary.BigEndian.PutUint32(info[8:], uint32(len(sig)))
+
+	signed := make([]byte, 0, len(content)+len(sig)+len(info)+len(moduleSignatureMagic))
+	signed = append(signed, content...)
+	signed = append(signed, sig...)
+	signed = append(signed, info...)
+	return append(signed, moduleSignatureMagic...), nil
+}
+
+// loadSigningKey reads a PEM encoded private key, given inline or as a path
+// to a file, along with any certificates beside it. The kernel's
+// signing_key.pem holds both.
+func loadSigningKey(key string) (crypto.Signer, []*x509.Certificate, error) {
+	data := []byte(key)
+	if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(key); err != nil {
+			return nil, nil, fmt.Errorf("failed to read signing key: %w", err)
+		}
+	}
+
+	var signer crypto.Signer
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		var parsed interface{}
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			parsed, err = x509.ParseECPrivateKey(block.Bytes)
+		case "CERTIFICATE":
+			c, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse signing certificate: %w", err)
+			}
+			certs = append(certs, c)
+			continue
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse signing key: %w", err)
+		}
+		var ok bool
+		if signer, ok = parsed.(crypto.Signer); !ok {
+			return nil, nil, fmt.Errorf("unsupported signing key type %T", parsed)
+		}
+	}
+	if signer == nil {
+		return nil, nil, errors.New("no private key found in signing key")
+	}
+	return signer, certs, nil
+}
+
+// signingCertificate picks the certificate for key's public half
+func signingCertificate(key crypto.Signer, certs []*x509.Certificate) (*x509.Certificate, error) {
+	type publicKey interface {
+		Equal(crypto.PublicKey) bool
+	}
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(publicKey); ok && pub.Equal(key.Public()) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("no signing certificate matches the signing key")
+}
+
+// signModules signs each installed module that has no signature yet with
+// ExtraOptions["signingKey"], for targets whose secure boot only trusts
+// modules signed with their own key. The certificate comes from
+// ExtraOptions["moduleSigningCert"] or the key file. Signing changes the
+// modules, so depmod runs again for their kernels.
+func (inst *Installer) signModules(ctx context.Context) error {
+	if inst.cfg.signingKey == "" {
+		return nil
+	}
+	key, certs, err := loadSigningKey(inst.cfg.signingKey)
+	if err != nil {
+		return err
+	}
+	if inst.cfg.moduleSigningCert != "" {
+		if certs, err = loadCertificates(inst.cfg.moduleSigningCert); err != nil {
+			return err
+		}
+	}
+	cert, err := signingCertificate(key, certs)
+	if err != nil {
+		return err
+	}
+	if inst.cfg.dryRun {
+		slog.Info("🔏 Would sign unsigned modules", "signer", cert.Subject.String())
+		return nil
+	}
+
+	versions := make(map[string]bool)
+	var errs []error
+	signed := 0
+	for _, entry := range inst.manifest.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Mode.IsRegular() || !isKernelModule(entry.Path) {
+			continue
+		}
+		path := rootfsJoin(inst.rootfsPath, entry.Path)
+		ok, err := inst.signModuleFile(path, key, cert)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		signed++
+		if kver, ok := inst.moduleKernelVersion(entry.Path); ok {
+			versions[kver] = true
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to sign %d modules: %w", len(errs), errors.Join(errs...))
+	}
+	slog.Info("🔏 Signed modules", "modules", signed, "signer", cert.Subject.String())
+
+	kvers := make([]string, 0, len(versions))
+	for kver := range versions {
+		kvers = append(kvers, kver)
+	}
+	sort.Strings(kvers)
+	for _, kver := range kvers {
+		if err := inst.regenerateModuleDeps(ctx, kver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signModuleFile signs the module at path unless it already carries a
+// signature, keeping its compression, and updates its manifest entry. It
+// reports whether the module was signed.
+func (inst *Installer) signModuleFile(path string, key crypto.Signer, cert *x509.Certificate) (bool, error) {
+	info, err := inst.fs.Lstat(path)
+	if err != nil {
+		return false, err
+	}
+	data, err := readModule(inst.fs, path)
+	if err != nil {
+		return false, err
+	}
+	if _, _, err := splitModuleSignature(data); err == nil {
+		return false, nil
+	} else if !errors.Is(err, errModuleUnsigned) {
+		return false, err
+	}
+
+	signed, err := signModule(data, key, cert)
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	w, err := compressModule(&buf, path)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(signed); err != nil {
+		return false, err
+	}
+	if err := w.Close(); err != nil {
+		return false, err
+	}
+
+	if err := inst.backup(path); err != nil {
+		return false, err
+	}
+	_, sum, err := inst.copyFile(&buf, path, info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	inst.preserveOwnership(path, info)
+	if err := inst.preserveTimes(path, info); err != nil {
+		return false, err
+	}
+	newInfo, err := inst.fs.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	inst.manifest.updateFile(path, newInfo, sum)
+	return true, nil
+}
@@ -0,0 +1,178 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// testSigningKey returns a self-signed certificate for key, and the key
+// and certificate PEM encoded together the way signing_key.pem holds them
+func testSigningKey(t *testing.T, key crypto.Signer) (*x509.Certificate, string) {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Build time autogenerated kernel key"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	return cert, string(data)
+}
+
+// testSigningKeys are a throwaway key of each type signModule supports
+func testSigningKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]crypto.Signer{"rsa": rsaKey, "ecdsa": ecKey}
+}
+
+func TestSignModule(t *testing.T) {
+	module := []byte(testModule().Data)
+	for name, key := range testSigningKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			cert, keyPEM := testSigningKey(t, key)
+			loaded, certs, err := loadSigningKey(keyPEM)
+			if err != nil {
+				t.Fatalf("loadSigningKey: %v", err)
+			}
+			if len(certs) != 1 || !certs[0].Equal(cert) {
+				t.Fatalf("loadSigningKey certificates = %v, want the signing certificate", certs)
+			}
+
+			signed, err := signModule(module, loaded, cert)
+			if err != nil {
+				t.Fatalf("signModule: %v", err)
+			}
+			content, sig, err := splitModuleSignature(signed)
+			if err != nil {
+				t.Fatalf("splitModuleSignature: %v", err)
+			}
+			if !bytes.Equal(content, module) {
+				t.Error("splitModuleSignature content differs from the unsigned module")
+			}
+			if err := verifyModuleSignature(content, sig, []*x509.Certificate{cert}); err != nil {
+				t.Errorf("verifyModuleSignature: %v", err)
+			}
+
+			tampered := bytes.Clone(content)
+			tampered[len(tampered)/2] ^= 0xff
+			if err := verifyModuleSignature(tampered, sig, []*x509.Certificate{cert}); err == nil {
+				t.Error("verifyModuleSignature accepted tampered content")
+			}
+		})
+	}
+}
+
+func TestInstallSignModules(t *testing.T) {
+	const rel = "lib/modules/" + testKver + "/kernel/drivers/gpu/nvidia.ko"
+
+	for name, key := range testSigningKeys(t) {
+		t.Run(name, func(t *testing.T) {
+			// The key is given as a path, the certificate inline
+			cert, keyPEM := testSigningKey(t, key)
+			keyFile := filepath.Join(t.TempDir(), "signing_key.pem")
+			if err := os.WriteFile(keyFile, []byte(keyPEM), 0600); err != nil {
+				t.Fatal(err)
+			}
+			certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+			extra := map[string]interface{}{"signingKey": keyFile, "moduleSigningCert": certPEM}
+			overlayPath := testOverlay().Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+
+			if err := runInstallTest(t, overlayPath, rootfs, extra); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			signed := readTestFile(t, rootfs, rel)
+			content, sig, err := splitModuleSignature([]byte(signed))
+			if err != nil {
+				t.Fatalf("installed module: %v", err)
+			}
+			if err := verifyModuleSignature(content, sig, []*x509.Certificate{cert}); err != nil {
+				t.Errorf("installed module: %v", err)
+			}
+			if err := verifyTest(t, rootfs, nil); err != nil {
+				t.Errorf("verify after signing: %v", err)
+			}
+
+			// A second signing pass leaves signed modules alone
+			inst := newTestInstaller(t, overlayPath, rootfs, extra)
+			if inst.manifest, err = readManifest(osFS{}, rootfs, defaultStateDir); err != nil {
+				t.Fatal(err)
+			}
+			if err := inst.signModules(context.Background()); err != nil {
+				t.Fatalf("signModules again: %v", err)
+			}
+			if got := readTestFile(t, rootfs, rel); got != signed {
+				t.Error("signModules changed a signed module")
+			}
+
+			// A reinstall copies the unsigned module again, so only checks
+			// it comes out signed; ECDSA signatures differ each time
+			if err := runInstallTest(t, overlayPath, rootfs, extra); err != nil {
+				t.Fatalf("reinstall: %v", err)
+			}
+			content, sig, err = splitModuleSignature([]byte(readTestFile(t, rootfs, rel)))
+			if err != nil {
+				t.Fatalf("reinstalled module: %v", err)
+			}
+			if err := verifyModuleSignature(content, sig, []*x509.Certificate{cert}); err != nil {
+				t.Errorf("reinstalled module: %v", err)
+			}
+		})
+	}
+}
+
+func TestInstallTamperedModuleSignature(t *testing.T) {
+	key := testSigningKeys(t)["ecdsa"]
+	cert, _ := testSigningKey(t, key)
+	signed, err := signModule([]byte(testModule().Data), key, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed[len(signed)/4] ^= 0xff
+
+	fixture := testOverlay()
+	fixture.KernelModules[testKver+"/kernel/drivers/gpu/nvidia.ko"] = testutil.File(string(signed))
+	certPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	err = runInstallTest(t, fixture.Build(t), testutil.Rootfs(t, testKver), map[string]interface{}{"moduleSigningCert": certPEM})
+	if err == nil || !strings.Contains(err.Error(), "module signature check failed") {
+		t.Errorf("install of a tampered module = %v, want a signature check failure", err)
+	}
+}
@@ -0,0 +1,213 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+)
+
+// errStripUnsupported is returned for modules stripModule can't rewrite
+var errStripUnsupported = errors.New("only 64-bit relocatable ELF modules can be stripped")
+
+// isDebugSection reports whether a section only carries debug info, which
+// the kernel never loads
+func isDebugSection(name string) bool {
+	return strings.HasPrefix(name, ".debug_") || strings.HasPrefix(name, ".zdebug_")
+}
+
+// stripModule returns the module ELF in data without its debug sections,
+// or nil when it has none. Their headers stay behind as empty SHT_NULL
+// entries, so section indices, which symbols and relocations refer to by
+// number, keep their meaning and nothing else needs rewriting; .modinfo
+// and everything else the loader reads is copied as is.
+func stripModule(data []byte) ([]byte, error) {
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if f.Class != elf.ELFCLASS64 || f.Type != elf.ET_REL {
+		return nil, errStripUnsupported
+	}
+
+	strip := make([]bool, len(f.Sections))
+	stripping := false
+	for i, s := range f.Sections {
+		if isDebugSection(s.Name) {
+			strip[i] = true
+			stripping = true
+		}
+	}
+	if !stripping {
+		return nil, nil
+	}
+	// Relocations against debug info go with it
+	for i, s := range f.Sections {
+		if (s.Type == elf.SHT_RELA || s.Type == elf.SHT_REL) && int(s.Info) < len(strip) && strip[s.Info] {
+			strip[i] = true
+		}
+	}
+
+	var hdr elf.Header64
+	if err := binary.Read(bytes.NewReader(data), f.ByteOrder, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.Phnum != 0 {
+		return nil, errStripUnsupported
+	}
+	shdrs := make([]elf.Section64, len(f.Sections))
+	if hdr.Shoff > uint64(len(data)) {
+		return nil, errors.New("section headers past end of file")
+	}
+	if err := binary.Read(bytes.NewReader(data[hdr.Shoff:]), f.ByteOrder, shdrs); err != nil {
+		return nil, fmt.Errorf("failed to read section headers: %w", err)
+	}
+
+	// Kept sections are laid out again in their original order, each at
+	// its alignment. Section 0 may hold extended section counts.
+	var order []int
+	for i := 1; i < len(shdrs); i++ {
+		if !strip[i] && elf.SectionType(shdrs[i].Type) != elf.SHT_NOBITS {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return shdrs[order[a]].Off < shdrs[order[b]].Off })
+
+	out := append([]byte(nil), data[:binary.Size(hdr)]...)
+	for _, i := range order {
+		sh := &shdrs[i]
+		if sh.Off > uint64(len(data)) || sh.Size > uint64(len(data))-sh.Off {
+			return nil, fmt.Errorf("section %s past end of file", f.Sections[i].Name)
+		}
+		for sh.Addralign > 1 && uint64(len(out))%sh.Addralign != 0 {
+			out = append(out, 0)
+		}
+		off := uint64(len(out))
+		out = append(out, data[sh.Off:sh.Off+sh.Size]...)
+		sh.Off = off
+	}
+	for i := range shdrs {
+		if strip[i] {
+			shdrs[i] = elf.Section64{}
+		}
+	}
+
+	for len(out)%8 != 0 {
+		out = append(out, 0)
+	}
+	hdr.Shoff = uint64(len(out))
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, f.ByteOrder, &hdr); err != nil {
+		return nil, err
+	}
+	copy(out, buf.Bytes())
+	buf.Reset()
+	if err := binary.Write(&buf, f.ByteOrder, shdrs); err != nil {
+		return nil, err
+	}
+	return append(out, buf.Bytes()...), nil
+}
+
+// stripModules drops the debug sections of each installed module, when
+// ExtraOptions["stripModules"] is set, keeping its compression. A signature
+// covers the whole module, so signed modules are left alone with a
+// warning; unsigned ones are stripped before signModules signs them.
+func (inst *Installer) stripModules(ctx context.Context) error {
+	if !inst.cfg.stripModules {
+		return nil
+	}
+	if inst.cfg.dryRun {
+		slog.Info("🪶 Would strip module debug sections")
+		return nil
+	}
+
+	var errs []error
+	stripped := 0
+	for _, entry := range inst.manifest.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !entry.Mode.IsRegular() || !isKernelModule(entry.Path) {
+			continue
+		}
+		path := rootfsJoin(inst.rootfsPath, entry.Path)
+		saved, err := inst.stripModuleFile(path)
+		if errors.Is(err, errStripUnsupported) {
+			slog.Debug("Not stripping module", "path", path, "reason", err)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", path, err))
+			continue
+		}
+		if saved != 0 {
+			stripped++
+			inst.summary.StrippedBytes += saved
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to strip %d modules: %w", len(errs), errors.Join(errs...))
+	}
+	slog.Info("🪶 Stripped modules", "modules", stripped, "savedBytes", inst.summary.StrippedBytes)
+	return nil
+}
+
+// stripModuleFile strips the module at path and updates its manifest
+// entry, returning how many bytes smaller the file got
+func (inst *Installer) stripModuleFile(path string) (int64, error) {
+	info, err := inst.fs.Lstat(path)
+	if err != nil {
+		return 0, err
+	}
+	data, err := readModule(inst.fs, path)
+	if err != nil {
+		return 0, err
+	}
+	if _, _, err := splitModuleSignature(data); err == nil {
+		slog.Warn("⚠️  Not stripping signed module, stripping would invalidate its signature", "path", path)
+		inst.summary.warn(fmt.Sprintf("signed module %s not stripped", path))
+		return 0, nil
+	} else if !errors.Is(err, errModuleUnsigned) {
+		return 0, err
+	}
+
+	content, err := stripModule(data)
+	if err != nil || content == nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	w, err := compressModule(&buf, path)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, err
+	}
+
+	if err := inst.backup(path); err != nil {
+		return 0, err
+	}
+	_, sum, err := inst.copyFile(&buf, path, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	inst.preserveOwnership(path, info)
+	if err := inst.preserveTimes(path, info); err != nil {
+		return 0, err
+	}
+	newInfo, err := inst.fs.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	inst.manifest.updateFile(path, newInfo, sum)
+	slog.Debug("stripped", "path", path, "before", info.Size(), "after", newInfo.Size())
+	return info.Size() - newInfo.Size(), nil
+}
@@ -0,0 +1,178 @@
+package overlay
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"debug/elf"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// testDebugModule is testModule built with debug info
+func testDebugModule(modinfo ...string) []byte {
+	return testutil.DebugModule(elf.EM_AARCH64, bytes.Repeat([]byte("dwarf"), 1024), modinfo...)
+}
+
+// sectionData returns the contents of the named section of a module
+func sectionData(t *testing.T, module []byte, name string) []byte {
+	t.Helper()
+	f, err := elf.NewFile(bytes.NewReader(module))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := f.Section(name)
+	if s == nil {
+		t.Fatalf("module has no %s section", name)
+	}
+	data, err := s.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStripModule(t *testing.T) {
+	modinfo := []string{"firmware=nvidia/gsp.bin", "alias=pci:v000010DEd*", "vermagic=" + testKver + " SMP"}
+	data := testDebugModule(modinfo...)
+
+	stripped, err := stripModule(data)
+	if err != nil {
+		t.Fatalf("stripModule: %v", err)
+	}
+	f, err := elf.NewFile(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatalf("stripped module doesn't parse: %v", err)
+	}
+	for _, s := range f.Sections {
+		if isDebugSection(s.Name) || s.Name == ".rela.debug_info" {
+			t.Errorf("stripped module still has %s", s.Name)
+		}
+	}
+	orig, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Section indices keep their meaning
+	if len(f.Sections) != len(orig.Sections) {
+		t.Errorf("stripped module has %d sections, want %d", len(f.Sections), len(orig.Sections))
+	}
+	if got, want := sectionData(t, stripped, ".modinfo"), sectionData(t, data, ".modinfo"); !bytes.Equal(got, want) {
+		t.Errorf(".modinfo = %q, want %q", got, want)
+	}
+	if len(stripped) >= len(data) {
+		t.Errorf("stripped module is %d bytes, unstripped %d", len(stripped), len(data))
+	}
+
+	// depmod must see the same module either way
+	dir := t.TempDir()
+	before, after := filepath.Join(dir, "before.ko"), filepath.Join(dir, "after.ko")
+	for path, module := range map[string][]byte{before: data, after: stripped} {
+		if err := os.WriteFile(path, module, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := inspectModule(osFS{}, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := inspectModule(osFS{}, after)
+	if err != nil {
+		t.Fatalf("inspectModule on the stripped module: %v", err)
+	}
+	want.name, got.name = "", ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("inspectModule after stripping = %+v, want %+v", got, want)
+	}
+
+	// Without debug sections there is nothing to do
+	if out, err := stripModule(stripped); out != nil || err != nil {
+		t.Errorf("stripModule on a stripped module = %d bytes, %v, want nil, nil", len(out), err)
+	}
+}
+
+func TestInstallStripModules(t *testing.T) {
+	const gpuDir = "kernel/drivers/gpu/"
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := testSigningKey(t, key)
+	signed, err := signModule(testDebugModule(), key, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := map[string][]byte{
+		gpuDir + "nvidia.ko":        testDebugModule("firmware=nvidia/gsp.bin"),
+		gpuDir + "nvidia-drm.ko.xz": compressTest(t, "nvidia-drm.ko.xz", testDebugModule()),
+		gpuDir + "nvidia-uvm.ko":    signed,
+	}
+
+	fixture := testOverlay()
+	for rel, data := range modules {
+		fixture.KernelModules[testKver+"/"+rel] = testutil.File(string(data))
+	}
+	rootfs := testutil.Rootfs(t, testKver)
+	var stdout bytes.Buffer
+	err = Install(context.Background(), &Options{
+		InstallOptions: InstallOptions{
+			MountPrefix:  rootfs,
+			ExtraOptions: map[string]interface{}{"stripModules": true, "outputFormat": "json"},
+		},
+		OverlayPath: fixture.Build(t),
+		Stdout:      &stdout,
+	})
+	if err != nil {
+		t.Fatalf("install: %v", err)
+	}
+	var summary installSummary
+	if err := json.Unmarshal(stdout.Bytes(), &summary); err != nil {
+		t.Fatalf("summary: %v", err)
+	}
+
+	var saved int64
+	for rel, data := range modules {
+		path := filepath.Join(rootfs, "lib/modules", testKver, rel)
+		installed, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		saved += int64(len(data) - len(installed))
+
+		// Signed modules are left alone, as stripping breaks the signature
+		if rel == gpuDir+"nvidia-uvm.ko" {
+			if !bytes.Equal(installed, data) {
+				t.Errorf("%s: signed module changed", rel)
+			}
+			continue
+		}
+		module, err := readModule(osFS{}, path)
+		if err != nil {
+			t.Fatalf("%s: %v", rel, err)
+		}
+		f, err := elf.NewFile(bytes.NewReader(module))
+		if err != nil {
+			t.Fatalf("%s: stripped module doesn't parse: %v", rel, err)
+		}
+		for _, s := range f.Sections {
+			if strings.HasPrefix(s.Name, ".debug_") {
+				t.Errorf("%s: still has %s", rel, s.Name)
+			}
+		}
+	}
+	if summary.StrippedBytes != saved {
+		t.Errorf("summary strippedBytes = %d, want %d", summary.StrippedBytes, saved)
+	}
+	if err := verifyTest(t, rootfs, nil); err != nil {
+		t.Errorf("verify after stripping: %v", err)
+	}
+}
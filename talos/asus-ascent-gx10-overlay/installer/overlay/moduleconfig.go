@@ -0,0 +1,376 @@
+package overlay
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// modulesLoadFile makes systemd-modules-load pick up the NVIDIA modules,
+// relative to the rootfs
+const modulesLoadFile = "etc/modules-load.d/nvidia.conf"
+
+// modprobeFile holds load time parameters for the NVIDIA modules,
+// relative to the rootfs
+const modprobeFile = "etc/modprobe.d/nvidia.conf"
+
+// defaultLoadModules are loaded at boot unless ExtraOptions["loadModules"]
+// or the overlay config says otherwise
+var defaultLoadModules = []string{"nvidia", "nvidia_uvm", "nvidia_modeset", "nvidia_drm"}
+
+// installModulesLoad writes the modules-load.d entry for the NVIDIA modules.
+// An existing file is merged with rather than replaced.
+func (inst *Installer) installModulesLoad() error {
+	modules, err := inst.loadModules()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(inst.rootfsPath, filepath.FromSlash(modulesLoadFile))
+	existing, err := inst.fs.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existed := err == nil
+
+	slog.Info("🧩 Writing module load list", "dst", path, "modules", strings.Join(modules, " "))
+	return inst.mergeFile(path, mergeModulesLoad(existing, modules), 0644, existed)
+}
+
+// loadModules returns the modules loaded at boot: ExtraOptions["loadModules"],
+// else the overlay config's, else defaultLoadModules
+func (inst *Installer) loadModules() ([]string, error) {
+	modules, ok, err := stringListOption(inst.extra, "loadModules")
+	if err != nil || ok {
+		return modules, err
+	}
+	if len(inst.config.LoadModules) > 0 {
+		return inst.config.LoadModules, nil
+	}
+	return defaultLoadModules, nil
+}
+
+// mergeModulesLoad adds modules to the contents of a modules-load.d file.
+// Existing entries, comments and blank lines are kept and duplicate module
+// names dropped; kmod treats dashes and underscores alike, so the
+// comparison does too.
+func mergeModulesLoad(existing []byte, modules []string) []byte {
+	var out strings.Builder
+	seen := make(map[string]bool)
+
+	if len(existing) == 0 {
+		out.WriteString("# Added by " + Name + "\n")
+	}
+
+	for _, line := range configLines(existing) {
+		name := strings.TrimSpace(line)
+		if name == "" || strings.HasPrefix(name, "#") || strings.HasPrefix(name, ";") {
+			out.WriteString(line + "\n")
+			continue
+		}
+		key := strings.ReplaceAll(name, "-", "_")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out.WriteString(name + "\n")
+	}
+
+	for _, name := range modules {
+		key := strings.ReplaceAll(name, "-", "_")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		out.WriteString(name + "\n")
+	}
+
+	return []byte(out.String())
+}
+
+// configLines splits the contents of a config file into its lines, without
+// the empty string a final newline would leave
+func configLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+// defaultModprobeOptions are the module parameters applied unless
+// ExtraOptions["modprobeOptions"] provides its own map of module to params
+var defaultModprobeOptions = map[string]string{
+	"nvidia":     "NVreg_OpenRmEnableUnsupportedGpus=1",
+	"nvidia_drm": "modeset=1",
+}
+
+// moduleNamePattern and moduleParamPattern match the module and parameter
+// names ExtraOptions["moduleParams"] may set
+var (
+	moduleNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	moduleParamPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// installModprobeOptions writes the modprobe.d options for the NVIDIA modules.
+// Re-running it replaces the overlay's options lines instead of appending.
+func (inst *Installer) installModprobeOptions() error {
+	options, ok, err := stringMapOption(inst.extra, "modprobeOptions")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		options = defaultModprobeOptions
+		if len(inst.config.ModprobeOptions) > 0 {
+			options = inst.config.ModprobeOptions
+		}
+	}
+	options = mergeModuleParams(options, inst.cfg.moduleParams)
+
+	path := filepath.Join(inst.rootfsPath, filepath.FromSlash(modprobeFile))
+	existing, err := inst.fs.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	existed := err == nil
+
+	slog.Info("🧩 Writing module options", "dst", path)
+	return inst.mergeFile(path, mergeModprobeOptions(existing, options), 0644, existed)
+}
+
+// mergeModprobeOptions merges module parameters into the contents of a
+// modprobe.d file, one key=value at a time. A parameter an existing options
+// line already sets for the module gets the new value in place; the rest
+// are appended on an "options <module> <params>" line per module. Every
+// other line, blank ones included, is kept, so re-running the merge leaves
+// the file as it is. Module and parameter names compare with dashes and
+// underscores alike, as kmod does.
+func mergeModprobeOptions(existing []byte, options map[string]string) []byte {
+	normalize := func(name string) string { return strings.ReplaceAll(name, "-", "_") }
+
+	modules := make([]string, 0, len(options))
+	for module := range options {
+		modules = append(modules, module)
+	}
+	sort.Strings(modules)
+
+	// wanted maps each module to its parameters by name, order lists the
+	// names as given, and applied marks those an options line already sets
+	wanted := make(map[string]map[string]string, len(modules))
+	order := make(map[string][]string, len(modules))
+	applied := make(map[string]map[string]bool, len(modules))
+	for _, module := range modules {
+		key := normalize(module)
+		if wanted[key] == nil {
+			wanted[key] = make(map[string]string)
+			applied[key] = make(map[string]bool)
+		}
+		for _, param := range splitModuleParams(options[module]) {
+			name, _, _ := strings.Cut(param, "=")
+			if _, dup := wanted[key][normalize(name)]; !dup {
+				order[key] = append(order[key], normalize(name))
+			}
+			wanted[key][normalize(name)] = param
+		}
+	}
+
+	var out strings.Builder
+	if len(existing) == 0 {
+		out.WriteString("# Added by " + Name + "\n")
+	}
+
+	for _, line := range configLines(existing) {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "options" || wanted[normalize(fields[1])] == nil {
+			out.WriteString(line + "\n")
+			continue
+		}
+		module := normalize(fields[1])
+		// Fields would split quoted values, so the parameters are cut
+		// from the line past the keyword and module name
+		rest := strings.TrimSpace(strings.TrimSpace(line)[len("options"):])
+		args := splitModuleParams(rest[len(fields[1]):])
+		changed := false
+		for i, arg := range args {
+			name, _, _ := strings.Cut(arg, "=")
+			param, ok := wanted[module][normalize(name)]
+			if !ok {
+				continue
+			}
+			applied[module][normalize(name)] = true
+			if arg != param {
+				args[i] = param
+				changed = true
+			}
+		}
+		if !changed {
+			out.WriteString(line + "\n")
+			continue
+		}
+		fmt.Fprintf(&out, "options %s %s\n", fields[1], strings.Join(args, " "))
+	}
+
+	for _, module := range modules {
+		key := normalize(module)
+		var params []string
+		for _, name := range order[key] {
+			// Marking them applied gives a module listed under two
+			// spellings one line
+			if !applied[key][name] {
+				params = append(params, wanted[key][name])
+				applied[key][name] = true
+			}
+		}
+		if len(params) > 0 {
+			fmt.Fprintf(&out, "options %s %s\n", module, strings.Join(params, " "))
+		}
+	}
+
+	return []byte(out.String())
+}
+
+// moduleParamsOption reads ExtraOptions["moduleParams"], a map of module
+// name to a map of parameter to value, rendering each value the way
+// modprobe.d needs it. Booleans become 1 or 0, as every kernel parameter
+// type parses those.
+func moduleParamsOption(extra map[string]interface{}) (map[string]map[string]string, error) {
+	raw, ok := extra["moduleParams"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	modules, isMap := raw.(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("extraOptions.moduleParams: expected a map of module to params, got %T", raw)
+	}
+
+	params := make(map[string]map[string]string, len(modules))
+	for module, raw := range modules {
+		if !moduleNamePattern.MatchString(module) {
+			return nil, fmt.Errorf("extraOptions.moduleParams: invalid module name %q", module)
+		}
+		values, isMap := raw.(map[string]interface{})
+		if !isMap && raw != nil {
+			return nil, fmt.Errorf("extraOptions.moduleParams.%s: expected a map of param to value, got %T", module, raw)
+		}
+		params[module] = make(map[string]string, len(values))
+		for key, v := range values {
+			if !moduleParamPattern.MatchString(key) {
+				return nil, fmt.Errorf("extraOptions.moduleParams.%s: invalid parameter name %q", module, key)
+			}
+			var value string
+			switch v := v.(type) {
+			case string:
+				value = v
+			case bool:
+				value = "0"
+				if v {
+					value = "1"
+				}
+			case int, float64:
+				value = fmt.Sprint(v)
+			default:
+				return nil, fmt.Errorf("extraOptions.moduleParams.%s.%s: expected a string, number or bool, got %T", module, key, v)
+			}
+			param, err := formatModuleParam(key, value)
+			if err != nil {
+				return nil, fmt.Errorf("extraOptions.moduleParams.%s.%s: %w", module, key, err)
+			}
+			params[module][key] = param
+		}
+	}
+	return params, nil
+}
+
+// formatModuleParam renders key=value for an options line. The kernel
+// splits module parameters at whitespace outside double quotes and has no
+// escapes, so a value with whitespace is quoted, and one with a double
+// quote or a control character, which would end the line, can't be given.
+func formatModuleParam(key, value string) (string, error) {
+	if i := strings.IndexFunc(value, func(r rune) bool { return r == '"' || (unicode.IsControl(r) && r != '\t') }); i >= 0 {
+		return "", fmt.Errorf("value %q holds %q, which modprobe.d can't express", value, value[i])
+	}
+	// A trailing backslash would join the next line onto the options line
+	if strings.HasSuffix(value, "\\") {
+		return "", fmt.Errorf("value %q ends in a backslash, which modprobe.d would read as a line continuation", value)
+	}
+	if value == "" || strings.ContainsAny(value, " \t") {
+		value = `"` + value + `"`
+	}
+	return key + "=" + value, nil
+}
+
+// mergeModuleParams folds params into the options lines of the modules
+// they name. A parameter already set for the module is replaced in place,
+// comparing names with dashes and underscores alike as kmod does, and new
+// ones are appended in name order.
+func mergeModuleParams(options map[string]string, params map[string]map[string]string) map[string]string {
+	if len(params) == 0 {
+		return options
+	}
+
+	normalize := func(name string) string { return strings.ReplaceAll(name, "-", "_") }
+	merged := make(map[string]string, len(options)+len(params))
+	byModule := make(map[string]string, len(options))
+	for module, line := range options {
+		merged[module] = line
+		byModule[normalize(module)] = module
+	}
+
+	for module, values := range params {
+		if existing, ok := byModule[normalize(module)]; ok {
+			module = existing
+		}
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		args := splitModuleParams(merged[module])
+		for _, key := range keys {
+			replaced := false
+			for i, arg := range args {
+				name, _, _ := strings.Cut(arg, "=")
+				if normalize(name) == normalize(key) {
+					args[i] = values[key]
+					replaced = true
+				}
+			}
+			if !replaced {
+				args = append(args, values[key])
+			}
+		}
+		merged[module] = strings.Join(args, " ")
+	}
+	return merged
+}
+
+// splitModuleParams splits the parameters of an options line at whitespace
+// outside double quotes, as the kernel does when loading the module
+func splitModuleParams(params string) []string {
+	var args []string
+	var arg strings.Builder
+	quoted := false
+	for _, r := range params {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case !quoted && unicode.IsSpace(r):
+			if arg.Len() > 0 {
+				args = append(args, arg.String())
+				arg.Reset()
+			}
+			continue
+		}
+		arg.WriteRune(r)
+	}
+	if arg.Len() > 0 {
+		args = append(args, arg.String())
+	}
+	return args
+}
@@ -0,0 +1,267 @@
+package overlay
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// modprobeCommands are the commands a modprobe.d line may start with
+var modprobeCommands = []string{"alias", "blacklist", "install", "options", "remove", "softdep"}
+
+// checkModprobeSyntax fails the test unless every line of a modprobe.d file
+// is blank, a comment or a modprobe.d command, with options lines reading
+// "options <module> <param>[=<value>] ..." with names kmod accepts and
+// double quotes balanced
+func checkModprobeSyntax(t *testing.T, data []byte) {
+	t.Helper()
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		t.Errorf("modprobe.d file doesn't end in a newline: %q", data)
+	}
+	for i, line := range configLines(data) {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		fields := strings.Fields(trimmed)
+		if !slices.Contains(modprobeCommands, fields[0]) || len(fields) < 2 {
+			t.Errorf("line %d: not a modprobe.d command: %q", i+1, line)
+			continue
+		}
+		if fields[0] != "options" {
+			continue
+		}
+		if len(fields) < 3 {
+			t.Errorf("line %d: options without parameters: %q", i+1, line)
+			continue
+		}
+		if !moduleNamePattern.MatchString(fields[1]) {
+			t.Errorf("line %d: invalid module name %q", i+1, fields[1])
+		}
+		if strings.Count(trimmed, `"`)%2 != 0 {
+			t.Errorf("line %d: unbalanced quotes: %q", i+1, line)
+		}
+		if strings.HasSuffix(trimmed, `\`) {
+			t.Errorf("line %d: continues onto the next line: %q", i+1, line)
+		}
+		rest := strings.TrimSpace(trimmed[len("options"):])
+		for _, param := range splitModuleParams(rest[len(fields[1]):]) {
+			name, _, _ := strings.Cut(param, "=")
+			if !moduleParamPattern.MatchString(name) {
+				t.Errorf("line %d: invalid parameter name %q", i+1, name)
+			}
+		}
+	}
+}
+
+// shippedModprobe is the modprobe.d file the overlay ships, shortened
+const shippedModprobe = `# NVIDIA kernel module configuration
+
+# Device file permissions
+options nvidia NVreg_DeviceFileUID=0
+options nvidia NVreg_DeviceFileMode=0666
+
+# Preserve video memory allocations
+options nvidia NVreg_PreserveVideoMemoryAllocations=1
+`
+
+func TestMergeModprobeOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		existing string
+		options  map[string]string
+		want     string
+	}{
+		{
+			name:    "new file",
+			options: defaultModprobeOptions,
+			want: "# Added by " + Name + "\n" +
+				"options nvidia NVreg_OpenRmEnableUnsupportedGpus=1\n" +
+				"options nvidia_drm modeset=1\n",
+		},
+		{
+			name:     "shipped lines and blank lines kept",
+			existing: shippedModprobe,
+			options:  defaultModprobeOptions,
+			want: shippedModprobe +
+				"options nvidia NVreg_OpenRmEnableUnsupportedGpus=1\n" +
+				"options nvidia_drm modeset=1\n",
+		},
+		{
+			name:     "parameter set in place",
+			existing: shippedModprobe,
+			options:  map[string]string{"nvidia": "NVreg_DeviceFileMode=0660 NVreg_EnableGpuFirmware=1"},
+			want: strings.Replace(shippedModprobe, "NVreg_DeviceFileMode=0666", "NVreg_DeviceFileMode=0660", 1) +
+				"options nvidia NVreg_EnableGpuFirmware=1\n",
+		},
+		{
+			name:     "parameters of a line set separately",
+			existing: "options nvidia NVreg_DeviceFileUID=0 NVreg_DeviceFileGID=0\n",
+			options:  map[string]string{"nvidia": "NVreg_DeviceFileGID=44"},
+			want:     "options nvidia NVreg_DeviceFileUID=0 NVreg_DeviceFileGID=44\n",
+		},
+		{
+			name:     "dashes and underscores alike",
+			existing: "options nvidia-drm modeset=0\n",
+			options:  map[string]string{"nvidia_drm": "modeset=1"},
+			want:     "options nvidia-drm modeset=1\n",
+		},
+		{
+			name:    "module listed under two spellings",
+			options: map[string]string{"nvidia-drm": "modeset=1", "nvidia_drm": "modeset=1"},
+			want:    "# Added by " + Name + "\noptions nvidia-drm modeset=1\n",
+		},
+		{
+			name:     "quoted value replaced",
+			existing: "options nvidia NVreg_RegistryDwords=\"RMUseSwI2c=1; RMI2cSpeed=100\"\n",
+			options:  map[string]string{"nvidia": `NVreg_RegistryDwords="RmEnableAggressiveVblank=1"`},
+			want:     "options nvidia NVreg_RegistryDwords=\"RmEnableAggressiveVblank=1\"\n",
+		},
+		{
+			name:     "other modules and directives untouched",
+			existing: "blacklist nouveau\noptions nouveau modeset=0\n# options nvidia NVreg_Foo=1\n",
+			options:  map[string]string{"nvidia": "NVreg_Foo=2"},
+			want:     "blacklist nouveau\noptions nouveau modeset=0\n# options nvidia NVreg_Foo=1\noptions nvidia NVreg_Foo=2\n",
+		},
+		{
+			name:     "missing final newline",
+			existing: "options nvidia NVreg_Foo=1",
+			options:  map[string]string{"nvidia": "NVreg_Foo=1"},
+			want:     "options nvidia NVreg_Foo=1\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeModprobeOptions([]byte(tc.existing), tc.options)
+			if string(got) != tc.want {
+				t.Errorf("mergeModprobeOptions() =\n%s\nwant\n%s", got, tc.want)
+			}
+			if again := mergeModprobeOptions(got, tc.options); string(again) != string(got) {
+				t.Errorf("merging again changed the file to\n%s", again)
+			}
+			checkModprobeSyntax(t, got)
+		})
+	}
+}
+
+func TestMergeModulesLoad(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		existing string
+		modules  []string
+		want     string
+	}{
+		{
+			name:    "new file",
+			modules: []string{"nvidia", "nvidia_uvm"},
+			want:    "# Added by " + Name + "\nnvidia\nnvidia_uvm\n",
+		},
+		{
+			name:     "comments and blank lines kept",
+			existing: "# Core driver\nnvidia\n\n# Modesetting\nnvidia-modeset\n",
+			modules:  []string{"nvidia", "nvidia_modeset", "nvidia_drm"},
+			want:     "# Core driver\nnvidia\n\n# Modesetting\nnvidia-modeset\nnvidia_drm\n",
+		},
+		{
+			name:     "duplicates dropped",
+			existing: "nvidia\nnvidia\n",
+			modules:  []string{"nvidia"},
+			want:     "nvidia\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeModulesLoad([]byte(tc.existing), tc.modules)
+			if string(got) != tc.want {
+				t.Errorf("mergeModulesLoad() =\n%s\nwant\n%s", got, tc.want)
+			}
+			if again := mergeModulesLoad(got, tc.modules); string(again) != string(got) {
+				t.Errorf("merging again changed the file to\n%s", again)
+			}
+		})
+	}
+}
+
+func TestModuleParamsOption(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		value interface{}
+		// want is the rendered param, or empty when the value is rejected
+		want string
+	}{
+		{"single word", "ttyS0", "p=ttyS0"},
+		{"multi-word", "low latency mode", `p="low latency mode"`},
+		{"tab", "a\tb", "p=\"a\tb\""},
+		{"empty", "", `p=""`},
+		{"special characters", "a,b;c=d:e/f$g'h*", "p=a,b;c=d:e/f$g'h*"},
+		{"special characters and spaces", "vendor's #1 = best", `p="vendor's #1 = best"`},
+		{"backslash inside", `C:\fw dir`, `p="C:\fw dir"`},
+		{"bool", true, "p=1"},
+		{"int", 256, "p=256"},
+		{"double quote", `say "hi"`, ""},
+		{"newline", "a\nb", ""},
+		{"trailing backslash", `dir\`, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			params, err := moduleParamsOption(map[string]interface{}{
+				"moduleParams": map[string]interface{}{"nvidia": map[string]interface{}{"p": tc.value}},
+			})
+			if tc.want == "" {
+				if err == nil {
+					t.Fatalf("value %q accepted as %q", tc.value, params["nvidia"]["p"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := params["nvidia"]["p"]; got != tc.want {
+				t.Errorf("param = %q, want %q", got, tc.want)
+			}
+
+			// The kernel must split the options line back into the one param
+			merged := mergeModprobeOptions(nil, mergeModuleParams(defaultModprobeOptions, params))
+			checkModprobeSyntax(t, merged)
+			for _, line := range configLines(merged) {
+				if rest, ok := strings.CutPrefix(line, "options nvidia "); ok {
+					if args := splitModuleParams(rest); !slices.Contains(args, tc.want) {
+						t.Errorf("options line %q splits into %q, missing %q", line, args, tc.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInstallModuleParams(t *testing.T) {
+	overlayPath := testOverlay().Build(t)
+	rootfs := testutil.Rootfs(t, testKver)
+	extra := map[string]interface{}{
+		"moduleParams": map[string]interface{}{
+			"nvidia": map[string]interface{}{
+				"NVreg_RegistryDwords":              "RMForceStaticBar1=1; RmGpuLocked=0",
+				"NVreg_OpenRmEnableUnsupportedGpus": false,
+			},
+			"nvidia-uvm": map[string]interface{}{"uvm_perf_prefetch_enable": 1},
+		},
+	}
+
+	// The second install must replace its params rather than add more
+	for i := range 2 {
+		if err := runInstallTest(t, overlayPath, rootfs, extra); err != nil {
+			t.Fatalf("install %d: %v", i+1, err)
+		}
+	}
+
+	data := readTestFile(t, rootfs, modprobeFile)
+	checkModprobeSyntax(t, []byte(data))
+	want := []string{
+		"# Added by " + Name,
+		`options nvidia NVreg_OpenRmEnableUnsupportedGpus=0 NVreg_RegistryDwords="RMForceStaticBar1=1; RmGpuLocked=0"`,
+		"options nvidia-uvm uvm_perf_prefetch_enable=1",
+		"options nvidia_drm modeset=1",
+	}
+	if got := configLines([]byte(data)); !slices.Equal(got, want) {
+		t.Errorf("%s lines = %q, want %q", modprobeFile, got, want)
+	}
+}
@@ -0,0 +1,167 @@
+package overlay
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// parseModulesDep reads a modules.dep into each module's path and the
+// paths of the modules it depends on
+func parseModulesDep(data []byte) (map[string][]string, error) {
+	deps := make(map[string][]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		path, rest, ok := strings.Cut(text, ":")
+		if !ok || path == "" {
+			return nil, fmt.Errorf("line %d: expected \"module: dependencies\"", line)
+		}
+		deps[path] = strings.Fields(rest)
+	}
+	return deps, scanner.Err()
+}
+
+// parseModulesSymbols reads a modules.symbols into the module exporting
+// each symbol
+func parseModulesSymbols(data []byte) map[string]string {
+	exporters := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[0] != "alias" {
+			continue
+		}
+		if sym, ok := strings.CutPrefix(fields[1], "symbol:"); ok {
+			exporters[sym] = fields[2]
+		}
+	}
+	return exporters
+}
+
+// checkModulesDep validates the modules.dep of kverDir, under rootfsPath,
+// after depmod: every module it references must exist, and each of the
+// given installed modules must be listed with the modules exporting the
+// symbols it needs, per modules.symbols. Symbols no module exports come
+// from the kernel itself.
+func checkModulesDep(fsys filesystem, rootfsPath, kverDir string, installed []string) error {
+	depPath := filepath.Join(kverDir, "modules.dep")
+	data, err := fsys.ReadFile(depPath)
+	if err != nil {
+		return err
+	}
+	deps, err := parseModulesDep(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", depPath, err)
+	}
+
+	var errs []error
+
+	// Older depmod wrote absolute paths, which are relative to the rootfs
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return filepath.Join(rootfsPath, path)
+		}
+		return filepath.Join(kverDir, filepath.FromSlash(path))
+	}
+	dangling := make(map[string]bool)
+	for path, needs := range deps {
+		for _, p := range append([]string{path}, needs...) {
+			if _, err := fsys.Stat(resolve(p)); err != nil && !dangling[p] {
+				dangling[p] = true
+				errs = append(errs, fmt.Errorf("%s references %s, which does not exist", depPath, p))
+			}
+		}
+	}
+
+	var exporters map[string]string
+	if data, err := fsys.ReadFile(filepath.Join(kverDir, "modules.symbols")); err == nil {
+		exporters = parseModulesSymbols(data)
+	}
+
+	for _, rel := range installed {
+		needs, ok := deps[rel]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s does not list %s", depPath, rel))
+			continue
+		}
+		if exporters == nil {
+			continue
+		}
+
+		listed := make(map[string]bool)
+		for _, dep := range needs {
+			listed[moduleName(dep)] = true
+		}
+		info, err := inspectModule(fsys, filepath.Join(kverDir, filepath.FromSlash(rel)))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		missing := make(map[string]bool)
+		for _, sym := range info.needs {
+			if mod, ok := exporters[sym]; ok && mod != info.name && !listed[mod] {
+				missing[mod] = true
+			}
+		}
+		if len(missing) > 0 {
+			names := make([]string, 0, len(missing))
+			for name := range missing {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			errs = append(errs, fmt.Errorf("%s lists %s without its dependencies %s", depPath, rel, strings.Join(names, ", ")))
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errors.Join(errs...)
+}
+
+// checkModuleDeps runs checkModulesDep for every kernel the install put
+// modules into, catching a depmod run against an incomplete tree
+func (inst *Installer) checkModuleDeps() error {
+	if inst.cfg.dryRun {
+		slog.Debug("Skipping modules.dep check in dry run")
+		return nil
+	}
+
+	installed := make(map[string][]string)
+	for _, entry := range inst.manifest.Files {
+		if !entry.Mode.IsRegular() {
+			continue
+		}
+		if kver, ok := inst.moduleKernelVersion(entry.Path); ok {
+			rel := strings.TrimPrefix(entry.Path, inst.cfg.modulesDir+"/"+kver+"/")
+			installed[kver] = append(installed[kver], rel)
+		}
+	}
+
+	kvers := make([]string, 0, len(installed))
+	for kver := range installed {
+		kvers = append(kvers, kver)
+	}
+	sort.Strings(kvers)
+
+	var errs []error
+	for _, kver := range kvers {
+		kverDir := filepath.Join(inst.rootfsPath, filepath.FromSlash(inst.cfg.modulesDir), kver)
+		if err := checkModulesDep(inst.fs, inst.rootfsPath, kverDir, installed[kver]); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("🔗 Module dependencies check out", "kver", kver, "modules", len(installed[kver]))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("modules.dep check failed: %w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,593 @@
+package overlay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// moduleExtensions lists the kernel module file suffixes kmod understands
+var moduleExtensions = []string{".ko", ".ko.xz", ".ko.zst", ".ko.gz"}
+
+// isKernelModule reports whether a file name looks like a kernel module
+func isKernelModule(name string) bool {
+	for _, ext := range moduleExtensions {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleName returns the name kmod uses for a module file,
+// e.g. kernel/drivers/gpu/nvidia-drm.ko.zst becomes nvidia_drm
+func moduleName(path string) string {
+	name := filepath.Base(path)
+	if i := strings.Index(name, ".ko"); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// moduleCompressions maps compressed module suffixes to the kmod feature
+// flag that reports support for them
+var moduleCompressions = map[string]string{
+	".xz":  "XZ",
+	".zst": "ZSTD",
+	".gz":  "ZLIB",
+}
+
+// isCompressedModule reports whether a module file is compressed
+func isCompressedModule(name string) bool {
+	return isKernelModule(name) && !strings.HasSuffix(name, ".ko")
+}
+
+// readModule returns the uncompressed ELF image of a kernel module
+func readModule(fsys filesystem, path string) ([]byte, error) {
+	r, err := openModule(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// openModule opens a kernel module, decompressing it on the fly
+func openModule(fsys filesystem, path string) (io.ReadCloser, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return decompressModule(f, path)
+}
+
+// decompressModule wraps the module file f, named name, in the decompressor
+// its extension calls for. Closing the result closes f.
+func decompressModule(f io.ReadCloser, name string) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		dec, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &moduleReader{Reader: dec, close: func() error { dec.Close(); return f.Close() }}, nil
+	case strings.HasSuffix(name, ".xz"):
+		dec, err := xz.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &moduleReader{Reader: dec, close: f.Close}, nil
+	case strings.HasSuffix(name, ".gz"):
+		dec, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &moduleReader{Reader: dec, close: func() error { dec.Close(); return f.Close() }}, nil
+	}
+	return f, nil
+}
+
+// moduleReader closes both a decompressor and the file underneath it
+type moduleReader struct {
+	io.Reader
+	close func() error
+}
+
+func (r *moduleReader) Close() error {
+	return r.close()
+}
+
+// compressModule wraps w in the compressor the module name's extension
+// calls for, the inverse of decompressModule. The result must be closed to
+// flush it; closing it leaves w open.
+func compressModule(w io.Writer, name string) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		return zstd.NewWriter(w)
+	case strings.HasSuffix(name, ".xz"):
+		// The kernel's xz decompressor only knows CRC32 checks
+		return xz.WriterConfig{CheckSum: xz.CRC32}.NewWriter(w)
+	case strings.HasSuffix(name, ".gz"):
+		return gzip.NewWriter(w), nil
+	}
+	return nopWriteCloser{w}, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// kernelVersions lists the <kver> directories in a kernel-modules tree
+func kernelVersions(fsys filesystem, modulesDir string) ([]string, error) {
+	entries, err := fsys.ReadDir(modulesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			versions = append(versions, entry.Name())
+		}
+	}
+
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("cannot determine kernel version: no <kver> directories in %s", modulesDir)
+	}
+	return versions, nil
+}
+
+// detectKernelVersion finds the kernel the rootfs ships modules for under
+// modulesDir. Only trees holding modules.builtin count, since those come
+// from a kernel build rather than from an earlier overlay install.
+func detectKernelVersion(fsys filesystem, modulesDir string) (string, error) {
+	versions, err := installedKernels(fsys, modulesDir)
+	if err != nil {
+		return "", err
+	}
+
+	switch len(versions) {
+	case 0:
+		return "", fmt.Errorf("cannot detect kernel version: no kernel module trees in %s, set extraOptions.kernelVersion", modulesDir)
+	case 1:
+		return versions[0], nil
+	default:
+		return "", fmt.Errorf("cannot detect kernel version: %s holds several kernels (%s), set extraOptions.kernelVersion", modulesDir, strings.Join(versions, ", "))
+	}
+}
+
+// installedKernels lists the kernels with a module tree under modulesDir,
+// telling them by the modules.builtin a kernel build installs
+func installedKernels(fsys filesystem, modulesDir string) ([]string, error) {
+	entries, err := fsys.ReadDir(modulesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var versions []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := fsys.Stat(filepath.Join(modulesDir, entry.Name(), "modules.builtin")); err == nil {
+			versions = append(versions, entry.Name())
+		}
+	}
+	return versions, nil
+}
+
+// runDepmod regenerates the module dependency files for kver under
+// modulesDir, relative to the rootfs. The imager environment does not
+// always ship kmod, so without a depmod binary the text indexes are
+// generated directly. depmod itself only knows <base>/lib/modules, so
+// other layouts are generated directly too.
+func runDepmod(ctx context.Context, fsys filesystem, rootfsPath, modulesDir, kver string) error {
+	kverDir := filepath.Join(rootfsPath, filepath.FromSlash(modulesDir), kver)
+
+	base, ok := strings.CutSuffix("/"+modulesDir, "/lib/modules")
+	if !ok {
+		slog.Info("🔗 Non-standard modules directory, generating module dependencies", "phase", "kernel-modules", "kver", kver, "dir", modulesDir)
+		return generateModuleDeps(ctx, fsys, kverDir)
+	}
+
+	if depmod, err := exec.LookPath("depmod"); err == nil {
+		// depmod silently skips modules it can't decompress, which would
+		// leave them out of modules.dep
+		missing, err := unsupportedCompressions(ctx, fsys, depmod, kverDir)
+		if err != nil {
+			return err
+		}
+		if len(missing) == 0 {
+			slog.Info("🔗 Running depmod", "phase", "kernel-modules", "kver", kver)
+			cmd := exec.CommandContext(ctx, depmod, "-b", filepath.Join(rootfsPath, filepath.FromSlash(base)), kver)
+			cmd.Stdout = os.Stderr
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("depmod %s failed: %w", kver, err)
+			}
+			return nil
+		}
+		slog.Info("🔗 depmod lacks module compression support, generating module dependencies", "phase", "kernel-modules", "kver", kver, "compression", strings.Join(missing, " "))
+		return generateModuleDeps(ctx, fsys, kverDir)
+	}
+
+	slog.Info("🔗 depmod not found, generating module dependencies", "phase", "kernel-modules", "kver", kver)
+	return generateModuleDeps(ctx, fsys, kverDir)
+}
+
+// unsupportedCompressions lists the module compressions used under kverDir
+// that the kmod build behind depmod was compiled without
+func unsupportedCompressions(ctx context.Context, fsys filesystem, depmod, kverDir string) ([]string, error) {
+	used := make(map[string]bool)
+	err := fsys.Walk(kverDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && isCompressedModule(path) {
+			used[moduleCompressions[filepath.Ext(path)]] = true
+		}
+		return nil
+	})
+	if err != nil || len(used) == 0 {
+		return nil, err
+	}
+
+	// kmod prints its feature flags, e.g. "+ZSTD +XZ -ZLIB", with the version
+	out, _ := exec.CommandContext(ctx, depmod, "--version").Output()
+	features := strings.Fields(string(out))
+
+	var missing []string
+	for feature := range used {
+		if !slices.Contains(features, "+"+feature) {
+			missing = append(missing, feature)
+		}
+	}
+	sort.Strings(missing)
+	return missing, nil
+}
+
+// moduleInfo holds what depmod needs to know about a single module
+type moduleInfo struct {
+	// path is relative to the lib/modules/<kver> directory
+	path    string
+	name    string
+	exports []string
+	needs   []string
+	aliases []string
+}
+
+// inspectModule extracts exported and required symbols and aliases from a module
+func inspectModule(fsys filesystem, path string) (*moduleInfo, error) {
+	data, err := readModule(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer f.Close()
+
+	info := &moduleInfo{name: moduleName(path)}
+
+	if section := f.Section("__ksymtab_strings"); section != nil {
+		strs, err := section.Data()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		info.exports = splitNul(strs)
+	}
+
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, sym := range symbols {
+		if sym.Section == elf.SHN_UNDEF && sym.Name != "" {
+			info.needs = append(info.needs, sym.Name)
+		}
+	}
+
+	modinfo, err := readModinfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, field := range modinfo {
+		if value, ok := strings.CutPrefix(field, "alias="); ok {
+			info.aliases = append(info.aliases, value)
+		}
+	}
+
+	return info, nil
+}
+
+// moduleVersion returns the version field of a module's .modinfo, or ""
+// when the module doesn't declare one
+func moduleVersion(fsys filesystem, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readModuleVersion(f, path)
+}
+
+// readModuleVersion reads the .modinfo version= field of the module named
+// path from r
+func readModuleVersion(r io.Reader, path string) (string, error) {
+	dec, err := decompressModule(io.NopCloser(r), path)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	data, err := io.ReadAll(dec)
+	dec.Close()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	defer f.Close()
+
+	modinfo, err := readModinfo(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", path, err)
+	}
+	for _, field := range modinfo {
+		if value, ok := strings.CutPrefix(field, "version="); ok {
+			return value, nil
+		}
+	}
+	return "", nil
+}
+
+// moduleFirmware returns the firmware files a module declares in its
+// .modinfo firmware= tags, relative to lib/firmware
+func moduleFirmware(fsys filesystem, path string) ([]string, error) {
+	data, err := readModule(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer f.Close()
+
+	modinfo, err := readModinfo(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var firmware []string
+	for _, field := range modinfo {
+		if value, ok := strings.CutPrefix(field, "firmware="); ok {
+			firmware = append(firmware, value)
+		}
+	}
+	return firmware, nil
+}
+
+// Where kernel modules and firmware live in a standard rootfs, relative to
+// the rootfs. ExtraOptions["modulesDir"] and ["firmwareDir"] override them.
+const (
+	defaultModulesDir  = "lib/modules"
+	defaultFirmwareDir = "lib/firmware"
+)
+
+// firmwareCompressions are the suffixes the kernel's firmware loader tries
+// when the plain file is missing
+var firmwareCompressions = []string{"", ".xz", ".zst"}
+
+// missingFirmware lists, as "module: firmware", each firmware file the
+// given modules declare that isn't in any of firmwareDirs
+func missingFirmware(fsys filesystem, firmwareDirs []string, modules []string) ([]string, error) {
+	var missing []string
+	for _, module := range modules {
+		firmware, err := moduleFirmware(fsys, module)
+		if err != nil {
+			return nil, err
+		}
+		for _, fw := range firmware {
+			if !firmwarePresent(fsys, firmwareDirs, fw) {
+				missing = append(missing, fmt.Sprintf("%s: %s", moduleName(module), fw))
+			}
+		}
+	}
+	return missing, nil
+}
+
+// checkFirmware confirms that every firmware file the installed modules
+// declare is present in the rootfs, since a missing one only shows up as a
+// GPU that fails to initialise at boot. Unless requireFirmware is off,
+// missing firmware fails the install.
+func (inst *Installer) checkFirmware() error {
+	if inst.cfg.dryRun {
+		slog.Debug("Skipping firmware check in dry run")
+		return nil
+	}
+
+	var modules []string
+	for _, entry := range inst.manifest.Files {
+		if entry.Mode.IsRegular() && isKernelModule(entry.Path) {
+			modules = append(modules, rootfsJoin(inst.rootfsPath, entry.Path))
+		}
+	}
+
+	firmwareDir := filepath.Join(inst.rootfsPath, filepath.FromSlash(inst.cfg.firmwareDir))
+	missing, err := missingFirmware(inst.fs, firmwareSearchDirs(firmwareDir, inst.kver), modules)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		slog.Info("🔎 Module firmware present", "modules", len(modules))
+		return nil
+	}
+	if inst.cfg.requireFirmware {
+		return fmt.Errorf("%d firmware files missing from %s: %s", len(missing), firmwareDir, strings.Join(missing, ", "))
+	}
+	for _, m := range missing {
+		slog.Warn("⚠️  Module firmware missing", "firmware", m)
+	}
+	return nil
+}
+
+// readModinfo returns the key=value fields of a module's .modinfo section
+func readModinfo(f *elf.File) ([]string, error) {
+	section := f.Section(".modinfo")
+	if section == nil {
+		return nil, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+	return splitNul(data), nil
+}
+
+// splitNul splits a block of NUL terminated strings, dropping empty ones
+func splitNul(data []byte) []string {
+	var out []string
+	for _, s := range bytes.Split(data, []byte{0}) {
+		if len(s) > 0 {
+			out = append(out, string(s))
+		}
+	}
+	return out
+}
+
+// generateModuleDeps writes modules.dep, modules.alias and modules.symbols
+// for the modules under kverDir, the same text files depmod produces. The
+// binary indexes of an earlier depmod run are removed, since modprobe reads
+// them in preference to the text files and they would go stale.
+func generateModuleDeps(ctx context.Context, fsys filesystem, kverDir string) error {
+	var modules []*moduleInfo
+	err := fsys.Walk(kverDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || !isKernelModule(path) {
+			return nil
+		}
+		info, err := inspectModule(fsys, path)
+		if err != nil {
+			return err
+		}
+		if info.path, err = filepath.Rel(kverDir, path); err != nil {
+			return err
+		}
+		info.path = filepath.ToSlash(info.path)
+		modules = append(modules, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(modules, func(i, j int) bool { return modules[i].path < modules[j].path })
+
+	exporters := make(map[string]int)
+	for i, mod := range modules {
+		for _, sym := range mod.exports {
+			exporters[sym] = i
+		}
+	}
+
+	// Direct dependencies per module; symbols nothing exports come from vmlinux
+	deps := make([][]int, len(modules))
+	for i, mod := range modules {
+		seen := make(map[int]bool)
+		for _, sym := range mod.needs {
+			if j, ok := exporters[sym]; ok && j != i && !seen[j] {
+				seen[j] = true
+				deps[i] = append(deps[i], j)
+			}
+		}
+		sort.Ints(deps[i])
+	}
+
+	var dep, alias, symbols strings.Builder
+	alias.WriteString("# Aliases extracted from modules themselves.\n")
+	symbols.WriteString("# Aliases for symbols, used by symbol_request().\n")
+
+	for i, mod := range modules {
+		dep.WriteString(mod.path + ":")
+		for _, j := range moduleDepOrder(i, deps) {
+			dep.WriteString(" " + modules[j].path)
+		}
+		dep.WriteString("\n")
+
+		for _, a := range mod.aliases {
+			fmt.Fprintf(&alias, "alias %s %s\n", a, mod.name)
+		}
+		for _, sym := range mod.exports {
+			fmt.Fprintf(&symbols, "alias symbol:%s %s\n", sym, mod.name)
+		}
+	}
+
+	files := map[string]string{
+		"modules.dep":     dep.String(),
+		"modules.alias":   alias.String(),
+		"modules.symbols": symbols.String(),
+	}
+	for name, content := range files {
+		if err := fsys.WriteFile(filepath.Join(kverDir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+		if err := fsys.Remove(filepath.Join(kverDir, name+".bin")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// moduleDepOrder returns the transitive dependencies of a module in the order
+// modules.dep lists them: modprobe loads them from last to first, so every
+// module comes before the modules it depends on.
+func moduleDepOrder(start int, deps [][]int) []int {
+	var order []int
+	visited := map[int]bool{start: true}
+
+	var visit func(int)
+	visit = func(m int) {
+		for _, d := range deps[m] {
+			if !visited[d] {
+				visited[d] = true
+				visit(d)
+				order = append(order, d)
+			}
+		}
+	}
+	visit(start)
+
+	for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+		order[i], order[j] = order[j], order[i]
+	}
+	return order
+}
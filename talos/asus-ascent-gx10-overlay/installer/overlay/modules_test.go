@@ -0,0 +1,85 @@
+package overlay
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// compressTest compresses data as the module file name's extension says
+func compressTest(t *testing.T, name string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := compressModule(&buf, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestInstallCompressedModules(t *testing.T) {
+	const dir = "kernel/drivers/gpu/"
+	module := testModule("firmware=nvidia/gsp.bin").Data
+
+	for _, tc := range []struct {
+		name       string
+		file       string
+		decompress bool
+		// want is the module's name in the rootfs
+		want string
+	}{
+		{"xz pass-through", "nvidia.ko.xz", false, "nvidia.ko.xz"},
+		{"zstd pass-through", "nvidia.ko.zst", false, "nvidia.ko.zst"},
+		{"gzip pass-through", "nvidia.ko.gz", false, "nvidia.ko.gz"},
+		{"xz decompressed", "nvidia.ko.xz", true, "nvidia.ko"},
+		{"zstd decompressed", "nvidia.ko.zst", true, "nvidia.ko"},
+		{"uncompressed", "nvidia.ko", true, "nvidia.ko"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			shipped := compressTest(t, tc.file, []byte(module))
+			fixture := testOverlay()
+			fixture.KernelModules = testutil.Tree{
+				testKver + "/" + dir + tc.file: testutil.File(string(shipped)),
+			}
+			overlayPath := fixture.Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+
+			extra := map[string]interface{}{"decompressModules": tc.decompress}
+			if err := runInstallTest(t, overlayPath, rootfs, extra); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			if err := verifyTest(t, rootfs, extra); err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+
+			kverDir := "lib/modules/" + testKver + "/"
+			want := module
+			if tc.file == tc.want {
+				// Passed through byte for byte
+				want = string(shipped)
+			}
+			if got := readTestFile(t, rootfs, kverDir+dir+tc.want); got != want {
+				t.Errorf("%s does not hold the %s module", tc.want, tc.name)
+			}
+			if tc.file != tc.want {
+				if _, err := os.Lstat(filepath.Join(rootfs, kverDir, dir, tc.file)); !os.IsNotExist(err) {
+					t.Errorf("%s installed alongside %s: %v", tc.file, tc.want, err)
+				}
+			}
+			dep := readTestFile(t, rootfs, kverDir+"modules.dep")
+			if !strings.Contains(dep, dir+tc.want+":") {
+				t.Errorf("modules.dep does not list %s:\n%s", tc.want, dep)
+			}
+		})
+	}
+}
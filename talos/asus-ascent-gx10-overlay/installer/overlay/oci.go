@@ -0,0 +1,483 @@
+package overlay
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Manifest media types understood when pulling an artifact
+const (
+	mediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex       = "application/vnd.oci.image.index.v1+json"
+	mediaTypeDockerManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerList     = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// artifactPlatform is the platform picked from multi-arch artifact indexes
+const artifactPlatform = "linux/arm64"
+
+// Registry responses are read at most this far. Blobs are bounded by the
+// size their descriptor gives instead.
+const (
+	maxManifestSize = 4 << 20
+	maxTokenSize    = 1 << 20
+)
+
+// ociDescriptor points at a manifest or blob by digest
+type ociDescriptor struct {
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	Platform  *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+// ociManifest covers both image manifests and indexes
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests,omitempty"`
+	Layers    []ociDescriptor `json:"layers,omitempty"`
+}
+
+// ociReference is a parsed registry/repository[:tag|@digest] reference
+type ociReference struct {
+	registry   string
+	repository string
+	// reference is the tag or digest to pull
+	reference string
+}
+
+// parseReference splits an artifact reference. Like docker, a first path
+// component without a dot or port is treated as a docker.io repository.
+func parseReference(ref string) (*ociReference, error) {
+	parsed := &ociReference{registry: "registry-1.docker.io"}
+
+	rest := ref
+	if i := strings.Index(rest, "/"); i >= 0 {
+		host := rest[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			parsed.registry = host
+			rest = rest[i+1:]
+		}
+	}
+
+	if i := strings.Index(rest, "@"); i >= 0 {
+		parsed.repository, parsed.reference = rest[:i], rest[i+1:]
+	} else if i := strings.LastIndex(rest, ":"); i >= 0 && !strings.Contains(rest[i:], "/") {
+		parsed.repository, parsed.reference = rest[:i], rest[i+1:]
+	} else {
+		parsed.repository, parsed.reference = rest, "latest"
+	}
+
+	if parsed.repository == "" || parsed.reference == "" {
+		return nil, fmt.Errorf("invalid artifact reference %q", ref)
+	}
+	if parsed.registry == "registry-1.docker.io" && !strings.Contains(parsed.repository, "/") {
+		parsed.repository = "library/" + parsed.repository
+	}
+	return parsed, nil
+}
+
+// registryClient talks to an OCI distribution registry
+type registryClient struct {
+	http   *http.Client
+	scheme string
+	ref    *ociReference
+	token  string
+}
+
+// get fetches a registry path, obtaining an anonymous bearer token if the
+// registry asks for one
+func (c *registryClient) get(ctx context.Context, path, accept string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s/v2/%s/%s", c.scheme, c.ref.registry, c.ref.repository, path), nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := c.authenticate(ctx, challenge); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// authenticate requests an anonymous token for a Bearer challenge
+func (c *registryClient) authenticate(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	fields := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		fields[key] = strings.Trim(value, `"`)
+	}
+	if fields["realm"] == "" {
+		return fmt.Errorf("registry auth challenge has no realm: %q", challenge)
+	}
+
+	query := url.Values{}
+	if fields["service"] != "" {
+		query.Set("service", fields["service"])
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", c.ref.repository))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fields["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get registry token: %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxTokenSize)).Decode(&token); err != nil {
+		return fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+// fetchManifest downloads a manifest and checks it against digest when given
+func (c *registryClient) fetchManifest(ctx context.Context, reference, digest string) (*ociManifest, string, error) {
+	accept := strings.Join([]string{mediaTypeOCIManifest, mediaTypeOCIIndex, mediaTypeDockerManifest, mediaTypeDockerList}, ", ")
+	resp, err := c.get(ctx, "manifests/"+reference, accept)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxManifestSize {
+		return nil, "", fmt.Errorf("manifest %s is larger than %d bytes", reference, maxManifestSize)
+	}
+
+	sum := sha256.Sum256(body)
+	actual := "sha256:" + hex.EncodeToString(sum[:])
+	if digest != "" && actual != digest {
+		return nil, "", fmt.Errorf("manifest digest mismatch: got %s, expected %s", actual, digest)
+	}
+
+	var manifest ociManifest
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = resp.Header.Get("Content-Type")
+	}
+	return &manifest, actual, nil
+}
+
+// fetchBlob downloads a blob to path, failing unless its size and digest
+// match the descriptor's
+func (c *registryClient) fetchBlob(ctx context.Context, desc ociDescriptor, path string) error {
+	expected, ok := strings.CutPrefix(desc.Digest, "sha256:")
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm in %s", desc.Digest)
+	}
+	if desc.Size <= 0 {
+		return fmt.Errorf("blob %s has no size", desc.Digest)
+	}
+
+	resp, err := c.get(ctx, "blobs/"+desc.Digest, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// One byte past the size is enough to tell the blob is too long
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, desc.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != desc.Size {
+		return fmt.Errorf("blob %s size mismatch: expected %d bytes", desc.Digest, desc.Size)
+	}
+	if actual := hex.EncodeToString(hash.Sum(nil)); actual != expected {
+		return fmt.Errorf("blob digest mismatch: got sha256:%s, expected %s", actual, desc.Digest)
+	}
+	return f.Close()
+}
+
+// fetchArtifact pulls the artifact ref and unpacks its layers into a new temp
+// directory laid out like an overlay. The manifest has to be pinned, by a
+// digest in ref or by pinnedDigest, since nothing else authenticates it;
+// when both are given they must agree. Every blob is verified before
+// anything is unpacked. cleanup removes the temp directory.
+func fetchArtifact(ctx context.Context, ref, pinnedDigest string, plainHTTP bool) (path string, cleanup func(), err error) {
+	parsed, err := parseReference(ref)
+	if err != nil {
+		return "", nil, err
+	}
+
+	client := &registryClient{http: http.DefaultClient, scheme: "https", ref: parsed}
+	if plainHTTP {
+		client.scheme = "http"
+	}
+
+	digest := pinnedDigest
+	if strings.HasPrefix(parsed.reference, "sha256:") {
+		if digest != "" && digest != parsed.reference {
+			return "", nil, fmt.Errorf("artifact reference digest %s does not match artifactDigest %s", parsed.reference, digest)
+		}
+		digest = parsed.reference
+	}
+	if digest == "" {
+		return "", nil, fmt.Errorf("artifact reference %s is not pinned to a digest", ref)
+	}
+
+	manifest, actual, err := client.fetchManifest(ctx, parsed.reference, digest)
+	if err != nil {
+		return "", nil, err
+	}
+	slog.Info("📥 Fetching overlay artifact", "ref", ref, "digest", actual)
+
+	if manifest.MediaType == mediaTypeOCIIndex || manifest.MediaType == mediaTypeDockerList {
+		desc, err := selectPlatform(manifest.Manifests)
+		if err != nil {
+			return "", nil, err
+		}
+		if manifest, _, err = client.fetchManifest(ctx, desc.Digest, desc.Digest); err != nil {
+			return "", nil, err
+		}
+	}
+	if len(manifest.Layers) == 0 {
+		return "", nil, fmt.Errorf("artifact %s has no layers", ref)
+	}
+
+	dir, err := os.MkdirTemp("", "gx10-overlay-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	// Download and verify every layer before unpacking any of them
+	blobs := make([]string, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		blobs[i] = filepath.Join(dir, fmt.Sprintf("layer-%d", i))
+		if err := client.fetchBlob(ctx, layer, blobs[i]); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+	}
+
+	root := filepath.Join(dir, "overlay")
+	for i, layer := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		if err := unpackLayer(blobs[i], layer.MediaType, root); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("failed to unpack layer %s: %w", layer.Digest, err)
+		}
+		os.Remove(blobs[i])
+	}
+	return root, cleanup, nil
+}
+
+// selectPlatform picks the artifactPlatform manifest from an index
+func selectPlatform(manifests []ociDescriptor) (ociDescriptor, error) {
+	for _, desc := range manifests {
+		if desc.Platform != nil && desc.Platform.OS+"/"+desc.Platform.Architecture == artifactPlatform {
+			return desc, nil
+		}
+	}
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+	return ociDescriptor{}, fmt.Errorf("artifact index has no %s manifest", artifactPlatform)
+}
+
+// unpackLayer extracts a tar layer, optionally gzip or zstd compressed
+func unpackLayer(path, mediaType, root string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(mediaType, "+gzip") || strings.HasSuffix(mediaType, ".gzip"):
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case strings.HasSuffix(mediaType, "+zstd") || strings.HasSuffix(mediaType, ".zstd"):
+		dec, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		r = dec
+	}
+	return extractTar(r, root)
+}
+
+// extractTar unpacks a tar stream under root. Entries that would land outside
+// root, directly or through a previously extracted symlink, are rejected.
+func extractTar(r io.Reader, root string) error {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path, err := securePath(root, hdr.Name)
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, mode); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			// Never write through a symlink left by an earlier entry
+			os.Remove(path)
+			f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
+				return err
+			}
+			if err := f.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			os.Remove(path)
+			if err := os.Symlink(hdr.Linkname, path); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			target, err := securePath(root, hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			os.Remove(path)
+			if err := os.Link(target, path); err != nil {
+				return err
+			}
+		default:
+			slog.Warn("⚠️  Skipping unsupported tar entry", "name", hdr.Name, "type", string(hdr.Typeflag))
+		}
+	}
+}
+
+// securePath resolves a tar entry name under root, refusing names that
+// escape it, including via symlinks already present in the tree
+func securePath(root, name string) (string, error) {
+	path := filepath.Join(root, filepath.Clean("/"+name))
+	if path == root {
+		return path, nil
+	}
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		// Walk up to the deepest parent that exists and check that instead
+		parent = filepath.Dir(path)
+		for {
+			parent = filepath.Dir(parent)
+			resolved, err := filepath.EvalSymlinks(parent)
+			if err == nil {
+				parent = resolved
+				break
+			}
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+	}
+
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if parent != resolvedRoot && !strings.HasPrefix(parent, resolvedRoot+string(filepath.Separator)) {
+		return "", fmt.Errorf("tar entry %q escapes the extraction directory", name)
+	}
+	return path, nil
+}
@@ -0,0 +1,145 @@
+package overlay
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRegistry serves one artifact, gx10/overlay:v1, from an in-memory
+// registry and returns its host and manifest digest
+func testRegistry(t *testing.T, layer []byte, layerSize int64) (string, string) {
+	t.Helper()
+	layerDigest := "sha256:" + sha256Hex(string(layer))
+	manifest, err := json.Marshal(ociManifest{
+		MediaType: mediaTypeOCIManifest,
+		Layers:    []ociDescriptor{{MediaType: "application/vnd.oci.image.layer.v1.tar", Digest: layerDigest, Size: layerSize}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := "sha256:" + sha256Hex(string(manifest))
+
+	mux := http.NewServeMux()
+	serveManifest := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", mediaTypeOCIManifest)
+		w.Write(manifest)
+	}
+	mux.HandleFunc("/v2/gx10/overlay/manifests/v1", serveManifest)
+	mux.HandleFunc("/v2/gx10/overlay/manifests/"+manifestDigest, serveManifest)
+	mux.HandleFunc("/v2/gx10/overlay/blobs/"+layerDigest, func(w http.ResponseWriter, r *http.Request) {
+		w.Write(layer)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), manifestDigest
+}
+
+// testLayer returns an uncompressed tar layer holding one firmware file
+func testLayer(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	data := []byte("gsp")
+	if err := tw.WriteHeader(&tar.Header{Name: "install/firmware/gsp.bin", Mode: 0o644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(data)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchArtifact(t *testing.T) {
+	layer := testLayer(t)
+
+	for _, tc := range []struct {
+		name string
+		// ref and pinned are given the registry host and manifest digest
+		ref       func(host, digest string) string
+		pinned    func(digest string) string
+		layerSize int64
+		wantErr   string
+	}{
+		{
+			name:   "digest reference",
+			ref:    func(host, digest string) string { return host + "/gx10/overlay@" + digest },
+			pinned: func(string) string { return "" },
+		},
+		{
+			name:   "tag with artifactDigest",
+			ref:    func(host, _ string) string { return host + "/gx10/overlay:v1" },
+			pinned: func(digest string) string { return digest },
+		},
+		{
+			name:    "tag only",
+			ref:     func(host, _ string) string { return host + "/gx10/overlay:v1" },
+			pinned:  func(string) string { return "" },
+			wantErr: "not pinned",
+		},
+		{
+			name:    "wrong artifactDigest",
+			ref:     func(host, _ string) string { return host + "/gx10/overlay:v1" },
+			pinned:  func(string) string { return "sha256:" + sha256Hex("other") },
+			wantErr: "manifest digest mismatch",
+		},
+		{
+			// The registry sends more than the descriptor it signed for
+			name:      "oversized blob",
+			ref:       func(host, digest string) string { return host + "/gx10/overlay@" + digest },
+			pinned:    func(string) string { return "" },
+			layerSize: 512,
+			wantErr:   "size mismatch",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			size := tc.layerSize
+			if size == 0 {
+				size = int64(len(layer))
+			}
+			host, digest := testRegistry(t, layer, size)
+
+			path, cleanup, err := fetchArtifact(context.Background(), tc.ref(host, digest), tc.pinned(digest), true)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("fetchArtifact() = %v, want error containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanup()
+			data, err := os.ReadFile(filepath.Join(path, "install/firmware/gsp.bin"))
+			if err != nil || string(data) != "gsp" {
+				t.Errorf("unpacked gsp.bin = %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestArtifactRefOption(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		extra   map[string]interface{}
+		wantErr bool
+	}{
+		{name: "digest reference", extra: map[string]interface{}{"artifactRef": "ghcr.io/gx10/overlay@sha256:" + sha256Hex("m")}},
+		{name: "tag with artifactDigest", extra: map[string]interface{}{"artifactRef": "ghcr.io/gx10/overlay:v1", "artifactDigest": "sha256:" + sha256Hex("m")}},
+		{name: "tag only", extra: map[string]interface{}{"artifactRef": "ghcr.io/gx10/overlay:v1"}, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseInstallConfig(tc.extra, nil); (err != nil) != tc.wantErr {
+				t.Errorf("parseInstallConfig() error = %v, want error %v", err, tc.wantErr)
+			}
+		})
+	}
+}
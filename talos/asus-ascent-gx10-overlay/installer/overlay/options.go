@@ -0,0 +1,780 @@
+package overlay
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// extraOptionKeys lists every ExtraOptions key the installer understands.
+// validate-options reports anything else, so new options must be added here.
+var extraOptionKeys = []string{
+	"artifactDigest",
+	"artifactPlainHTTP",
+	"artifactRef",
+	"cdiMounts",
+	"cdiSpec",
+	"cleanupOnNoSpace",
+	"copyBufferKiB",
+	"copySpecial",
+	"decompressModules",
+	"dedupe",
+	"diff",
+	"dirMode",
+	"dryRun",
+	"enableBackup",
+	"exclude",
+	"expectedDriverVersion",
+	"firmwareCoverage",
+	"firmwareDir",
+	"firmwareUpdatesDir",
+	"firmwareInclude",
+	"firmwareReference",
+	"force",
+	"fsync",
+	"gpuCount",
+	"gpuUUIDs",
+	"hooks",
+	"incremental",
+	"installContainerToolkitConfig",
+	"keepGoing",
+	"kernelArgs",
+	"kernelVersion",
+	"loadModules",
+	"logFormat",
+	"logLevel",
+	"modprobeOptions",
+	"moduleParams",
+	"moduleSigningCert",
+	"modulesDir",
+	"onCompressionMismatch",
+	"onConflict",
+	"outputFormat",
+	"overlayPath",
+	"parallel",
+	"preserveXattrs",
+	"profile",
+	"requireArtifacts",
+	"requireFirmware",
+	"requireInstalledKernel",
+	"requireSignedModules",
+	"retryAttempts",
+	"retryBackoffMs",
+	"sbom",
+	"signingKey",
+	"since",
+	"skipSpaceCheck",
+	"stateDir",
+	"stripModules",
+	"targetArch",
+	"targetPrefix",
+	"timeoutSeconds",
+	"udevRules",
+	"verbosity",
+	"verifyKey",
+}
+
+// installConfig holds the ExtraOptions and flags that shape an install run
+type installConfig struct {
+	// dryRun reports what would be installed without writing anything
+	dryRun bool
+
+	// diff is a dry run that also prints the files it would add, change
+	// and remove compared to the installed manifest
+	diff bool
+
+	// skipSpaceCheck disables the free space precheck on the rootfs
+	skipSpaceCheck bool
+
+	// workers is the number of files copied concurrently, at least 1
+	workers int
+
+	// artifactRef is an OCI artifact to pull the overlay contents from
+	artifactRef string
+
+	// artifactDigest pins the manifest digest artifactRef must resolve to
+	artifactDigest string
+
+	// artifactPlainHTTP talks to the registry without TLS
+	artifactPlainHTTP bool
+
+	// verifyKey is a PEM public key or certificate, inline or as a path,
+	// that must have signed the overlay's digest listing
+	verifyKey string
+
+	// profile selects one of the overlay's profiles directories as the
+	// artifacts to install
+	profile string
+
+	// kernelVersion overrides the kernel version detected from the rootfs
+	kernelVersion string
+
+	// modulesDir and firmwareDir are where kernel modules and firmware go,
+	// relative to the rootfs
+	modulesDir  string
+	firmwareDir string
+
+	// firmwareUpdates installs the overlay's firmware under firmwareDir's
+	// updates/<kver>, which the target kernel searches before firmwareDir,
+	// to override the firmware the rootfs already has
+	firmwareUpdates bool
+
+	// stateDir holds the manifest, backups and SBOM, relative to the
+	// rootfs
+	stateDir string
+
+	// decompressModules stores .ko.xz/.ko.zst/.ko.gz modules uncompressed
+	decompressModules bool
+
+	// dedupe hard links a file with the same contents as one copied
+	// before, to another destination, to that copy instead of writing it
+	// again
+	dedupe bool
+
+	// dirMode is the mode of directories created without a source
+	// directory to take it from
+	dirMode os.FileMode
+
+	// timeout bounds the whole install; zero means no limit
+	timeout time.Duration
+
+	// outputFormat is "json" to print an install summary to stdout
+	outputFormat string
+
+	// requireArtifacts fails the install when kernel modules or firmware
+	// are missing instead of skipping them
+	requireArtifacts bool
+
+	// moduleSigningCert holds the certificates, or a path to them, that
+	// installed modules' signatures are verified against
+	moduleSigningCert string
+
+	// requireInstalledKernel fails the install when the target kernel has
+	// no module tree in the rootfs, rather than warning
+	requireInstalledKernel bool
+
+	// requireSignedModules fails the install when an installed module has
+	// no signature, as secure boot won't load it
+	requireSignedModules bool
+
+	// signingKey holds the private key, or a path to it, that unsigned
+	// installed modules are signed with
+	signingKey string
+
+	// stripModules drops the debug sections of installed modules that
+	// aren't signed, before any are signed with signingKey
+	stripModules bool
+
+	// requireFirmware fails the install when an installed module declares
+	// firmware the rootfs lacks, instead of warning
+	requireFirmware bool
+
+	// onConflict decides what happens when a destination file exists with
+	// different content: overwrite, skip or error
+	onConflict string
+
+	// onCompressionMismatch decides what happens when installed modules
+	// aren't compressed the way the target kernel's config expects: warn,
+	// error or recompress
+	onCompressionMismatch string
+
+	// retryAttempts is how many times a file copy is tried before a
+	// transient error fails the install
+	retryAttempts int
+
+	// retryBackoff is the delay before the first retry, doubling each time
+	retryBackoff time.Duration
+
+	// fsync flushes every installed file and changed directory to disk,
+	// at a cost in install time; see sync.go
+	fsync bool
+
+	// copyBuffer is the size in bytes of the buffer each file is copied
+	// through
+	copyBuffer int
+
+	// copySpecial recreates FIFOs and, as root, device nodes found among
+	// the sources instead of skipping them
+	copySpecial bool
+
+	// exclude holds glob patterns for source files that are never copied
+	exclude []string
+
+	// firmwareInclude, when set, limits the firmware phase to the files
+	// matching one of its extensions or glob patterns
+	firmwareInclude []string
+
+	// firmwareCoverage reports, in the summary, how much of a reference
+	// firmware set the rootfs holds
+	firmwareCoverage bool
+
+	// firmwareReference is the firmware set coverage is measured against,
+	// relative to firmwareDir; when empty, firmwareReferenceFile names a
+	// file listing it, else the installed modules' firmware is used
+	firmwareReference     []string
+	firmwareReferenceFile string
+
+	// preserveXattrs copies extended attributes, like SELinux labels,
+	// along with the files
+	preserveXattrs bool
+
+	// expectedDriverVersion is the NVIDIA driver version the overlay's
+	// nvidia module must report; it overrides the overlay config's
+	expectedDriverVersion string
+
+	// targetArch is the architecture the overlay's kernel modules must be
+	// built for, detected from the rootfs when empty
+	targetArch string
+
+	// force replaces an install of a different overlay version, removing
+	// its files first, instead of failing
+	force bool
+
+	// enableBackup saves every file the install replaces so rollback
+	// can restore it
+	enableBackup bool
+
+	// cleanupOnNoSpace undoes what an install wrote when the rootfs fills
+	// up part way, restoring replaced files from their backups
+	cleanupOnNoSpace bool
+
+	// keepGoing turns config files that fail to copy into warnings; module
+	// and firmware failures still fail the install
+	keepGoing bool
+
+	// sbom writes a CycloneDX inventory of the install to the rootfs
+	sbom bool
+
+	// containerToolkit writes the NVIDIA container runtime config, in CDI
+	// mode, so pods can use the GPU
+	containerToolkit bool
+
+	// cdiSpec writes a CDI spec for the GPUs; the container toolkit config
+	// implies it
+	cdiSpec bool
+
+	// gpuCount is how many GPUs the CDI spec lists
+	gpuCount int
+
+	// gpuUUIDs name the GPUs in the CDI spec, in index order, besides
+	// their index
+	gpuUUIDs []string
+
+	// cdiMounts are extra hostPath[:containerPath] bind mounts the CDI
+	// spec gives every container
+	cdiMounts []cdiMount
+
+	// hooks maps hook points to shell commands run there
+	hooks map[string]string
+
+	// moduleParams maps modules to the key=value params, rendered for
+	// modprobe.d, merged into their options lines
+	moduleParams map[string]map[string]string
+
+	// incremental skips files already present with the same contents:
+	// "checksum" compares digests, "mtime" trusts size and modification time
+	// and "since" trusts the digests of the since manifest
+	incremental string
+
+	// since is the path of an earlier install's manifest to sync the rootfs
+	// from: files it records with unchanged contents are left in place,
+	// and files it lists that this install no longer does are removed
+	since string
+}
+
+// maxDefaultWorkers caps the default of ExtraOptions["parallel"]
+const maxDefaultWorkers = 8
+
+// parseInstallConfig builds the run config from ExtraOptions and the
+// arguments following the install command. Flags win over ExtraOptions.
+func parseInstallConfig(extra map[string]interface{}, args []string) (*installConfig, error) {
+	// A misspelt option would otherwise be silently ignored
+	if errs := unknownOptions(extra); len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	cfg := &installConfig{}
+
+	var err error
+	// Slow imager storage gains nothing from more concurrent writes
+	if cfg.workers, err = intOption(extra, "parallel", min(runtime.NumCPU(), maxDefaultWorkers)); err != nil {
+		return nil, err
+	}
+	if cfg.dryRun, err = boolOption(extra, "dryRun", false); err != nil {
+		return nil, err
+	}
+	if cfg.diff, err = boolOption(extra, "diff", false); err != nil {
+		return nil, err
+	}
+	if cfg.force, err = boolOption(extra, "force", false); err != nil {
+		return nil, err
+	}
+	if cfg.skipSpaceCheck, err = boolOption(extra, "skipSpaceCheck", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.artifactRef, err = stringOption(extra, "artifactRef", ""); err != nil {
+		return nil, err
+	}
+	if cfg.artifactDigest, err = stringOption(extra, "artifactDigest", ""); err != nil {
+		return nil, err
+	}
+	// A tag alone could be moved to anything by whoever controls the registry
+	if cfg.artifactRef != "" && cfg.artifactDigest == "" && !strings.Contains(cfg.artifactRef, "@sha256:") {
+		return nil, fmt.Errorf("extraOptions.artifactRef %q is not pinned: use a name@sha256:<digest> reference or set extraOptions.artifactDigest", cfg.artifactRef)
+	}
+	if cfg.artifactPlainHTTP, err = boolOption(extra, "artifactPlainHTTP", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.verifyKey, err = stringOption(extra, "verifyKey", ""); err != nil {
+		return nil, err
+	}
+
+	if cfg.profile, err = stringOption(extra, "profile", ""); err != nil {
+		return nil, err
+	}
+
+	if cfg.kernelVersion, err = stringOption(extra, "kernelVersion", ""); err != nil {
+		return nil, err
+	}
+
+	if cfg.modulesDir, err = rootfsDirOption(extra, "modulesDir", defaultModulesDir); err != nil {
+		return nil, err
+	}
+	if cfg.firmwareDir, err = rootfsDirOption(extra, "firmwareDir", defaultFirmwareDir); err != nil {
+		return nil, err
+	}
+	if cfg.firmwareUpdates, err = boolOption(extra, "firmwareUpdatesDir", false); err != nil {
+		return nil, err
+	}
+	if cfg.stateDir, err = stateDirOption(extra); err != nil {
+		return nil, err
+	}
+
+	if cfg.decompressModules, err = boolOption(extra, "decompressModules", false); err != nil {
+		return nil, err
+	}
+	if cfg.dedupe, err = boolOption(extra, "dedupe", false); err != nil {
+		return nil, err
+	}
+	if cfg.dirMode, err = modeOption(extra, "dirMode", 0755); err != nil {
+		return nil, err
+	}
+
+	timeoutSeconds, err := intOption(extra, "timeoutSeconds", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.timeout = time.Duration(timeoutSeconds) * time.Second
+
+	if cfg.outputFormat, err = stringOption(extra, "outputFormat", ""); err != nil {
+		return nil, err
+	}
+	if cfg.outputFormat != "" && cfg.outputFormat != "text" && cfg.outputFormat != "json" {
+		return nil, fmt.Errorf("extraOptions.outputFormat: expected text or json, got %q", cfg.outputFormat)
+	}
+
+	if cfg.requireArtifacts, err = boolOption(extra, "requireArtifacts", true); err != nil {
+		return nil, err
+	}
+	if cfg.requireFirmware, err = boolOption(extra, "requireFirmware", true); err != nil {
+		return nil, err
+	}
+	if cfg.moduleSigningCert, err = stringOption(extra, "moduleSigningCert", ""); err != nil {
+		return nil, err
+	}
+	if cfg.requireSignedModules, err = boolOption(extra, "requireSignedModules", false); err != nil {
+		return nil, err
+	}
+	if cfg.requireInstalledKernel, err = boolOption(extra, "requireInstalledKernel", false); err != nil {
+		return nil, err
+	}
+	if cfg.signingKey, err = stringOption(extra, "signingKey", ""); err != nil {
+		return nil, err
+	}
+	if cfg.stripModules, err = boolOption(extra, "stripModules", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.onConflict, err = stringOption(extra, "onConflict", conflictOverwrite); err != nil {
+		return nil, err
+	}
+	switch cfg.onConflict {
+	case conflictOverwrite, conflictSkip, conflictError:
+	default:
+		return nil, fmt.Errorf("extraOptions.onConflict: expected overwrite, skip or error, got %q", cfg.onConflict)
+	}
+
+	if cfg.onCompressionMismatch, err = stringOption(extra, "onCompressionMismatch", compressionWarn); err != nil {
+		return nil, err
+	}
+	switch cfg.onCompressionMismatch {
+	case compressionWarn, compressionError, compressionRecompress:
+	default:
+		return nil, fmt.Errorf("extraOptions.onCompressionMismatch: expected warn, error or recompress, got %q", cfg.onCompressionMismatch)
+	}
+
+	if cfg.retryAttempts, err = intOption(extra, "retryAttempts", 3); err != nil {
+		return nil, err
+	}
+	if cfg.retryAttempts < 1 {
+		return nil, fmt.Errorf("extraOptions.retryAttempts: must be at least 1, got %d", cfg.retryAttempts)
+	}
+	retryBackoffMs, err := intOption(extra, "retryBackoffMs", 100)
+	if err != nil {
+		return nil, err
+	}
+	cfg.retryBackoff = time.Duration(retryBackoffMs) * time.Millisecond
+
+	if cfg.fsync, err = boolOption(extra, "fsync", false); err != nil {
+		return nil, err
+	}
+
+	copyBufferKiB, err := intOption(extra, "copyBufferKiB", 1024)
+	if err != nil {
+		return nil, err
+	}
+	if copyBufferKiB < 4 {
+		return nil, fmt.Errorf("extraOptions.copyBufferKiB: must be at least 4, got %d", copyBufferKiB)
+	}
+	cfg.copyBuffer = copyBufferKiB << 10
+
+	if cfg.copySpecial, err = boolOption(extra, "copySpecial", false); err != nil {
+		return nil, err
+	}
+	if cfg.exclude, _, err = stringListOption(extra, "exclude"); err != nil {
+		return nil, err
+	}
+	if cfg.firmwareInclude, _, err = stringListOption(extra, "firmwareInclude"); err != nil {
+		return nil, err
+	}
+	// A single string names a file, relative to the overlay, with one
+	// firmware path per line
+	if file, ok := extra["firmwareReference"].(string); ok {
+		cfg.firmwareReferenceFile = file
+	} else if cfg.firmwareReference, _, err = stringListOption(extra, "firmwareReference"); err != nil {
+		return nil, err
+	}
+	hasReference := cfg.firmwareReferenceFile != "" || len(cfg.firmwareReference) > 0
+	if cfg.firmwareCoverage, err = boolOption(extra, "firmwareCoverage", hasReference); err != nil {
+		return nil, err
+	}
+	if cfg.preserveXattrs, err = boolOption(extra, "preserveXattrs", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.expectedDriverVersion, err = stringOption(extra, "expectedDriverVersion", ""); err != nil {
+		return nil, err
+	}
+	if cfg.targetArch, err = stringOption(extra, "targetArch", ""); err != nil {
+		return nil, err
+	}
+	if _, ok := archMachines[cfg.targetArch]; cfg.targetArch != "" && !ok {
+		return nil, fmt.Errorf("extraOptions.targetArch: unknown architecture %q", cfg.targetArch)
+	}
+
+	if cfg.enableBackup, err = boolOption(extra, "enableBackup", false); err != nil {
+		return nil, err
+	}
+	if cfg.cleanupOnNoSpace, err = boolOption(extra, "cleanupOnNoSpace", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.keepGoing, err = boolOption(extra, "keepGoing", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.sbom, err = boolOption(extra, "sbom", false); err != nil {
+		return nil, err
+	}
+
+	if cfg.containerToolkit, err = boolOption(extra, "installContainerToolkitConfig", false); err != nil {
+		return nil, err
+	}
+	if cfg.cdiSpec, err = boolOption(extra, "cdiSpec", cfg.containerToolkit); err != nil {
+		return nil, err
+	}
+	if cfg.gpuUUIDs, _, err = stringListOption(extra, "gpuUUIDs"); err != nil {
+		return nil, err
+	}
+	gpus := 1
+	if len(cfg.gpuUUIDs) > 0 {
+		gpus = len(cfg.gpuUUIDs)
+	}
+	if cfg.gpuCount, err = intOption(extra, "gpuCount", gpus); err != nil {
+		return nil, err
+	}
+	if cfg.gpuCount < 1 {
+		return nil, fmt.Errorf("extraOptions.gpuCount: must be at least 1, got %d", cfg.gpuCount)
+	}
+	if len(cfg.gpuUUIDs) > 0 && len(cfg.gpuUUIDs) != cfg.gpuCount {
+		return nil, fmt.Errorf("extraOptions.gpuUUIDs: lists %d GPUs, but gpuCount is %d", len(cfg.gpuUUIDs), cfg.gpuCount)
+	}
+	for _, uuid := range cfg.gpuUUIDs {
+		if !cdiDevicePattern.MatchString(uuid) {
+			return nil, fmt.Errorf("extraOptions.gpuUUIDs: %q is not a valid CDI device name", uuid)
+		}
+	}
+	mounts, _, err := stringListOption(extra, "cdiMounts")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.cdiMounts, err = parseCDIMounts(mounts); err != nil {
+		return nil, err
+	}
+
+	if cfg.hooks, _, err = stringMapOption(extra, "hooks"); err != nil {
+		return nil, err
+	}
+	for name := range cfg.hooks {
+		if !slices.Contains(hookNames, name) {
+			return nil, fmt.Errorf("extraOptions.hooks: unknown hook %q, expected one of %s", name, strings.Join(hookNames, ", "))
+		}
+	}
+
+	if cfg.moduleParams, err = moduleParamsOption(extra); err != nil {
+		return nil, err
+	}
+
+	if cfg.incremental, err = incrementalOption(extra); err != nil {
+		return nil, err
+	}
+	if cfg.since, err = stringOption(extra, "since", ""); err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range cfg.exclude {
+		if _, err := matchGlob(pattern, ""); err != nil {
+			return nil, fmt.Errorf("extraOptions.exclude: %q: %w", pattern, err)
+		}
+	}
+	for _, pattern := range cfg.firmwareInclude {
+		if _, err := matchGlob(pattern, ""); err != nil {
+			return nil, fmt.Errorf("extraOptions.firmwareInclude: %q: %w", pattern, err)
+		}
+	}
+
+	flags := flag.NewFlagSet("install", flag.ContinueOnError)
+	flags.BoolVar(&cfg.dryRun, "dry-run", cfg.dryRun, "report actions without writing to the rootfs")
+	flags.BoolVar(&cfg.diff, "diff", cfg.diff, "dry run printing how the install would change the installed files")
+	flags.BoolVar(&cfg.force, "force", cfg.force, "replace an install of a different overlay version")
+	flags.BoolVar(&cfg.keepGoing, "keep-going", cfg.keepGoing, "warn about config files that fail to copy instead of failing")
+	flags.BoolVar(&cfg.skipSpaceCheck, "skip-space-check", cfg.skipSpaceCheck, "do not check for free space before copying")
+	flags.IntVar(&cfg.workers, "parallel", cfg.workers, "number of files to copy concurrently, 0 or less to copy one at a time")
+	flags.DurationVar(&cfg.timeout, "timeout", cfg.timeout, "abort the install after this long, 0 for no limit")
+	flags.StringVar(&cfg.since, "since", cfg.since, "sync from the install recorded by this manifest, copying only changed files and removing dropped ones")
+	// SetupLogging has already acted on these
+	flags.Bool("quiet", false, "log errors only")
+	flags.Bool("verbose", false, "log every file")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	// Zero or less copies one file at a time
+	cfg.workers = max(1, cfg.workers)
+
+	if cfg.diff {
+		cfg.dryRun = true
+	}
+	if cfg.since != "" {
+		cfg.incremental = incrementalSince
+	}
+	return cfg, nil
+}
+
+// boolOption reads a boolean from ExtraOptions, accepting "true"/"false"
+// strings as well as YAML booleans
+func boolOption(extra map[string]interface{}, key string, def bool) (bool, error) {
+	raw, ok := extra[key]
+	if !ok || raw == nil {
+		return def, nil
+	}
+
+	switch v := raw.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("extraOptions.%s: %w", key, err)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("extraOptions.%s: expected a boolean, got %T", key, raw)
+	}
+}
+
+// intOption reads an integer from ExtraOptions, accepting numeric strings
+func intOption(extra map[string]interface{}, key string, def int) (int, error) {
+	raw, ok := extra[key]
+	if !ok || raw == nil {
+		return def, nil
+	}
+
+	switch v := raw.(type) {
+	case int:
+		return v, nil
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("extraOptions.%s: %w", key, err)
+		}
+		return n, nil
+	default:
+		return 0, fmt.Errorf("extraOptions.%s: expected an integer, got %T", key, raw)
+	}
+}
+
+// modeOption reads permission bits from ExtraOptions, given as an octal
+// string like "0750" or an integer
+func modeOption(extra map[string]interface{}, key string, def os.FileMode) (os.FileMode, error) {
+	raw, ok := extra[key]
+	if !ok || raw == nil {
+		return def, nil
+	}
+
+	var mode uint64
+	switch v := raw.(type) {
+	case int:
+		if v < 0 {
+			return 0, fmt.Errorf("extraOptions.%s: %d is not a file mode", key, v)
+		}
+		mode = uint64(v)
+	case string:
+		n, err := strconv.ParseUint(strings.TrimPrefix(v, "0o"), 8, 32)
+		if err != nil {
+			return 0, fmt.Errorf("extraOptions.%s: expected an octal mode: %w", key, err)
+		}
+		mode = n
+	default:
+		return 0, fmt.Errorf("extraOptions.%s: expected an octal mode, got %T", key, raw)
+	}
+	if mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("extraOptions.%s: %#o has bits outside 0777", key, mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// incrementalOption reads ExtraOptions["incremental"], which is a mode
+// name or a boolean where true means checksum mode
+func incrementalOption(extra map[string]interface{}) (string, error) {
+	if mode, ok := extra["incremental"].(string); ok && (mode == incrementalChecksum || mode == incrementalMtime) {
+		return mode, nil
+	}
+	enabled, err := boolOption(extra, "incremental", false)
+	if err != nil {
+		return "", fmt.Errorf("extraOptions.incremental: expected checksum, mtime or a boolean, got %v", extra["incremental"])
+	}
+	if enabled {
+		return incrementalChecksum, nil
+	}
+	return "", nil
+}
+
+// stringListOption reads a list of strings from ExtraOptions.
+// A single string is split on whitespace, so both YAML lists and
+// "a b c" style values work. ok is false when the key is absent.
+func stringListOption(extra map[string]interface{}, key string) (values []string, ok bool, err error) {
+	raw, ok := extra[key]
+	if !ok || raw == nil {
+		return nil, false, nil
+	}
+
+	switch v := raw.(type) {
+	case string:
+		return strings.Fields(v), true, nil
+	case []interface{}:
+		for _, item := range v {
+			s, isString := item.(string)
+			if !isString {
+				return nil, true, fmt.Errorf("extraOptions.%s: expected a list of strings, got %T in list", key, item)
+			}
+			values = append(values, s)
+		}
+		return values, true, nil
+	default:
+		return nil, true, fmt.Errorf("extraOptions.%s: expected a list of strings, got %T", key, raw)
+	}
+}
+
+// stringMapOption reads a map of string values from ExtraOptions.
+// ok is false when the key is absent.
+func stringMapOption(extra map[string]interface{}, key string) (values map[string]string, ok bool, err error) {
+	raw, ok := extra[key]
+	if !ok || raw == nil {
+		return nil, false, nil
+	}
+
+	m, isMap := raw.(map[string]interface{})
+	if !isMap {
+		return nil, true, fmt.Errorf("extraOptions.%s: expected a map, got %T", key, raw)
+	}
+
+	values = make(map[string]string, len(m))
+	for k, v := range m {
+		switch v := v.(type) {
+		case string:
+			values[k] = v
+		case int, bool, float64:
+			values[k] = fmt.Sprint(v)
+		default:
+			return nil, true, fmt.Errorf("extraOptions.%s.%s: expected a string, got %T", key, k, v)
+		}
+	}
+	return values, true, nil
+}
+
+// stateDirOption reads ExtraOptions["stateDir"], where the install keeps
+// its manifest, backups and SBOM, as a rootfs relative path. Every command
+// reading the manifest must be given the same.
+func stateDirOption(extra map[string]interface{}) (string, error) {
+	return rootfsDirOption(extra, "stateDir", defaultStateDir)
+}
+
+// targetPrefixOption reads ExtraOptions["targetPrefix"], the directory
+// under the rootfs a staged install writes to, as a rootfs relative path.
+// It is empty when unset, for installs straight into the rootfs.
+func targetPrefixOption(extra map[string]interface{}) (string, error) {
+	prefix, err := stringOption(extra, "targetPrefix", "")
+	if err != nil || strings.Trim(prefix, "/") == "" {
+		return "", err
+	}
+	return rootfsDirOption(extra, "targetPrefix", "")
+}
+
+// rootfsDirOption reads a directory relative to the rootfs from
+// ExtraOptions. A leading slash is allowed, but the path may not climb
+// out of the rootfs.
+func rootfsDirOption(extra map[string]interface{}, key, def string) (string, error) {
+	dir, err := stringOption(extra, key, def)
+	if err != nil {
+		return "", err
+	}
+	rel := strings.TrimLeft(dir, "/")
+	if !filepath.IsLocal(rel) || slices.Contains(strings.Split(rel, "/"), "..") {
+		return "", fmt.Errorf("extraOptions.%s: %q is not a directory inside the rootfs", key, dir)
+	}
+	return path.Clean(rel), nil
+}
+
+// stringOption reads a string from ExtraOptions
+func stringOption(extra map[string]interface{}, key, def string) (string, error) {
+	raw, ok := extra[key]
+	if !ok || raw == nil {
+		return def, nil
+	}
+
+	s, isString := raw.(string)
+	if !isString {
+		return "", fmt.Errorf("extraOptions.%s: expected a string, got %T", key, raw)
+	}
+	return s, nil
+}
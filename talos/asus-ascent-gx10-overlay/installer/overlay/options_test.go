@@ -0,0 +1,70 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestRootfsDirOptions(t *testing.T) {
+	for _, tc := range []struct {
+		key     string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"modulesDir", "usr/lib/modules", "usr/lib/modules", false},
+		{"modulesDir", "/usr/lib/modules/", "usr/lib/modules", false},
+		{"modulesDir", "lib/./modules", "lib/modules", false},
+		{"modulesDir", "..", "", true},
+		{"modulesDir", "../modules", "", true},
+		{"modulesDir", "/lib/../../modules", "", true},
+		{"modulesDir", "lib/modules/..", "", true},
+		{"firmwareDir", "usr/lib/firmware", "usr/lib/firmware", false},
+		{"firmwareDir", "../../host/firmware", "", true},
+		{"firmwareDir", "lib/../firmware", "", true},
+		{"firmwareDir", "", "", true},
+	} {
+		t.Run(tc.key+" "+tc.value, func(t *testing.T) {
+			cfg, err := parseInstallConfig(map[string]interface{}{tc.key: tc.value}, nil)
+			if tc.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "extraOptions."+tc.key) {
+					t.Fatalf("parse %s=%q returned %v, want an extraOptions.%s error", tc.key, tc.value, err, tc.key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := cfg.modulesDir
+			if tc.key == "firmwareDir" {
+				got = cfg.firmwareDir
+			}
+			if got != tc.want {
+				t.Errorf("%s = %q, want %q", tc.key, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestInstallRejectsEscapingDirs(t *testing.T) {
+	for _, key := range []string{"modulesDir", "firmwareDir"} {
+		t.Run(key, func(t *testing.T) {
+			overlayPath := testOverlay().Build(t)
+			parent := t.TempDir()
+			rootfs := filepath.Join(parent, "rootfs")
+			testutil.WriteTree(t, rootfs, testutil.Tree{"lib/modules/" + testKver: testutil.Dir()})
+
+			extra := map[string]interface{}{key: "../escape"}
+			if err := runInstallTest(t, overlayPath, rootfs, extra); err == nil {
+				t.Fatalf("install with %s=../escape succeeded", key)
+			}
+			if _, err := os.Lstat(filepath.Join(parent, "escape")); !os.IsNotExist(err) {
+				t.Errorf("install wrote outside the rootfs: %v", err)
+			}
+		})
+	}
+}
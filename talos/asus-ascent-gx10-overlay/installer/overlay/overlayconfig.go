@@ -0,0 +1,123 @@
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v4"
+)
+
+// overlayConfigFile is the optional config bundled with the overlay artifacts
+const overlayConfigFile = "overlay.yaml"
+
+// OverlayConfig is the optional overlay.yaml shipped alongside the artifacts.
+// It lets a packaged overlay tune the installer without rebuilding it.
+type OverlayConfig struct {
+	// DriverVersion is the NVIDIA driver version the bundled nvidia module
+	// must report, e.g. 580.95.05
+	DriverVersion string `yaml:"driverVersion,omitempty"`
+
+	// KernelArgs are added to defaultKernelArgs
+	KernelArgs []string `yaml:"kernelArgs,omitempty"`
+
+	// Steps replace the built-in kernel-modules/firmware/files layout with
+	// copy operations run in order
+	Steps []CopyStep `yaml:"steps,omitempty"`
+
+	// LoadModules replaces defaultLoadModules
+	LoadModules []string `yaml:"loadModules,omitempty"`
+
+	// ModprobeOptions replaces defaultModprobeOptions
+	ModprobeOptions map[string]string `yaml:"modprobeOptions,omitempty"`
+
+	// Sysctls are added to defaultSysctls in the get-options machine config
+	Sysctls map[string]string `yaml:"sysctls,omitempty"`
+
+	// UdevRules replace defaultUdevRules
+	UdevRules []string `yaml:"udevRules,omitempty"`
+
+	// ExtraMounts are reported as machine.kubelet.extraMounts by get-options
+	ExtraMounts []Mount `yaml:"extraMounts,omitempty"`
+
+	// Profiles adjust the settings above per board revision; see applyProfile
+	Profiles map[string]ProfileConfig `yaml:"profiles,omitempty"`
+}
+
+// CopyStep copies a file or directory from the overlay into the rootfs
+type CopyStep struct {
+	// From is relative to the overlay directory
+	From string `yaml:"from"`
+
+	// To is relative to the rootfs; a leading slash is allowed
+	To string `yaml:"to"`
+
+	// Optional steps are skipped when From doesn't exist
+	Optional bool `yaml:"optional,omitempty"`
+
+	// Mode, in octal, replaces the permissions of every copied file
+	Mode string `yaml:"mode,omitempty"`
+}
+
+// fileMode parses Mode, returning zero when it is unset
+func (s CopyStep) fileMode() (os.FileMode, error) {
+	if s.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions like 0644", s.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validate rejects steps that would read outside the overlay or write
+// outside the rootfs
+func (s CopyStep) validate() error {
+	if s.From == "" || s.To == "" {
+		return fmt.Errorf("step needs both from and to")
+	}
+	if !filepath.IsLocal(s.From) {
+		return fmt.Errorf("step from %q must be a path inside the overlay", s.From)
+	}
+	if to := strings.TrimPrefix(s.To, "/"); to != "" && !filepath.IsLocal(to) {
+		return fmt.Errorf("step to %q must be a path inside the rootfs", s.To)
+	}
+	_, err := s.fileMode()
+	return err
+}
+
+// loadOverlayConfig reads overlay.yaml from the overlay, returning an empty
+// config when none is bundled
+func loadOverlayConfig(fsys filesystem, overlayPath string) (*OverlayConfig, error) {
+	// Check both artifacts/ and the overlay root for backward compatibility
+	candidates := []string{
+		filepath.Join(overlayPath, "artifacts", overlayConfigFile),
+		filepath.Join(overlayPath, overlayConfigFile),
+	}
+
+	for _, path := range candidates {
+		data, err := fsys.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read overlay config: %w", err)
+		}
+
+		var config OverlayConfig
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("failed to decode overlay config %s: %w", path, err)
+		}
+		for i, step := range config.Steps {
+			if err := step.validate(); err != nil {
+				return nil, fmt.Errorf("overlay config %s: steps[%d]: %w", path, i, err)
+			}
+		}
+		return &config, nil
+	}
+
+	return &OverlayConfig{}, nil
+}
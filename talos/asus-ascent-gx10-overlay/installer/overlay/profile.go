@@ -0,0 +1,73 @@
+package overlay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// profilesDir holds one artifacts directory per board revision, laid out
+// like the overlay itself, for ExtraOptions["profile"] to choose from
+const profilesDir = "profiles"
+
+// ProfileConfig is a profile's entry in overlay.yaml. Fields that are set
+// replace the overlay-wide ones of the same name.
+type ProfileConfig struct {
+	KernelArgs      []string          `yaml:"kernelArgs,omitempty"`
+	LoadModules     []string          `yaml:"loadModules,omitempty"`
+	ModprobeOptions map[string]string `yaml:"modprobeOptions,omitempty"`
+	Sysctls         map[string]string `yaml:"sysctls,omitempty"`
+}
+
+// applyProfile selects a profile, returning the directory artifacts are
+// read from and the overlay config with the profile's settings applied.
+// Without a profile that is the overlay itself and config unchanged.
+func applyProfile(fsys filesystem, overlayPath string, config *OverlayConfig, profile string) (string, *OverlayConfig, error) {
+	if profile == "" {
+		return overlayPath, config, nil
+	}
+
+	dir := artifactDir(fsys, overlayPath, profilesDir, profile)
+	if info, err := fsys.Stat(dir); err != nil || !info.IsDir() || !filepath.IsLocal(profile) || strings.ContainsAny(profile, `/\`) {
+		available, _ := listProfiles(fsys, overlayPath)
+		if len(available) == 0 {
+			return "", nil, fmt.Errorf("profile %q not found, the overlay has no profiles", profile)
+		}
+		return "", nil, fmt.Errorf("profile %q not found, available profiles: %s", profile, strings.Join(available, ", "))
+	}
+
+	merged := *config
+	if p, ok := config.Profiles[profile]; ok {
+		if len(p.KernelArgs) > 0 {
+			merged.KernelArgs = p.KernelArgs
+		}
+		if len(p.LoadModules) > 0 {
+			merged.LoadModules = p.LoadModules
+		}
+		if len(p.ModprobeOptions) > 0 {
+			merged.ModprobeOptions = p.ModprobeOptions
+		}
+		if len(p.Sysctls) > 0 {
+			merged.Sysctls = p.Sysctls
+		}
+	}
+	return dir, &merged, nil
+}
+
+// listProfiles returns the names of the overlay's profile directories
+func listProfiles(fsys filesystem, overlayPath string) ([]string, error) {
+	entries, err := fsys.ReadDir(artifactDir(fsys, overlayPath, profilesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
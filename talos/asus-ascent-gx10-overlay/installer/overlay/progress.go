@@ -0,0 +1,96 @@
+package overlay
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// progressInterval and progressStep bound how often copy progress is
+// reported: once a second, or whenever another 5% is done
+const (
+	progressInterval = time.Second
+	progressStep     = 5
+)
+
+// progressLine is where copy progress is drawn as a single updating line.
+// SetupLogging sets it to the log output when that is a terminal showing
+// text logs; otherwise progress goes to the logger as periodic entries.
+var progressLine io.Writer
+
+// progress reports how much of a batch of copies is done
+type progress struct {
+	dst   string
+	total int64
+
+	mu          sync.Mutex
+	done        int64
+	lastPercent int
+	lastReport  time.Time
+	reported    bool
+}
+
+func newProgress(dst string, total int64) *progress {
+	return &progress{dst: dst, total: total, lastReport: time.Now()}
+}
+
+// add counts n more bytes as copied and reports if enough has changed
+func (p *progress) add(n int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done += n
+	percent := p.percent()
+	if percent < p.lastPercent+progressStep && time.Since(p.lastReport) < progressInterval {
+		return
+	}
+	p.lastPercent = percent - percent%progressStep
+	p.lastReport = time.Now()
+	p.report(percent)
+	p.reported = p.done == p.total
+}
+
+// finish reports the final count, unless that was just reported, and ends
+// the progress line
+func (p *progress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.total == 0 {
+		return
+	}
+	if !p.reported {
+		p.report(p.percent())
+	}
+	if progressLine != nil {
+		fmt.Fprintln(progressLine)
+	}
+}
+
+func (p *progress) percent() int {
+	if p.total == 0 {
+		return 100
+	}
+	return int(p.done * 100 / p.total)
+}
+
+func (p *progress) report(percent int) {
+	if progressLine != nil {
+		// Clear the rest of the line in case the previous one was longer
+		fmt.Fprintf(progressLine, "\r📊 Copying to %s: %d%% (%s of %s)\033[K", p.dst, percent, formatMiB(uint64(p.done)), formatMiB(uint64(p.total)))
+		return
+	}
+	slog.Info("📊 Copy progress", "dst", p.dst, "percent", percent, "bytes", p.done, "total", p.total)
+}
+
+// isTerminal reports whether f is a terminal. Being a character device
+// isn't enough, as /dev/null is one too.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
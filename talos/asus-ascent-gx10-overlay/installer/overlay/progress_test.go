@@ -0,0 +1,33 @@
+package overlay
+
+import (
+	"os"
+	"testing"
+)
+
+func TestIsTerminal(t *testing.T) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	regular, err := os.Create(t.TempDir() + "/log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer regular.Close()
+
+	for _, tc := range []struct {
+		name string
+		f    *os.File
+	}{
+		{"dev null", devNull},
+		{"regular file", regular},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if isTerminal(tc.f) {
+				t.Errorf("isTerminal(%s) = true, want false", tc.f.Name())
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package overlay
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Prune removes firmware this overlay installed that no kernel module in
+// the rootfs declares any more, as left behind by successive installs of
+// different driver versions. Only firmware the manifest records is ever
+// considered. Nothing is removed unless options.Args has -apply; without
+// it Prune only prints what it would remove.
+func Prune(options *Options) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	apply := flags.Bool("apply", false, "remove the unreferenced firmware instead of listing it")
+	if err := flags.Parse(options.Args); err != nil {
+		return err
+	}
+
+	rootfsPath, err := installRoot(osFS{}, options.MountPrefix, options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	stateDir, err := stateDirOption(options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	modulesDir, err := rootfsDirOption(options.ExtraOptions, "modulesDir", defaultModulesDir)
+	if err != nil {
+		return err
+	}
+	firmwareDir, err := rootfsDirOption(options.ExtraOptions, "firmwareDir", defaultFirmwareDir)
+	if err != nil {
+		return err
+	}
+
+	fsys := osFS{}
+	manifest, err := readManifest(fsys, rootfsPath, stateDir)
+	if err != nil {
+		return err
+	}
+
+	referenced, err := referencedFirmware(fsys, rootfsPath, modulesDir, firmwareDir)
+	if err != nil {
+		return err
+	}
+
+	var prune []ManifestEntry
+	for _, entry := range manifest.Files {
+		// Firmware under updates/ or a kernel's directory is loaded by the
+		// name below it
+		rel, ok := strings.CutPrefix(entry.Path, firmwareDir+"/")
+		if !ok || slices.ContainsFunc(firmwareNames(rel), func(name string) bool { return referenced[name] }) {
+			continue
+		}
+		// A file changed since the install may no longer be ours
+		if err := verifyEntry(fsys, rootfsJoin(rootfsPath, entry.Path), entry); err != nil {
+			slog.Warn("⚠️  Keeping firmware changed since install", "path", entry.Path, "reason", err)
+			continue
+		}
+		prune = append(prune, entry)
+	}
+
+	if len(prune) == 0 {
+		slog.Log(context.Background(), levelResult, "✅ No unreferenced firmware to prune")
+		return nil
+	}
+	if !*apply {
+		for _, entry := range prune {
+			fmt.Fprintf(options.stdout(), "would remove /%s\n", entry.Path)
+		}
+		slog.Log(context.Background(), levelResult, "🧹 Unreferenced firmware found, rerun with -apply to remove it", "files", len(prune))
+		return nil
+	}
+
+	var errs []error
+	pruned := make(map[string]bool)
+	for _, entry := range prune {
+		p, err := resolveRootfsPath(fsys, rootfsPath, entry.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := fsys.Remove(p); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+			continue
+		}
+		pruned[entry.Path] = true
+		fmt.Fprintf(options.stdout(), "removed /%s\n", entry.Path)
+	}
+
+	// Directories the install created that held only pruned firmware go too
+	dirs := append([]string(nil), manifest.Directories...)
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	var keptDirs []string
+	for _, dir := range dirs {
+		if strings.HasPrefix(dir, firmwareDir+"/") {
+			if p, err := resolveRootfsPath(fsys, rootfsPath, dir); err == nil && fsys.Remove(p) == nil {
+				continue
+			}
+		}
+		keptDirs = append(keptDirs, dir)
+	}
+	sort.Strings(keptDirs)
+
+	// The manifest must not list what is gone, or verify would fail
+	files := manifest.Files[:0]
+	for _, entry := range manifest.Files {
+		if !pruned[entry.Path] {
+			files = append(files, entry)
+		}
+	}
+	manifest.Files = files
+	manifest.Directories = keptDirs
+	if err := writeManifest(fsys, rootfsPath, stateDir, manifest); err != nil {
+		errs = append(errs, fmt.Errorf("failed to write manifest: %w", err))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to prune %d paths: %w", len(errs), errors.Join(errs...))
+	}
+	slog.Log(context.Background(), levelResult, "✅ Pruned unreferenced firmware", "files", len(pruned))
+	return nil
+}
+
+// referencedFirmware returns the firmware, relative to firmwareDir, that
+// any kernel module under modulesDir declares, for every kernel in the
+// rootfs. Compressed variants of a name, and the targets of symlinks
+// among the referenced files, count as referenced too.
+func referencedFirmware(fsys filesystem, rootfsPath, modulesDir, firmwareDir string) (map[string]bool, error) {
+	var names []string
+	root := filepath.Join(rootfsPath, filepath.FromSlash(modulesDir))
+	err := fsys.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if p == root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.Mode().IsRegular() || !isKernelModule(p) {
+			return nil
+		}
+		firmware, err := moduleFirmware(fsys, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, firmware...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool)
+	fwRoot := filepath.Join(rootfsPath, filepath.FromSlash(firmwareDir))
+	for len(names) > 0 {
+		name := path.Clean(names[0])
+		names = names[1:]
+		for _, ext := range firmwareCompressions {
+			rel := name + ext
+			if referenced[rel] {
+				continue
+			}
+			referenced[rel] = true
+
+			target, err := fsys.Readlink(filepath.Join(fwRoot, filepath.FromSlash(rel)))
+			if err != nil {
+				continue
+			}
+			// Absolute targets are within the rootfs
+			if path.IsAbs(target) {
+				if t, ok := strings.CutPrefix(path.Clean(target), "/"+firmwareDir+"/"); ok {
+					names = append(names, t)
+				}
+			} else {
+				names = append(names, path.Join(path.Dir(rel), target))
+			}
+		}
+	}
+	return referenced, nil
+}
@@ -0,0 +1,82 @@
+package overlay
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestPrune(t *testing.T) {
+	const stale = "lib/firmware/nvidia/520/gsp.bin"
+
+	for _, tc := range []struct {
+		name       string
+		args       []string
+		wantOutput string
+		wantPruned bool
+	}{
+		{
+			name:       "dry run",
+			wantOutput: "would remove /" + stale + "\n",
+		},
+		{
+			name:       "apply",
+			args:       []string{"-apply"},
+			wantOutput: "removed /" + stale + "\n",
+			wantPruned: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fixture := testutil.Overlay{
+				KernelModules: testutil.Tree{
+					testKver + "/kernel/drivers/gpu/nvidia.ko":     testModule("firmware=nvidia/gsp.bin"),
+					testKver + "/kernel/drivers/gpu/nvidia-uvm.ko": testModule("firmware=nvidia/uvm.bin"),
+				},
+				Firmware: testutil.Tree{
+					"nvidia/gsp.bin":     testutil.File("gsp firmware"),
+					"nvidia/uvm.bin":     testutil.File("uvm firmware"),
+					"nvidia/520/gsp.bin": testutil.File("old gsp firmware"),
+				},
+			}
+			rootfs := testutil.Rootfs(t, testKver)
+			if err := runInstallTest(t, fixture.Build(t), rootfs, nil); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			// Firmware the overlay didn't install is never pruned
+			testutil.WriteTree(t, rootfs, testutil.Tree{"lib/firmware/vendor/blob.bin": testutil.File("vendor firmware")})
+
+			var stdout bytes.Buffer
+			err := Prune(&Options{
+				InstallOptions: InstallOptions{MountPrefix: rootfs},
+				Args:           tc.args,
+				Stdout:         &stdout,
+			})
+			if err != nil {
+				t.Fatalf("prune: %v", err)
+			}
+			if got := stdout.String(); got != tc.wantOutput {
+				t.Errorf("prune output = %q, want %q", got, tc.wantOutput)
+			}
+
+			for _, rel := range []string{"lib/firmware/nvidia/gsp.bin", "lib/firmware/nvidia/uvm.bin", "lib/firmware/vendor/blob.bin"} {
+				if _, err := os.Lstat(filepath.Join(rootfs, rel)); err != nil {
+					t.Errorf("%s removed: %v", rel, err)
+				}
+			}
+			for _, rel := range []string{stale, filepath.Dir(stale)} {
+				_, err := os.Lstat(filepath.Join(rootfs, rel))
+				if gotPruned := os.IsNotExist(err); gotPruned != tc.wantPruned {
+					t.Errorf("%s pruned = %v, want %v (%v)", rel, gotPruned, tc.wantPruned, err)
+				}
+			}
+
+			// The manifest must still match the rootfs
+			if err := verifyTest(t, rootfs, nil); err != nil {
+				t.Errorf("verify after prune: %v", err)
+			}
+		})
+	}
+}
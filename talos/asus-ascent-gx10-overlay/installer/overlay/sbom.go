@@ -0,0 +1,116 @@
+package overlay
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// sbomFile is the CycloneDX inventory of an install, in the state dir
+const sbomFile = "sbom.json"
+
+// cycloneDXBOM is the subset of a CycloneDX 1.5 JSON document the
+// installer fills in
+type cycloneDXBOM struct {
+	BOMFormat    string             `json:"bomFormat"`
+	SpecVersion  string             `json:"specVersion"`
+	SerialNumber string             `json:"serialNumber"`
+	Version      int                `json:"version"`
+	Metadata     cycloneDXMetadata  `json:"metadata"`
+	Components   []cycloneDXPackage `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string           `json:"timestamp"`
+	Component cycloneDXPackage `json:"component"`
+}
+
+type cycloneDXPackage struct {
+	Type    string          `json:"type"`
+	Name    string          `json:"name"`
+	Version string          `json:"version,omitempty"`
+	Hashes  []cycloneDXHash `json:"hashes,omitempty"`
+}
+
+type cycloneDXHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+// installSBOM writes a CycloneDX inventory of what this install put in the
+// rootfs: the overlay itself, every kernel module with the NVIDIA driver
+// version found before the install, and every firmware blob, each with its
+// digest
+func (inst *Installer) installSBOM() error {
+	if !inst.cfg.sbom {
+		return nil
+	}
+
+	serial, err := newUUID()
+	if err != nil {
+		return err
+	}
+	bom := cycloneDXBOM{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + serial,
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: inst.manifest.InstalledAt.Format(time.RFC3339),
+			Component: cycloneDXPackage{Type: "platform", Name: Name, Version: Version},
+		},
+		Components: []cycloneDXPackage{},
+	}
+
+	driverVersion := inst.summary.DriverVersion
+	// The manifest is only sorted once written; the inventory must not
+	// depend on copy order either
+	entries := slices.Clone(inst.manifest.Files)
+	sortEntries(entries)
+	for _, entry := range entries {
+		if !entry.Mode.IsRegular() {
+			continue
+		}
+		var component cycloneDXPackage
+		switch {
+		case strings.HasPrefix(entry.Path, inst.cfg.modulesDir+"/") && isKernelModule(entry.Path):
+			component = cycloneDXPackage{Type: "device-driver", Name: moduleName(entry.Path)}
+			if strings.HasPrefix(component.Name, "nvidia") {
+				component.Version = driverVersion
+			}
+		case strings.HasPrefix(entry.Path, inst.cfg.firmwareDir+"/"):
+			component = cycloneDXPackage{Type: "firmware", Name: strings.TrimPrefix(entry.Path, inst.cfg.firmwareDir+"/")}
+		default:
+			continue
+		}
+		if entry.SHA256 != "" {
+			component.Hashes = []cycloneDXHash{{Alg: "SHA-256", Content: entry.SHA256}}
+		}
+		bom.Components = append(bom.Components, component)
+	}
+
+	data, err := json.MarshalIndent(bom, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(rootfsJoin(inst.rootfsPath, inst.cfg.stateDir), sbomFile)
+	slog.Info("🧾 Writing SBOM", "dst", path, "components", len(bom.Components), "driverVersion", driverVersion)
+	return inst.writeFile(path, append(data, '\n'), 0644)
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
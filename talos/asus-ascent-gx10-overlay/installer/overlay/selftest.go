@@ -0,0 +1,112 @@
+package overlay
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// SelfTest installs the overlay into a temporary rootfs and verifies the
+// result, as a smoke test of the packaged artifacts that touches no real
+// node. options.MountPrefix is ignored; the other install options apply as
+// for install. The temporary rootfs only holds a stub tree for the target
+// kernel, ExtraOptions["kernelVersion"] or else the first kernel the
+// overlay ships modules for, and is removed afterwards.
+func SelfTest(ctx context.Context, options *Options) error {
+	cfg, err := parseInstallConfig(options.ExtraOptions, options.Args)
+	if err != nil {
+		return classify(ErrInvalidOptions, err)
+	}
+
+	kver := cfg.kernelVersion
+	if kver == "" {
+		if kver, err = overlayKernelVersion(options.OverlayPath, cfg.profile); err != nil {
+			return err
+		}
+	}
+
+	rootfsPath, err := os.MkdirTemp("", "overlay-selftest-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary rootfs: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(rootfsPath); err != nil {
+			slog.Warn("⚠️  Failed to remove temporary rootfs", "rootfs", rootfsPath, "error", err)
+		}
+	}()
+
+	// The install detects the target kernel from its modules.builtin, as it
+	// would on a rootfs built by the imager
+	if kver != "" {
+		kverDir := filepath.Join(rootfsPath, filepath.FromSlash(cfg.modulesDir), kver)
+		if err := os.MkdirAll(kverDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create temporary rootfs: %w", err)
+		}
+		if err := os.WriteFile(filepath.Join(kverDir, "modules.builtin"), nil, 0o644); err != nil {
+			return fmt.Errorf("failed to create temporary rootfs: %w", err)
+		}
+	}
+
+	slog.Info("🧪 Self-testing overlay install", "overlay", options.OverlayPath, "rootfs", rootfsPath, "kver", kver)
+	testOptions := *options
+	testOptions.MountPrefix = rootfsPath
+	testOptions.InstallDisk = ""
+	if err := Install(ctx, &testOptions); err != nil {
+		return fmt.Errorf("self-test install failed: %w", err)
+	}
+	if err := Verify(&testOptions); err != nil {
+		return fmt.Errorf("self-test verify failed: %w", err)
+	}
+
+	slog.Log(ctx, levelResult, "✅ Self-test passed")
+	return nil
+}
+
+// overlayKernelVersion returns the first kernel, in name order, the overlay
+// or its profile ships modules for, from either the kernel-modules
+// directory or its archive. It is empty when the overlay ships no modules.
+func overlayKernelVersion(overlayPath, profile string) (string, error) {
+	fsys := osFS{}
+	config, err := loadOverlayConfig(fsys, overlayPath)
+	if err != nil {
+		return "", err
+	}
+	if overlayPath, _, err = applyProfile(fsys, overlayPath, config, profile); err != nil {
+		return "", err
+	}
+
+	sourceDir := kernelModulesSource(fsys, overlayPath)
+	var versions []string
+	if archive, ok := artifactArchive(fsys, sourceDir); ok {
+		err := walkArchive(fsys, archive, nil, func(hdr *tar.Header, _ io.Reader) error {
+			name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+			if kver, _, _ := strings.Cut(name, "/"); kver != "." && !slices.Contains(versions, kver) {
+				versions = append(versions, kver)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	} else if _, err := fsys.Stat(sourceDir); err == nil {
+		if versions, err = kernelVersions(fsys, sourceDir); err != nil {
+			return "", err
+		}
+	}
+
+	if len(versions) == 0 {
+		return "", nil
+	}
+	slices.Sort(versions)
+	if len(versions) > 1 {
+		slog.Info("Overlay ships modules for several kernels, self-testing the first; set extraOptions.kernelVersion for another", "kvers", strings.Join(versions, ", "))
+	}
+	return versions[0], nil
+}
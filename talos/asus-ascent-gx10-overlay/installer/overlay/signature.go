@@ -0,0 +1,261 @@
+package overlay
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The signed digest listing shipped at the overlay root. SHA256SUMS uses the
+// sha256sum format with paths relative to the overlay, and SHA256SUMS.sig is
+// a detached signature over it, e.g. from "cosign sign-blob".
+const (
+	checksumsFile = "SHA256SUMS"
+	signatureFile = checksumsFile + ".sig"
+)
+
+// verifyArtifacts checks the signature on the overlay's digest listing with
+// key, then checks every artifact of profile, or of the overlay itself
+// without one, against the listing. Any file that is unlisted or modified
+// fails verification, as does a missing file outside the profiles.
+func verifyArtifacts(fsys filesystem, overlayPath, profile, key string) error {
+	pub, err := loadPublicKey(key)
+	if err != nil {
+		return err
+	}
+
+	sums, err := fsys.ReadFile(filepath.Join(overlayPath, checksumsFile))
+	if err != nil {
+		return fmt.Errorf("failed to read digest listing: %w", err)
+	}
+	sig, err := fsys.ReadFile(filepath.Join(overlayPath, signatureFile))
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+	if err := verifySignature(pub, sums, sig); err != nil {
+		return err
+	}
+
+	listed, err := parseChecksums(checksumsFile, sums)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	seen := make(map[string]bool)
+	check := func(path string, info os.FileInfo) {
+		rel, err := filepath.Rel(overlayPath, path)
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		want, ok := listed[rel]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: not listed in %s", rel, checksumsFile))
+			return
+		}
+		got, err := signedDigest(fsys, path, info)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+			return
+		}
+		if got != want {
+			errs = append(errs, fmt.Errorf("%s: sha256 mismatch", rel))
+		}
+	}
+
+	// The overlay config is checked first since it decides what gets copied,
+	// and, unlike an artifact, is read rather than installed, so it can't
+	// be a symlink
+	for _, path := range []string{filepath.Join(overlayPath, "artifacts", overlayConfigFile), filepath.Join(overlayPath, overlayConfigFile)} {
+		info, err := fsys.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			errs = append(errs, err)
+		case !info.Mode().IsRegular():
+			errs = append(errs, fmt.Errorf("%s: not a regular file", path))
+		default:
+			check(path, info)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("artifact verification failed: %w", errors.Join(errs...))
+	}
+	config, err := loadOverlayConfig(fsys, overlayPath)
+	if err != nil {
+		return err
+	}
+	root, config, err := applyProfile(fsys, overlayPath, config, profile)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range artifactSources(fsys, root, config) {
+		// An archive is checked as a whole
+		if archive, ok := artifactArchive(fsys, dir); ok {
+			info, err := fsys.Stat(archive)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			check(archive, info)
+			continue
+		}
+		err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			// Special files have no contents to sign
+			if info.Mode().IsRegular() || info.Mode()&os.ModeSymlink != 0 {
+				check(path, info)
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+
+	// A listed file that is gone may be a removed firmware blob. Other
+	// profiles' files are listed too but aren't installed.
+	for rel := range listed {
+		if !seen[rel] && !strings.HasPrefix(rel, profilesDir+"/") && !strings.HasPrefix(rel, "artifacts/"+profilesDir+"/") {
+			errs = append(errs, fmt.Errorf("%s: listed in %s but missing", rel, checksumsFile))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("artifact verification failed: %w", errors.Join(errs...))
+	}
+
+	slog.Info("🔏 Verified artifact signature", "files", len(listed))
+	return nil
+}
+
+// signedDigest returns the digest SHA256SUMS lists for an artifact. A
+// symlink is installed as a link rather than as what it points to, which
+// may be outside the overlay, so its listed digest is that of its target
+// path, the output of readlink.
+func signedDigest(fsys filesystem, path string, info os.FileInfo) (string, error) {
+	if info.Mode()&os.ModeSymlink == 0 {
+		return fileSHA256(fsys, path)
+	}
+	target, err := fsys.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(target))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadPublicKey reads a PEM public key or certificate, given inline or as a
+// path to a file. Certificates only supply the key; their chain is not checked.
+func loadPublicKey(key string) (crypto.PublicKey, error) {
+	data := []byte(key)
+	if !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(key); err != nil {
+			return nil, fmt.Errorf("failed to read verify key: %w", err)
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("verify key is not PEM encoded")
+	}
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse verify key: %w", err)
+		}
+		return pub, nil
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse verify certificate: %w", err)
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported verify key type %q", block.Type)
+	}
+}
+
+// verifySignature checks a detached signature over data. Base64 encoded
+// signatures, as cosign writes them, are decoded first.
+func verifySignature(pub crypto.PublicKey, data, sig []byte) error {
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig))); err == nil {
+		sig = decoded
+	}
+	digest := sha256.Sum256(data)
+
+	var ok bool
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(pub, digest[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pub, data, sig)
+	default:
+		return fmt.Errorf("unsupported verify key algorithm %T", pub)
+	}
+
+	if !ok {
+		return fmt.Errorf("invalid signature on %s", checksumsFile)
+	}
+	return nil
+}
+
+// parseChecksums reads sha256sum output from the file name into a map of
+// path to digest. Each line is the digest, a space, then a space for text
+// mode or '*' for binary mode, and the path verbatim, leading spaces
+// included. A line starting with a backslash has a path with "\\" and "\n"
+// escapes.
+func parseChecksums(name string, data []byte) (map[string]string, error) {
+	const digestLen = sha256.Size * 2
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" {
+			continue
+		}
+		escaped := strings.HasPrefix(text, "\\")
+		if escaped {
+			text = text[1:]
+		}
+		if len(text) <= digestLen+2 || text[digestLen] != ' ' || (text[digestLen+1] != ' ' && text[digestLen+1] != '*') {
+			return nil, fmt.Errorf("%s:%d: malformed line", name, line)
+		}
+		digest, path := text[:digestLen], text[digestLen+2:]
+		if _, err := hex.DecodeString(digest); err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed digest", name, line)
+		}
+		if escaped {
+			path = strings.NewReplacer("\\\\", "\\", "\\n", "\n").Replace(path)
+		}
+		sums[filepath.ToSlash(filepath.Clean(path))] = strings.ToLower(digest)
+	}
+	return sums, scanner.Err()
+}
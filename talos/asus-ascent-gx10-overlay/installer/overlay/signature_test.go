@@ -0,0 +1,179 @@
+package overlay
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestParseChecksums(t *testing.T) {
+	digest := sha256Hex("x")
+
+	for _, tc := range []struct {
+		name    string
+		line    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "text mode", line: digest + "  a/b.bin", want: map[string]string{"a/b.bin": digest}},
+		{name: "binary mode", line: digest + " *a/b.bin", want: map[string]string{"a/b.bin": digest}},
+		{name: "path with leading spaces", line: digest + "    b.bin", want: map[string]string{"  b.bin": digest}},
+		{name: "path with a leading asterisk", line: digest + "  *b.bin", want: map[string]string{"*b.bin": digest}},
+		{name: "escaped path", line: `\` + digest + `  a\nb\\c`, want: map[string]string{"a\nb\\c": digest}},
+		{name: "upper case digest", line: strings.ToUpper(digest) + "  a", want: map[string]string{"a": digest}},
+		{name: "single space", line: digest + " a", wantErr: true},
+		{name: "no path", line: digest + "  ", wantErr: true},
+		{name: "short digest", line: digest[2:] + "  a", wantErr: true},
+		{name: "non-hex digest", line: strings.Repeat("z", 64) + "  a", wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseChecksums("SHA256SUMS", []byte(tc.line+"\n"))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("parseChecksums() error = %v, want error %v", err, tc.wantErr)
+			}
+			if !tc.wantErr && !maps.Equal(got, tc.want) {
+				t.Errorf("parseChecksums() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// signOverlay writes SHA256SUMS for the given paths and digests to the
+// overlay, signed with a new key, and returns the public key in PEM
+func signOverlay(t *testing.T, overlayPath string, sums map[string]string) string {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := make([]string, 0, len(sums))
+	for path := range sums {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var listing strings.Builder
+	for _, path := range paths {
+		fmt.Fprintf(&listing, "%s  %s\n", sums[path], path)
+	}
+	testutil.WriteTree(t, overlayPath, testutil.Tree{
+		checksumsFile: testutil.File(listing.String()),
+		signatureFile: testutil.File(string(ed25519.Sign(priv, []byte(listing.String())))),
+	})
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestVerifyArtifacts(t *testing.T) {
+	outside := filepath.Join(t.TempDir(), "outside.bin")
+	if err := os.WriteFile(outside, []byte("not from the overlay"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		sums    map[string]string
+		wantErr string
+	}{
+		{
+			name: "all listed",
+			sums: map[string]string{
+				"firmware/nvidia/gsp.bin": sha256Hex("gsp"),
+				"firmware/nvidia/ext.bin": sha256Hex(outside),
+			},
+		},
+		{
+			name: "content tampered",
+			sums: map[string]string{
+				"firmware/nvidia/gsp.bin": sha256Hex("gsp v2"),
+				"firmware/nvidia/ext.bin": sha256Hex(outside),
+			},
+			wantErr: "gsp.bin: sha256 mismatch",
+		},
+		{
+			// A symlink signed by what it points to lets the link be redirected
+			name: "symlink listed by contents",
+			sums: map[string]string{
+				"firmware/nvidia/gsp.bin": sha256Hex("gsp"),
+				"firmware/nvidia/ext.bin": sha256Hex("not from the overlay"),
+			},
+			wantErr: "ext.bin: sha256 mismatch",
+		},
+		{
+			name:    "unlisted symlink",
+			sums:    map[string]string{"firmware/nvidia/gsp.bin": sha256Hex("gsp")},
+			wantErr: "ext.bin: not listed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testutil.Overlay{
+				Firmware: testutil.Tree{
+					"nvidia/gsp.bin": testutil.File("gsp"),
+					"nvidia/ext.bin": testutil.Symlink(outside),
+				},
+			}.Build(t)
+			// The fixture keeps firmware under install/
+			sums := make(map[string]string)
+			for path, sum := range tc.sums {
+				sums["install/"+path] = sum
+			}
+			key := signOverlay(t, overlayPath, sums)
+
+			err := verifyArtifacts(osFS{}, overlayPath, "", key)
+			switch {
+			case tc.wantErr == "" && err != nil:
+				t.Fatalf("verifyArtifacts() = %v", err)
+			case tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)):
+				t.Fatalf("verifyArtifacts() = %v, want error containing %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestInstallVerifiesBeforeWriting(t *testing.T) {
+	overlayPath := testOverlay().Build(t)
+	key := signOverlay(t, overlayPath, map[string]string{"install/firmware/nvidia/gsp.bin": sha256Hex("tampered")})
+	rootfs := testutil.Rootfs(t, testKver)
+
+	extra := map[string]interface{}{"verifyKey": key}
+	cfg, err := parseInstallConfig(extra, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := &recordingFS{written: make(map[string]bool)}
+	options := &Options{
+		InstallOptions: InstallOptions{MountPrefix: rootfs, ExtraOptions: extra},
+		OverlayPath:    overlayPath,
+		Stdout:         io.Discard,
+	}
+	err = runInstall(context.Background(), fsys, options, cfg, newInstallSummary(cfg, nil))
+	if !errors.Is(err, ErrVerification) {
+		t.Fatalf("install of a tampered overlay = %v, want a verification error", err)
+	}
+	for path := range fsys.written {
+		t.Errorf("install wrote %s before the overlay was verified", path)
+	}
+}
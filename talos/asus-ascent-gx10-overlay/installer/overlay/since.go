@@ -0,0 +1,111 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// removeStale finishes a sync from ExtraOptions["since"]: files the since
+// manifest lists that this install didn't, left by artifacts the overlay
+// no longer ships, are removed, then the directories it recorded that are
+// left empty. Files changed since that install are kept, as they may not
+// be ours any more.
+func (inst *Installer) removeStale() error {
+	if inst.since == nil {
+		return nil
+	}
+	// A dry run only knows what the install would write when it plans a diff,
+	// which lists the removals itself
+	if inst.cfg.dryRun {
+		if !inst.cfg.diff {
+			slog.Info("Dry run without -diff, not listing stale files", "since", inst.cfg.since)
+		}
+		return nil
+	}
+
+	current := make(map[string]bool, len(inst.manifest.Files))
+	for _, entry := range inst.manifest.Files {
+		current[entry.Path] = true
+	}
+
+	var errs []error
+	removed := 0
+	for _, entry := range inst.since.Files {
+		if current[entry.Path] {
+			continue
+		}
+		path, err := resolveRootfsPath(inst.fs, inst.rootfsPath, entry.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := inst.fs.Lstat(path); os.IsNotExist(err) {
+			continue
+		}
+		if err := verifyEntry(inst.fs, path, entry); err != nil {
+			slog.Warn("⚠️  Keeping stale file changed since install", "path", path, "reason", err)
+			continue
+		}
+		if err := inst.backup(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := inst.fs.Remove(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		inst.markDirty(filepath.Dir(path))
+		inst.manifest.addRemoval(path)
+		slog.Debug("removed stale", "path", path)
+		removed++
+	}
+
+	// Reverse lexical order visits children before their parents. A
+	// directory still holding files this install wrote isn't empty.
+	dirs := append([]string(nil), inst.since.Directories...)
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		if inst.installedUnder(dir) || strings.HasPrefix(inst.cfg.stateDir+"/", dir+"/") {
+			continue
+		}
+		path, err := resolveRootfsPath(inst.fs, inst.rootfsPath, dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries, err := inst.fs.ReadDir(path)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := inst.fs.Remove(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		inst.markDirty(filepath.Dir(path))
+		inst.manifest.addRemoval(path)
+		removed++
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove %d paths: %w", len(errs), errors.Join(errs...))
+	}
+	slog.Info("🗑️  Removed stale paths", "since", inst.cfg.since, "count", removed)
+	return nil
+}
+
+// sinceOwns reports whether the since manifest records path. A sync trusts
+// it as the earlier install, so a file merged in place must stay recorded
+// or removeStale would take it for one the overlay dropped.
+func (inst *Installer) sinceOwns(path string) bool {
+	rel, ok := inst.manifest.relPath(path)
+	if !ok {
+		return false
+	}
+	_, owned := inst.sinceFiles[rel]
+	return owned
+}
@@ -0,0 +1,92 @@
+package overlay
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestInstallSinceRemovesStale(t *testing.T) {
+	// The state directory is one the first install created, so it is
+	// recorded in the since manifest, and the manifest is moved out of it,
+	// so the stale removal leaves it empty
+	const stateDir = "etc/old"
+
+	first := testOverlay()
+	for _, rel := range []string{
+		"etc/nvidia/dropped.conf",
+		"etc/nvidia/modified.conf",
+		"etc/old/a.conf",
+		"etc/gone/b.conf",
+		"etc/kept/c.conf",
+	} {
+		first.Files[rel] = testutil.File(rel + "\n")
+	}
+	rootfs := testutil.Rootfs(t, testKver)
+	extra := map[string]interface{}{"stateDir": stateDir}
+	if err := runInstallTest(t, first.Build(t), rootfs, extra); err != nil {
+		t.Fatalf("first install: %v", err)
+	}
+
+	since := filepath.Join(t.TempDir(), manifestFile)
+	if err := os.Rename(manifestPath(rootfs, stateDir), since); err != nil {
+		t.Fatal(err)
+	}
+	testutil.WriteTree(t, rootfs, testutil.Tree{
+		"etc/nvidia/modified.conf": testutil.File("changed\n"),
+		"etc/kept/user.conf":       testutil.File("mine\n"),
+	})
+
+	extra["since"] = since
+	if err := runInstallTest(t, testOverlay().Build(t), rootfs, extra); err != nil {
+		t.Fatalf("install since: %v", err)
+	}
+
+	for _, rel := range []string{"etc/nvidia/dropped.conf", "etc/old/a.conf", "etc/gone/b.conf", "etc/gone", "etc/kept/c.conf"} {
+		if _, err := os.Lstat(filepath.Join(rootfs, rel)); !os.IsNotExist(err) {
+			t.Errorf("stale %s left in place: %v", rel, err)
+		}
+	}
+	for _, rel := range []string{"etc/nvidia/app.conf", modulesLoadFile, "etc/kept/user.conf", "etc/kept", stateDir} {
+		if _, err := os.Lstat(filepath.Join(rootfs, rel)); err != nil {
+			t.Errorf("%s removed: %v", rel, err)
+		}
+	}
+	if got := readTestFile(t, rootfs, "etc/nvidia/modified.conf"); got != "changed\n" {
+		t.Errorf("etc/nvidia/modified.conf = %q, want the local change kept", got)
+	}
+
+	manifest, err := readManifest(osFS{}, rootfs, stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"etc/gone", "etc/gone/b.conf", "etc/kept/c.conf", "etc/nvidia/dropped.conf", "etc/old/a.conf"}
+	got := slices.Clone(manifest.Removed)
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("manifest removed = %q, want %q", got, want)
+	}
+}
+
+func TestInstallSinceRejectsEscapingManifest(t *testing.T) {
+	rootfs := testutil.Rootfs(t, testKver)
+	outside := filepath.Join(filepath.Dir(rootfs), "escape")
+	if err := os.WriteFile(outside, []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	since := filepath.Join(t.TempDir(), manifestFile)
+	if err := os.WriteFile(since, []byte("files:\n  - path: ../escape\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := runInstallTest(t, testOverlay().Build(t), rootfs, map[string]interface{}{"since": since})
+	if err == nil {
+		t.Error("install with an escaping since manifest succeeded")
+	}
+	if _, err := os.Lstat(outside); err != nil {
+		t.Errorf("install removed %s outside the rootfs: %v", outside, err)
+	}
+}
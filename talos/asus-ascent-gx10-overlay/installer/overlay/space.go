@@ -0,0 +1,201 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// checkDiskSpace makes sure the filesystem backing the rootfs can hold every
+// artifact before anything is copied, so a full disk fails the install up
+// front instead of leaving a half installed overlay behind
+func checkDiskSpace(fsys filesystem, sources []string, rootfsPath string) error {
+	need, err := sourcesSize(fsys, sources)
+	if err != nil {
+		return err
+	}
+	free, err := freeSpace(rootfsPath)
+	if err != nil {
+		return err
+	}
+
+	if need > free {
+		return classify(ErrIO, fmt.Errorf("not enough space on %s: need %s, have %s free", rootfsPath, formatMiB(need), formatMiB(free)))
+	}
+
+	slog.Info("💾 Disk space", "need", formatMiB(need), "free", formatMiB(free))
+	return nil
+}
+
+// sourcesSize sums the sizes of the artifact directories an install copies
+func sourcesSize(fsys filesystem, sources []string) (uint64, error) {
+	var size uint64
+	for _, dir := range sources {
+		n, err := treeSize(fsys, dir)
+		if err != nil {
+			return 0, fmt.Errorf("failed to size %s: %w", dir, err)
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// freeSpace returns the bytes available to unprivileged writes on the
+// filesystem holding path
+func freeSpace(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat filesystem of %s: %w", path, err)
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+// isNoSpace reports whether err comes from the rootfs filling up
+func isNoSpace(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// writtenPath is a file, symlink or hard link a run wrote to the rootfs
+type writtenPath struct {
+	path string
+	size int64
+
+	// existed is set when the run replaced something already at path
+	existed bool
+}
+
+// exists reports whether anything is at path yet
+func (inst *Installer) exists(path string) bool {
+	_, err := inst.fs.Lstat(path)
+	return err == nil
+}
+
+// wrote records a completed write of size bytes to path
+func (inst *Installer) wrote(path string, size int64, existed bool) {
+	inst.writtenMu.Lock()
+	defer inst.writtenMu.Unlock()
+	inst.written = append(inst.written, writtenPath{path: path, size: size, existed: existed})
+}
+
+// noSpaceError explains a run that filled the rootfs: how much it wrote
+// before the disk filled and how far short the space was of the artifacts
+func (inst *Installer) noSpaceError(err error) error {
+	var written uint64
+	for _, w := range inst.written {
+		written += uint64(w.size)
+	}
+
+	msg := fmt.Sprintf("rootfs %s ran out of space after writing %d bytes", inst.rootfsPath, written)
+	need, nerr := sourcesSize(inst.fs, artifactSources(inst.fs, inst.overlayPath, inst.config))
+	free, ferr := freeSpace(inst.rootfsPath)
+	if nerr == nil && ferr == nil && need > written+free {
+		msg += fmt.Sprintf(", %d bytes short", need-written-free)
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// cleanupWritten undoes the writes of a run that failed part way: files it
+// replaced are restored from their backups, files and links it created are
+// removed, and so are the directories it created once empty. Replaced
+// files without a backup can't be restored and are left as written.
+func (inst *Installer) cleanupWritten() error {
+	var errs []error
+
+	restored := make(map[string]bool)
+	for _, rel := range inst.manifest.Backups {
+		path := rootfsJoin(inst.rootfsPath, rel)
+		err := inst.fs.Rename(rootfsJoin(inst.rootfsPath, backupDir(inst.cfg.stateDir)+"/"+rel), path)
+		if os.IsNotExist(err) {
+			// The disk filled while backing it up, before it was replaced
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		restored[path] = true
+	}
+
+	removed, kept := 0, 0
+	for i := len(inst.written) - 1; i >= 0; i-- {
+		w := inst.written[i]
+		switch {
+		case restored[w.path]:
+		case w.existed:
+			kept++
+		default:
+			if err := inst.fs.Remove(w.path); err != nil && !os.IsNotExist(err) {
+				errs = append(errs, err)
+				continue
+			}
+			removed++
+		}
+	}
+
+	dirs := append([]string(nil), inst.manifest.Directories...)
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, dir := range dirs {
+		path := rootfsJoin(inst.rootfsPath, dir)
+		if entries, err := inst.fs.ReadDir(path); err != nil || len(entries) > 0 {
+			continue
+		}
+		if err := inst.fs.Remove(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if len(restored) > 0 {
+		if err := inst.fs.RemoveAll(rootfsJoin(inst.rootfsPath, backupDir(inst.cfg.stateDir))); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if kept > 0 {
+		slog.Warn("⚠️  Replaced files have no backup and stay as written, install with extraOptions.enableBackup to restore them", "files", kept)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to clean up %d paths: %w", len(errs), errors.Join(errs...))
+	}
+	slog.Info("🧹 Cleaned up partial install", "restored", len(restored), "removed", removed)
+	return nil
+}
+
+// treeSize sums the sizes of the regular files under dir, counting hard
+// linked files once. A missing directory has size zero, unless it is
+// shipped as an archive.
+func treeSize(fsys filesystem, dir string) (uint64, error) {
+	if archive, ok := artifactArchive(fsys, dir); ok {
+		return archiveSize(fsys, archive)
+	}
+
+	var size uint64
+	linked := make(map[fileID]bool)
+	err := fsys.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if id, ok := hardLinkID(info); ok {
+			if linked[id] {
+				return nil
+			}
+			linked[id] = true
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size, err
+}
+
+// formatMiB renders a byte count in whole MiB
+func formatMiB(bytes uint64) string {
+	return fmt.Sprintf("%dMiB", bytes>>20)
+}
@@ -0,0 +1,85 @@
+package overlay
+
+import (
+	"archive/tar"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// specialKind names the type of a file that is neither regular, a
+// directory nor a symlink
+func specialKind(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	default:
+		return "irregular file"
+	}
+}
+
+// specialDevice returns the device number of a source device node
+func specialDevice(info os.FileInfo) uint64 {
+	switch sys := info.Sys().(type) {
+	case *syscall.Stat_t:
+		return uint64(sys.Rdev)
+	case *tar.Header:
+		return unix.Mkdev(uint32(sys.Devmajor), uint32(sys.Devminor))
+	}
+	return 0
+}
+
+// copySpecial recreates a FIFO or device node at dst when
+// ExtraOptions["copySpecial"] is set; copying one like a regular file
+// would leave an empty file instead. Device nodes need root. Anything that
+// can't be recreated, sockets included, is skipped with a warning.
+func (inst *Installer) copySpecial(src, dst string, info os.FileInfo) error {
+	kind := specialKind(info.Mode())
+	isDevice := info.Mode()&os.ModeDevice != 0
+	switch {
+	case !inst.cfg.copySpecial:
+		slog.Warn("⚠️  Skipping special file, set extraOptions.copySpecial to recreate it", "src", src, "type", kind)
+		inst.summary.skip(src)
+		return nil
+	case info.Mode()&os.ModeNamedPipe == 0 && !isDevice:
+		slog.Warn("⚠️  Skipping special file that can't be recreated", "src", src, "type", kind)
+		inst.summary.skip(src)
+		return nil
+	case isDevice && os.Geteuid() != 0:
+		slog.Warn("⚠️  Skipping device node, creating it needs root", "src", src, "type", kind)
+		inst.summary.skip(src)
+		return nil
+	}
+
+	existed := inst.exists(dst)
+	if err := inst.backup(dst); err != nil {
+		return err
+	}
+	// Mknod refuses to replace an existing entry
+	if err := inst.fs.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	inst.markDirty(filepath.Dir(dst))
+	if err := inst.fs.Mknod(dst, info.Mode(), specialDevice(info)); err != nil {
+		return err
+	}
+	inst.preserveOwnership(dst, info)
+
+	dstInfo, err := inst.fs.Lstat(dst)
+	if err != nil {
+		return err
+	}
+	inst.manifest.addFile(dst, dstInfo, "")
+	inst.wrote(dst, 0, existed)
+	slog.Debug("created", "dst", dst, "type", kind)
+	return nil
+}
@@ -0,0 +1,91 @@
+package overlay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestCopyDirectorySpecial(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// mode and dev make the source special file
+		mode uint32
+		dev  uint64
+		// existing is a regular file already at the destination
+		existing    bool
+		copySpecial bool
+		root        bool
+		// want is the destination's type, or zero when it's skipped
+		want os.FileMode
+	}{
+		{name: "fifo skipped", mode: unix.S_IFIFO | 0o644},
+		{name: "fifo recreated", mode: unix.S_IFIFO | 0o644, copySpecial: true, want: os.ModeNamedPipe},
+		{name: "fifo replaces a file", mode: unix.S_IFIFO | 0o600, existing: true, copySpecial: true, want: os.ModeNamedPipe},
+		{name: "character device skipped", mode: unix.S_IFCHR | 0o666, dev: unix.Mkdev(1, 3), root: true},
+		{name: "character device recreated", mode: unix.S_IFCHR | 0o666, dev: unix.Mkdev(1, 3), copySpecial: true, root: true, want: os.ModeDevice | os.ModeCharDevice},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.root && os.Geteuid() != 0 {
+				t.Skip("creating device nodes needs root")
+			}
+			src := t.TempDir()
+			testutil.WriteTree(t, src, testutil.Tree{"nvidia/app.conf": testutil.File("key=value\n")})
+			srcPath := filepath.Join(src, "nvidia", "special")
+			if err := unix.Mknod(srcPath, tc.mode, int(tc.dev)); err != nil {
+				t.Fatal(err)
+			}
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "etc")
+			dstPath := filepath.Join(dst, "nvidia", "special")
+			if tc.existing {
+				testutil.WriteTree(t, dst, testutil.Tree{"nvidia/special": testutil.File("stale")})
+			}
+
+			inst := newTestInstaller(t, src, rootfs, map[string]interface{}{"copySpecial": tc.copySpecial})
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			info, err := os.Lstat(dstPath)
+			_, listed := inst.manifest.entry(dstPath)
+			if tc.want == 0 {
+				if !os.IsNotExist(err) {
+					t.Errorf("skipped special file was copied: %v", err)
+				}
+				if listed {
+					t.Error("skipped special file is in the manifest")
+				}
+				if !slices.Contains(inst.summary.Skipped, srcPath) {
+					t.Errorf("summary skipped %q, want %s", inst.summary.Skipped, srcPath)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Type(); got != tc.want {
+				t.Errorf("destination type %v, want %v", got, tc.want)
+			}
+			srcInfo, err := os.Lstat(srcPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := info.Mode().Perm(), srcInfo.Mode().Perm(); got != want {
+				t.Errorf("destination mode %#o, want %#o", got, want)
+			}
+			if tc.dev != 0 && specialDevice(info) != tc.dev {
+				t.Errorf("destination device %#x, want %#x", specialDevice(info), tc.dev)
+			}
+			if !listed {
+				t.Error("recreated special file is not in the manifest")
+			}
+		})
+	}
+}
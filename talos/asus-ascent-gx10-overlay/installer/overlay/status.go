@@ -0,0 +1,38 @@
+package overlay
+
+import (
+	"fmt"
+	"time"
+)
+
+// Status reports whether the overlay is installed on the rootfs, and which
+// version, based on its manifest. A missing manifest is reported as
+// ErrNotInstalled.
+func Status(options *Options) error {
+	rootfsPath, err := installRoot(osFS{}, options.MountPrefix, options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	stateDir, err := stateDirOption(options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	manifest, err := readManifest(osFS{}, rootfsPath, stateDir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, entry := range manifest.Files {
+		if entry.Mode.IsRegular() {
+			total += entry.Size
+		}
+	}
+
+	fmt.Fprintf(options.stdout(), "overlay: %s\n", manifest.Overlay)
+	fmt.Fprintf(options.stdout(), "version: %s\n", manifestVersion(manifest))
+	fmt.Fprintf(options.stdout(), "installedAt: %s\n", manifest.InstalledAt.Format(time.RFC3339))
+	fmt.Fprintf(options.stdout(), "files: %d\n", len(manifest.Files))
+	fmt.Fprintf(options.stdout(), "bytes: %d\n", total)
+	return nil
+}
@@ -0,0 +1,63 @@
+package overlay
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		manifest *Manifest
+		want     []string
+		wantErr  error
+	}{
+		{
+			name: "installed",
+			manifest: &Manifest{
+				Overlay: Name,
+				Version: "1.2.3",
+				Files: []ManifestEntry{
+					{Path: "lib/firmware/a.bin", Size: 3, Mode: 0o644},
+					{Path: "lib/firmware/b.bin", Size: 0, Mode: os.ModeSymlink | 0o777, Target: "a.bin"},
+				},
+			},
+			want: []string{"overlay: " + Name, "version: 1.2.3", "files: 2", "bytes: 3"},
+		},
+		{
+			name:     "unknown version",
+			manifest: &Manifest{Overlay: Name},
+			want:     []string{"version: unknown", "files: 0"},
+		},
+		{
+			name:    "not installed",
+			wantErr: ErrNotInstalled,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			if tc.manifest != nil {
+				if err := writeManifest(osFS{}, rootfs, defaultStateDir, tc.manifest); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var out bytes.Buffer
+			options := &Options{InstallOptions: InstallOptions{MountPrefix: rootfs}, Stdout: &out}
+			err := Status(options)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Status() error = %v, want %v", err, tc.wantErr)
+			}
+			lines := strings.Split(out.String(), "\n")
+			for _, want := range tc.want {
+				if !slices.Contains(lines, want) {
+					t.Errorf("Status() output lacks %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package overlay
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// artifactSources lists what an install copies out of the overlay: the
+// sources of the overlay config's steps, or the built-in layout without any
+func artifactSources(fsys filesystem, overlayPath string, config *OverlayConfig) []string {
+	if len(config.Steps) == 0 {
+		return []string{kernelModulesSource(fsys, overlayPath), firmwareSource(fsys, overlayPath), configFilesSource(fsys, overlayPath)}
+	}
+
+	sources := make([]string, len(config.Steps))
+	for i, step := range config.Steps {
+		sources[i] = filepath.Join(overlayPath, step.From)
+	}
+	return sources
+}
+
+// installSteps runs the copy steps declared in the overlay config in order,
+// then regenerates module dependencies for any kernel they installed into
+func (inst *Installer) installSteps(ctx context.Context) error {
+	for i, step := range inst.config.Steps {
+		src := filepath.Join(inst.overlayPath, step.From)
+		dst := filepath.Join(inst.rootfsPath, strings.TrimPrefix(step.To, "/"))
+		name := fmt.Sprintf("step %d: %s", i+1, step.From)
+
+		err := inst.summary.phase(name, inst.manifest, func() error {
+			// validate already parsed the mode when the config was loaded
+			mode, _ := step.fileMode()
+
+			if archive, ok := artifactArchive(inst.fs, src); ok {
+				slog.Info("📦 Copying", "phase", name, "src", archive, "dst", dst)
+				_, err := inst.copyArchive(ctx, archive, dst, "", mode, nil)
+				return err
+			}
+
+			if _, err := inst.fs.Stat(src); os.IsNotExist(err) {
+				if !step.Optional {
+					return fmt.Errorf("source missing: %s", src)
+				}
+				slog.Warn("⚠️  Optional step source not found, skipping", "phase", name, "src", src)
+				inst.summary.skip(src)
+				return nil
+			}
+
+			slog.Info("📦 Copying", "phase", name, "src", src, "dst", dst)
+			return inst.copyDirectory(ctx, src, dst, mode, nil)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to run %s: %w", name, err)
+		}
+	}
+
+	// Steps don't say which kernel they target, so use the ones they filled
+	versions := make(map[string]bool)
+	for _, entry := range inst.manifest.Files {
+		if kver, ok := inst.moduleKernelVersion(entry.Path); ok {
+			versions[kver] = true
+		}
+	}
+	kvers := make([]string, 0, len(versions))
+	for kver := range versions {
+		kvers = append(kvers, kver)
+	}
+	sort.Strings(kvers)
+	for _, kver := range kvers {
+		if err := inst.regenerateModuleDeps(ctx, kver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
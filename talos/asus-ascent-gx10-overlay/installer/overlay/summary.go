@@ -0,0 +1,184 @@
+package overlay
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProgressReporter observes an install as it runs, for a host application
+// drawing its own progress or exporting metrics. Calls are never made
+// concurrently, even while files are copied in parallel, but they hold up
+// the install until they return.
+type ProgressReporter interface {
+	// OnPhaseStart is called as a phase, like "kernel-modules", begins
+	OnPhaseStart(phase string)
+	// OnFileCopied is called for each file a phase copies to dst
+	OnFileCopied(phase, dst string, bytes int64)
+	// OnPhaseEnd is called once a phase is done, with its error if it failed
+	OnPhaseEnd(phase string, err error)
+}
+
+// nopReporter is the ProgressReporter of installs that don't set one
+type nopReporter struct{}
+
+func (nopReporter) OnPhaseStart(string)                {}
+func (nopReporter) OnFileCopied(string, string, int64) {}
+func (nopReporter) OnPhaseEnd(string, error)           {}
+
+// installSummary is the machine-readable result of an install, printed to
+// stdout when ExtraOptions["outputFormat"] is "json"
+type installSummary struct {
+	Phases         []phaseSummary `json:"phases"`
+	Files          int            `json:"files"`
+	Bytes          int64          `json:"bytes"`
+	ElapsedSeconds float64        `json:"elapsedSeconds"`
+	Skipped        []string       `json:"skipped,omitempty"`
+	Warnings       []string       `json:"warnings,omitempty"`
+	Copied         int            `json:"copied"`
+	Unchanged      int            `json:"unchanged"`
+	// Parallel is how many files were copied at a time, to compare with
+	// the phases' throughput when tuning ExtraOptions["parallel"]
+	Parallel int `json:"parallel"`
+	// DedupedBytes were linked to an earlier copy rather than written
+	DedupedBytes int64 `json:"dedupedBytes,omitempty"`
+	// StrippedBytes is how much smaller stripping debug sections made the
+	// installed modules
+	StrippedBytes    int64             `json:"strippedBytes,omitempty"`
+	DriverVersion    string            `json:"driverVersion,omitempty"`
+	FirmwareCoverage *firmwareCoverage `json:"firmwareCoverage,omitempty"`
+	// ModuleCompression is what each target kernel's config expects
+	ModuleCompression map[string]string `json:"moduleCompression,omitempty"`
+	DryRun            bool              `json:"dryRun"`
+	Error             string            `json:"error,omitempty"`
+
+	start time.Time
+
+	// reporter is told about phases and files as they happen, within the
+	// current phase
+	reporter ProgressReporter
+	current  string
+
+	// mu guards Copied, Unchanged, DedupedBytes, Skipped and Warnings
+	// against concurrent copy workers, and serializes calls to reporter
+	mu sync.Mutex
+}
+
+// phaseSummary covers one install phase
+type phaseSummary struct {
+	Name           string  `json:"name"`
+	Files          int     `json:"files"`
+	Bytes          int64   `json:"bytes"`
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	// BytesPerSecond is the phase's copy throughput. It stops growing with
+	// more parallel copies once the rootfs disk is the bottleneck.
+	BytesPerSecond int64  `json:"bytesPerSecond"`
+	Error          string `json:"error,omitempty"`
+
+	elapsed time.Duration
+}
+
+func newInstallSummary(cfg *installConfig, reporter ProgressReporter) *installSummary {
+	if reporter == nil {
+		reporter = nopReporter{}
+	}
+	return &installSummary{Phases: []phaseSummary{}, Parallel: cfg.workers, DryRun: cfg.dryRun, start: time.Now(), reporter: reporter}
+}
+
+// phase runs fn as the named phase, attributing the manifest entries it adds
+func (s *installSummary) phase(name string, manifest *Manifest, fn func() error) error {
+	s.mu.Lock()
+	s.current = name
+	s.reporter.OnPhaseStart(name)
+	s.mu.Unlock()
+
+	before := len(manifest.Files)
+	start := time.Now()
+	err := fn()
+
+	s.mu.Lock()
+	s.reporter.OnPhaseEnd(name, err)
+	s.current = ""
+	s.mu.Unlock()
+
+	p := phaseSummary{Name: name, elapsed: time.Since(start)}
+	p.ElapsedSeconds = p.elapsed.Seconds()
+	for _, entry := range manifest.Files[before:] {
+		p.Files++
+		if entry.Mode.IsRegular() {
+			p.Bytes += entry.Size
+		}
+	}
+	if p.elapsed > 0 {
+		p.BytesPerSecond = int64(float64(p.Bytes) / p.elapsed.Seconds())
+	}
+	if err != nil {
+		p.Error = err.Error()
+	}
+
+	s.Phases = append(s.Phases, p)
+	s.Files += p.Files
+	s.Bytes += p.Bytes
+	return err
+}
+
+// skip records a source directory the overlay doesn't ship
+func (s *installSummary) skip(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Skipped = append(s.Skipped, dir)
+}
+
+// warn records a failure the install carried on past
+func (s *installSummary) warn(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Warnings = append(s.Warnings, msg)
+}
+
+// dedupe counts bytes a deduplicated link saved writing
+func (s *installSummary) dedupe(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.DedupedBytes += bytes
+}
+
+// countFile counts a regular file as copied to dst, or as left in place by
+// an incremental install because it was unchanged
+func (s *installSummary) countFile(dst string, bytes int64, copied bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if copied {
+		s.Copied++
+		s.reporter.OnFileCopied(s.current, dst, bytes)
+	} else {
+		s.Unchanged++
+	}
+}
+
+// logTimings reports how long each phase took and how fast it copied, for
+// the text output. Throughput that doesn't improve with more parallel
+// copies means the disk, not the installer, sets the pace.
+func (s *installSummary) logTimings() {
+	for _, p := range s.Phases {
+		slog.Info("⏱️  Phase timing", "phase", p.Name, "files", p.Files, "bytes", p.Bytes, "elapsed", p.elapsed.Round(time.Millisecond), "bytesPerSecond", p.BytesPerSecond)
+	}
+	slog.Info("⏱️  Total", "elapsed", time.Since(s.start).Round(time.Millisecond), "parallel", s.Parallel)
+}
+
+// write finishes the summary with the install's outcome and encodes it to w
+func (s *installSummary) write(w io.Writer, err error) error {
+	s.ElapsedSeconds = time.Since(s.start).Seconds()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	// Skips are recorded as workers get to them
+	sort.Strings(s.Skipped)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
@@ -0,0 +1,79 @@
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+// Durability with ExtraOptions["fsync"]: every file is flushed before it is
+// renamed into place, and every directory whose entries changed is flushed
+// once the copies are done, so an image captured right after the install
+// can't lose files that were reported as installed. This makes the install
+// noticeably slower, especially with many small firmware files, so it is off
+// by default.
+
+// syncer is implemented by *os.File
+type syncer interface {
+	Sync() error
+}
+
+// syncPath flushes the file or directory at path to disk
+func (inst *Installer) syncPath(path string) error {
+	f, err := inst.fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if s, ok := f.(syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// markDirty records that the entries of dir changed, for syncDirs
+func (inst *Installer) markDirty(dir string) {
+	if !inst.cfg.fsync {
+		return
+	}
+	inst.dirtyMu.Lock()
+	defer inst.dirtyMu.Unlock()
+	if inst.dirty == nil {
+		inst.dirty = make(map[string]bool)
+	}
+	inst.dirty[dir] = true
+}
+
+// syncDirs flushes every directory marked dirty, so the creates and renames
+// in them are durable
+func (inst *Installer) syncDirs() error {
+	inst.dirtyMu.Lock()
+	dirs := make([]string, 0, len(inst.dirty))
+	for dir := range inst.dirty {
+		dirs = append(dirs, dir)
+	}
+	inst.dirty = nil
+	inst.dirtyMu.Unlock()
+	sort.Strings(dirs)
+
+	var errs []error
+	for _, dir := range dirs {
+		if err := inst.syncPath(dir); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to sync %d directories: %w", len(errs), errors.Join(errs...))
+	}
+	return nil
+}
+
+// syncWritten flushes a file written in place and marks its directory dirty
+func (inst *Installer) syncWritten(path string) error {
+	if !inst.cfg.fsync {
+		return nil
+	}
+	inst.markDirty(filepath.Dir(path))
+	return inst.syncPath(path)
+}
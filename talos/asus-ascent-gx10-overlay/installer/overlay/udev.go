@@ -0,0 +1,68 @@
+package overlay
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// udevRulesFile sets permissions on the NVIDIA device nodes,
+// relative to the rootfs
+const udevRulesFile = "etc/udev/rules.d/71-nvidia.rules"
+
+// defaultUdevRules open the NVIDIA character devices to every user, as the
+// driver's own installer does. Containers still only see the nodes the
+// device plugin hands them.
+var defaultUdevRules = []string{
+	`KERNEL=="nvidiactl", MODE="0666"`,
+	`KERNEL=="nvidia[0-9]*", MODE="0666"`,
+	`KERNEL=="nvidia-modeset", MODE="0666"`,
+	`KERNEL=="nvidia-uvm", MODE="0666"`,
+	`KERNEL=="nvidia-uvm-tools", MODE="0666"`,
+}
+
+// udevRules returns the rule lines for this install. ExtraOptions["udevRules"]
+// wins over the overlay config, which wins over defaultUdevRules.
+// Rules contain spaces, so a single string option is split on lines.
+func udevRules(extra map[string]interface{}, config *OverlayConfig) ([]string, error) {
+	if s, ok := extra["udevRules"].(string); ok {
+		return strings.Split(s, "\n"), nil
+	}
+	rules, ok, err := stringListOption(extra, "udevRules")
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return rules, nil
+	}
+	if len(config.UdevRules) > 0 {
+		return config.UdevRules, nil
+	}
+	return defaultUdevRules, nil
+}
+
+// installUdevRules writes the udev rules for the NVIDIA device nodes.
+// The file belongs to the overlay, so re-running replaces it.
+func (inst *Installer) installUdevRules() error {
+	rules, err := udevRules(inst.extra, inst.config)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(inst.rootfsPath, filepath.FromSlash(udevRulesFile))
+	slog.Info("🔌 Writing udev rules", "dst", path, "rules", len(rules))
+
+	return inst.writeFile(path, renderUdevRules(rules), 0644)
+}
+
+// renderUdevRules formats rule lines as a rules file, dropping blank lines
+func renderUdevRules(rules []string) []byte {
+	var out strings.Builder
+	out.WriteString("# Added by " + Name + "\n")
+	for _, rule := range rules {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			out.WriteString(rule + "\n")
+		}
+	}
+	return []byte(out.String())
+}
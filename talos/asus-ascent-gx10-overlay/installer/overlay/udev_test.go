@@ -0,0 +1,85 @@
+package overlay
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+// udevKey is one comma separated key of a udev rule, e.g. MODE="0666"
+var udevKey = regexp.MustCompile(`^[A-Z_]+(\{[^}]+\})?(==|!=|=|\+=|-=|:=)"[^"]*"$`)
+
+// checkUdevSyntax fails the test for any rule line udev wouldn't parse
+func checkUdevSyntax(t *testing.T, rules string) {
+	t.Helper()
+	for _, line := range strings.Split(strings.TrimSuffix(rules, "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, key := range strings.Split(line, ",") {
+			if !udevKey.MatchString(strings.TrimSpace(key)) {
+				t.Errorf("malformed udev rule %q", line)
+				break
+			}
+		}
+	}
+}
+
+func TestInstallUdevRules(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		extra  map[string]interface{}
+		want   []string
+	}{
+		{
+			name: "defaults",
+			want: defaultUdevRules,
+		},
+		{
+			name:   "overlay config",
+			config: "udevRules:\n  - 'KERNEL==\"nvidiactl\", GROUP=\"video\", MODE=\"0660\"'\n",
+			want:   []string{`KERNEL=="nvidiactl", GROUP="video", MODE="0660"`},
+		},
+		{
+			name:   "extra options list",
+			config: "udevRules:\n  - 'KERNEL==\"nvidiactl\", MODE=\"0660\"'\n",
+			extra:  map[string]interface{}{"udevRules": []interface{}{`KERNEL=="nvidia-uvm", GROUP="video", MODE="0660"`}},
+			want:   []string{`KERNEL=="nvidia-uvm", GROUP="video", MODE="0660"`},
+		},
+		{
+			name:  "extra options string",
+			extra: map[string]interface{}{"udevRules": "KERNEL==\"nvidiactl\", MODE=\"0600\"\n\n  KERNEL==\"nvidia[0-9]*\", MODE=\"0600\"  \n"},
+			want:  []string{`KERNEL=="nvidiactl", MODE="0600"`, `KERNEL=="nvidia[0-9]*", MODE="0600"`},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fixture := testOverlay()
+			fixture.Config = tc.config
+			overlayPath := fixture.Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+
+			// Installing again must leave the same file
+			var rules string
+			for i := range 2 {
+				if err := runInstallTest(t, overlayPath, rootfs, tc.extra); err != nil {
+					t.Fatalf("install %d: %v", i+1, err)
+				}
+				got := readTestFile(t, rootfs, udevRulesFile)
+				if i > 0 && got != rules {
+					t.Errorf("%s changed on reinstall:\n%s\nthen\n%s", udevRulesFile, rules, got)
+				}
+				rules = got
+			}
+
+			checkUdevSyntax(t, rules)
+			want := append([]string{"# Added by " + Name}, tc.want...)
+			if got := strings.Split(strings.TrimSuffix(rules, "\n"), "\n"); !slices.Equal(got, want) {
+				t.Errorf("%s lines = %q, want %q", udevRulesFile, got, want)
+			}
+		})
+	}
+}
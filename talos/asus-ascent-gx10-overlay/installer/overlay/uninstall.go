@@ -0,0 +1,157 @@
+package overlay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Uninstall removes everything a prior install recorded in its manifest.
+// Directories are only removed when empty, so files placed by anything other
+// than this overlay are never touched.
+func Uninstall(options *Options) error {
+	rootfsPath, err := installRoot(osFS{}, options.MountPrefix, options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	stateDir, err := stateDirOption(options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	modulesDir, err := rootfsDirOption(options.ExtraOptions, "modulesDir", defaultModulesDir)
+	if err != nil {
+		return err
+	}
+
+	fsys := osFS{}
+	manifest, err := readManifest(fsys, rootfsPath, stateDir)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Uninstalling ASUS Ascent GX10 overlay...", "rootfs", rootfsPath)
+
+	if err := removeInstalled(fsys, rootfsPath, stateDir, manifest, nil); err != nil {
+		return err
+	}
+
+	// The removed modules are still listed in modules.dep and the other
+	// indexes until they are regenerated
+	ctx := context.Background()
+	for _, kver := range manifestKernels(manifest, modulesDir) {
+		if _, err := fsys.Stat(filepath.Join(rootfsPath, filepath.FromSlash(modulesDir), kver)); err != nil {
+			continue
+		}
+		if err := runDepmod(ctx, fsys, rootfsPath, modulesDir, kver); err != nil {
+			return fmt.Errorf("failed to regenerate module dependencies for %s: %w", kver, err)
+		}
+	}
+
+	slog.Log(ctx, levelResult, "✅ Overlay uninstalled successfully")
+	return nil
+}
+
+// manifestKernels returns the kernel versions manifest installed modules
+// for under modulesDir, in order
+func manifestKernels(manifest *Manifest, modulesDir string) []string {
+	seen := make(map[string]bool)
+	var kvers []string
+	for _, entry := range manifest.Files {
+		rest, ok := strings.CutPrefix(entry.Path, modulesDir+"/")
+		if !ok || !isKernelModule(rest) {
+			continue
+		}
+		kver := strings.SplitN(rest, "/", 2)[0]
+		if !seen[kver] {
+			seen[kver] = true
+			kvers = append(kvers, kver)
+		}
+	}
+	sort.Strings(kvers)
+	return kvers
+}
+
+// removeInstalled removes the files and empty directories manifest lists,
+// then the manifest itself. save, when set, is called on each file first.
+func removeInstalled(fsys filesystem, rootfsPath, stateDir string, manifest *Manifest, save func(path string) error) error {
+	var removed []string
+	var errs []error
+
+	for _, entry := range manifest.Files {
+		path, err := resolveRootfsPath(fsys, rootfsPath, entry.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if save != nil {
+			if err := save(path); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		if err := fsys.Remove(path); err != nil {
+			if os.IsNotExist(err) {
+				slog.Warn("⚠️  Already absent", "path", path)
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+
+	// Reverse lexical order visits children before their parents
+	dirs := append([]string(nil), manifest.Directories...)
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, dir := range dirs {
+		path, err := resolveRootfsPath(fsys, rootfsPath, dir)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		entries, err := fsys.ReadDir(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if len(entries) > 0 {
+			slog.Warn("⚠️  Keeping non-empty directory", "path", path)
+			continue
+		}
+		if err := fsys.Remove(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, path)
+	}
+
+	for _, path := range removed {
+		slog.Info("removed", "path", path)
+	}
+	slog.Info("🗑️  Removed overlay paths", "count", len(removed))
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to remove %d paths: %w", len(errs), errors.Join(errs...))
+	}
+
+	// Only drop the manifest once everything it lists is gone
+	path := manifestPath(rootfsPath, stateDir)
+	if save != nil {
+		if err := save(path); err != nil {
+			return err
+		}
+	}
+	if err := fsys.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove manifest: %w", err)
+	}
+	return nil
+}
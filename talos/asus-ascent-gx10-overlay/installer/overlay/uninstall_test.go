@@ -0,0 +1,141 @@
+package overlay
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestUninstallModuleDeps(t *testing.T) {
+	const (
+		installed = "kernel/drivers/gpu/nvidia.ko"
+		kept      = "kernel/drivers/net/igb.ko"
+	)
+	kverDir := "lib/modules/" + testKver + "/"
+
+	for _, tc := range []struct {
+		name   string
+		rootfs testutil.Tree
+		// wantDep is what modules.dep lists after the uninstall
+		wantDep string
+	}{
+		{
+			name:    "overlay modules only",
+			wantDep: "",
+		},
+		{
+			name: "other modules kept",
+			rootfs: testutil.Tree{
+				kverDir + kept: testModule(),
+			},
+			wantDep: kept + ":\n",
+		},
+		{
+			name: "stale binary indexes",
+			rootfs: testutil.Tree{
+				kverDir + "modules.dep.bin":     testutil.File("stale"),
+				kverDir + "modules.alias.bin":   testutil.File("stale"),
+				kverDir + "modules.symbols.bin": testutil.File("stale"),
+			},
+			wantDep: "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testOverlay().Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+			testutil.WriteTree(t, rootfs, tc.rootfs)
+
+			if err := runInstallTest(t, overlayPath, rootfs, nil); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+			if dep := readTestFile(t, rootfs, kverDir+"modules.dep"); !strings.Contains(dep, installed+":") {
+				t.Fatalf("modules.dep after install does not list %s:\n%s", installed, dep)
+			}
+			for _, name := range []string{"modules.dep.bin", "modules.alias.bin", "modules.symbols.bin"} {
+				if _, err := os.Lstat(filepath.Join(rootfs, kverDir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s left in place by the generated indexes: %v", name, err)
+				}
+			}
+
+			err := Uninstall(&Options{
+				InstallOptions: InstallOptions{MountPrefix: rootfs},
+				Stdout:         io.Discard,
+			})
+			if err != nil {
+				t.Fatalf("uninstall: %v", err)
+			}
+			if got := readTestFile(t, rootfs, kverDir+"modules.dep"); got != tc.wantDep {
+				t.Errorf("modules.dep after uninstall = %q, want %q", got, tc.wantDep)
+			}
+		})
+	}
+}
+
+func TestUninstallStaysInRootfs(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// edit tampers with the installed rootfs and manifest, returning
+		// the host file the uninstall must leave alone
+		edit    func(t *testing.T, rootfs string, manifest *Manifest) string
+		wantErr bool
+	}{
+		{
+			name: "escaping entry",
+			edit: func(t *testing.T, rootfs string, manifest *Manifest) string {
+				manifest.Files = append(manifest.Files, ManifestEntry{Path: "../escape"})
+				return filepath.Join(filepath.Dir(rootfs), "escape")
+			},
+			wantErr: true,
+		},
+		{
+			name: "symlinked parent",
+			edit: func(t *testing.T, rootfs string, manifest *Manifest) string {
+				host := t.TempDir()
+				testutil.WriteTree(t, host, testutil.Tree{"app.conf": testutil.File("host")})
+				dir := filepath.Join(rootfs, "etc/nvidia")
+				if err := os.RemoveAll(dir); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink(host, dir); err != nil {
+					t.Fatal(err)
+				}
+				return filepath.Join(host, "app.conf")
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			overlayPath := testOverlay().Build(t)
+			rootfs := testutil.Rootfs(t, testKver)
+			if err := runInstallTest(t, overlayPath, rootfs, nil); err != nil {
+				t.Fatalf("install: %v", err)
+			}
+
+			manifest, err := readManifest(osFS{}, rootfs, defaultStateDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outside := tc.edit(t, rootfs, manifest)
+			if err := writeManifest(osFS{}, rootfs, defaultStateDir, manifest); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(outside, []byte("host"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err = Uninstall(&Options{
+				InstallOptions: InstallOptions{MountPrefix: rootfs},
+				Stdout:         io.Discard,
+			})
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Errorf("uninstall error = %v, want error %v", err, tc.wantErr)
+			}
+			if _, err := os.Lstat(outside); err != nil {
+				t.Errorf("uninstall removed %s outside the rootfs: %v", outside, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package overlay
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// optionProblem is one issue found in InstallOptions
+type optionProblem struct {
+	fatal   bool
+	message string
+}
+
+// ValidateOptions lint-checks the install options without installing
+// anything, printing each problem found. Only fatal problems fail the command.
+func ValidateOptions(options *Options) error {
+	problems := checkInstallOptions(&options.InstallOptions)
+
+	fatal := 0
+	for _, p := range problems {
+		severity := "warning"
+		if p.fatal {
+			severity = "error"
+			fatal++
+		}
+		fmt.Fprintf(options.stdout(), "%s: %s\n", severity, p.message)
+	}
+
+	if fatal > 0 {
+		return classify(ErrInvalidOptions, fmt.Errorf("%d of %d problems in install options are fatal", fatal, len(problems)))
+	}
+	if len(problems) == 0 {
+		fmt.Fprintln(options.stdout(), "install options OK")
+	}
+	return nil
+}
+
+// checkInstallOptions returns every problem found in options
+func checkInstallOptions(options *InstallOptions) []optionProblem {
+	var problems []optionProblem
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, optionProblem{fatal: true, message: fmt.Sprintf(format, args...)})
+	}
+	warn := func(format string, args ...interface{}) {
+		problems = append(problems, optionProblem{message: fmt.Sprintf(format, args...)})
+	}
+
+	if err := checkMountPrefix(options.MountPrefix); err != nil {
+		fail("%v", err)
+	} else if info, err := os.Stat(options.MountPrefix); err != nil {
+		fail("mountPrefix: %v", err)
+	} else if !info.IsDir() {
+		fail("mountPrefix %s is not a directory", options.MountPrefix)
+	}
+
+	switch {
+	case options.InstallDisk == "":
+		warn("installDisk is empty")
+	case !filepath.IsAbs(options.InstallDisk):
+		fail("installDisk %q is not an absolute path", options.InstallDisk)
+	}
+
+	if options.ArtifactsPath != "" {
+		if _, err := os.Stat(options.ArtifactsPath); err != nil {
+			warn("artifactsPath: %v", err)
+		}
+	}
+
+	// Unknown keys are each reported here rather than by
+	// parseInstallConfig, which stops at them
+	extra := make(map[string]interface{}, len(options.ExtraOptions))
+	for key, value := range options.ExtraOptions {
+		if slices.Contains(extraOptionKeys, key) {
+			extra[key] = value
+		}
+	}
+	for _, err := range unknownOptions(options.ExtraOptions) {
+		fail("%v", err)
+	}
+
+	// Parse the options the way install does to catch bad values
+	if _, err := parseInstallConfig(extra, nil); err != nil {
+		fail("%v", err)
+	}
+	level, format, err := logSettings(extra, nil)
+	if err == nil {
+		_, err = newLogger(io.Discard, level, format)
+	}
+	if err != nil {
+		fail("%v", err)
+	}
+	for _, key := range []string{"kernelArgs", "loadModules"} {
+		if _, _, err := stringListOption(extra, key); err != nil {
+			fail("%v", err)
+		}
+	}
+	if _, _, err := stringMapOption(extra, "modprobeOptions"); err != nil {
+		fail("%v", err)
+	}
+	if _, err := udevRules(extra, &OverlayConfig{}); err != nil {
+		fail("%v", err)
+	}
+	if _, err := targetPrefixOption(extra); err != nil {
+		fail("%v", err)
+	}
+
+	if key, err := stringOption(extra, "verifyKey", ""); err == nil && key != "" && !strings.HasPrefix(strings.TrimSpace(key), "-----BEGIN") {
+		if _, err := os.Stat(key); err != nil {
+			fail("extraOptions.verifyKey: %v", err)
+		}
+	}
+
+	return problems
+}
+
+// unknownOptions returns an error for each ExtraOptions key the installer
+// doesn't understand, sorted by key
+func unknownOptions(extra map[string]interface{}) []error {
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		if !slices.Contains(extraOptionKeys, key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		if suggestion := closestOptionKey(key); suggestion != "" {
+			errs[i] = fmt.Errorf("extraOptions.%s is not a known option, did you mean %s?", key, suggestion)
+		} else {
+			errs[i] = fmt.Errorf("extraOptions.%s is not a known option", key)
+		}
+	}
+	return errs
+}
+
+// closestOptionKey suggests the known key a typo was probably meant to be
+func closestOptionKey(key string) string {
+	best, bestDistance := "", 3
+	for _, known := range extraOptionKeys {
+		if d := editDistance(strings.ToLower(key), strings.ToLower(known)); d < bestDistance {
+			best, bestDistance = known, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
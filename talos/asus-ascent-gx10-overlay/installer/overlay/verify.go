@@ -0,0 +1,112 @@
+package overlay
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Verify checks every file recorded in the install manifest against the
+// size, mode and digest captured at install time. Nothing is copied.
+func Verify(options *Options) error {
+	rootfsPath, err := installRoot(osFS{}, options.MountPrefix, options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+	stateDir, err := stateDirOption(options.ExtraOptions)
+	if err != nil {
+		return err
+	}
+
+	fsys := osFS{}
+	manifest, err := readManifest(fsys, rootfsPath, stateDir)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Verifying ASUS Ascent GX10 overlay...", "rootfs", rootfsPath)
+
+	failed := 0
+	for _, entry := range manifest.Files {
+		path := rootfsJoin(rootfsPath, entry.Path)
+		if err := verifyEntry(fsys, path, entry); err != nil {
+			fmt.Fprintf(options.stdout(), "FAIL %s: %v\n", entry.Path, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(options.stdout(), "PASS %s\n", entry.Path)
+	}
+
+	if failed > 0 {
+		return classify(ErrVerification, fmt.Errorf("%d of %d files failed verification", failed, len(manifest.Files)))
+	}
+
+	slog.Log(context.Background(), levelResult, "✅ All files verified", "files", len(manifest.Files))
+	return nil
+}
+
+// verifyEntry compares a single installed file with its manifest entry
+func verifyEntry(fsys filesystem, path string, entry ManifestEntry) error {
+	info, err := fsys.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("missing")
+		}
+		return err
+	}
+
+	if info.Mode() != entry.Mode {
+		return fmt.Errorf("mode %v, expected %v", info.Mode(), entry.Mode)
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := fsys.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if target != entry.Target {
+			return fmt.Errorf("symlink target %s, expected %s", target, entry.Target)
+		}
+		return nil
+	}
+	if info.Size() != entry.Size {
+		return fmt.Errorf("size %d, expected %d", info.Size(), entry.Size)
+	}
+
+	// Entries written before digests were recorded can only be checked by size
+	if entry.SHA256 == "" {
+		return nil
+	}
+
+	sum, err := fileSHA256(fsys, path)
+	if err != nil {
+		return err
+	}
+	if sum != entry.SHA256 {
+		return fmt.Errorf("sha256 %s, expected %s", sum, entry.SHA256)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of a file's contents
+func fileSHA256(fsys filesystem, path string) (string, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return readerSHA256(f)
+}
+
+// readerSHA256 returns the hex encoded SHA-256 of everything r yields
+func readerSHA256(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
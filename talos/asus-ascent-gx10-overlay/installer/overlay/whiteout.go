@@ -0,0 +1,106 @@
+package overlay
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// OCI layer whiteouts let a layered overlay take away what an earlier one
+// installed: a ".wh.<name>" file deletes <name> from the destination
+// instead of being copied, and a ".wh..wh..opq" file makes its directory
+// opaque, deleting whatever the destination directory held before
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// isWhiteout reports whether a source file name is a whiteout marker
+func isWhiteout(name string) bool {
+	return strings.HasPrefix(name, whiteoutPrefix)
+}
+
+// whiteout applies the whiteout marker that would be copied to dst. An
+// opaque marker was applied when its directory was entered.
+func (inst *Installer) whiteout(dst string) error {
+	base := filepath.Base(dst)
+	if base == whiteoutOpaque {
+		return nil
+	}
+	name := strings.TrimPrefix(base, whiteoutPrefix)
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("invalid whiteout %s", base)
+	}
+	return inst.removePath(filepath.Join(filepath.Dir(dst), name))
+}
+
+// clearOpaque deletes the contents of the destination directory of an
+// opaque source directory, except the paths in keep this copy already wrote
+func (inst *Installer) clearOpaque(dir string, keep map[string]bool) error {
+	entries, err := inst.fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if keep[path] {
+			continue
+		}
+		if err := inst.removePath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removePath deletes path from the rootfs for a whiteout, with everything
+// below it for a directory, and records the removal in the manifest.
+// Backups are taken first, so a rollback brings the files back.
+func (inst *Installer) removePath(path string) error {
+	info, err := inst.fs.Lstat(path)
+	if os.IsNotExist(err) {
+		slog.Debug("Nothing to white out", "path", path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if inst.cfg.dryRun {
+		slog.Info("would remove", "path", path)
+		return nil
+	}
+
+	// A directory is walked parents first, so removing in reverse empties
+	// each directory before it goes
+	paths := []string{path}
+	if info.IsDir() {
+		paths = paths[:0]
+		err := inst.fs.Walk(path, func(p string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			paths = append(paths, p)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if err := inst.backup(paths[i]); err != nil {
+			return err
+		}
+		if err := inst.fs.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+	inst.markDirty(filepath.Dir(path))
+	inst.manifest.addRemoval(path)
+	slog.Info("🗑️  Whited out", "path", path)
+	return nil
+}
@@ -0,0 +1,109 @@
+package overlay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/internal/testutil"
+)
+
+func TestCopyDirectoryWhiteouts(t *testing.T) {
+	// installed is what an earlier overlay left in lib/firmware
+	installed := testutil.Tree{
+		"nvidia/old.bin":       testutil.File("old firmware"),
+		"nvidia/keep.bin":      testutil.File("kept firmware"),
+		"nvidia/ga10x/gsp.bin": testutil.File("ga10x firmware"),
+	}
+
+	for _, tc := range []struct {
+		name   string
+		source testutil.Tree
+		// want are the paths left in lib/firmware, and removed those the
+		// manifest records as removed
+		want    []string
+		removed []string
+	}{
+		{
+			name:    "file",
+			source:  testutil.Tree{"nvidia/.wh.old.bin": testutil.File("")},
+			want:    []string{"nvidia/keep.bin", "nvidia/ga10x/gsp.bin"},
+			removed: []string{"lib/firmware/nvidia/old.bin"},
+		},
+		{
+			name:    "directory",
+			source:  testutil.Tree{"nvidia/.wh.ga10x": testutil.File("")},
+			want:    []string{"nvidia/old.bin", "nvidia/keep.bin"},
+			removed: []string{"lib/firmware/nvidia/ga10x"},
+		},
+		{
+			name:   "missing target",
+			source: testutil.Tree{"nvidia/.wh.missing.bin": testutil.File("")},
+			want:   []string{"nvidia/old.bin", "nvidia/keep.bin", "nvidia/ga10x/gsp.bin"},
+		},
+		{
+			name: "opaque directory",
+			source: testutil.Tree{
+				"nvidia/" + whiteoutOpaque: testutil.File(""),
+				"nvidia/new.bin":           testutil.File("new firmware"),
+			},
+			want:    []string{"nvidia/new.bin"},
+			removed: []string{"lib/firmware/nvidia/ga10x", "lib/firmware/nvidia/keep.bin", "lib/firmware/nvidia/old.bin"},
+		},
+		{
+			name: "opaque directory recopying a name",
+			source: testutil.Tree{
+				"nvidia/" + whiteoutOpaque: testutil.File(""),
+				"nvidia/keep.bin":          testutil.File("new firmware"),
+			},
+			want:    []string{"nvidia/keep.bin"},
+			removed: []string{"lib/firmware/nvidia/ga10x", "lib/firmware/nvidia/keep.bin", "lib/firmware/nvidia/old.bin"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			src := t.TempDir()
+			testutil.WriteTree(t, src, tc.source)
+			rootfs := t.TempDir()
+			dst := filepath.Join(rootfs, "lib", "firmware")
+			testutil.WriteTree(t, dst, installed)
+
+			inst := newTestInstaller(t, src, rootfs, nil)
+			if err := inst.copyDirectory(context.Background(), src, dst, 0, nil); err != nil {
+				t.Fatalf("copy: %v", err)
+			}
+
+			var got []string
+			err := filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(dst, path)
+				got = append(got, filepath.ToSlash(rel))
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			slices.Sort(got)
+			want := slices.Clone(tc.want)
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Errorf("lib/firmware holds %q, want %q", got, want)
+			}
+
+			removed := slices.Clone(inst.manifest.Removed)
+			slices.Sort(removed)
+			if !slices.Equal(removed, tc.removed) {
+				t.Errorf("manifest removed %q, want %q", removed, tc.removed)
+			}
+			for rel := range tc.source {
+				_, listed := inst.manifest.entry(filepath.Join(dst, filepath.FromSlash(rel)))
+				if whiteout := isWhiteout(filepath.Base(rel)); listed == whiteout {
+					t.Errorf("%s in the manifest: %v, want %v", rel, listed, !whiteout)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package overlay
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+
+	"golang.org/x/sys/unix"
+)
+
+// preserveXattrs gives dst the extended attributes of src, such as SELinux
+// labels and file capabilities, when ExtraOptions["preserveXattrs"] is set.
+// Neither path is followed if it is a symlink. A rootfs that can't store an
+// attribute gets a warning and the copy carries on.
+//
+// It must run after preserveOwnership, since a chown drops capabilities.
+func (inst *Installer) preserveXattrs(src, dst string) error {
+	if !inst.cfg.preserveXattrs {
+		return nil
+	}
+
+	attrs, err := inst.fs.Xattrs(src)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return inst.setXattrs(dst, attrs)
+}
+
+// setXattrs sets extended attributes on dst without following a symlink
+func (inst *Installer) setXattrs(dst string, attrs map[string][]byte) error {
+	for name, value := range attrs {
+		err := inst.fs.SetXattr(dst, name, value)
+		if errors.Is(err, unix.ENOTSUP) {
+			slog.Warn("⚠️  Rootfs does not support extended attribute", "dst", dst, "xattr", name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listXattrs reads every extended attribute of path without following symlinks
+func listXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(path, string(name), value)
+		if err != nil {
+			return nil, err
+		}
+		attrs[string(name)] = value[:size]
+	}
+	return attrs, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"runtime/debug"
+
+	"github.com/microscaler/dcops/talos/asus-ascent-gx10-overlay/installer/overlay"
+)
+
+// Build metadata, injected with
+// -ldflags "-X main.version=1.2.3 -X main.commit=abc1234"
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// buildInfo describes the running installer binary
+type buildInfo struct {
+	Overlay   string `json:"overlay"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	GoVersion string `json:"goVersion,omitempty"`
+}
+
+// currentBuild collects the build metadata. Without an injected commit the
+// VCS revision Go stamps into the binary is used.
+func currentBuild() buildInfo {
+	b := buildInfo{Overlay: overlay.Name, Version: version, Commit: commit}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		b.GoVersion = info.GoVersion
+		if b.Commit == "" {
+			for _, setting := range info.Settings {
+				if setting.Key == "vcs.revision" {
+					b.Commit = setting.Value
+				}
+			}
+		}
+	}
+	return b
+}
+
+// printVersion writes the build metadata to stdout, as a single line or,
+// with -output json, as a JSON object. Flag errors and usage go to stderr.
+func printVersion(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("version", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	output := flags.String("output", "text", "output format, text or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	b := currentBuild()
+	switch *output {
+	case "text":
+		commit := b.Commit
+		if commit == "" {
+			commit = "unknown"
+		}
+		fmt.Fprintf(stdout, "%s %s (commit %s, %s)\n", b.Overlay, b.Version, commit, b.GoVersion)
+		return nil
+	case "json":
+		return json.NewEncoder(stdout).Encode(b)
+	default:
+		return fmt.Errorf("invalid output format %q, expected text or json", *output)
+	}
+}
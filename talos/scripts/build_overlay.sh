@@ -79,7 +79,9 @@ if command -v go &> /dev/null; then
     echo "🔧 Building overlay installer..."
     cd "${OVERLAY_DIR}/installer"
     if [ -f "go.mod" ]; then
-        go build -o "${OVERLAY_DIR}/installer/bin/installer" ./installer.go || {
+        go build \
+            -ldflags "-X main.version=${VERSION} -X main.commit=$(git rev-parse --short HEAD 2>/dev/null)" \
+            -o "${OVERLAY_DIR}/installer/bin/installer" . || {
             echo "⚠️  Warning: Failed to build installer (this is OK if Talos SDK not available)"
         }
     fi